@@ -8,6 +8,8 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
@@ -73,8 +75,8 @@ func Service(ctx context.Context, r client.Client, service *corev1.Service, log
 // VirtualService reconciles an Istio virtual service object.
 func VirtualService(ctx context.Context, r client.Client, virtualServiceName, namespace string, virtualservice *unstructured.Unstructured, log logr.Logger) error {
 	foundVirtualService := &unstructured.Unstructured{}
-	foundVirtualService.SetAPIVersion("networking.istio.io/v1alpha3")
-	foundVirtualService.SetKind("VirtualService")
+	// Read it with the version of the desired one, e.g. v1alpha3 or v1beta1
+	foundVirtualService.SetGroupVersionKind(virtualservice.GroupVersionKind())
 	justCreated := false
 	if err := r.Get(ctx, types.NamespacedName{Name: virtualServiceName, Namespace: namespace}, foundVirtualService); err != nil {
 		if apierrs.IsNotFound(err) {
@@ -103,28 +105,32 @@ func VirtualService(ctx context.Context, r client.Client, virtualServiceName, na
 // Reference: https://github.com/pwittrock/kubebuilder-workshop/blob/master/pkg/util/util.go
 
 // CopyStatefulSetFields copies the owned fields from one StatefulSet to another
-// Returns true if the fields copied from don't match to.
+// Returns true if the fields copied from don't match to. The whole Pod spec of
+// the template is owned, so that manual edits of the containers, e.g. of their
+// env, ports, working dir or security context, are reverted, and so are the
+// labels of the template. Its annotations are left to the caller.
 func CopyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
 	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
-		}
+	if !stringMapsEqual(from.Labels, to.Labels) {
+		requireUpdate = true
 	}
 	to.Labels = from.Labels
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
-		}
+	if !stringMapsEqual(from.Annotations, to.Annotations) {
+		requireUpdate = true
 	}
 	to.Annotations = from.Annotations
 
-	if from.Spec.Replicas != to.Spec.Replicas {
+	if !reflect.DeepEqual(from.Spec.Replicas, to.Spec.Replicas) {
 		to.Spec.Replicas = from.Spec.Replicas
 		requireUpdate = true
 	}
 
+	if !stringMapsEqual(from.Spec.Template.Labels, to.Spec.Template.Labels) {
+		requireUpdate = true
+	}
+	to.Spec.Template.Labels = from.Spec.Template.Labels
+
 	if !reflect.DeepEqual(to.Spec.Template.Spec, from.Spec.Template.Spec) {
 		requireUpdate = true
 	}
@@ -133,6 +139,58 @@ func CopyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
 	return requireUpdate
 }
 
+// stringMapsEqual returns whether the maps have the same entries, a nil map
+// being equal to an empty one.
+func stringMapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// StatefulSetImmutableFieldsChanged returns the paths of the immutable fields
+// of the StatefulSet spec that differ between from and to. CopyStatefulSetFields
+// doesn't copy these fields, since the API server rejects updates to them.
+func StatefulSetImmutableFieldsChanged(from, to *appsv1.StatefulSet) []string {
+	fields := []string{}
+	if !reflect.DeepEqual(from.Spec.Selector, to.Spec.Selector) {
+		fields = append(fields, "spec.selector")
+	}
+	if from.Spec.ServiceName != to.Spec.ServiceName {
+		fields = append(fields, "spec.serviceName")
+	}
+	if !volumeClaimTemplatesEqual(from.Spec.VolumeClaimTemplates, to.Spec.VolumeClaimTemplates) {
+		fields = append(fields, "spec.volumeClaimTemplates")
+	}
+	return fields
+}
+
+// volumeClaimTemplatesEqual compares the fields of the claim templates that
+// aren't defaulted by the API server.
+func volumeClaimTemplatesEqual(from, to []corev1.PersistentVolumeClaim) bool {
+	if len(from) != len(to) {
+		return false
+	}
+	for i := range from {
+		if from[i].Name != to[i].Name ||
+			!reflect.DeepEqual(from[i].Spec.AccessModes, to[i].Spec.AccessModes) ||
+			!reflect.DeepEqual(from[i].Spec.StorageClassName, to[i].Spec.StorageClassName) {
+			return false
+		}
+		fromStorage := from[i].Spec.Resources.Requests[corev1.ResourceStorage]
+		toStorage := to[i].Spec.Resources.Requests[corev1.ResourceStorage]
+		if fromStorage.Cmp(toStorage) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func CopyDeploymentSetFields(from, to *appsv1.Deployment) bool {
 	requireUpdate := false
 	for k, v := range to.Labels {
@@ -194,6 +252,44 @@ func CopyServiceFields(from, to *corev1.Service) bool {
 	return requireUpdate
 }
 
+// CopyIngressFields copies the owned fields from one Ingress to another
+func CopyIngressFields(from, to *networkingv1beta1.Ingress) bool {
+	requireUpdate := false
+	if !reflect.DeepEqual(to.Labels, from.Labels) {
+		requireUpdate = true
+	}
+	to.Labels = from.Labels
+
+	// The annotations configure the ingress controller, e.g. its class
+	if !reflect.DeepEqual(to.Annotations, from.Annotations) {
+		requireUpdate = true
+	}
+	to.Annotations = from.Annotations
+
+	if !reflect.DeepEqual(to.Spec, from.Spec) {
+		requireUpdate = true
+	}
+	to.Spec = from.Spec
+
+	return requireUpdate
+}
+
+// CopyNetworkPolicyFields copies the owned fields from one NetworkPolicy to another
+func CopyNetworkPolicyFields(from, to *networkingv1.NetworkPolicy) bool {
+	requireUpdate := false
+	if !reflect.DeepEqual(to.Labels, from.Labels) {
+		requireUpdate = true
+	}
+	to.Labels = from.Labels
+
+	if !reflect.DeepEqual(to.Spec, from.Spec) {
+		requireUpdate = true
+	}
+	to.Spec = from.Spec
+
+	return requireUpdate
+}
+
 // Copy configuration related fields to another instance and returns true if there
 // is a diff and thus needs to update.
 func CopyVirtualService(from, to *unstructured.Unstructured) bool {
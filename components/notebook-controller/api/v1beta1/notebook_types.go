@@ -17,6 +17,7 @@ package v1beta1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -28,12 +29,299 @@ type NotebookSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	Template NotebookTemplateSpec `json:"template,omitempty"`
+
+	// Kind is the kind of the Notebook, e.g. jupyter, rstudio or vscode, one
+	// of the NOTEBOOK_KINDS env var of the controller. It sets the image of
+	// the notebook container if the container doesn't set one, and the port
+	// it listens on if it doesn't declare any.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// NetworkingMode controls whether the controller creates the Service and
+	// the Istio VirtualService of the Notebook. Set it to "none" when the
+	// networking is managed outside of the controller. Defaults to "managed".
+	// +kubebuilder:validation:Enum=managed;none
+	// +optional
+	NetworkingMode NetworkingMode `json:"networkingMode,omitempty"`
+
+	// HomeSubPath is mounted as the home directory instead of the root of the
+	// workspace volume, so that several Notebooks can share a single PVC.
+	// +optional
+	HomeSubPath string `json:"homeSubPath,omitempty"`
+
+	// ReadOnly mounts the workspace volume read-only, so that the Notebook
+	// can be used to review files without modifying them.
+	// +optional
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// ShmSize is the size of the memory-backed emptyDir mounted at /dev/shm.
+	// It counts against the memory limit of the notebook container.
+	// Defaults to the DEFAULT_SHM_SIZE env var of the controller.
+	// +optional
+	ShmSize *resource.Quantity `json:"shmSize,omitempty"`
+
+	// CloneFrom is the name of a Notebook in the same namespace whose
+	// workspace PVC is copied into the workspace PVC of this Notebook when it
+	// is created. The Notebook isn't started until the copy completes.
+	// +optional
+	CloneFrom string `json:"cloneFrom,omitempty"`
+
+	// CullingPolicy sets how the Notebook is stopped when it is culled or
+	// stopped by hand. Defaults to the CULL_MODE env var of the controller.
+	// +optional
+	CullingPolicy *NotebookCullingPolicy `json:"cullingPolicy,omitempty"`
+
+	// WorkspaceFrom is the source the workspace PVC of the Notebook is
+	// provisioned from when it is created, instead of an empty PVC. The
+	// Notebook isn't started until the PVC is bound. It can't be combined
+	// with cloneFrom.
+	// +optional
+	WorkspaceFrom *WorkspaceSource `json:"workspaceFrom,omitempty"`
+
+	// WorkspaceStorageClass is the StorageClass of the workspace PVC when the
+	// controller provisions it, i.e. when the Notebook is cloned or restored
+	// from a snapshot, instead of the StorageClass of the cloned PVC or the
+	// default one of the cluster. The storageClassName of workspaceFrom
+	// takes precedence over it.
+	// +kubebuilder:validation:MinLength=1
+	// +optional
+	WorkspaceStorageClass *string `json:"workspaceStorageClass,omitempty"`
+
+	// RuntimeClassName is the RuntimeClass the Notebook Pod runs with, e.g.
+	// gVisor or Kata for a stronger isolation. It takes precedence over the
+	// runtimeClassName of the Pod template. Defaults to the
+	// DEFAULT_RUNTIME_CLASS env var of the controller.
+	// +optional
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+
+	// SchedulerName is the scheduler of the Notebook Pod, e.g. Volcano for
+	// the Notebooks coordinating with gang-scheduled jobs. It takes
+	// precedence over the schedulerName of the Pod template. Defaults to the
+	// DEFAULT_SCHEDULER_NAME env var of the controller.
+	// +kubebuilder:validation:MinLength=1
+	// +optional
+	SchedulerName string `json:"schedulerName,omitempty"`
+
+	// AutomountServiceAccountToken sets whether the token of the service
+	// account is mounted in the Notebook Pod. It takes precedence over the
+	// automountServiceAccountToken of the Pod template. Defaults to the
+	// DEFAULT_AUTOMOUNT_SA_TOKEN env var of the controller.
+	// +optional
+	AutomountServiceAccountToken *bool `json:"automountServiceAccountToken,omitempty"`
+
+	// BackupOnStop makes the controller sync the workspace PVC to object
+	// storage when the Notebook is stopped, before scaling it down.
+	// +optional
+	BackupOnStop *NotebookBackup `json:"backupOnStop,omitempty"`
+
+	// PodAnnotations are added to the annotations of the Notebook Pod, e.g.
+	// to configure the Istio sidecar or a log shipper. Changing them restarts
+	// the Pod. The annotations set by the controller take precedence.
+	// +optional
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+
+	// GPU is the GPUs requested by the Notebook. The actual resource name and
+	// the nodes they are scheduled on are configured by the GPU_RESOURCES env
+	// var of the controller.
+	// +optional
+	GPU *NotebookGPU `json:"gpu,omitempty"`
+
+	// TTLSeconds is the lifetime of the Notebook: it is deleted, with its
+	// resources, once TTLSeconds have passed since its creation.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSeconds *int64 `json:"ttlSeconds,omitempty"`
+
+	// PostStartCommand is run in the notebook container right after it
+	// starts, e.g. to register the Notebook with an external service. It
+	// takes precedence over the postStart hook of the container. The
+	// container isn't Ready until it succeeds, and is restarted if it fails.
+	// +kubebuilder:validation:MinItems=1
+	// +optional
+	PostStartCommand []string `json:"postStartCommand,omitempty"`
+
+	// MetricsSidecar adds a container exporting the usage of the PVCs and the
+	// kernel activity of the Notebook as Prometheus metrics, with the image
+	// set by the METRICS_SIDECAR_IMAGE env var of the controller.
+	// +optional
+	MetricsSidecar bool `json:"metricsSidecar,omitempty"`
+
+	// GenerateAccessToken generates a Secret holding a random token to access
+	// the Notebook programmatically, mounted into the notebook container and
+	// set in its NOTEBOOK_ACCESS_TOKEN env var.
+	// +optional
+	GenerateAccessToken bool `json:"generateAccessToken,omitempty"`
+
+	// StripPathPrefix serves the Notebook at the root of its server: the
+	// VirtualService rewrites its URL prefix to "/" instead of keeping it.
+	// +optional
+	StripPathPrefix bool `json:"stripPathPrefix,omitempty"`
+
+	// InitContainers run before the init containers of the Pod template, e.g.
+	// to clone a repository or download data into the workspace. The
+	// workspace volume is mounted in them like in the notebook container.
+	// +optional
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// ProjectedTokens are ServiceAccount tokens with a custom audience and
+	// expiry mounted into the notebook container, e.g. to call external
+	// services through workload identity, instead of the default token.
+	// +optional
+	ProjectedTokens []TokenMount `json:"projectedTokens,omitempty"`
+
+	// LivenessProbe is the liveness probe of the notebook container, e.g. a
+	// command checking that its kernels respond. It takes precedence over
+	// the livenessProbe of the container, and the default probe of the
+	// controller isn't added when it is set.
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+
+	// AdditionalPorts are auxiliary ports of the notebook, e.g. a Dask
+	// scheduler or a debugger, exposed by its Service next to the notebook
+	// port. With Istio, the TCP ones are routed under <prefix>/<name>/.
+	// +optional
+	AdditionalPorts []ServicePortSpec `json:"additionalPorts,omitempty"`
+
+	// TemplateRef names the NotebookTemplate whose pod template is merged
+	// into the one of the Notebook. The fields the Notebook sets win.
+	// +optional
+	TemplateRef *NotebookTemplateReference `json:"templateRef,omitempty"`
+}
+
+// ServicePortSpec describes an auxiliary port exposed by the Service of a
+// Notebook.
+type ServicePortSpec struct {
+	// Name is the name of the port of the Service, unique among the ports of
+	// the Notebook, e.g. "http-dask". It is also the sub-path it is routed
+	// under.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Port is the port of the Service.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+
+	// TargetPort is the port the container listens on. Defaults to Port.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	TargetPort int32 `json:"targetPort,omitempty"`
+
+	// Protocol is the protocol of the port, TCP, UDP or SCTP. Defaults to TCP.
+	// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+	// +optional
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+}
+
+// NotebookTemplateReference references a NotebookTemplate.
+type NotebookTemplateReference struct {
+	// Name is the name of the NotebookTemplate.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// Namespace is the namespace of the NotebookTemplate, e.g. a namespace
+	// of the platform team shared by the whole cluster. Defaults to the
+	// namespace of the Notebook.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// TokenMount describes a projected ServiceAccount token mounted into the
+// notebook container.
+type TokenMount struct {
+	// Audience is the intended audience of the token, e.g. the identity
+	// provider it is exchanged with.
+	// +kubebuilder:validation:MinLength=1
+	Audience string `json:"audience"`
+
+	// ExpirationSeconds is the requested lifetime of the token, which the
+	// kubelet rotates before it expires. Defaults to 1 hour.
+	// +kubebuilder:validation:Minimum=600
+	// +optional
+	ExpirationSeconds *int64 `json:"expirationSeconds,omitempty"`
+
+	// MountPath is the directory the token is mounted in, as a "token" file.
+	// +kubebuilder:validation:MinLength=1
+	MountPath string `json:"mountPath"`
+}
+
+// NotebookGPU describes the GPUs requested by a Notebook.
+type NotebookGPU struct {
+	// Count is the number of GPUs.
+	// +kubebuilder:validation:Minimum=0
+	Count int64 `json:"count"`
+
+	// Shared requests time-sliced GPUs, shared with other Pods, instead of
+	// dedicated ones.
+	// +optional
+	Shared bool `json:"shared,omitempty"`
+}
+
+// NotebookBackup describes where the workspace of a Notebook is backed up.
+type NotebookBackup struct {
+	// Destination is the rclone remote path the workspace is synced to, e.g.
+	// "s3:my-bucket/notebooks/my-notebook".
+	Destination string `json:"destination"`
+
+	// SecretName is the name of a Secret in the namespace of the Notebook
+	// whose keys are set as env vars of the backup Job, e.g. the
+	// RCLONE_CONFIG_* ones configuring the remote and its credentials.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
 }
 
+// NetworkingMode describes who manages the networking resources of a Notebook.
+type NetworkingMode string
+
+const (
+	// NetworkingModeManaged makes the controller reconcile a Service and a VirtualService.
+	NetworkingModeManaged NetworkingMode = "managed"
+	// NetworkingModeNone leaves the networking resources to the user.
+	NetworkingModeNone NetworkingMode = "none"
+)
+
+// NotebookCullingPolicy describes how a Notebook is stopped.
+type NotebookCullingPolicy struct {
+	// StopMethod is how the Notebook is stopped.
+	// +kubebuilder:validation:Enum=scaleToZero;detach
+	// +optional
+	StopMethod StopMethod `json:"stopMethod,omitempty"`
+}
+
+// StopMethod describes how a stopped Notebook releases its resources.
+type StopMethod string
+
+const (
+	// StopMethodScaleToZero scales the StatefulSet of the Notebook down to 0
+	// replicas. Its resources are freed, but its volumes are detached and
+	// attached again when it restarts, which is slow on some storage.
+	StopMethodScaleToZero StopMethod = "scaleToZero"
+	// StopMethodDetach keeps the Pod of the Notebook running, with its
+	// volumes attached, but removes it from the endpoints of its Service. It
+	// restarts instantly, but its resources stay reserved.
+	StopMethodDetach StopMethod = "detach"
+)
+
 type NotebookTemplateSpec struct {
 	Spec corev1.PodSpec `json:"spec,omitempty"`
 }
 
+// WorkspaceSource is the source the workspace PVC of a Notebook is
+// provisioned from.
+type WorkspaceSource struct {
+	// SnapshotName is the name of a VolumeSnapshot in the namespace of the
+	// Notebook the workspace PVC is restored from.
+	// +kubebuilder:validation:MinLength=1
+	SnapshotName string `json:"snapshotName"`
+
+	// StorageClassName is the StorageClass of the workspace PVC, whose
+	// provisioner must be the CSI driver of the snapshot. Defaults to the
+	// default StorageClass of the cluster.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+}
+
 // NotebookStatus defines the observed state of Notebook
 type NotebookStatus struct {
 	// Conditions is an array of current conditions
@@ -42,6 +330,46 @@ type NotebookStatus struct {
 	ReadyReplicas int32 `json:"readyReplicas"`
 	// ContainerState is the state of underlying container.
 	ContainerState corev1.ContainerState `json:"containerState"`
+	// LastCullCheck is the last time the culler checked whether the Notebook
+	// is idle.
+	// +optional
+	LastCullCheck *metav1.Time `json:"lastCullCheck,omitempty"`
+	// CullReason explains the outcome of the last culling check.
+	// +optional
+	CullReason string `json:"cullReason,omitempty"`
+	// LastActivityUser is the last user who accessed the Notebook, as
+	// reported by the activity poller.
+	// +optional
+	LastActivityUser string `json:"lastActivityUser,omitempty"`
+	// LastActivityTime is when the LastActivityUser accessed the Notebook.
+	// +optional
+	LastActivityTime *metav1.Time `json:"lastActivityTime,omitempty"`
+	// ContainerImage is the image of the notebook container reported by its
+	// Pod.
+	// +optional
+	ContainerImage string `json:"containerImage,omitempty"`
+	// ImageID is the ID of the image of the notebook container reported by
+	// its Pod, with the digest the image was resolved to.
+	// +optional
+	ImageID string `json:"imageID,omitempty"`
+	// AccessTokenSecret is the name of the Secret holding the access token
+	// of the Notebook, under the "token" key, if it generates one.
+	// +optional
+	AccessTokenSecret string `json:"accessTokenSecret,omitempty"`
+	// Volumes lists the PVCs mounted by the Notebook.
+	// +optional
+	Volumes []VolumeStatus `json:"volumes,omitempty"`
+}
+
+// VolumeStatus describes a PVC mounted by a Notebook.
+type VolumeStatus struct {
+	// Name is the name of the volume in the Pod spec.
+	Name string `json:"name"`
+	// PVCName is the name of the PVC.
+	PVCName string `json:"pvcName"`
+	// Size is the capacity of the PVC, once it is bound.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
 }
 
 type NotebookCondition struct {
@@ -0,0 +1,52 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NotebookTemplateDefinition defines the pod template of a NotebookTemplate
+type NotebookTemplateDefinition struct {
+	// Template is merged into the pod template of the Notebooks referencing
+	// the NotebookTemplate. The fields the Notebooks set win.
+	Template NotebookTemplateSpec `json:"template"`
+}
+
+// +kubebuilder:object:root=true
+
+// NotebookTemplate is the Schema for the notebooktemplates API. It is an
+// approved pod template, e.g. an image with its resources and volumes, the
+// Notebooks are instantiated from.
+type NotebookTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NotebookTemplateDefinition `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NotebookTemplateList contains a list of NotebookTemplate
+type NotebookTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NotebookTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NotebookTemplate{}, &NotebookTemplateList{})
+}
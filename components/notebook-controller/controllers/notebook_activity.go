@@ -0,0 +1,148 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"time"
+
+	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// The activity poller sets this annotation on a Notebook to the user who last
+// accessed it, e.g. from the identity header of the request, and the
+// LastActivityTimeAnnotation to when, an RFC3339 timestamp. The controller
+// reports them in the status of the Notebook.
+const (
+	LastActivityUserAnnotation = "notebook.kubeflow.org/last-activity-user"
+	LastActivityTimeAnnotation = "notebook.kubeflow.org/last-activity-time"
+)
+
+// activityServiceEnabled returns whether the controller creates a second
+// Service for each Notebook, through which the culler queries the activity of
+// the server, set by the ACTIVITY_SERVICE env var.
+func activityServiceEnabled() bool {
+	return os.Getenv("ACTIVITY_SERVICE") == "true"
+}
+
+// activityServiceName returns the name of the Service the culler reaches the
+// server of the Notebook through: its activity Service if enabled, or its
+// main Service.
+func activityServiceName(instance *v1beta1.Notebook) string {
+	if activityServiceEnabled() {
+		return instance.Name + "-activity"
+	}
+	return instance.Name
+}
+
+// generateActivityService returns the activity Service of the Notebook. Unlike
+// the main Service, its port isn't named after the Istio protocols, so that
+// the policies restricting the user traffic don't apply to it, and it is
+// never detached from the Pod.
+func generateActivityService(instance *v1beta1.Notebook) *corev1.Service {
+	port := int(notebookContainerPort(instance))
+	containers := instance.Spec.Template.Spec.Containers
+	if len(containers) != 0 && len(containers[0].Ports) != 0 {
+		port = int(containers[0].Ports[0].ContainerPort)
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      activityServiceName(instance),
+			Namespace: instance.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     "ClusterIP",
+			Selector: map[string]string{"statefulset": instance.Name},
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "activity",
+					Port:       DefaultServingPort,
+					TargetPort: intstr.FromInt(port),
+					Protocol:   "TCP",
+				},
+			},
+		},
+	}
+}
+
+// reconcileActivityService creates or updates the activity Service of the
+// Notebook, and deletes the one the controller created when ACTIVITY_SERVICE
+// is unset.
+func (r *NotebookReconciler) reconcileActivityService(instance *v1beta1.Notebook) error {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	name := instance.Name + "-activity"
+	foundService := &corev1.Service{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace}, foundService)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if !activityServiceEnabled() {
+		if !found || !metav1.IsControlledBy(foundService, instance) {
+			return nil
+		}
+		log.Info("Deleting activity Service", "namespace", foundService.Namespace, "name", foundService.Name)
+		return ignoreNotFound(r.Delete(context.TODO(), foundService))
+	}
+
+	service := generateActivityService(instance)
+	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating activity Service", "namespace", service.Namespace, "name", service.Name)
+		return r.Create(context.TODO(), service)
+	}
+	if reconcilehelper.CopyServiceFields(service, foundService) {
+		log.Info("Updating activity Service", "namespace", service.Namespace, "name", service.Name)
+		return r.Update(context.TODO(), foundService)
+	}
+	return nil
+}
+
+// updateLastActivityUser copies the user who last accessed the Notebook, and
+// when, from the annotations set by the activity poller to the status. The
+// status is left as is while the poller doesn't set the user; an invalid time
+// is reported as unknown. Returns true if the status changed.
+func updateLastActivityUser(instance *v1beta1.Notebook) bool {
+	user, ok := instance.GetAnnotations()[LastActivityUserAnnotation]
+	if !ok {
+		return false
+	}
+	var accessed *metav1.Time
+	if t, err := time.Parse(time.RFC3339, instance.GetAnnotations()[LastActivityTimeAnnotation]); err == nil {
+		// The status only keeps seconds
+		rounded := metav1.NewTime(t).Rfc3339Copy()
+		accessed = &rounded
+	}
+
+	status := &instance.Status
+	if status.LastActivityUser == user && status.LastActivityTime.Equal(accessed) {
+		return false
+	}
+	status.LastActivityUser = user
+	status.LastActivityTime = accessed
+	return true
+}
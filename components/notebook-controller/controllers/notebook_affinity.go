@@ -0,0 +1,161 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The values of the DEFAULT_NODE_AFFINITY_MODE env var: the default node
+// affinity is either a preference of the scheduler, or a requirement.
+const (
+	NodeAffinityPreferred = "preferred"
+	NodeAffinityRequired  = "required"
+)
+
+// getDefaultNodeAffinity returns the node selector term the Notebook Pods
+// are scheduled with by default, read from the DEFAULT_NODE_AFFINITY env var,
+// a JSON NodeSelectorTerm. It returns nil if the env var isn't set.
+func getDefaultNodeAffinity() (*corev1.NodeSelectorTerm, error) {
+	value := os.Getenv("DEFAULT_NODE_AFFINITY")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	term := &corev1.NodeSelectorTerm{}
+	if err := json.Unmarshal([]byte(value), term); err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_NODE_AFFINITY %q, expected a JSON object: %v", value, err)
+	}
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return nil, fmt.Errorf("DEFAULT_NODE_AFFINITY should have matchExpressions or matchFields, got %q", value)
+	}
+	return term, nil
+}
+
+// getDefaultNodeAffinityMode returns whether the default node affinity is
+// preferred or required, set by the DEFAULT_NODE_AFFINITY_MODE env var.
+// Defaults to NodeAffinityPreferred.
+func getDefaultNodeAffinityMode() string {
+	if os.Getenv("DEFAULT_NODE_AFFINITY_MODE") == NodeAffinityRequired {
+		return NodeAffinityRequired
+	}
+	return NodeAffinityPreferred
+}
+
+func validateDefaultNodeAffinity() error {
+	switch mode := os.Getenv("DEFAULT_NODE_AFFINITY_MODE"); mode {
+	case "", NodeAffinityPreferred, NodeAffinityRequired:
+	default:
+		return fmt.Errorf("DEFAULT_NODE_AFFINITY_MODE should be %q or %q, got %q",
+			NodeAffinityPreferred, NodeAffinityRequired, mode)
+	}
+	_, err := getDefaultNodeAffinity()
+	return err
+}
+
+// applyDefaultNodeAffinity sets the default node affinity on the Pod, unless
+// its template sets a node affinity or it is pinned to a node, which the
+// users chose over the default.
+func applyDefaultNodeAffinity(podSpec *corev1.PodSpec) {
+	term, err := getDefaultNodeAffinity()
+	if err != nil || term == nil {
+		// The controller doesn't start with an invalid default node affinity
+		return
+	}
+	if podSpec.NodeName != "" || podSpec.NodeSelector["kubernetes.io/hostname"] != "" {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity != nil {
+		return
+	}
+
+	if getDefaultNodeAffinityMode() == NodeAffinityRequired {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{*term},
+			},
+		}
+		return
+	}
+	podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+			{Weight: 100, Preference: *term},
+		},
+	}
+}
+
+// Setting this annotation to "false" on a Notebook opts its Pod out of the
+// default pod anti-affinity.
+const PodAntiAffinityAnnotation = "notebook.kubeflow.org/pod-anti-affinity"
+
+// getPodAntiAffinityTopologyKey returns the topology key the Notebook Pods
+// are spread across, e.g. "kubernetes.io/hostname", set by the
+// POD_ANTI_AFFINITY env var. It returns "" if they aren't spread.
+func getPodAntiAffinityTopologyKey() string {
+	return os.Getenv("POD_ANTI_AFFINITY")
+}
+
+func validatePodAntiAffinity() error {
+	key := getPodAntiAffinityTopologyKey()
+	if key == "" {
+		return nil
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+		return fmt.Errorf("POD_ANTI_AFFINITY should be a topology label key, got %q: %v", key, errs)
+	}
+	return nil
+}
+
+// applyDefaultPodAntiAffinity makes the scheduler prefer the nodes, or the
+// other topology domains, that don't run another Notebook of the namespace,
+// so that a node failure doesn't stop many of them at once. It isn't applied
+// if the template sets a pod anti-affinity, or the Notebook opts out.
+func applyDefaultPodAntiAffinity(instance *v1beta1.Notebook, podSpec *corev1.PodSpec) {
+	key := getPodAntiAffinityTopologyKey()
+	if key == "" || instance.GetAnnotations()[PodAntiAffinityAnnotation] == "false" {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.PodAntiAffinity != nil {
+		return
+	}
+	podSpec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+			{
+				Weight: 100,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{
+							{Key: "notebook-name", Operator: metav1.LabelSelectorOpExists},
+						},
+					},
+					TopologyKey: key,
+				},
+			},
+		},
+	}
+}
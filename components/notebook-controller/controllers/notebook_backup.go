@@ -0,0 +1,231 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The type of the condition reporting the backup of the workspace of a
+// stopped Notebook.
+const BackupCondition = "Backup"
+
+// The reasons of the Backup condition.
+const (
+	BackupRunning           = "Running"
+	BackupCompleted         = "Completed"
+	BackupFailed            = "Failed"
+	BackupNotConfigured     = "NotConfigured"
+	BackupWorkspaceNotFound = "WorkspaceNotFound"
+)
+
+// backupInProgress returns true if the Notebook is stopped and its workspace
+// is being backed up, in which case it must not be scaled down yet. A failed
+// backup doesn't keep the Notebook running, the workspace PVC is kept anyway.
+func backupInProgress(instance *v1beta1.Notebook) bool {
+	if instance.Spec.BackupOnStop == nil || !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		return false
+	}
+	for _, c := range instance.Status.Conditions {
+		if c.Type == BackupCondition && c.Reason != BackupRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// generateBackupJob returns a Job syncing the content of the claim PVC to the
+// backup destination with rclone. Like the rsync Job, it prefers the node of
+// the Notebook Pod, so that a ReadWriteOnce PVC can be mounted while the
+// Notebook runs.
+func generateBackupJob(instance *v1beta1.Notebook, image, claim string) *batchv1.Job {
+	backoffLimit := int32(3)
+	backup := instance.Spec.BackupOnStop
+
+	container := corev1.Container{
+		Name:    "backup",
+		Image:   image,
+		Command: []string{"rclone", "sync", "/workspace/", backup.Destination},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "workspace", MountPath: "/workspace", ReadOnly: true},
+		},
+	}
+	if backup.SecretName != "" {
+		container.EnvFrom = []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: backup.SecretName},
+			},
+		}}
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + "-backup",
+			Namespace: instance.Namespace,
+			Labels:    map[string]string{"notebook-name": instance.Name},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+					Containers:    []corev1.Container{container},
+					Volumes: []corev1.Volume{
+						{
+							Name: "workspace",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: claim,
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					Affinity: &corev1.Affinity{
+						PodAffinity: &corev1.PodAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: corev1.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{
+											MatchLabels: map[string]string{"statefulset": instance.Name},
+										},
+										TopologyKey: "kubernetes.io/hostname",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// setBackupCondition updates the Backup condition of the Notebook and records
+// an event if it changed.
+func (r *NotebookReconciler) setBackupCondition(instance *v1beta1.Notebook, reason, message string) error {
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    BackupCondition,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return nil
+	}
+
+	switch reason {
+	case BackupCompleted:
+		r.countMaintenanceJob("backup", true)
+	case BackupFailed:
+		r.countMaintenanceJob("backup", false)
+	}
+	eventType := corev1.EventTypeNormal
+	if reason != BackupRunning && reason != BackupCompleted {
+		eventType = corev1.EventTypeWarning
+	}
+	r.EventRecorder.Event(instance, eventType, BackupCondition+reason, message)
+	return r.Status().Update(context.TODO(), instance)
+}
+
+// reconcileBackup backs up the workspace of the Notebook with a Job when it is
+// stopped and Spec.BackupOnStop is set. The Notebook is kept running until
+// the Job finishes. Once the Notebook is started again, the Job and the
+// Backup condition are removed so that the next stop triggers a new backup.
+func (r *NotebookReconciler) reconcileBackup(instance *v1beta1.Notebook) error {
+	ctx := context.TODO()
+	log := r.Log.WithValues("notebook", instance.Namespace)
+
+	if instance.Spec.BackupOnStop == nil || !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		if !hasNotebookCondition(&instance.Status, BackupCondition) {
+			return nil
+		}
+		job := &batchv1.Job{}
+		err := r.Get(ctx, types.NamespacedName{Name: instance.Name + "-backup", Namespace: instance.Namespace}, job)
+		if err != nil && !apierrs.IsNotFound(err) {
+			return err
+		} else if err == nil && metav1.IsControlledBy(job, instance) {
+			log.Info("Deleting Job", "namespace", job.Namespace, "name", job.Name)
+			err = r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrs.IsNotFound(err) {
+				return err
+			}
+		}
+		removeNotebookCondition(&instance.Status, BackupCondition)
+		return r.Status().Update(ctx, instance)
+	}
+	if !backupInProgress(instance) {
+		return nil
+	}
+
+	image := os.Getenv("BACKUP_IMAGE")
+	if len(image) == 0 {
+		return r.setBackupCondition(instance, BackupNotConfigured,
+			"The BACKUP_IMAGE env var of the controller must be set to back up Notebooks")
+	}
+	claim := workspaceClaimName(instance)
+	if claim == "" {
+		return r.setBackupCondition(instance, BackupWorkspaceNotFound,
+			fmt.Sprintf("The home directory of Notebook %s must be mounted from a PVC to be backed up", instance.Name))
+	}
+
+	job := generateBackupJob(instance, image, claim)
+	if err := ctrl.SetControllerReference(instance, job, r.Scheme); err != nil {
+		return err
+	}
+	foundJob := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, foundJob)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Job", "namespace", job.Namespace, "name", job.Name)
+		err = r.Create(ctx, job)
+		if err != nil {
+			return err
+		}
+		message := fmt.Sprintf("Backing up PVC %s to %s", claim, instance.Spec.BackupOnStop.Destination)
+		r.notify(instance, notify.EventMaintenance, message)
+		return r.setBackupCondition(instance, BackupRunning, message)
+	} else if err != nil {
+		return err
+	}
+	if foundJob.DeletionTimestamp != nil {
+		// The Job of the previous stop is still being deleted
+		return nil
+	}
+
+	if jobHasCondition(foundJob, batchv1.JobComplete) {
+		return r.setBackupCondition(instance, BackupCompleted,
+			fmt.Sprintf("Backed up PVC %s to %s", claim, instance.Spec.BackupOnStop.Destination))
+	}
+	if jobHasCondition(foundJob, batchv1.JobFailed) {
+		return r.setBackupCondition(instance, BackupFailed,
+			fmt.Sprintf("Job %s failed to back up PVC %s, the Notebook is stopped without a backup", foundJob.Name, claim))
+	}
+	return r.setBackupCondition(instance, BackupRunning,
+		fmt.Sprintf("Backing up PVC %s to %s", claim, instance.Spec.BackupOnStop.Destination))
+}
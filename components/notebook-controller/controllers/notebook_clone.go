@@ -0,0 +1,380 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// The type of the condition reporting the progress of a clone.
+const CloneCondition = "Clone"
+
+// The reasons of the Clone condition.
+const (
+	CloneCopying              = "Copying"
+	CloneCompleted            = "Completed"
+	CloneIgnored              = "Ignored"
+	CloneInvalidSource        = "InvalidSource"
+	CloneNotConfigured        = "NotConfigured"
+	CloneSourceNotFound       = "SourceNotFound"
+	CloneWorkspaceNotFound    = "WorkspaceNotFound"
+	CloneWorkspaceExists      = "WorkspaceExists"
+	CloneStorageClassNotFound = "StorageClassNotFound"
+	CloneCopyFailed           = "CopyFailed"
+)
+
+// The annotation set on the PVCs created for a clone, naming the Notebook
+// they are copied from. The controller only copies into PVCs it created.
+const CloneSourceAnnotation = "notebook.kubeflow.org/cloned-from"
+
+// The command of the rsync Job, if the RSYNC_COMMAND env var isn't set. The
+// source and destination directories are appended to it.
+var DefaultRsyncCommand = []string{"rsync", "-a"}
+
+// helperConfig is the image and command of a helper container run by the
+// controller, so that it doesn't rely on the tools of the notebook image.
+type helperConfig struct {
+	Image   string
+	Command []string
+}
+
+// getRsyncConfig returns the configuration of the rsync Job, read from the
+// RSYNC_IMAGE env var and the RSYNC_COMMAND one, a JSON array.
+func getRsyncConfig() (helperConfig, error) {
+	config := helperConfig{
+		Image:   os.Getenv("RSYNC_IMAGE"),
+		Command: DefaultRsyncCommand,
+	}
+	if command := os.Getenv("RSYNC_COMMAND"); len(command) != 0 {
+		config.Command = nil
+		if err := json.Unmarshal([]byte(command), &config.Command); err != nil {
+			return config, fmt.Errorf("invalid RSYNC_COMMAND %q, expected a JSON array: %v", command, err)
+		}
+		if len(config.Command) == 0 {
+			return config, fmt.Errorf("RSYNC_COMMAND should not be empty")
+		}
+	}
+	return config, nil
+}
+
+func validateRsyncConfig() error {
+	_, err := getRsyncConfig()
+	return err
+}
+
+// cloneInProgress returns true if the Notebook is waiting for the workspace
+// of another Notebook to be copied, in which case it must not be started.
+func cloneInProgress(instance *v1beta1.Notebook) bool {
+	if instance.Spec.CloneFrom == "" {
+		return false
+	}
+	for _, c := range instance.Status.Conditions {
+		if c.Type == CloneCondition && (c.Reason == CloneCompleted || c.Reason == CloneIgnored) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasNotebookCondition(status *v1beta1.NotebookStatus, conditionType string) bool {
+	for _, c := range status.Conditions {
+		if c.Type == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// workspaceClaimName returns the name of the PVC mounted as the home directory
+// of the Notebook, or "" if the home directory isn't backed by a PVC.
+func workspaceClaimName(instance *v1beta1.Notebook) string {
+	podSpec := &instance.Spec.Template.Spec
+	if len(podSpec.Containers) == 0 {
+		return ""
+	}
+	mount := workspaceVolumeMount(&podSpec.Containers[0])
+	if mount == nil {
+		return ""
+	}
+	for _, v := range podSpec.Volumes {
+		if v.Name == mount.Name && v.PersistentVolumeClaim != nil {
+			return v.PersistentVolumeClaim.ClaimName
+		}
+	}
+	return ""
+}
+
+// generateClonePVC returns a PVC with the same storage request, access modes
+// and StorageClass as the given one, unless the Notebook sets the StorageClass
+// of its workspace.
+func generateClonePVC(instance *v1beta1.Notebook, name string, source *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+	storageClass := source.Spec.StorageClassName
+	if instance.Spec.WorkspaceStorageClass != nil {
+		storageClass = instance.Spec.WorkspaceStorageClass
+	}
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   instance.Namespace,
+			Annotations: map[string]string{CloneSourceAnnotation: instance.Spec.CloneFrom},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      source.Spec.AccessModes,
+			Resources:        source.Spec.Resources,
+			StorageClassName: storageClass,
+		},
+	}
+}
+
+// generateRsyncJob returns a Job copying the content of the srcClaim PVC into
+// the dstClaim PVC with the given rsync helper, whose command is run with the
+// source and destination directories as arguments. The Job prefers the node
+// of the srcNotebook Pod, so that a ReadWriteOnce source PVC can be mounted
+// while the source Notebook runs.
+func generateRsyncJob(instance *v1beta1.Notebook, suffix string, rsync helperConfig, srcClaim, dstClaim, srcNotebook string) *batchv1.Job {
+	backoffLimit := int32(3)
+	command := append(append([]string{}, rsync.Command...), "/src/", "/dst/")
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + "-" + suffix,
+			Namespace: instance.Namespace,
+			Labels:    map[string]string{"notebook-name": instance.Name},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+					Containers: []corev1.Container{
+						{
+							Name:    "rsync",
+							Image:   rsync.Image,
+							Command: command,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "src", MountPath: "/src", ReadOnly: true},
+								{Name: "dst", MountPath: "/dst"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "src",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: srcClaim,
+									ReadOnly:  true,
+								},
+							},
+						},
+						{
+							Name: "dst",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: dstClaim,
+								},
+							},
+						},
+					},
+					Affinity: &corev1.Affinity{
+						PodAffinity: &corev1.PodAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: corev1.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{
+											MatchLabels: map[string]string{"statefulset": srcNotebook},
+										},
+										TopologyKey: "kubernetes.io/hostname",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func jobHasCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == conditionType && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// setCloneCondition updates the Clone condition of the Notebook and records
+// an event if it changed.
+func (r *NotebookReconciler) setCloneCondition(instance *v1beta1.Notebook, reason, message string) error {
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    CloneCondition,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return nil
+	}
+
+	switch reason {
+	case CloneCompleted:
+		r.countMaintenanceJob("clone", true)
+	case CloneCopyFailed:
+		r.countMaintenanceJob("clone", false)
+	}
+	eventType := corev1.EventTypeNormal
+	if reason != CloneCopying && reason != CloneCompleted {
+		eventType = corev1.EventTypeWarning
+	}
+	r.EventRecorder.Event(instance, eventType, CloneCondition+reason, message)
+	return r.Status().Update(context.TODO(), instance)
+}
+
+// reconcileClone copies the workspace of the Notebook named in
+// Spec.CloneFrom into the workspace of this Notebook, when it is created. The
+// workspace PVC is created like the source one, the controller doesn't copy
+// into an existing PVC. The Notebook is kept stopped until the copy completes.
+func (r *NotebookReconciler) reconcileClone(instance *v1beta1.Notebook) error {
+	if instance.Spec.CloneFrom == "" {
+		if removeNotebookCondition(&instance.Status, CloneCondition) {
+			return r.Status().Update(context.TODO(), instance)
+		}
+		return nil
+	}
+	if !cloneInProgress(instance) {
+		return nil
+	}
+	ctx := context.TODO()
+	log := r.Log.WithValues("notebook", instance.Namespace)
+
+	// Copying over the workspace of a running Notebook would lose its data
+	if !hasNotebookCondition(&instance.Status, CloneCondition) {
+		err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &appsv1.StatefulSet{})
+		if err == nil {
+			return r.setCloneCondition(instance, CloneIgnored,
+				fmt.Sprintf("cloneFrom is only applied when the Notebook is created, %s was not copied",
+					instance.Spec.CloneFrom))
+		} else if !apierrs.IsNotFound(err) {
+			return err
+		}
+	}
+	if instance.Spec.CloneFrom == instance.Name {
+		return r.setCloneCondition(instance, CloneInvalidSource, "A Notebook can't be cloned from itself")
+	}
+	rsync, err := getRsyncConfig()
+	if err != nil {
+		return err
+	}
+	if len(rsync.Image) == 0 {
+		return r.setCloneCondition(instance, CloneNotConfigured,
+			"The RSYNC_IMAGE env var of the controller must be set to clone Notebooks")
+	}
+
+	source := &v1beta1.Notebook{}
+	err = r.Get(ctx, types.NamespacedName{Name: instance.Spec.CloneFrom, Namespace: instance.Namespace}, source)
+	if err != nil && apierrs.IsNotFound(err) {
+		return r.setCloneCondition(instance, CloneSourceNotFound,
+			fmt.Sprintf("Notebook %s to clone from was not found", instance.Spec.CloneFrom))
+	} else if err != nil {
+		return err
+	}
+
+	srcClaim := workspaceClaimName(source)
+	dstClaim := workspaceClaimName(instance)
+	if srcClaim == "" || dstClaim == "" {
+		return r.setCloneCondition(instance, CloneWorkspaceNotFound,
+			fmt.Sprintf("The home directories of Notebooks %s and %s must be mounted from PVCs",
+				source.Name, instance.Name))
+	}
+
+	srcPVC := &corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, types.NamespacedName{Name: srcClaim, Namespace: instance.Namespace}, srcPVC)
+	if err != nil && apierrs.IsNotFound(err) {
+		return r.setCloneCondition(instance, CloneWorkspaceNotFound,
+			fmt.Sprintf("PVC %s of Notebook %s was not found", srcClaim, source.Name))
+	} else if err != nil {
+		return err
+	}
+	dstPVC := &corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, types.NamespacedName{Name: dstClaim, Namespace: instance.Namespace}, dstPVC)
+	if err != nil && apierrs.IsNotFound(err) {
+		if className := instance.Spec.WorkspaceStorageClass; className != nil {
+			sc, err := r.getStorageClass(*className)
+			if err != nil {
+				return err
+			}
+			if sc == nil {
+				return r.setCloneCondition(instance, CloneStorageClassNotFound,
+					fmt.Sprintf("StorageClass %s was not found", *className))
+			}
+		}
+		log.Info("Creating PVC", "namespace", instance.Namespace, "name", dstClaim)
+		err = r.Create(ctx, generateClonePVC(instance, dstClaim, srcPVC))
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if dstPVC.Annotations[CloneSourceAnnotation] != source.Name {
+		return r.setCloneCondition(instance, CloneWorkspaceExists,
+			fmt.Sprintf("PVC %s already exists, Notebooks are only cloned into a new PVC. "+
+				"Delete the PVC or remove cloneFrom", dstClaim))
+	}
+
+	job := generateRsyncJob(instance, "clone", rsync, srcClaim, dstClaim, source.Name)
+	if err := ctrl.SetControllerReference(instance, job, r.Scheme); err != nil {
+		return err
+	}
+	foundJob := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, foundJob)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Job", "namespace", job.Namespace, "name", job.Name)
+		err = r.Create(ctx, job)
+		if err != nil {
+			return err
+		}
+		message := fmt.Sprintf("Copying PVC %s of Notebook %s into PVC %s", srcClaim, source.Name, dstClaim)
+		r.notify(instance, notify.EventMaintenance, message)
+		return r.setCloneCondition(instance, CloneCopying, message)
+	} else if err != nil {
+		return err
+	}
+
+	if jobHasCondition(foundJob, batchv1.JobComplete) {
+		return r.setCloneCondition(instance, CloneCompleted,
+			fmt.Sprintf("Copied PVC %s of Notebook %s into PVC %s", srcClaim, source.Name, dstClaim))
+	}
+	if jobHasCondition(foundJob, batchv1.JobFailed) {
+		return r.setCloneCondition(instance, CloneCopyFailed,
+			fmt.Sprintf("Job %s failed to copy PVC %s into PVC %s, delete it to retry", foundJob.Name, srcClaim, dstClaim))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// The annotation of the Pod template holding a checksum of the ConfigMaps and
+// Secrets referenced by the Notebook, so that changing them rolls the Pod.
+const ConfigChecksumAnnotation = "notebook.kubeflow.org/config-checksum"
+
+// configRolloutEnabled returns whether the Pods are rolled when the ConfigMaps
+// and Secrets they reference change. It is disabled by default, since it
+// makes the controller watch all the ConfigMaps and Secrets of the cluster.
+func configRolloutEnabled() bool {
+	return os.Getenv("ROLL_ON_CONFIG_CHANGE") == "true"
+}
+
+// referencedConfig returns the sorted names of the ConfigMaps and Secrets
+// referenced by the volumes and the environment of the Pod.
+func referencedConfig(podSpec *corev1.PodSpec) (configMaps, secrets []string) {
+	cms, scs := map[string]bool{}, map[string]bool{}
+	for _, v := range podSpec.Volumes {
+		if v.ConfigMap != nil {
+			cms[v.ConfigMap.Name] = true
+		}
+		if v.Secret != nil {
+			scs[v.Secret.SecretName] = true
+		}
+		if v.Projected != nil {
+			for _, s := range v.Projected.Sources {
+				if s.ConfigMap != nil {
+					cms[s.ConfigMap.Name] = true
+				}
+				if s.Secret != nil {
+					scs[s.Secret.Name] = true
+				}
+			}
+		}
+	}
+	containers := append([]corev1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, c := range containers {
+		for _, e := range c.EnvFrom {
+			if e.ConfigMapRef != nil {
+				cms[e.ConfigMapRef.Name] = true
+			}
+			if e.SecretRef != nil {
+				scs[e.SecretRef.Name] = true
+			}
+		}
+		for _, e := range c.Env {
+			if e.ValueFrom == nil {
+				continue
+			}
+			if e.ValueFrom.ConfigMapKeyRef != nil {
+				cms[e.ValueFrom.ConfigMapKeyRef.Name] = true
+			}
+			if e.ValueFrom.SecretKeyRef != nil {
+				scs[e.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+	}
+	return sortedKeys(cms), sortedKeys(scs)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configChecksum returns a checksum of the data of the ConfigMaps and Secrets
+// referenced by the Notebook. Missing ones are part of the checksum too, so
+// that creating an optional ConfigMap or Secret rolls the Pod.
+func (r *NotebookReconciler) configChecksum(instance *v1beta1.Notebook) (string, error) {
+	ctx := context.TODO()
+	configMaps, secrets := referencedConfig(&instance.Spec.Template.Spec)
+	h := sha256.New()
+	for _, name := range configMaps {
+		cm := &corev1.ConfigMap{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, cm)
+		if err != nil && apierrs.IsNotFound(err) {
+			fmt.Fprintf(h, "configmap/%s missing\n", name)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "configmap/%s\n", name)
+		for _, k := range sortedStringKeys(cm.Data) {
+			fmt.Fprintf(h, "%s=%q\n", k, cm.Data[k])
+		}
+		for _, k := range sortedBytesKeys(cm.BinaryData) {
+			fmt.Fprintf(h, "%s=%q\n", k, cm.BinaryData[k])
+		}
+	}
+	for _, name := range secrets {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, secret)
+		if err != nil && apierrs.IsNotFound(err) {
+			fmt.Fprintf(h, "secret/%s missing\n", name)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "secret/%s\n", name)
+		for _, k := range sortedBytesKeys(secret.Data) {
+			fmt.Fprintf(h, "%s=%q\n", k, secret.Data[k])
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedBytesKeys(m map[string][]byte) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// notebooksReferencingConfig returns a handler.ToRequestsFunc enqueuing the Notebooks
+// referencing a ConfigMap or a Secret, depending on isSecret.
+func (r *NotebookReconciler) notebooksReferencingConfig(isSecret bool) handler.ToRequestsFunc {
+	return func(a handler.MapObject) []ctrl.Request {
+		notebooks := &v1beta1.NotebookList{}
+		if err := r.List(context.TODO(), notebooks, client.InNamespace(a.Meta.GetNamespace())); err != nil {
+			r.Log.Error(err, "unable to list Notebooks", "namespace", a.Meta.GetNamespace())
+			return nil
+		}
+
+		requests := []ctrl.Request{}
+		for _, nb := range notebooks.Items {
+			configMaps, secrets := referencedConfig(&nb.Spec.Template.Spec)
+			names := configMaps
+			if isSecret {
+				names = secrets
+			}
+			for _, name := range names {
+				if name == a.Meta.GetName() {
+					requests = append(requests, ctrl.Request{
+						NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+					})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
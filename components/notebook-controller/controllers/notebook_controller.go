@@ -17,26 +17,38 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
 	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
 	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
 	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/metrics"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -51,6 +63,144 @@ const DefaultServingPort = 80
 // https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.11/#podsecuritycontext-v1-core
 const DefaultFSGroup = int64(100)
 
+// The home directory of the notebook images, where the workspace volume is mounted.
+const DefaultWorkspacePath = "/home/jovyan"
+
+// The mount path of the shared memory volume.
+const ShmPath = "/dev/shm"
+
+// The mount path of the temporary files volume.
+const TmpPath = "/tmp"
+
+// Setting this annotation to "false" on a Notebook opts it out of the
+// temporary files volume set by the TMP_VOLUME_SIZE env var.
+const TmpVolumeAnnotation = "notebook.kubeflow.org/tmp-volume"
+
+// When this annotation is set to "true" the controller stops managing the
+// Notebook's child resources, so that operators can debug the Pod by hand.
+// Reconciling resumes once the annotation is removed.
+const PauseAnnotation = "notebook.kubeflow.org/pause"
+
+// The type of the condition set while the PauseAnnotation is set.
+const PausedCondition = "Paused"
+
+// The annotation of the StatefulSet recording the immutable fields of its
+// spec, as they were applied when it was created.
+const ImmutableSpecAnnotation = "notebook.kubeflow.org/immutable-spec"
+
+// The type of the condition set while the desired immutable fields of the
+// StatefulSet differ from the applied ones.
+const ImmutableFieldsCondition = "ImmutableFieldsChanged"
+
+// The annotation of the StatefulSet listing the keys of the annotations the
+// controller set on its Pod template, so that the ones removed from the
+// Notebook are removed from the Pod as well.
+const PodAnnotationsAnnotation = "notebook.kubeflow.org/pod-annotations"
+
+// The name of the node the Notebook Pod must be scheduled on, set as a
+// nodeSelector on the kubernetes.io/hostname label. It is ignored if the
+// Notebook sets a node affinity or a nodeName.
+const NodeNameAnnotation = "notebook.kubeflow.org/node-name"
+
+// The number of replicas of the StatefulSet of the Notebook, overriding the
+// default one and the stop annotation, e.g. "0" to keep a Notebook stopped or
+// more for specialized workloads. Such Notebooks aren't culled. It is ignored
+// if it isn't a non-negative integer.
+const ReplicasAnnotation = "notebook.kubeflow.org/replicas"
+
+// The governing Service of the StatefulSet of the Notebook, giving its Pod the
+// <pod>.<service> DNS name, e.g. a headless Service managed by the user.
+// Defaults to the Service of the Notebook, it is ignored if it isn't a valid
+// Service name. The StatefulSets created before the default was set keep
+// their empty one.
+const ServiceNameAnnotation = "notebook.kubeflow.org/service-name"
+
+// The host the HTTP traffic of the Notebook is mirrored to by its
+// VirtualService, e.g. "collector.debug.svc.cluster.local" or with a port,
+// "collector.debug.svc.cluster.local:8080". No traffic is mirrored by default.
+const MirrorHostAnnotation = "notebook.kubeflow.org/mirror-host"
+
+// The percentage of the requests mirrored to the MirrorHostAnnotation, a
+// number between 0 and 100. All of them are mirrored if it isn't set, it is
+// ignored if it is invalid.
+const MirrorPercentageAnnotation = "notebook.kubeflow.org/mirror-percentage"
+
+// Setting this annotation to "false" removes the route of the VirtualService
+// redirecting the prefix of the Notebook without its trailing slash to the
+// prefix with it.
+const TrailingSlashRedirectAnnotation = "notebook.kubeflow.org/trailing-slash-redirect"
+
+// The annotation of the Culled events of the Notebooks, set to the number of
+// seconds they had been idle for.
+const IdleSecondsAnnotation = "notebook.kubeflow.org/idle-seconds"
+
+// The type of the condition set while the node named by the
+// NodeNameAnnotation doesn't exist.
+const NodeNotFoundCondition = "NodeNotFound"
+
+// When this annotation is set to "true", the NB_PREFIX env var isn't set on the
+// notebook container, for images that don't use it.
+const NoNbPrefixAnnotation = "notebook.kubeflow.org/no-nb-prefix"
+
+// The type of the condition set while the workspace is mounted read-only.
+const ReadOnlyCondition = "ReadOnly"
+
+// The type of the condition set while a PVC mounted by the Notebook is being
+// expanded. Its reason is the condition reported by the PVC, Resizing or
+// FileSystemResizePending.
+const PVCResizingCondition = "PVCResizing"
+
+// The type of the condition set while a PVC mounted by the Notebook doesn't
+// exist, which keeps its StatefulSet from being created.
+const MissingVolumeCondition = "MissingVolume"
+
+// The type of the condition set while the routing object of the Notebook, e.g.
+// its VirtualService, fails to reconcile.
+const NetworkingDegradedCondition = "NetworkingDegraded"
+
+// The type of the condition set when the Pod couldn't be scheduled for longer
+// than SCHEDULE_TIMEOUT minutes.
+const ScheduleTimeoutCondition = "ScheduleTimeout"
+
+// The type of the condition set while the Notebook is stopped, i.e. it has the
+// stop annotation and no ready replica, or its Pod is detached. Its reason is
+// why it was stopped: StoppedReasonCulled, StoppedReasonScheduled or
+// StoppedReasonManual.
+const StoppedCondition = "Stopped"
+
+const (
+	StoppedReasonCulled    = "CulledByIdle"
+	StoppedReasonScheduled = "ScheduledStop"
+	StoppedReasonManual    = "ManuallyStopped"
+)
+
+// The type of the condition set while the Notebook strips its URL prefix but
+// its server is still configured with it through NB_PREFIX.
+const PrefixConflictCondition = "PrefixConflict"
+
+// The default value of the SCHEDULE_TIMEOUT env var, in minutes.
+const DefaultScheduleTimeout = 5
+
+// The default value of the UNHEALTHY_REQUEUE_PERIOD env var, in seconds.
+const DefaultUnhealthyRequeuePeriod = 30
+
+// The values of the CULL_MODE env var: stopped Notebooks are either scaled
+// down, or keep running but are detached from their Service, so that they
+// restart instantly.
+const (
+	CullModeScale  = "scale"
+	CullModeDetach = "detach"
+)
+
+// The label added to the selector of the Service of a detached Notebook. No
+// Pod has it, so that the Service has no endpoints.
+const DetachedLabel = "notebook.kubeflow.org/detached"
+
+// The default template of the URL prefix a Notebook is served under. It can be
+// overridden with the NB_PREFIX_TEMPLATE env var, e.g. when Kubeflow is exposed
+// behind a reverse proxy under an additional base path.
+const DefaultPrefixTemplate = "/notebook/{namespace}/{name}"
+
 /*
 We generally want to ignore (not requeue) NotFound errors, since we'll get a
 reconciliation request once the object exists, and requeuing in the meantime
@@ -63,6 +213,26 @@ func ignoreNotFound(err error) error {
 	return err
 }
 
+// isTransientError returns true for API errors that are expected to go away
+// when the request is retried.
+func isTransientError(err error) bool {
+	// The API server or etcd didn't answer in time, e.g. during an etcd
+	// leader election.
+	if apierrs.IsServerTimeout(err) {
+		return true
+	}
+	// A webhook or the API server timed out while processing the request.
+	if apierrs.IsTimeout(err) {
+		return true
+	}
+	// The object was modified concurrently, a retry reads the latest version.
+	if apierrs.IsConflict(err) {
+		return true
+	}
+	// The API server is rate limiting the controller.
+	return apierrs.IsTooManyRequests(err)
+}
+
 // NotebookReconciler reconciles a Notebook object
 type NotebookReconciler struct {
 	client.Client
@@ -70,14 +240,43 @@ type NotebookReconciler struct {
 	Scheme        *runtime.Scheme
 	Metrics       *metrics.Metrics
 	EventRecorder record.EventRecorder
+
+	// reissuedEvents maps the UIDs of the reissued Pod and StatefulSet
+	// events to a reissuedEvent, to reissue them once.
+	reissuedEvents sync.Map
+
+	// maintenanceLocks serializes the maintenance flows of each Notebook.
+	maintenanceLocks keyedMutex
+
+	// Notifier, if set, notifies the owners of the Notebooks when they are
+	// culled, started again, or a maintenance Job starts.
+	Notifier notify.Notifier
 }
 
 // +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=statefulsets/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;patch
+// +kubebuilder:rbac:groups=metrics.k8s.io,resources=pods,verbs=get
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=sidecars,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots;volumesnapshotcontents,verbs=get;list;watch
+// +kubebuilder:rbac:groups=kubeflow.org,resources=poddefaults,verbs=get;list
 // +kubebuilder:rbac:groups=kubeflow.org,resources=notebooks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=kubeflow.org,resources=notebooktemplates,verbs=get;list;watch
 // +kubebuilder:rbac:groups=kubeflow.org,resources=notebooks/status,verbs=get;update;patch
+
 func (r *NotebookReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 	log := r.Log.WithValues("notebook", req.NamespacedName)
@@ -97,8 +296,7 @@ func (r *NotebookReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			log.Error(err, "unable to fetch Notebook by looking at event")
 			return ctrl.Result{}, ignoreNotFound(err)
 		}
-		r.EventRecorder.Eventf(involvedNotebook, event.Type, event.Reason,
-			"Reissued from %s/%s: %s", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Message)
+		r.reissueEvent(involvedNotebook, event)
 	}
 	if getEventErr != nil && !apierrs.IsNotFound(getEventErr) {
 		return ctrl.Result{}, getEventErr
@@ -110,32 +308,183 @@ func (r *NotebookReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		log.Error(err, "unable to fetch Notebook")
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
+	log = notebookLogger(log, instance)
+	log.V(1).Info("Reconciling Notebook", "namespace", instance.Namespace, "name", instance.Name,
+		"resourceVersion", instance.ResourceVersion)
+
+	// The children can't be created in a namespace being deleted, and the
+	// Notebook is deleted along with it
+	if terminating, err := r.namespaceIsTerminating(instance.Namespace); err != nil {
+		return ctrl.Result{}, err
+	} else if terminating {
+		log.Info("Namespace is terminating, skipping reconcile", "namespace", instance.Namespace, "name", instance.Name)
+		return ctrl.Result{}, nil
+	}
+
+	if instance.GetAnnotations()[PauseAnnotation] == "true" {
+		log.Info("Notebook is paused, skipping reconcile", "namespace", instance.Namespace, "name", instance.Name)
+		message := fmt.Sprintf("Reconcile is paused by the %s annotation", PauseAnnotation)
+		if !setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+			Type:    PausedCondition,
+			Reason:  "PauseAnnotation",
+			Message: message,
+		}) {
+			return ctrl.Result{}, nil
+		}
+		r.EventRecorder.Event(instance, corev1.EventTypeNormal, PausedCondition, message)
+		return ctrl.Result{}, r.Status().Update(ctx, instance)
+	}
+	if removeNotebookCondition(&instance.Status, PausedCondition) {
+		log.Info("Notebook is resumed", "namespace", instance.Namespace, "name", instance.Name)
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, "Resumed",
+			"Reconcile is resumed after removing the %s annotation", PauseAnnotation)
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Delete the Notebook once its TTL has passed
+	if deleted, err := r.reconcileTTL(instance); err != nil || deleted {
+		return ctrl.Result{}, err
+	}
+
+	// Copy the workspace of the Notebook this one is cloned from, and back
+	// it up before stopping it
+	if err := r.reconcileMaintenance(instance); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Generate the access token of the Notebook, before its Pod mounts it
+	if changed, err := r.reconcileAccessToken(instance); err != nil {
+		return ctrl.Result{}, err
+	} else if changed {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The kind of the Notebook only changes with its spec, or with the
+	// NOTEBOOK_KINDS of the controller, so there is no point in retrying
+	if _, err := getNotebookKind(instance); err != nil {
+		log.Info("Unable to resolve the kind of the Notebook", "namespace", instance.Namespace, "name", instance.Name, "error", err.Error())
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, "UnknownKind", err.Error())
+		return requeueBeforeDeadline(instance, ctrl.Result{}), nil
+	}
+
+	// Merge the NotebookTemplate of the Notebook into the pod template its
+	// StatefulSet and Service are generated from. The merged spec isn't
+	// written back to the Notebook
+	generated, err := r.applyNotebookTemplate(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if r.updateMissingTemplate(instance, generated == nil) {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if generated == nil {
+		log.Info("Waiting for the NotebookTemplate of the Notebook", "namespace", instance.Namespace,
+			"name", instance.Name, "template", templateKey(instance).String())
+		return requeueBeforeDeadline(instance, ctrl.Result{RequeueAfter: getUnhealthyRequeuePeriod()}), nil
+	}
+
+	// Nothing can be generated without a notebook container. The CRD requires
+	// the containers field, but accepts an empty list, and the containers may
+	// come from the NotebookTemplate.
+	if err := checkContainers(generated); err != nil {
+		log.Info("Invalid Notebook", "namespace", instance.Namespace, "name", instance.Name, "error", err.Error())
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, "NoContainers", err.Error())
+		return ctrl.Result{}, err
+	}
 
 	// Reconcile StatefulSet
-	ss := generateStatefulSet(instance)
+	ss := generateStatefulSet(generated)
+	if os.Getenv("PROPAGATE_LABEL_PREFIXES") != "" {
+		keys, err := r.podDefaultLabelKeys(instance.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		for k := range keys {
+			if v, ok := instance.Labels[k]; ok && !reservedLabels[k] {
+				ss.Spec.Template.Labels[k] = v
+			}
+		}
+	}
+	if configRolloutEnabled() {
+		checksum, err := r.configChecksum(generated)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		ss.Spec.Template.Annotations[ConfigChecksumAnnotation] = checksum
+	}
+	ss.Annotations[PodAnnotationsAnnotation] = strings.Join(sortedStringKeys(ss.Spec.Template.Annotations), ",")
 	if err := ctrl.SetControllerReference(instance, ss, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
 	// Check if the StatefulSet already exists
 	foundStateful := &appsv1.StatefulSet{}
 	justCreated := false
-	err := r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
+	err = r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
 	if err != nil && apierrs.IsNotFound(err) {
+		// The Pod of a StatefulSet mounting a missing PVC would stay pending
+		// until the PVC is created, wait for it instead. A StatefulSet without
+		// replicas, e.g. while its workspace is cloned, has no Pod to wait.
+		var missing []string
+		if ss.Spec.Replicas == nil || *ss.Spec.Replicas != 0 {
+			var pvcErr error
+			missing, pvcErr = r.missingPVCs(instance, &ss.Spec.Template.Spec)
+			if pvcErr != nil {
+				return ctrl.Result{}, pvcErr
+			}
+		}
+		if r.updateMissingVolume(instance, missing) {
+			if err := r.Status().Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if len(missing) != 0 {
+			log.Info("Waiting for the PVCs of the Notebook", "namespace", instance.Namespace,
+				"name", instance.Name, "pvcs", missing)
+			return requeueBeforeDeadline(instance, ctrl.Result{RequeueAfter: getUnhealthyRequeuePeriod()}), nil
+		}
 		log.Info("Creating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
-		r.Metrics.NotebookCreation.WithLabelValues(ss.Namespace).Inc()
 		err = r.Create(ctx, ss)
 		justCreated = true
-		if err != nil {
+		if err != nil && isTransientError(err) {
+			log.Info("Transient error creating Statefulset, requeueing", "error", err.Error())
+			return ctrl.Result{Requeue: true}, nil
+		} else if err != nil {
 			log.Error(err, "unable to create Statefulset")
 			r.Metrics.NotebookFailCreation.WithLabelValues(ss.Namespace).Inc()
 			return ctrl.Result{}, err
 		}
+		r.Metrics.NotebookCreation.WithLabelValues(ss.Namespace).Inc()
 	} else if err != nil {
 		log.Error(err, "error getting Statefulset")
 		return ctrl.Result{}, err
 	}
+	// Immutable fields can't be updated, let the user know the change is ignored
+	if !justCreated {
+		err = r.checkImmutableFields(instance, ss, foundStateful)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// The Notebook was started again since the StatefulSet was stopped, give
+	// it a full idle window before it can be culled again
+	if !justCreated && culler.StopAnnotationIsSet(foundStateful.ObjectMeta) &&
+		!culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		log.Info("Notebook was started again", "namespace", instance.Namespace, "name", instance.Name)
+		culler.RemoveStopAnnotation(&instance.ObjectMeta)
+		err = r.Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		r.notify(instance, notify.EventStarted, "The notebook was started again")
+	}
 	// Update the foundStateful object and write the result back if there are any changes
-	if !justCreated && reconcilehelper.CopyStatefulSetFields(ss, foundStateful) {
+	if !justCreated && copyStatefulSetFields(ss, foundStateful) {
 		log.Info("Updating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
 		err = r.Update(ctx, foundStateful)
 		if err != nil {
@@ -144,64 +493,137 @@ func (r *NotebookReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	// Reconcile service
-	service := generateService(instance)
-	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
-		return ctrl.Result{}, err
-	}
-	// Check if the Service already exists
-	foundService := &corev1.Service{}
-	justCreated = false
-	err = r.Get(ctx, types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
-	if err != nil && apierrs.IsNotFound(err) {
-		log.Info("Creating Service", "namespace", service.Namespace, "name", service.Name)
-		err = r.Create(ctx, service)
-		justCreated = true
+	// Reconcile the Service and VirtualService, unless the user manages them
+	networkingChanged := false
+	if instance.Spec.NetworkingMode != v1beta1.NetworkingModeNone {
+		err = r.reconcileService(generated)
 		if err != nil {
-			log.Error(err, "unable to create Service")
 			return ctrl.Result{}, err
 		}
-	} else if err != nil {
-		log.Error(err, "error getting Statefulset")
-		return ctrl.Result{}, err
-	}
-	// Update the foundService object and write the result back if there are any changes
-	if !justCreated && reconcilehelper.CopyServiceFields(service, foundService) {
-		log.Info("Updating Service\n", "namespace", service.Namespace, "name", service.Name)
-		err = r.Update(ctx, foundService)
+
+		// Reconcile the VirtualService or the Ingress routing to the Service.
+		// A failure, e.g. of the Istio API, doesn't block the lifecycle of
+		// the Notebook, it is retried sooner.
+		if router := r.getRouter(); router != nil {
+			err = router.reconcile(instance)
+			if err != nil {
+				log.Error(err, "unable to reconcile the "+router.kind())
+			}
+			networkingChanged = r.updateNetworkingDegraded(instance, router.kind(), err)
+		} else {
+			networkingChanged = removeNotebookCondition(&instance.Status, NetworkingDegradedCondition)
+		}
+	} else {
+		err = r.deleteNetworking(instance)
 		if err != nil {
-			log.Error(err, "unable to update Service")
 			return ctrl.Result{}, err
 		}
+		networkingChanged = removeNotebookCondition(&instance.Status, NetworkingDegradedCondition)
 	}
-
-	// Reconcile virtual service if we use ISTIO.
-	if os.Getenv("USE_ISTIO") == "true" {
-		err = r.reconcileVirtualService(instance)
+	if networkingChanged {
+		err = r.Status().Update(ctx, instance)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
+	// Restrict the egress of the Notebook to the allowed destinations
+	err = r.reconcileEgressNetworkPolicy(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Scope the configuration of the Istio proxy of the Notebook
+	err = r.reconcileSidecar(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile the Service the culler queries the activity of the Notebook
+	// through, apart from the user traffic
+	err = r.reconcileActivityService(generated)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Update the readyReplicas if the status is changed
 	if foundStateful.Status.ReadyReplicas != instance.Status.ReadyReplicas {
 		log.Info("Updating Status", "namespace", instance.Namespace, "name", instance.Name)
+		firstReady := instance.Status.ReadyReplicas == 0 && foundStateful.Status.ReadyReplicas > 0 &&
+			foundStateful.Generation == 1
 		instance.Status.ReadyReplicas = foundStateful.Status.ReadyReplicas
 		err = r.Status().Update(ctx, instance)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		// The StatefulSet spec changes when the Notebook is stopped or
+		// updated, so only the first start of the Notebook is measured.
+		if firstReady {
+			r.Metrics.NotebookReadyLatency.WithLabelValues(instance.Namespace).Observe(
+				time.Since(instance.CreationTimestamp.Time).Seconds())
+		}
+	}
+
+	// Reflect the read-only mode in the conditions
+	conditionChanged := false
+	if instance.Spec.ReadOnly {
+		conditionChanged = setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+			Type:    ReadOnlyCondition,
+			Reason:  "ReadOnlyWorkspace",
+			Message: "The workspace volume is mounted read-only",
+		})
+	} else {
+		conditionChanged = removeNotebookCondition(&instance.Status, ReadOnlyCondition)
+	}
+	if conditionChanged {
+		log.Info("Updating read-only condition", "namespace", instance.Namespace, "name", instance.Name)
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Warn about a server configured with the prefix it is no longer served under
+	if r.updatePrefixConflict(instance) {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Check that the node the Notebook is pinned to exists
+	conditionChanged, err = r.updateNodeNotFound(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if conditionChanged {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Report the PVCs mounted by the Notebook
+	volumesChanged, err := r.updateVolumesStatus(instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if volumesChanged {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
 	// Check the pod status
-	pod := &corev1.Pod{}
 	podFound := false
-	err = r.Get(ctx, types.NamespacedName{Name: ss.Name + "-0", Namespace: ss.Namespace}, pod)
-	if err != nil && apierrs.IsNotFound(err) {
+	pod, err := r.getStatefulSetPod(ss)
+	if err != nil {
+		return ctrl.Result{}, err
+	} else if pod == nil {
 		// This should be reconciled by the StatefulSet
 		log.Info("Pod not found...")
-	} else if err != nil {
-		return ctrl.Result{}, err
+		pod = &corev1.Pod{}
 	} else {
 		// Got the pod
 		podFound = true
@@ -224,130 +646,1196 @@ func (r *NotebookReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				return ctrl.Result{}, err
 			}
 		}
+
+		// Report the image the notebook container actually runs
+		if updateImageStatus(instance, generated.Spec.Template.Spec.Containers[0].Name, pod) {
+			log.Info("Updating image status", "namespace", instance.Namespace, "name", instance.Name,
+				"image", instance.Status.ContainerImage, "imageID", instance.Status.ImageID)
+			err = r.Status().Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+
+		// Check if the Pod is stuck waiting for a node
+		if r.updateScheduleTimeout(instance, pod) {
+			err = r.Status().Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 	}
 
-	// Check if the Notebook needs to be stopped
-	if podFound && culler.NotebookNeedsCulling(instance.ObjectMeta) {
+	// Record whether the CPU of the Pod is idle, for the culling decision
+	if podFound && culler.CPUCullingEnabled() && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		usage, err := culler.GetPodCPUUsage(r.Client, pod)
+		if err != nil {
+			log.Info("Unable to read the CPU usage of the Pod", "namespace", pod.Namespace, "name", pod.Name, "error", err.Error())
+		} else if culler.UpdateCPUIdleAnnotation(&instance.ObjectMeta, usage) {
+			err = r.Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Record when the files of the workspace were last modified, for the
+	// culling decision. The workspace is never idle while it can't be checked
+	if podFound && culler.WorkspaceCullingEnabled() && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		var changed bool
+		lastModified, err := culler.GetWorkspaceLastModified(pod)
+		if err != nil {
+			log.Info("Unable to check the workspace of the Pod", "namespace", pod.Namespace, "name", pod.Name, "error", err.Error())
+			changed = culler.RemoveWorkspaceAnnotation(&instance.ObjectMeta)
+		} else {
+			changed = culler.UpdateWorkspaceAnnotation(&instance.ObjectMeta, lastModified)
+		}
+		if changed {
+			err = r.Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Report who last accessed the Notebook
+	if updateLastActivityUser(instance) {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Report whether the Notebook is stopped, and why
+	if updateStoppedCondition(instance) {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Check if the Notebook needs to be stopped, unless its replicas are
+	// set explicitly
+	if _, explicit := getExplicitReplicas(instance); !podFound || explicit {
+		return requeueBeforeDeadline(instance, networkingRetryResult(instance)), nil
+	}
+	decision := culler.NotebookNeedsCulling(instance.ObjectMeta, activityServiceName(instance), notebookPrefix(instance))
+	log.V(1).Info("Checked the culling of the Notebook", "namespace", instance.Namespace, "name", instance.Name,
+		"cull", decision.Cull, "reason", decision.Reason)
+	if decision.Reason != "" && (decision.Cull || cullCheckIsDue(instance)) {
+		now := metav1.Now()
+		instance.Status.LastCullCheck = &now
+		instance.Status.CullReason = decision.Reason
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if decision.Cull && cullDryRun() {
+		r.reportDryRunCull(instance, decision)
+		return requeueBeforeDeadline(instance, ctrl.Result{RequeueAfter: getRequeueTime(instance, pod)}), nil
+	}
+	if decision.Cull {
 		log.Info(fmt.Sprintf(
 			"Notebook %s/%s needs culling. Setting annotations",
-			instance.Namespace, instance.Name))
+			instance.Namespace, instance.Name), "reason", decision.Reason)
 
-		// Set annotations to the Notebook
-		culler.SetStopAnnotation(&instance.ObjectMeta, r.Metrics)
-		r.Metrics.NotebookCullingCount.WithLabelValues(instance.Namespace, instance.Name).Inc()
-		err = r.Update(ctx, instance)
+		err = r.cullNotebook(instance, decision)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
-	} else if podFound && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+	} else if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
 		// The Pod is either too fresh, or the idle time has passed and it has
 		// received traffic. In this case we will be periodically checking if
-		// it needs culling.
-		return ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, nil
+		// it needs culling, and sooner while it is unhealthy to report its
+		// recovery.
+		return requeueBeforeDeadline(instance, ctrl.Result{RequeueAfter: getRequeueTime(instance, pod)}), nil
 	}
 
-	return ctrl.Result{}, nil
+	return requeueBeforeDeadline(instance, networkingRetryResult(instance)), nil
 }
 
-func getNextCondition(cs corev1.ContainerState) v1beta1.NotebookCondition {
-	var nbtype = ""
-	var nbreason = ""
-	var nbmsg = ""
+// copyStatefulSetFields copies the fields of the StatefulSet managed by the
+// controller, and returns whether an update is required.
+func copyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
+	applied := to.Annotations[PodAnnotationsAnnotation]
+	requireUpdate := reconcilehelper.CopyStatefulSetFields(from, to)
+	if copyPodAnnotations(from, to, applied) {
+		requireUpdate = true
+	}
+	return requireUpdate
+}
 
-	if cs.Running != nil {
-		nbtype = "Running"
-	} else if cs.Waiting != nil {
-		nbtype = "Waiting"
-		nbreason = cs.Waiting.Reason
-		nbmsg = cs.Waiting.Message
-	} else {
-		nbtype = "Terminated"
-		nbreason = cs.Terminated.Reason
-		nbmsg = cs.Terminated.Reason
+// copyPodAnnotations copies the annotations of the Pod template of from to the
+// one of to, and removes the applied ones (listed in the
+// PodAnnotationsAnnotation) that aren't desired anymore. It returns whether
+// they changed. The other annotations of the template are kept, e.g. the one
+// set by `kubectl rollout restart`.
+func copyPodAnnotations(from, to *appsv1.StatefulSet, applied string) bool {
+	changed := false
+	for _, k := range strings.Split(applied, ",") {
+		if _, ok := from.Spec.Template.Annotations[k]; ok {
+			continue
+		}
+		if _, ok := to.Spec.Template.Annotations[k]; ok {
+			delete(to.Spec.Template.Annotations, k)
+			changed = true
+		}
+	}
+	for k, v := range from.Spec.Template.Annotations {
+		if existing, ok := to.Spec.Template.Annotations[k]; ok && existing == v {
+			continue
+		}
+		if to.Spec.Template.Annotations == nil {
+			to.Spec.Template.Annotations = map[string]string{}
+		}
+		to.Spec.Template.Annotations[k] = v
+		changed = true
+	}
+	return changed
+}
+
+// getStatefulSetPod returns the Pod of the StatefulSet, or nil if it has
+// none. The Pods are listed by the statefulset label rather than assuming
+// their names, and the one with the lowest name that isn't being deleted is
+// picked, i.e. the "-0" one for a single replica.
+func (r *NotebookReconciler) getStatefulSetPod(ss *appsv1.StatefulSet) (*corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	err := r.List(context.TODO(), pods, client.InNamespace(ss.Namespace),
+		client.MatchingLabels{"statefulset": ss.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	var pod *corev1.Pod
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.DeletionTimestamp != nil {
+			continue
+		}
+		if pod == nil || p.Name < pod.Name {
+			pod = p
+		}
+	}
+	return pod, nil
+}
+
+// cullNotebook sets the stop annotation on the Notebook. The update relies on
+// the Notebook's resourceVersion, so if a concurrent reconcile has already
+// culled the Notebook it fails with a conflict and the culling side effects
+// are skipped. Reconciles only run on the elected leader, so the side effects
+// aren't repeated by the other replicas either. The time the Notebook was idle
+// for, when known, is reported by a metric and a Culled event, for dashboards
+// to correlate the culls with the usage.
+func (r *NotebookReconciler) cullNotebook(instance *v1beta1.Notebook, decision culler.CullingDecision) error {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+	instance.Annotations[culler.STOP_REASON_ANNOTATION] = culler.STOP_REASON_CULLED
+	culler.RemoveCPUIdleAnnotation(&instance.ObjectMeta)
+	culler.RemoveWorkspaceAnnotation(&instance.ObjectMeta)
+	err := r.Update(context.TODO(), instance)
+	if err != nil && apierrs.IsConflict(err) {
+		log.Info("Notebook was modified concurrently, skipping culling", "namespace", instance.Namespace, "name", instance.Name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	r.Metrics.NotebookCullingCount.WithLabelValues(instance.Namespace, instance.Name).Inc()
+	r.Metrics.NotebookCullingTimestamp.WithLabelValues(instance.Namespace, instance.Name).Set(float64(time.Now().Unix()))
+	if decision.IdleSince.IsZero() {
+		r.EventRecorder.Event(instance, corev1.EventTypeNormal, "Culled", "The notebook was culled: "+decision.Reason)
+	} else {
+		idle := time.Since(decision.IdleSince).Round(time.Second)
+		r.Metrics.NotebookCullingIdleTime.WithLabelValues(instance.Namespace, instance.Name).Set(idle.Seconds())
+		message := fmt.Sprintf("The notebook was culled after being idle for %v: %s", idle, decision.Reason)
+		r.EventRecorder.AnnotatedEventf(instance, map[string]string{IdleSecondsAnnotation: fmt.Sprint(int64(idle.Seconds()))},
+			corev1.EventTypeNormal, "Culled", "%s", message)
+	}
+	r.notify(instance, notify.EventCulled, decision.Reason)
+	return nil
+}
+
+// cullCheckIsDue returns whether the last culling check recorded in the
+// status is older than CULLING_CHECK_PERIOD. The status isn't updated more
+// often, since each update triggers another reconcile, which would check the
+// Notebook again right away.
+func cullCheckIsDue(instance *v1beta1.Notebook) bool {
+	last := instance.Status.LastCullCheck
+	return last == nil || time.Since(last.Time) >= culler.GetRequeueTime()
+}
+
+// cullDryRun returns whether the culler only reports the Notebooks it would
+// cull, set by the CULL_DRY_RUN env var, so that the idleness thresholds can
+// be checked before culling is enforced.
+func cullDryRun() bool {
+	return os.Getenv("CULL_DRY_RUN") == "true"
+}
+
+// reportDryRunCull logs and records an event for a Notebook that would be
+// culled, and counts it, without stopping it.
+func (r *NotebookReconciler) reportDryRunCull(instance *v1beta1.Notebook, decision culler.CullingDecision) {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	message := "The notebook would be culled: " + decision.Reason
+	if !decision.IdleSince.IsZero() {
+		idle := time.Since(decision.IdleSince).Round(time.Minute)
+		message = fmt.Sprintf("The notebook would be culled after being idle for %v: %s", idle, decision.Reason)
+	}
+	log.Info("Would cull Notebook, CULL_DRY_RUN is set", "namespace", instance.Namespace, "name", instance.Name,
+		"reason", decision.Reason)
+	r.Metrics.NotebookCullingDryRunCount.WithLabelValues(instance.Namespace, instance.Name).Inc()
+	r.EventRecorder.Event(instance, corev1.EventTypeNormal, "CullDryRun", message)
+}
+
+// immutableStatefulSetSpec holds the fields of the StatefulSet spec that can't
+// be updated.
+type immutableStatefulSetSpec struct {
+	Selector             *metav1.LabelSelector          `json:"selector,omitempty"`
+	ServiceName          string                         `json:"serviceName,omitempty"`
+	VolumeClaimTemplates []corev1.PersistentVolumeClaim `json:"volumeClaimTemplates,omitempty"`
+}
+
+func immutableSpec(ss *appsv1.StatefulSet) string {
+	spec, _ := json.Marshal(immutableStatefulSetSpec{
+		Selector:             ss.Spec.Selector,
+		ServiceName:          ss.Spec.ServiceName,
+		VolumeClaimTemplates: ss.Spec.VolumeClaimTemplates,
+	})
+	return string(spec)
+}
+
+// checkImmutableFields compares the immutable fields of the desired
+// StatefulSet with the ones applied when the found one was created, and sets
+// the ImmutableFieldsChanged condition while they differ. The applied fields
+// are kept in the annotation of the desired StatefulSet, since they weren't
+// updated.
+func (r *NotebookReconciler) checkImmutableFields(instance *v1beta1.Notebook, ss, found *appsv1.StatefulSet) error {
+	// The StatefulSets created without a serviceName keep it empty, rather
+	// than report a change for all of them, unless the users set one
+	if found.Spec.ServiceName == "" && instance.GetAnnotations()[ServiceNameAnnotation] == "" {
+		ss.Spec.ServiceName = ""
+		ss.Annotations[ImmutableSpecAnnotation] = immutableSpec(ss)
+	}
+	applied, ok := found.Annotations[ImmutableSpecAnnotation]
+	changed := false
+	if ok && applied != ss.Annotations[ImmutableSpecAnnotation] {
+		ss.Annotations[ImmutableSpecAnnotation] = applied
+		appliedSpec := immutableStatefulSetSpec{}
+		if err := json.Unmarshal([]byte(applied), &appliedSpec); err != nil {
+			return err
+		}
+		appliedSts := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{
+			Selector:             appliedSpec.Selector,
+			ServiceName:          appliedSpec.ServiceName,
+			VolumeClaimTemplates: appliedSpec.VolumeClaimTemplates,
+		}}
+		fields := reconcilehelper.StatefulSetImmutableFieldsChanged(ss, appliedSts)
+		hint := "Delete the StatefulSet for it to be recreated with them."
+		for _, field := range fields {
+			if field == "spec.volumeClaimTemplates" {
+				hint = "Resize the PVCs of the StatefulSet directly if their StorageClass allows volume expansion. " +
+					"Deleting the StatefulSet recreates it with the new templates, but keeps the PVCs it created as they are."
+			}
+		}
+		message := fmt.Sprintf("Fields %s of StatefulSet %s are immutable and can't be updated in place. %s",
+			strings.Join(fields, ", "), ss.Name, hint)
+		changed = setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+			Type:    ImmutableFieldsCondition,
+			Reason:  "ImmutableFieldChanged",
+			Message: message,
+		})
+		if changed {
+			r.Log.Info("Immutable StatefulSet fields changed", "namespace", ss.Namespace, "name", ss.Name, "fields", fields)
+			r.EventRecorder.Event(instance, corev1.EventTypeWarning, "ImmutableFieldChanged", message)
+		}
+	} else {
+		changed = removeNotebookCondition(&instance.Status, ImmutableFieldsCondition)
+	}
+	if !changed {
+		return nil
+	}
+	return r.Status().Update(context.TODO(), instance)
+}
+
+// updateNodeNotFound sets the NodeNotFound condition, and records an event,
+// if the node named by the NodeNameAnnotation doesn't exist. Returns true if
+// the conditions changed.
+func (r *NotebookReconciler) updateNodeNotFound(instance *v1beta1.Notebook) (bool, error) {
+	nodeName := instance.GetAnnotations()[NodeNameAnnotation]
+	if nodeName == "" {
+		return removeNotebookCondition(&instance.Status, NodeNotFoundCondition), nil
+	}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: nodeName}, &corev1.Node{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return false, err
+	} else if err == nil {
+		return removeNotebookCondition(&instance.Status, NodeNotFoundCondition), nil
+	}
+
+	message := fmt.Sprintf("Node %s set by the %s annotation doesn't exist, the Pod can't be scheduled",
+		nodeName, NodeNameAnnotation)
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    NodeNotFoundCondition,
+		Reason:  NodeNotFoundCondition,
+		Message: message,
+	})
+	if changed {
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, NodeNotFoundCondition, message)
+	}
+	return changed, nil
+}
+
+// updateVolumesStatus sets the Volumes of the Notebook status to the PVCs
+// mounted by its Pod, and the PVCResizing condition while one of them is being
+// expanded. Returns true if the status changed.
+func (r *NotebookReconciler) updateVolumesStatus(instance *v1beta1.Notebook) (bool, error) {
+	var volumes []v1beta1.VolumeStatus
+	var resizing []corev1.PersistentVolumeClaimCondition
+	var resizingPVCs []string
+	for _, v := range instance.Spec.Template.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		volume := v1beta1.VolumeStatus{Name: v.Name, PVCName: v.PersistentVolumeClaim.ClaimName}
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: volume.PVCName, Namespace: instance.Namespace}, pvc)
+		if err != nil && !apierrs.IsNotFound(err) {
+			return false, err
+		} else if err == nil {
+			if size, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+				volume.Size = &size
+			}
+			if c := pvcResizeCondition(pvc); c != nil {
+				resizing = append(resizing, *c)
+				resizingPVCs = append(resizingPVCs, pvc.Name)
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+
+	changed := r.updatePVCResizing(instance, resizingPVCs, resizing)
+	if !apiequality.Semantic.DeepEqual(volumes, instance.Status.Volumes) {
+		instance.Status.Volumes = volumes
+		changed = true
+	}
+	return changed, nil
+}
+
+// missingPVCs returns the names of the PVCs mounted by the Pod that don't
+// exist. PVCs that exist but aren't bound yet, e.g. being provisioned, aren't
+// missing.
+func (r *NotebookReconciler) missingPVCs(instance *v1beta1.Notebook, podSpec *corev1.PodSpec) ([]string, error) {
+	var missing []string
+	for _, v := range podSpec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		name := v.PersistentVolumeClaim.ClaimName
+		err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace},
+			&corev1.PersistentVolumeClaim{})
+		if err != nil && apierrs.IsNotFound(err) {
+			missing = append(missing, name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// updateMissingVolume sets the MissingVolume condition listing the given PVCs,
+// or removes it if there are none. Returns true if the conditions changed.
+func (r *NotebookReconciler) updateMissingVolume(instance *v1beta1.Notebook, pvcs []string) bool {
+	if len(pvcs) == 0 {
+		return removeNotebookCondition(&instance.Status, MissingVolumeCondition)
+	}
+	message := fmt.Sprintf("The StatefulSet isn't created until PVCs %s exist", strings.Join(pvcs, ", "))
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    MissingVolumeCondition,
+		Reason:  "PVCNotFound",
+		Message: message,
+	})
+	if changed {
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, MissingVolumeCondition, message)
+	}
+	return changed
+}
+
+// pvcResizeCondition returns the condition of the PVC reporting that it is
+// being expanded, or nil if it isn't.
+func pvcResizeCondition(pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaimCondition {
+	for i, c := range pvc.Status.Conditions {
+		if (c.Type == corev1.PersistentVolumeClaimResizing || c.Type == corev1.PersistentVolumeClaimFileSystemResizePending) &&
+			c.Status == corev1.ConditionTrue {
+			return &pvc.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// updatePVCResizing sets the PVCResizing condition from the resize conditions
+// of the given PVCs, or removes it if there are none. The reason is
+// FileSystemResizePending if one of the PVCs waits for its file system to be
+// resized, Resizing otherwise. Returns true if the conditions changed.
+func (r *NotebookReconciler) updatePVCResizing(instance *v1beta1.Notebook, pvcs []string,
+	conditions []corev1.PersistentVolumeClaimCondition) bool {
+	if len(conditions) == 0 {
+		return removeNotebookCondition(&instance.Status, PVCResizingCondition)
+	}
+
+	reason := string(corev1.PersistentVolumeClaimResizing)
+	messages := []string{}
+	for i, c := range conditions {
+		if c.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+			reason = string(corev1.PersistentVolumeClaimFileSystemResizePending)
+		}
+		message := fmt.Sprintf("PVC %s: %s", pvcs[i], c.Type)
+		if c.Message != "" {
+			message += ", " + c.Message
+		}
+		messages = append(messages, message)
+	}
+	message := strings.Join(messages, "; ")
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    PVCResizingCondition,
+		Reason:  reason,
+		Message: message,
+	})
+	if changed {
+		r.EventRecorder.Event(instance, corev1.EventTypeNormal, PVCResizingCondition, message)
+	}
+	return changed
+}
+
+// getScheduleTimeout returns how long a Pod may stay unschedulable before the
+// Notebook reports it, configured by the SCHEDULE_TIMEOUT env var in minutes.
+func getScheduleTimeout() time.Duration {
+	timeout := DefaultScheduleTimeout
+	if value, exists := os.LookupEnv("SCHEDULE_TIMEOUT"); exists {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			ctrl.Log.WithName("controllers").Info(fmt.Sprintf(
+				"SCHEDULE_TIMEOUT should be a positive Int. Got '%s'. Using default value.", value))
+		} else {
+			timeout = parsed
+		}
+	}
+	return time.Duration(timeout) * time.Minute
+}
+
+// getUnhealthyRequeuePeriod returns how often an unhealthy Notebook is
+// reconciled, configured by the UNHEALTHY_REQUEUE_PERIOD env var in seconds.
+func getUnhealthyRequeuePeriod() time.Duration {
+	period := DefaultUnhealthyRequeuePeriod
+	if value, exists := os.LookupEnv("UNHEALTHY_REQUEUE_PERIOD"); exists {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			ctrl.Log.WithName("controllers").Info(fmt.Sprintf(
+				"UNHEALTHY_REQUEUE_PERIOD should be a positive Int. Got '%s'. Using default value.", value))
+		} else {
+			period = parsed
+		}
+	}
+	return time.Duration(period) * time.Second
+}
+
+// notebookIsHealthy returns whether the notebook container is running and its
+// Pod is Ready, from the container state recorded in the Notebook status.
+func notebookIsHealthy(instance *v1beta1.Notebook, pod *corev1.Pod) bool {
+	if instance.Status.ContainerState.Running == nil ||
+		hasNotebookCondition(&instance.Status, NetworkingDegradedCondition) {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// getRequeueTime returns when the Notebook is reconciled again: after the
+// culling check period while it is healthy, and after UNHEALTHY_REQUEUE_PERIOD
+// while its container is waiting or terminated, e.g. crash looping, its Pod
+// isn't Ready or its networking is degraded, so that its recovery is reported
+// quickly. The shortest of the two is used.
+func getRequeueTime(instance *v1beta1.Notebook, pod *corev1.Pod) time.Duration {
+	requeueTime := culler.GetRequeueTime()
+	if notebookIsHealthy(instance, pod) {
+		return requeueTime
+	}
+	if unhealthy := getUnhealthyRequeuePeriod(); unhealthy < requeueTime {
+		return unhealthy
+	}
+	return requeueTime
+}
+
+// networkingRetryResult requeues the Notebook after UNHEALTHY_REQUEUE_PERIOD
+// while its networking is degraded, to retry reconciling it even if the
+// Notebook isn't requeued otherwise, e.g. while it is stopped.
+func networkingRetryResult(instance *v1beta1.Notebook) ctrl.Result {
+	if hasNotebookCondition(&instance.Status, NetworkingDegradedCondition) {
+		return ctrl.Result{RequeueAfter: getUnhealthyRequeuePeriod()}
+	}
+	return ctrl.Result{}
+}
+
+// updateNetworkingDegraded sets the NetworkingDegraded condition, and records
+// an event, if the routing object of the given kind failed to reconcile with
+// err, and removes it otherwise. Returns true if the conditions changed.
+func (r *NotebookReconciler) updateNetworkingDegraded(instance *v1beta1.Notebook, kind string, err error) bool {
+	if err == nil {
+		if !removeNotebookCondition(&instance.Status, NetworkingDegradedCondition) {
+			return false
+		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, "NetworkingRecovered", "The %s is reconciled", kind)
+		return true
+	}
+	message := fmt.Sprintf("Unable to reconcile the %s: %v", kind, err)
+	if !setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    NetworkingDegradedCondition,
+		Reason:  "ReconcileFailed",
+		Message: message,
+	}) {
+		return false
+	}
+	r.EventRecorder.Event(instance, corev1.EventTypeWarning, NetworkingDegradedCondition, message)
+	return true
+}
+
+// updateImageStatus sets the image and the image ID of the notebook container,
+// the given one, reported by the Pod in the status of the Notebook, once the
+// image is pulled. Returns true if the status changed.
+func updateImageStatus(instance *v1beta1.Notebook, name string, pod *corev1.Pod) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != name || cs.ImageID == "" {
+			continue
+		}
+		if instance.Status.ContainerImage == cs.Image && instance.Status.ImageID == cs.ImageID {
+			return false
+		}
+		instance.Status.ContainerImage = cs.Image
+		instance.Status.ImageID = cs.ImageID
+		return true
+	}
+	return false
+}
+
+func podIsUnschedulable(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodPending {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse &&
+			c.Reason == corev1.PodReasonUnschedulable {
+			return true
+		}
+	}
+	return false
+}
+
+// updateScheduleTimeout sets the ScheduleTimeout condition if the Pod has been
+// unschedulable for longer than SCHEDULE_TIMEOUT since it was created, and
+// removes it once the Pod gets scheduled. Returns true if the conditions changed.
+func (r *NotebookReconciler) updateScheduleTimeout(instance *v1beta1.Notebook, pod *corev1.Pod) bool {
+	if !podIsUnschedulable(pod) {
+		return removeNotebookCondition(&instance.Status, ScheduleTimeoutCondition)
+	}
+	timeout := getScheduleTimeout()
+	if time.Since(pod.CreationTimestamp.Time) < timeout {
+		return false
+	}
+
+	message := fmt.Sprintf("Pod %s couldn't be scheduled for more than %v", pod.Name, timeout)
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    ScheduleTimeoutCondition,
+		Reason:  corev1.PodReasonUnschedulable,
+		Message: message,
+	})
+	if changed {
+		r.Log.Info("Pod is unschedulable", "namespace", instance.Namespace, "name", instance.Name, "pod", pod.Name)
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, ScheduleTimeoutCondition, message)
+		r.Metrics.NotebookScheduleTimeouts.WithLabelValues(instance.Namespace).Inc()
+	}
+	return changed
+}
+
+// updateStoppedCondition sets the Stopped condition once the Notebook with the
+// stop annotation has no ready replica left, or right away in the detach
+// cull mode, and removes it when the Notebook isn't stopped. Notebooks whose
+// replicas are set explicitly aren't stopped by the annotation. Returns true
+// if the conditions changed.
+func updateStoppedCondition(instance *v1beta1.Notebook) bool {
+	_, explicit := getExplicitReplicas(instance)
+	stopped, ok := instance.GetAnnotations()[culler.STOP_ANNOTATION]
+	if !ok || explicit || (instance.Status.ReadyReplicas > 0 && getCullMode(instance) == CullModeScale) {
+		return removeNotebookCondition(&instance.Status, StoppedCondition)
+	}
+
+	reason, message := StoppedReasonManual, "The notebook was stopped by hand at "+stopped
+	switch instance.GetAnnotations()[culler.STOP_REASON_ANNOTATION] {
+	case culler.STOP_REASON_CULLED:
+		reason, message = StoppedReasonCulled, "The notebook was culled for being idle at "+stopped
+	case culler.STOP_REASON_SCHEDULED:
+		reason, message = StoppedReasonScheduled, "The notebook was stopped on schedule at "+stopped
+	}
+	return setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    StoppedCondition,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// prefixConflict returns why the NB_PREFIX of the notebook container conflicts
+// with the StripPathPrefix of the Notebook, or "" if it doesn't: the server is
+// served at "/" but told to serve under another prefix.
+func prefixConflict(instance *v1beta1.Notebook) string {
+	if !instance.Spec.StripPathPrefix {
+		return ""
+	}
+	// The controller appends its NB_PREFIX after the env of the template
+	nbPrefix := ""
+	if containers := instance.Spec.Template.Spec.Containers; len(containers) != 0 {
+		for _, env := range containers[0].Env {
+			if env.Name == "NB_PREFIX" {
+				nbPrefix = env.Value
+			}
+		}
+	}
+	if instance.GetAnnotations()[NoNbPrefixAnnotation] != "true" {
+		nbPrefix = notebookPrefix(instance)
+	}
+	if nbPrefix == "" || nbPrefix == "/" {
+		return ""
+	}
+	return fmt.Sprintf("stripPathPrefix serves the notebook at /, but its NB_PREFIX is %s: "+
+		"set the %s annotation to \"true\" for the server to run at /", nbPrefix, NoNbPrefixAnnotation)
+}
+
+// updatePrefixConflict sets the PrefixConflict condition, with a Warning event,
+// while the NB_PREFIX of the Notebook conflicts with its StripPathPrefix.
+// Returns true if the conditions changed.
+func (r *NotebookReconciler) updatePrefixConflict(instance *v1beta1.Notebook) bool {
+	message := prefixConflict(instance)
+	if message == "" {
+		return removeNotebookCondition(&instance.Status, PrefixConflictCondition)
+	}
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    PrefixConflictCondition,
+		Reason:  "NbPrefixSet",
+		Message: message,
+	})
+	if changed {
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, PrefixConflictCondition, message)
+	}
+	return changed
+}
+
+func getNextCondition(cs corev1.ContainerState) v1beta1.NotebookCondition {
+	var nbtype = ""
+	var nbreason = ""
+	var nbmsg = ""
+
+	if cs.Running != nil {
+		nbtype = "Running"
+	} else if cs.Waiting != nil {
+		nbtype = "Waiting"
+		nbreason = cs.Waiting.Reason
+		nbmsg = cs.Waiting.Message
+	} else {
+		nbtype = "Terminated"
+		nbreason = cs.Terminated.Reason
+		nbmsg = cs.Terminated.Reason
+	}
+
+	newCondition := v1beta1.NotebookCondition{
+		Type:          nbtype,
+		LastProbeTime: metav1.Now(),
+		Reason:        nbreason,
+		Message:       nbmsg,
+	}
+	return newCondition
+}
+
+// setNotebookCondition sets a condition that isn't related to the container
+// state, replacing any existing condition of the same type. The container
+// state conditions are prepended to the list, so these are kept at the end.
+// Returns true if the conditions changed.
+func setNotebookCondition(status *v1beta1.NotebookStatus, condition v1beta1.NotebookCondition) bool {
+	condition.LastProbeTime = metav1.Now()
+	for i, c := range status.Conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		if c.Reason == condition.Reason && c.Message == condition.Message {
+			return false
+		}
+		status.Conditions[i] = condition
+		return true
+	}
+	status.Conditions = append(status.Conditions, condition)
+	return true
+}
+
+// removeNotebookCondition removes the conditions of the given type. Returns
+// true if the conditions changed.
+func removeNotebookCondition(status *v1beta1.NotebookStatus, conditionType string) bool {
+	conditions := []v1beta1.NotebookCondition{}
+	for _, c := range status.Conditions {
+		if c.Type != conditionType {
+			conditions = append(conditions, c)
+		}
+	}
+	if len(conditions) == len(status.Conditions) {
+		return false
+	}
+	status.Conditions = conditions
+	return true
+}
+
+// namespaceIsTerminating returns whether the namespace is being deleted.
+func (r *NotebookReconciler) namespaceIsTerminating(name string) (bool, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: name}, namespace); err != nil {
+		return false, ignoreNotFound(err)
+	}
+	return namespace.Status.Phase == corev1.NamespaceTerminating, nil
+}
+
+// getExplicitReplicas returns the number of replicas set by the
+// ReplicasAnnotation, and whether it is set to a valid number.
+func getExplicitReplicas(instance *v1beta1.Notebook) (int32, bool) {
+	value, ok := instance.GetAnnotations()[ReplicasAnnotation]
+	if !ok {
+		return 0, false
+	}
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || replicas < 0 {
+		return 0, false
+	}
+	return int32(replicas), true
+}
+
+// statefulSetServiceName returns the governing Service of the StatefulSet of
+// the Notebook, set by the ServiceNameAnnotation.
+func statefulSetServiceName(instance *v1beta1.Notebook) string {
+	name := instance.GetAnnotations()[ServiceNameAnnotation]
+	if name == "" || len(validation.IsDNS1035Label(name)) != 0 {
+		return instance.Name
+	}
+	return name
+}
+
+// generateStatefulSet returns the StatefulSet running the Notebook. Its pod
+// template must have a container, see checkContainers.
+func generateStatefulSet(instance *v1beta1.Notebook) *appsv1.StatefulSet {
+	replicas := int32(1)
+	if explicit, ok := getExplicitReplicas(instance); ok {
+		replicas = explicit
+	} else if culler.StopAnnotationIsSet(instance.ObjectMeta) && !backupInProgress(instance) && getCullMode(instance) == CullModeScale {
+		replicas = 0
+	}
+	if cloneInProgress(instance) || restoreInProgress(instance) {
+		replicas = 0
+	}
+
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        instance.Name,
+			Namespace:   instance.Namespace,
+			Annotations: map[string]string{},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: statefulSetServiceName(instance),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"statefulset": instance.Name,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"statefulset":   instance.Name,
+						"notebook-name": instance.Name,
+					},
+					Annotations: map[string]string{},
+				},
+				Spec: *instance.Spec.Template.Spec.DeepCopy(),
+			},
+		},
+	}
+	// Record when the Notebook was stopped, to tell when it is started again
+	if stopped, ok := instance.GetAnnotations()[culler.STOP_ANNOTATION]; ok {
+		ss.Annotations[culler.STOP_ANNOTATION] = stopped
+	}
+	// copy all of the Notebook labels to the pod including poddefault related labels
+	l := &ss.Spec.Template.ObjectMeta.Labels
+	for k, v := range instance.ObjectMeta.Labels {
+		if labelIsPropagated(k) {
+			(*l)[k] = v
+		}
+	}
+
+	for k, v := range instance.Spec.PodAnnotations {
+		ss.Spec.Template.ObjectMeta.Annotations[k] = v
+	}
+
+	podSpec := &ss.Spec.Template.Spec
+	if nodeName := instance.GetAnnotations()[NodeNameAnnotation]; nodeName != "" && podSpec.NodeName == "" &&
+		(podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil) {
+		if podSpec.NodeSelector == nil {
+			podSpec.NodeSelector = map[string]string{}
+		}
+		podSpec.NodeSelector["kubernetes.io/hostname"] = nodeName
+	}
+	applyDefaultNodeAffinity(podSpec)
+	applyDefaultPodAntiAffinity(instance, podSpec)
+	if runtimeClassName := getRuntimeClassName(instance); runtimeClassName != nil {
+		podSpec.RuntimeClassName = runtimeClassName
+	}
+	if schedulerName := getSchedulerName(instance); schedulerName != "" {
+		podSpec.SchedulerName = schedulerName
+	}
+	if automount := getAutomountServiceAccountToken(instance); automount != nil {
+		podSpec.AutomountServiceAccountToken = automount
+	}
+	applyDefaultResources(instance, &podSpec.Containers[0])
+	applyGPU(instance, podSpec)
+	container := &podSpec.Containers[0]
+	container.Image = notebookImage(instance)
+	applyDefaultCommand(instance, container)
+	if container.WorkingDir == "" {
+		container.WorkingDir = DefaultWorkspacePath
+	}
+	if mount := workspaceVolumeMount(container); mount != nil {
+		if instance.Spec.HomeSubPath != "" {
+			mount.SubPath = instance.Spec.HomeSubPath
+		}
+		mount.ReadOnly = mount.ReadOnly || instance.Spec.ReadOnly
+	}
+	if len(instance.Spec.PostStartCommand) != 0 {
+		if container.Lifecycle == nil {
+			container.Lifecycle = &corev1.Lifecycle{}
+		}
+		container.Lifecycle.PostStart = &corev1.Handler{
+			Exec: &corev1.ExecAction{Command: append([]string{}, instance.Spec.PostStartCommand...)},
+		}
+	}
+	if len(instance.Spec.InitContainers) != 0 {
+		podSpec.InitContainers = append(workspaceInitContainers(instance, workspaceVolumeMount(container)),
+			podSpec.InitContainers...)
+	}
+	if container.Ports == nil {
+		container.Ports = []corev1.ContainerPort{
+			{
+				ContainerPort: notebookContainerPort(instance),
+				Name:          "notebook-port",
+				Protocol:      "TCP",
+			},
+		}
+	}
+	applyLivenessProbe(instance, container)
+	if shmSize := getShmSize(instance); shmSize != nil && !hasVolumeMount(container, ShmPath) {
+		volumeName := uniqueVolumeName(podSpec, "dshm")
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					Medium:    corev1.StorageMediumMemory,
+					SizeLimit: shmSize,
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: ShmPath,
+		})
+	}
+	if tmpSize := getTmpVolumeSize(instance); tmpSize != nil && !hasVolumeMount(container, TmpPath) {
+		volumeName := uniqueVolumeName(podSpec, "tmp")
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: tmpSize},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: TmpPath,
+		})
+	}
+	if instance.GetAnnotations()[NoNbPrefixAnnotation] != "true" {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  "NB_PREFIX",
+			Value: notebookPrefix(instance),
+		})
+	}
+	applyAccessToken(instance, podSpec)
+	applyProjectedTokens(instance, podSpec)
+	applyMetricsSidecar(instance, &ss.Spec.Template)
+	applyDefaultSecurityContext(podSpec)
+
+	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
+	// This allows for those platforms to bypass the automatic addition of the fsGroup
+	// and will allow for the Pod Security Policy controller to make an appropriate choice
+	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
+	if addFSGroup() {
+		if podSpec.SecurityContext == nil {
+			fsGroup := DefaultFSGroup
+			podSpec.SecurityContext = &corev1.PodSecurityContext{
+				FSGroup: &fsGroup,
+			}
+		}
+	}
+	ss.Annotations[ImmutableSpecAnnotation] = immutableSpec(ss)
+	return ss
+}
+
+// workspaceInitContainers returns the InitContainers of the Notebook, with the
+// given workspace volumeMount and working directory unless they set them.
+func workspaceInitContainers(instance *v1beta1.Notebook, workspace *corev1.VolumeMount) []corev1.Container {
+	containers := []corev1.Container{}
+	for _, c := range instance.Spec.InitContainers {
+		c = *c.DeepCopy()
+		if workspace != nil && !hasVolumeMount(&c, workspace.MountPath) {
+			mounted := false
+			for _, m := range c.VolumeMounts {
+				mounted = mounted || m.Name == workspace.Name
+			}
+			if !mounted {
+				c.VolumeMounts = append(c.VolumeMounts, *workspace)
+			}
+		}
+		if c.WorkingDir == "" {
+			c.WorkingDir = DefaultWorkspacePath
+		}
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+// workspaceVolumeMount returns the volumeMount of the container's home
+// directory, or nil if the workspace isn't backed by a volume.
+func workspaceVolumeMount(container *corev1.Container) *corev1.VolumeMount {
+	for i := range container.VolumeMounts {
+		if container.VolumeMounts[i].MountPath == DefaultWorkspacePath {
+			return &container.VolumeMounts[i]
+		}
+	}
+	return nil
+}
+
+func hasVolumeMount(container *corev1.Container, mountPath string) bool {
+	for _, m := range container.VolumeMounts {
+		if m.MountPath == mountPath {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueVolumeName returns the given name, suffixed if a volume of the pod
+// already uses it.
+func uniqueVolumeName(podSpec *corev1.PodSpec, name string) string {
+	names := map[string]bool{}
+	for _, v := range podSpec.Volumes {
+		names[v.Name] = true
+	}
+	unique := name
+	for i := 1; names[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// reservedLabels are the labels of the Pod set by the controller. The
+// StatefulSet and the Service select the Pod with them, so the labels of the
+// Notebook with these keys are never copied to the Pod.
+var reservedLabels = map[string]bool{
+	"statefulset":   true,
+	"notebook-name": true,
+}
+
+// labelIsPropagated returns whether the Notebook label with the given key is
+// copied to the Pod, according to the PROPAGATE_LABEL_PREFIXES env var. It is
+// a comma-separated list of key prefixes, those starting with "-" excluding
+// the matching keys. If it lists prefixes to include, only the matching keys
+// are copied. All the labels are copied if it isn't set, except the
+// reservedLabels.
+func labelIsPropagated(key string) bool {
+	if reservedLabels[key] {
+		return false
+	}
+	allowed, hasAllowList := false, false
+	for _, prefix := range strings.Split(os.Getenv("PROPAGATE_LABEL_PREFIXES"), ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if strings.HasPrefix(prefix, "-") {
+			if strings.HasPrefix(key, strings.TrimPrefix(prefix, "-")) {
+				return false
+			}
+			continue
+		}
+		hasAllowList = true
+		allowed = allowed || strings.HasPrefix(key, prefix)
+	}
+	return allowed || !hasAllowList
+}
+
+// podDefaultLabelKeys returns the label keys selected by the PodDefaults of
+// the namespace. These labels of the Notebook are always copied to the Pod,
+// so that the PodDefaults picked for the Notebook apply.
+func (r *NotebookReconciler) podDefaultLabelKeys(namespace string) (map[string]bool, error) {
+	podDefaults := &unstructured.UnstructuredList{}
+	podDefaults.SetAPIVersion("kubeflow.org/v1alpha1")
+	podDefaults.SetKind("PodDefaultList")
+	err := r.List(context.TODO(), podDefaults, client.InNamespace(namespace))
+	if err != nil && apimeta.IsNoMatchError(err) {
+		// The PodDefault CRD isn't installed
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for _, pd := range podDefaults.Items {
+		matchLabels, _, _ := unstructured.NestedStringMap(pd.Object, "spec", "selector", "matchLabels")
+		for k := range matchLabels {
+			keys[k] = true
+		}
+		expressions, _, _ := unstructured.NestedSlice(pd.Object, "spec", "selector", "matchExpressions")
+		for _, e := range expressions {
+			if expression, ok := e.(map[string]interface{}); ok {
+				if key, ok := expression["key"].(string); ok {
+					keys[key] = true
+				}
+			}
+		}
 	}
+	return keys, nil
+}
 
-	newCondition := v1beta1.NotebookCondition{
-		Type:          nbtype,
-		LastProbeTime: metav1.Now(),
-		Reason:        nbreason,
-		Message:       nbmsg,
+// getRuntimeClassName returns the RuntimeClass of the Notebook Pod, or nil to
+// keep the one of the Pod template. The RuntimeClass isn't checked, the
+// StatefulSet fails to create the Pod if it doesn't exist.
+func getRuntimeClassName(instance *v1beta1.Notebook) *string {
+	if instance.Spec.RuntimeClassName != nil {
+		return instance.Spec.RuntimeClassName
 	}
-	return newCondition
+	if instance.Spec.Template.Spec.RuntimeClassName != nil {
+		return nil
+	}
+	if runtimeClassName := os.Getenv("DEFAULT_RUNTIME_CLASS"); runtimeClassName != "" {
+		return &runtimeClassName
+	}
+	return nil
 }
 
-func generateStatefulSet(instance *v1beta1.Notebook) *appsv1.StatefulSet {
-	replicas := int32(1)
-	if culler.StopAnnotationIsSet(instance.ObjectMeta) {
-		replicas = 0
+// getSchedulerName returns the scheduler of the Notebook Pod, or "" to keep
+// the one of the Pod template.
+func getSchedulerName(instance *v1beta1.Notebook) string {
+	if instance.Spec.SchedulerName != "" {
+		return instance.Spec.SchedulerName
 	}
+	if instance.Spec.Template.Spec.SchedulerName != "" {
+		return ""
+	}
+	return os.Getenv("DEFAULT_SCHEDULER_NAME")
+}
 
-	ss := &appsv1.StatefulSet{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name,
-			Namespace: instance.Namespace,
-		},
-		Spec: appsv1.StatefulSetSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"statefulset": instance.Name,
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
-					"statefulset":   instance.Name,
-					"notebook-name": instance.Name,
-				}},
-				Spec: instance.Spec.Template.Spec,
-			},
-		},
+// getAutomountServiceAccountToken returns whether the service account token is
+// mounted in the Notebook Pod, or nil to keep the setting of the Pod template
+// and of the service account.
+func getAutomountServiceAccountToken(instance *v1beta1.Notebook) *bool {
+	if instance.Spec.AutomountServiceAccountToken != nil {
+		return instance.Spec.AutomountServiceAccountToken
 	}
-	// copy all of the Notebook labels to the pod including poddefault related labels
-	l := &ss.Spec.Template.ObjectMeta.Labels
-	for k, v := range instance.ObjectMeta.Labels {
-		(*l)[k] = v
+	if instance.Spec.Template.Spec.AutomountServiceAccountToken != nil {
+		return nil
+	}
+	if os.Getenv("DEFAULT_AUTOMOUNT_SA_TOKEN") == "false" {
+		automount := false
+		return &automount
 	}
+	return nil
+}
 
-	podSpec := &ss.Spec.Template.Spec
-	container := &podSpec.Containers[0]
-	if container.WorkingDir == "" {
-		container.WorkingDir = "/home/jovyan"
+// validateDefaultShmSize checks the DEFAULT_SHM_SIZE env var once, when the
+// controller starts.
+func validateDefaultShmSize() error {
+	value, exists := os.LookupEnv("DEFAULT_SHM_SIZE")
+	if !exists {
+		return nil
 	}
-	if container.Ports == nil {
-		container.Ports = []corev1.ContainerPort{
-			{
-				ContainerPort: DefaultContainerPort,
-				Name:          "notebook-port",
-				Protocol:      "TCP",
-			},
-		}
+	size, err := resource.ParseQuantity(value)
+	if err != nil || size.Sign() <= 0 {
+		return fmt.Errorf("DEFAULT_SHM_SIZE should be a positive quantity. Got '%s'", value)
 	}
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name:  "NB_PREFIX",
-		Value: "/notebook/" + instance.Namespace + "/" + instance.Name,
-	})
+	return nil
+}
 
-	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
-	// This allows for those platforms to bypass the automatic addition of the fsGroup
-	// and will allow for the Pod Security Policy controller to make an appropriate choice
-	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
-	if value, exists := os.LookupEnv("ADD_FSGROUP"); !exists || value == "true" {
-		if podSpec.SecurityContext == nil {
-			fsGroup := DefaultFSGroup
-			podSpec.SecurityContext = &corev1.PodSecurityContext{
-				FSGroup: &fsGroup,
-			}
+// getShmSize returns the size of the /dev/shm volume of the Notebook, falling
+// back to the DEFAULT_SHM_SIZE env var. Returns nil if neither is set, or if
+// the size isn't positive.
+func getShmSize(instance *v1beta1.Notebook) *resource.Quantity {
+	if instance.Spec.ShmSize != nil {
+		if instance.Spec.ShmSize.Sign() <= 0 {
+			return nil
 		}
+		return instance.Spec.ShmSize
 	}
-	return ss
+	value, exists := os.LookupEnv("DEFAULT_SHM_SIZE")
+	if !exists {
+		return nil
+	}
+	size, err := resource.ParseQuantity(value)
+	if err != nil || size.Sign() <= 0 {
+		return nil
+	}
+	return &size
+}
+
+// validateTmpVolumeSize checks the TMP_VOLUME_SIZE env var once, when the
+// controller starts.
+func validateTmpVolumeSize() error {
+	value, exists := os.LookupEnv("TMP_VOLUME_SIZE")
+	if !exists {
+		return nil
+	}
+	size, err := resource.ParseQuantity(value)
+	if err != nil || size.Sign() <= 0 {
+		return fmt.Errorf("TMP_VOLUME_SIZE should be a positive quantity. Got '%s'", value)
+	}
+	return nil
+}
+
+// getTmpVolumeSize returns the size of the emptyDir mounted at /tmp in the
+// notebook container, read from the TMP_VOLUME_SIZE env var. Returns nil if
+// it isn't set or isn't positive, or if the Notebook opts out with the
+// TmpVolumeAnnotation.
+func getTmpVolumeSize(instance *v1beta1.Notebook) *resource.Quantity {
+	if instance.GetAnnotations()[TmpVolumeAnnotation] == "false" {
+		return nil
+	}
+	value, exists := os.LookupEnv("TMP_VOLUME_SIZE")
+	if !exists {
+		return nil
+	}
+	size, err := resource.ParseQuantity(value)
+	if err != nil || size.Sign() <= 0 {
+		return nil
+	}
+	return &size
 }
 
 func generateService(instance *v1beta1.Notebook) *corev1.Service {
 	// Define the desired Service object
-	port := DefaultContainerPort
-	containerPorts := instance.Spec.Template.Spec.Containers[0].Ports
-	if containerPorts != nil {
-		port = int(containerPorts[0].ContainerPort)
+	port := int(notebookContainerPort(instance))
+	containers := instance.Spec.Template.Spec.Containers
+	if len(containers) != 0 && len(containers[0].Ports) != 0 {
+		port = int(containers[0].Ports[0].ContainerPort)
 	}
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -359,8 +1847,7 @@ func generateService(instance *v1beta1.Notebook) *corev1.Service {
 			Selector: map[string]string{"statefulset": instance.Name},
 			Ports: []corev1.ServicePort{
 				{
-					// Make port name follow Istio pattern so it can be managed by istio rbac
-					Name:       "http-" + instance.Name,
+					Name:       servicePortName(instance),
 					Port:       DefaultServingPort,
 					TargetPort: intstr.FromInt(port),
 					Protocol:   "TCP",
@@ -368,9 +1855,161 @@ func generateService(instance *v1beta1.Notebook) *corev1.Service {
 			},
 		},
 	}
+	svc.Spec.Ports = append(svc.Spec.Ports, additionalServicePorts(instance)...)
+	if culler.StopAnnotationIsSet(instance.ObjectMeta) && getCullMode(instance) == CullModeDetach {
+		svc.Spec.Selector[DetachedLabel] = "true"
+	}
 	return svc
 }
 
+// additionalServicePorts returns the ServicePorts of the AdditionalPorts of
+// the Notebook. The ones using the name or the number of the notebook port,
+// or of a previous port, are skipped: the validating webhook rejects them.
+func additionalServicePorts(instance *v1beta1.Notebook) []corev1.ServicePort {
+	names := map[string]bool{servicePortName(instance): true}
+	numbers := map[int32]bool{DefaultServingPort: true}
+	ports := []corev1.ServicePort{}
+	for _, p := range instance.Spec.AdditionalPorts {
+		if names[p.Name] || numbers[p.Port] {
+			continue
+		}
+		names[p.Name] = true
+		numbers[p.Port] = true
+		targetPort := p.TargetPort
+		if targetPort == 0 {
+			targetPort = p.Port
+		}
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		ports = append(ports, corev1.ServicePort{
+			Name:       p.Name,
+			Port:       p.Port,
+			TargetPort: intstr.FromInt(int(targetPort)),
+			Protocol:   protocol,
+		})
+	}
+	return ports
+}
+
+// servicePortName returns the name of the port of the Service of the Notebook,
+// set by the SERVICE_PORT_NAME env var. It defaults to "http-<name>" when
+// USE_ISTIO is true, following the Istio pattern so that the port can be
+// managed by Istio RBAC, and to "http" otherwise.
+func servicePortName(instance *v1beta1.Notebook) string {
+	if name := os.Getenv("SERVICE_PORT_NAME"); len(name) != 0 {
+		return name
+	}
+	if os.Getenv("USE_ISTIO") == "true" {
+		return "http-" + instance.Name
+	}
+	return "http"
+}
+
+// validateServicePortName checks the SERVICE_PORT_NAME env var once, when the
+// controller starts.
+func validateServicePortName() error {
+	name := os.Getenv("SERVICE_PORT_NAME")
+	if len(name) == 0 {
+		return nil
+	}
+	if errs := validation.IsValidPortName(name); len(errs) != 0 {
+		return fmt.Errorf("SERVICE_PORT_NAME should be a valid port name, got %q: %v", name, errs)
+	}
+	return nil
+}
+
+// getCullMode returns how the Notebook is stopped, set by the StopMethod of its
+// CullingPolicy, or else by the CULL_MODE env var. Defaults to CullModeScale.
+func getCullMode(instance *v1beta1.Notebook) string {
+	if policy := instance.Spec.CullingPolicy; policy != nil {
+		switch policy.StopMethod {
+		case v1beta1.StopMethodScaleToZero:
+			return CullModeScale
+		case v1beta1.StopMethodDetach:
+			return CullModeDetach
+		}
+	}
+	if os.Getenv("CULL_MODE") == CullModeDetach {
+		return CullModeDetach
+	}
+	return CullModeScale
+}
+
+func validateCullMode() error {
+	mode := os.Getenv("CULL_MODE")
+	if mode != "" && mode != CullModeScale && mode != CullModeDetach {
+		return fmt.Errorf("CULL_MODE should be %q or %q, got %q", CullModeScale, CullModeDetach, mode)
+	}
+	return nil
+}
+
+// validatePrefixTemplate checks the NB_PREFIX_TEMPLATE env var once, when the
+// controller starts. Without both placeholders, Notebooks would share the
+// same prefix.
+func validatePrefixTemplate() error {
+	template := os.Getenv("NB_PREFIX_TEMPLATE")
+	if len(template) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("NB_PREFIX_TEMPLATE should start with '/'. Got '%s'", template)
+	}
+	for _, placeholder := range []string{"{namespace}", "{name}"} {
+		if !strings.Contains(template, placeholder) {
+			return fmt.Errorf("NB_PREFIX_TEMPLATE should contain %s. Got '%s'", placeholder, template)
+		}
+	}
+	return nil
+}
+
+// notebookPrefix returns the URL prefix the Notebook is served under, built
+// from the NB_PREFIX_TEMPLATE env var.
+func notebookPrefix(instance *v1beta1.Notebook) string {
+	template := os.Getenv("NB_PREFIX_TEMPLATE")
+	if len(template) == 0 {
+		template = DefaultPrefixTemplate
+	}
+	r := strings.NewReplacer("{namespace}", instance.Namespace, "{name}", instance.Name)
+	return strings.TrimSuffix(r.Replace(template), "/")
+}
+
+func (r *NotebookReconciler) reconcileService(instance *v1beta1.Notebook) error {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	service := generateService(instance)
+	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
+		return err
+	}
+	// Check if the Service already exists
+	foundService := &corev1.Service{}
+	justCreated := false
+	err := r.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Service", "namespace", service.Namespace, "name", service.Name)
+		err = r.Create(context.TODO(), service)
+		justCreated = true
+		if err != nil {
+			log.Error(err, "unable to create Service")
+			return err
+		}
+	} else if err != nil {
+		log.Error(err, "error getting Service")
+		return err
+	}
+	// Update the foundService object and write the result back if there are any changes
+	if !justCreated && reconcilehelper.CopyServiceFields(service, foundService) {
+		log.Info("Updating Service\n", "namespace", service.Namespace, "name", service.Name)
+		err = r.Update(context.TODO(), foundService)
+		if err != nil {
+			log.Error(err, "unable to update Service")
+			return err
+		}
+	}
+
+	return nil
+}
+
 func virtualServiceName(kfName string, namespace string) string {
 	return fmt.Sprintf("notebook-%s-%s", namespace, kfName)
 }
@@ -378,25 +2017,23 @@ func virtualServiceName(kfName string, namespace string) string {
 func generateVirtualService(instance *v1beta1.Notebook) (*unstructured.Unstructured, error) {
 	name := instance.Name
 	namespace := instance.Namespace
-	prefix := fmt.Sprintf("/notebook/%s/%s/", namespace, name)
-	rewrite := fmt.Sprintf("/notebook/%s/%s/", namespace, name)
+	prefix := notebookPrefix(instance) + "/"
+	rewrite := notebookPrefix(instance) + "/"
+	if instance.Spec.StripPathPrefix {
+		rewrite = "/"
+	}
 	// TODO(gabrielwen): Make clusterDomain an option.
 	service := fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace)
 
 	vsvc := &unstructured.Unstructured{}
-	vsvc.SetAPIVersion("networking.istio.io/v1alpha3")
-	vsvc.SetKind("VirtualService")
+	vsvc.SetGroupVersionKind(virtualServiceGVK())
 	vsvc.SetName(virtualServiceName(name, namespace))
 	vsvc.SetNamespace(namespace)
 	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{"*"}, "spec", "hosts"); err != nil {
 		return nil, fmt.Errorf("Set .spec.hosts error: %v", err)
 	}
 
-	istioGateway := os.Getenv("ISTIO_GATEWAY")
-	if len(istioGateway) == 0 {
-		istioGateway = "kubeflow/kubeflow-gateway"
-	}
-	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{istioGateway},
+	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{istioGateway()},
 		"spec", "gateways"); err != nil {
 		return nil, fmt.Errorf("Set .spec.gateways error: %v", err)
 	}
@@ -426,6 +2063,32 @@ func generateVirtualService(instance *v1beta1.Notebook) (*unstructured.Unstructu
 			"timeout": "300s",
 		},
 	}
+	if mirror := generateMirror(instance); mirror != nil {
+		route := http[0].(map[string]interface{})
+		for k, v := range mirror {
+			route[k] = v
+		}
+	}
+	// The sub-paths of the additional ports go first, since the prefix of
+	// the notebook port matches them as well
+	http = append(additionalPortRoutes(instance, prefix, service), http...)
+	// The prefix only matches the URLs with the trailing slash, redirect the
+	// ones without it instead of answering with a 404
+	if instance.GetAnnotations()[TrailingSlashRedirectAnnotation] != "false" {
+		http = append(http, map[string]interface{}{
+			"match": []interface{}{
+				map[string]interface{}{
+					"uri": map[string]interface{}{
+						"exact": strings.TrimSuffix(prefix, "/"),
+					},
+				},
+			},
+			"redirect": map[string]interface{}{
+				"uri":          prefix,
+				"redirectCode": int64(301),
+			},
+		})
+	}
 	if err := unstructured.SetNestedSlice(vsvc.Object, http, "spec", "http"); err != nil {
 		return nil, fmt.Errorf("Set .spec.http error: %v", err)
 	}
@@ -434,6 +2097,70 @@ func generateVirtualService(instance *v1beta1.Notebook) (*unstructured.Unstructu
 
 }
 
+// additionalPortRoutes returns the HTTP routes of the VirtualService routing
+// <prefix>/<name>/ to the TCP AdditionalPorts of the Notebook, rewritten to
+// "/".
+func additionalPortRoutes(instance *v1beta1.Notebook, prefix, service string) []interface{} {
+	routes := []interface{}{}
+	for _, p := range additionalServicePorts(instance) {
+		if p.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		routes = append(routes, map[string]interface{}{
+			"match": []interface{}{
+				map[string]interface{}{
+					"uri": map[string]interface{}{
+						"prefix": prefix + p.Name + "/",
+					},
+				},
+			},
+			"rewrite": map[string]interface{}{
+				"uri": "/",
+			},
+			"route": []interface{}{
+				map[string]interface{}{
+					"destination": map[string]interface{}{
+						"host": service,
+						"port": map[string]interface{}{
+							"number": int64(p.Port),
+						},
+					},
+				},
+			},
+			"timeout": "300s",
+		})
+	}
+	return routes
+}
+
+// generateMirror returns the mirror and mirrorPercentage fields of the HTTP
+// route of the VirtualService mirroring the traffic of the Notebook to the
+// host of its MirrorHostAnnotation, or nil if it doesn't set one.
+func generateMirror(instance *v1beta1.Notebook) map[string]interface{} {
+	host := instance.GetAnnotations()[MirrorHostAnnotation]
+	if host == "" {
+		return nil
+	}
+	destination := map[string]interface{}{"host": host}
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		if port, err := strconv.ParseInt(host[i+1:], 10, 32); err == nil && port > 0 && port < 65536 {
+			destination["host"] = host[:i]
+			destination["port"] = map[string]interface{}{"number": port}
+		}
+	}
+	fields := map[string]interface{}{"mirror": destination}
+	value, ok := instance.GetAnnotations()[MirrorPercentageAnnotation]
+	if !ok {
+		return fields
+	}
+	percentage, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(percentage >= 0 && percentage <= 100) {
+		return fields
+	}
+	fields["mirrorPercentage"] = map[string]interface{}{"value": percentage}
+	return fields
+}
+
 func (r *NotebookReconciler) reconcileVirtualService(instance *v1beta1.Notebook) error {
 	log := r.Log.WithValues("notebook", instance.Namespace)
 	virtualService, err := generateVirtualService(instance)
@@ -443,8 +2170,7 @@ func (r *NotebookReconciler) reconcileVirtualService(instance *v1beta1.Notebook)
 	// Check if the virtual service already exists.
 	foundVirtual := &unstructured.Unstructured{}
 	justCreated := false
-	foundVirtual.SetAPIVersion("networking.istio.io/v1alpha3")
-	foundVirtual.SetKind("VirtualService")
+	foundVirtual.SetGroupVersionKind(virtualServiceGVK())
 	err = r.Get(context.TODO(), types.NamespacedName{Name: virtualServiceName(instance.Name,
 		instance.Namespace), Namespace: instance.Namespace}, foundVirtual)
 	if err != nil && apierrs.IsNotFound(err) {
@@ -471,6 +2197,48 @@ func (r *NotebookReconciler) reconcileVirtualService(instance *v1beta1.Notebook)
 	return nil
 }
 
+// deleteNetworking deletes the Service and the VirtualService or Ingress the
+// controller created for the Notebook, e.g. before its NetworkingMode was set
+// to none. Objects that aren't controlled by the Notebook are left alone.
+func (r *NotebookReconciler) deleteNetworking(instance *v1beta1.Notebook) error {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	type object struct {
+		kind string
+		name string
+		obj  runtime.Object
+	}
+	objects := []object{{kind: "Service", name: instance.Name, obj: &corev1.Service{}}}
+	if router := r.getRouter(); router != nil {
+		objects = append(objects, object{
+			kind: router.kind(),
+			name: router.objectName(instance),
+			obj:  router.newObject(),
+		})
+	}
+
+	for _, o := range objects {
+		name, obj := o.name, o.obj
+		err := r.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: instance.Namespace}, obj)
+		if err != nil && apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		meta, err := apimeta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		if !metav1.IsControlledBy(meta, instance) {
+			continue
+		}
+		log.Info("Deleting "+o.kind, "namespace", instance.Namespace, "name", name)
+		if err := r.Delete(context.TODO(), obj); ignoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func isStsOrPodEvent(event *corev1.Event) bool {
 	return event.InvolvedObject.Kind == "Pod" || event.InvolvedObject.Kind == "StatefulSet"
 }
@@ -510,16 +2278,24 @@ func nbNameExists(client client.Client, nbName string, namespace string) bool {
 }
 
 func (r *NotebookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := ValidateConfig(); err != nil {
+		return err
+	}
+	if err := detectPlatform(mgr.GetRESTMapper()); err != nil {
+		return err
+	}
+	r.Log.Info("Running on platform " + getPlatform())
+
+	if _, ok := r.getRouter().(*virtualServiceRouter); ok {
+		if err := checkVirtualServiceCRD(mgr.GetRESTMapper()); err != nil {
+			return err
+		}
+	}
 	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&v1beta1.Notebook{}).
-		Owns(&appsv1.StatefulSet{}).
-		Owns(&corev1.Service{})
-	// watch Istio virtual service
-	if os.Getenv("USE_ISTIO") == "true" {
-		virtualService := &unstructured.Unstructured{}
-		virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
-		virtualService.SetKind("VirtualService")
-		builder.Owns(virtualService)
+		WithOptions(controller.Options{MaxConcurrentReconciles: getMaxConcurrentReconciles()})
+	for _, obj := range r.ownedTypes() {
+		builder.Owns(obj)
 	}
 
 	// TODO(lunkai): After this is fixed:
@@ -596,6 +2372,16 @@ func (r *NotebookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	// watch the workspace PVCs restored from a snapshot, until they are bound
+	if err = c.Watch(
+		&source.Kind{Type: &corev1.PersistentVolumeClaim{}},
+		&handler.EnqueueRequestsFromMapFunc{
+			ToRequests: mapFn,
+		},
+		p); err != nil {
+		return err
+	}
+
 	if err = c.Watch(
 		&source.Kind{Type: &corev1.Event{}},
 		&handler.EnqueueRequestsFromMapFunc{
@@ -605,5 +2391,93 @@ func (r *NotebookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	// watch the ConfigMaps and Secrets referenced by the notebooks
+	if configRolloutEnabled() {
+		if err = c.Watch(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: r.notebooksReferencingConfig(false),
+			}); err != nil {
+			return err
+		}
+		if err = c.Watch(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: r.notebooksReferencingConfig(true),
+			}); err != nil {
+			return err
+		}
+	}
+
+	// watch the NotebookTemplates, to roll out their changes
+	if installed, err := notebookTemplateCRDInstalled(mgr.GetRESTMapper()); err != nil {
+		return err
+	} else if installed {
+		if err = c.Watch(
+			&source.Kind{Type: &v1beta1.NotebookTemplate{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: r.notebooksReferencingTemplate(),
+			}); err != nil {
+			return err
+		}
+	} else {
+		r.Log.Info("The NotebookTemplate CRD isn't installed, the Notebooks can't reference templates")
+	}
+
+	// watch the PVCs, to report their resize
+	if err = c.Watch(
+		&source.Kind{Type: &corev1.PersistentVolumeClaim{}},
+		&handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.notebooksMountingPVC(),
+		}); err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// ownedTypes returns the types of the children the controller generates for
+// the Notebooks. They are watched without predicates, so that a child
+// deleted by hand, e.g. the Service or the VirtualService, triggers a
+// reconcile of its Notebook, which recreates it right away.
+func (r *NotebookReconciler) ownedTypes() []runtime.Object {
+	owned := []runtime.Object{&appsv1.StatefulSet{}, &corev1.Service{}, &batchv1.Job{}}
+	if egressRestricted() {
+		owned = append(owned, &networkingv1.NetworkPolicy{})
+	}
+	// the Istio virtual service or the ingress
+	if router := r.getRouter(); router != nil {
+		owned = append(owned, router.newObject())
+	}
+	if istioSidecarEnabled() {
+		sidecar := &unstructured.Unstructured{}
+		sidecar.SetGroupVersionKind(sidecarGVK())
+		owned = append(owned, sidecar)
+	}
+	return owned
+}
+
+// notebooksMountingPVC returns a handler.ToRequestsFunc enqueuing the
+// Notebooks mounting a PVC.
+func (r *NotebookReconciler) notebooksMountingPVC() handler.ToRequestsFunc {
+	return func(a handler.MapObject) []ctrl.Request {
+		notebooks := &v1beta1.NotebookList{}
+		if err := r.List(context.TODO(), notebooks, client.InNamespace(a.Meta.GetNamespace())); err != nil {
+			r.Log.Error(err, "unable to list Notebooks", "namespace", a.Meta.GetNamespace())
+			return nil
+		}
+
+		requests := []ctrl.Request{}
+		for _, nb := range notebooks.Items {
+			for _, v := range nb.Spec.Template.Spec.Volumes {
+				if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == a.Meta.GetName() {
+					requests = append(requests, ctrl.Request{
+						NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+					})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
@@ -1,18 +1,138 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 
+	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/metrics"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	storagev1 "k8s.io/api/storage/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
+func init() {
+	_ = v1beta1.AddToScheme(scheme.Scheme)
+}
+
+func newTestNotebook(name, namespace string) *v1beta1.Notebook {
+	return &v1beta1.Notebook{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: v1beta1.NotebookSpec{
+			Template: v1beta1.NotebookTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: name, Image: "jupyter"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// The metrics are registered globally, so all the tests share them.
+var testMetrics = metrics.NewMetrics(nil)
+
+func newTestReconciler(objects ...runtime.Object) (*NotebookReconciler, *record.FakeRecorder) {
+	recorder := record.NewFakeRecorder(20)
+	return &NotebookReconciler{
+		Client:        fake.NewFakeClientWithScheme(scheme.Scheme, objects...),
+		Log:           logf.Log.WithName("test"),
+		Scheme:        scheme.Scheme,
+		Metrics:       testMetrics,
+		EventRecorder: recorder,
+	}, recorder
+}
+
+// failingCreateClient returns the given error on every Create call.
+type failingCreateClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingCreateClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	return c.err
+}
+
+// optimisticClient rejects updates of stale objects with a conflict, like the
+// API server does, since the fake client ignores the resourceVersion.
+type optimisticClient struct {
+	client.Client
+}
+
+func (c *optimisticClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	nb := obj.(*v1beta1.Notebook)
+	current := &v1beta1.Notebook{}
+	if err := c.Get(ctx, types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, current); err != nil {
+		return err
+	}
+	if current.ResourceVersion != nb.ResourceVersion {
+		return apierrs.NewConflict(schema.GroupResource{Group: "kubeflow.org", Resource: "notebooks"}, nb.Name, fmt.Errorf("stale object"))
+	}
+	nb.ResourceVersion = current.ResourceVersion + "1"
+	return c.Client.Update(ctx, nb, opts...)
+}
+
+// statusCountingClient counts the updates of the status subresource.
+type statusCountingClient struct {
+	client.Client
+	updates *int
+}
+
+func (c *statusCountingClient) Status() client.StatusWriter {
+	return &statusCountingWriter{StatusWriter: c.Client.Status(), updates: c.updates}
+}
+
+type statusCountingWriter struct {
+	client.StatusWriter
+	updates *int
+}
+
+func (w *statusCountingWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	*w.updates++
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
 func TestNbNameFromInvolvedObject(t *testing.T) {
 	testPod := &corev1.Pod{
 		ObjectMeta: v1.ObjectMeta{
@@ -84,3 +204,5255 @@ func TestNbNameFromInvolvedObject(t *testing.T) {
 		})
 	}
 }
+
+func TestReconcilePaused(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Annotations = map[string]string{PauseAnnotation: "true"}
+	nb.Spec.Template.Spec.Containers[0].Image = "jupyter:v2"
+
+	sts := generateStatefulSet(newTestNotebook("test-notebook", "test-namespace"))
+	r, recorder := newTestReconciler(nb, sts)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	foundSts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, foundSts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image := foundSts.Spec.Template.Spec.Containers[0].Image; image != "jupyter" {
+		t.Errorf("StatefulSet was updated while paused, got image %v", image)
+	}
+	err := r.Get(context.TODO(), req.NamespacedName, &corev1.Service{})
+	if !apierrs.IsNotFound(err) {
+		t.Errorf("Service should not be created while paused, got %v", err)
+	}
+	// Reconciling again must not repeat the event
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("Expected a single Paused event, got %d events", len(recorder.Events))
+	}
+	<-recorder.Events
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(found.Status.Conditions) != 1 || found.Status.Conditions[0].Type != PausedCondition {
+		t.Errorf("Got conditions %v, Expected a %s condition", found.Status.Conditions, PausedCondition)
+	}
+
+	// Removing the annotation resumes the reconcile
+	found.Annotations = nil
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "Resumed") {
+		t.Errorf("Got event %q, Expected a Resumed event", event)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, foundSts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image := foundSts.Spec.Template.Spec.Containers[0].Image; image != "jupyter:v2" {
+		t.Errorf("StatefulSet should be updated once resumed, got image %v", image)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, c := range found.Status.Conditions {
+		if c.Type == PausedCondition {
+			t.Errorf("The %s condition should be removed once resumed", PausedCondition)
+		}
+	}
+}
+
+func TestNotebookPrefix(t *testing.T) {
+	tests := []struct {
+		name           string
+		template       string
+		expectedPrefix string
+	}{
+		{
+			name:           "default template",
+			template:       "",
+			expectedPrefix: "/notebook/test-namespace/test-notebook",
+		},
+		{
+			name:           "custom base path",
+			template:       "/kubeflow/notebook/{namespace}/{name}/",
+			expectedPrefix: "/kubeflow/notebook/test-namespace/test-notebook",
+		},
+	}
+	defer os.Unsetenv("NB_PREFIX_TEMPLATE")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("NB_PREFIX_TEMPLATE", test.template)
+			nb := newTestNotebook("test-notebook", "test-namespace")
+
+			sts := generateStatefulSet(nb)
+			env := sts.Spec.Template.Spec.Containers[0].Env
+			if len(env) != 1 || env[0].Name != "NB_PREFIX" || env[0].Value != test.expectedPrefix {
+				t.Errorf("Got NB_PREFIX %v, Expected %v", env, test.expectedPrefix)
+			}
+
+			vsvc, err := generateVirtualService(nb)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+			route := http[0].(map[string]interface{})
+			match := route["match"].([]interface{})[0].(map[string]interface{})
+			prefix := match["uri"].(map[string]interface{})["prefix"]
+			rewrite := route["rewrite"].(map[string]interface{})["uri"]
+			if prefix != test.expectedPrefix+"/" || rewrite != test.expectedPrefix+"/" {
+				t.Errorf("Got prefix %v and rewrite %v, Expected %v/", prefix, rewrite, test.expectedPrefix)
+			}
+		})
+	}
+}
+
+func TestValidatePrefixTemplate(t *testing.T) {
+	tests := []struct {
+		template    string
+		expectError bool
+	}{
+		{template: "", expectError: false},
+		{template: "/kubeflow/notebook/{namespace}/{name}", expectError: false},
+		{template: "kubeflow/{namespace}/{name}", expectError: true},
+		{template: "/notebook/{namespace}", expectError: true},
+		{template: "/notebook/{name}", expectError: true},
+	}
+	defer os.Unsetenv("NB_PREFIX_TEMPLATE")
+
+	for _, test := range tests {
+		os.Setenv("NB_PREFIX_TEMPLATE", test.template)
+		err := validatePrefixTemplate()
+		if (err != nil) != test.expectError {
+			t.Errorf("Template %q: got error %v, Expected error: %v", test.template, err, test.expectError)
+		}
+	}
+}
+
+func TestGenerateStatefulSetTmpVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         string
+		annotations  map[string]string
+		mounts       []corev1.VolumeMount
+		expectedSize string
+	}{
+		{
+			name:         "no size",
+			expectedSize: "",
+		},
+		{
+			name:         "size from env",
+			size:         "1Gi",
+			expectedSize: "1Gi",
+		},
+		{
+			name:         "invalid size",
+			size:         "a lot",
+			expectedSize: "",
+		},
+		{
+			name:         "user defined /tmp",
+			size:         "1Gi",
+			mounts:       []corev1.VolumeMount{{Name: "my-tmp", MountPath: TmpPath}},
+			expectedSize: "",
+		},
+		{
+			name:         "opted out",
+			size:         "1Gi",
+			annotations:  map[string]string{TmpVolumeAnnotation: "false"},
+			expectedSize: "",
+		},
+		{
+			name:         "other annotation value",
+			size:         "1Gi",
+			annotations:  map[string]string{TmpVolumeAnnotation: "true"},
+			expectedSize: "1Gi",
+		},
+	}
+	defer os.Unsetenv("TMP_VOLUME_SIZE")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Unsetenv("TMP_VOLUME_SIZE")
+			if test.size != "" {
+				os.Setenv("TMP_VOLUME_SIZE", test.size)
+			}
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Annotations = test.annotations
+			nb.Spec.Template.Spec.Containers[0].VolumeMounts = test.mounts
+
+			sts := generateStatefulSet(nb)
+			volumes := sts.Spec.Template.Spec.Volumes
+			mounts := sts.Spec.Template.Spec.Containers[0].VolumeMounts[len(test.mounts):]
+			if test.expectedSize == "" {
+				if len(volumes) != 0 || len(mounts) != 0 {
+					t.Errorf("Expected no tmp volume, got volumes %+v and mounts %+v", volumes, mounts)
+				}
+				return
+			}
+			if len(volumes) != 1 || volumes[0].EmptyDir == nil ||
+				volumes[0].EmptyDir.Medium != corev1.StorageMediumDefault ||
+				volumes[0].EmptyDir.SizeLimit.String() != test.expectedSize {
+				t.Errorf("Got volumes %+v, Expected a %v emptyDir", volumes, test.expectedSize)
+			}
+			if len(mounts) != 1 || mounts[0].MountPath != TmpPath || mounts[0].Name != volumes[0].Name {
+				t.Errorf("Got mounts %+v, Expected the volume mounted at %v", mounts, TmpPath)
+			}
+		})
+	}
+}
+
+func TestValidateTmpVolumeSize(t *testing.T) {
+	tests := []struct {
+		size        string
+		expectError bool
+	}{
+		{size: "1Gi", expectError: false},
+		{size: "a lot", expectError: true},
+		{size: "0", expectError: true},
+	}
+	defer os.Unsetenv("TMP_VOLUME_SIZE")
+
+	for _, test := range tests {
+		os.Setenv("TMP_VOLUME_SIZE", test.size)
+		err := validateTmpVolumeSize()
+		if (err != nil) != test.expectError {
+			t.Errorf("Size %q: got error %v, Expected error: %v", test.size, err, test.expectError)
+		}
+	}
+}
+
+func TestValidateDefaultShmSize(t *testing.T) {
+	tests := []struct {
+		size        string
+		expectError bool
+	}{
+		{size: "1Gi", expectError: false},
+		{size: "a lot", expectError: true},
+		{size: "0", expectError: true},
+		{size: "-1Gi", expectError: true},
+	}
+	defer os.Unsetenv("DEFAULT_SHM_SIZE")
+
+	for _, test := range tests {
+		os.Setenv("DEFAULT_SHM_SIZE", test.size)
+		err := validateDefaultShmSize()
+		if (err != nil) != test.expectError {
+			t.Errorf("Size %q: got error %v, Expected error: %v", test.size, err, test.expectError)
+		}
+	}
+}
+
+func TestGetRsyncConfig(t *testing.T) {
+	tests := []struct {
+		command         string
+		expectedCommand []string
+		expectError     bool
+	}{
+		{command: "", expectedCommand: DefaultRsyncCommand},
+		{command: `["/usr/bin/rsync", "-rlt"]`, expectedCommand: []string{"/usr/bin/rsync", "-rlt"}},
+		{command: "rsync -a", expectError: true},
+		{command: "[]", expectError: true},
+	}
+	defer os.Unsetenv("RSYNC_COMMAND")
+
+	for _, test := range tests {
+		os.Setenv("RSYNC_COMMAND", test.command)
+		config, err := getRsyncConfig()
+		if (err != nil) != test.expectError {
+			t.Errorf("Command %q: got error %v, Expected error: %v", test.command, err, test.expectError)
+		}
+		if err == nil && !reflect.DeepEqual(config.Command, test.expectedCommand) {
+			t.Errorf("Command %q: got %v, Expected %v", test.command, config.Command, test.expectedCommand)
+		}
+	}
+
+	job := generateRsyncJob(newTestNotebook("clone", "test-namespace"), "clone",
+		helperConfig{Image: "rsync", Command: []string{"/usr/bin/rsync", "-rlt"}}, "src", "dst", "source")
+	expected := []string{"/usr/bin/rsync", "-rlt", "/src/", "/dst/"}
+	if command := job.Spec.Template.Spec.Containers[0].Command; !reflect.DeepEqual(command, expected) {
+		t.Errorf("Got Job command %v, Expected %v", command, expected)
+	}
+}
+
+func TestReconcileCreateStatefulSetError(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+	tests := []struct {
+		name            string
+		err             error
+		expectError     bool
+		expectRequeue   bool
+		expectedFailInc float64
+	}{
+		{
+			name:            "transient server timeout",
+			err:             apierrs.NewServerTimeout(gr, "create", 1),
+			expectError:     false,
+			expectRequeue:   true,
+			expectedFailInc: 0,
+		},
+		{
+			name:            "transient conflict",
+			err:             apierrs.NewConflict(gr, "test-notebook", fmt.Errorf("conflict")),
+			expectError:     false,
+			expectRequeue:   true,
+			expectedFailInc: 0,
+		},
+		{
+			name:            "transient rate limiting",
+			err:             apierrs.NewTooManyRequests("too many requests", 1),
+			expectError:     false,
+			expectRequeue:   true,
+			expectedFailInc: 0,
+		},
+		{
+			name:            "permanent internal error",
+			err:             apierrs.NewInternalError(fmt.Errorf("admission webhook denied the request")),
+			expectError:     true,
+			expectRequeue:   false,
+			expectedFailInc: 1,
+		},
+		{
+			name:            "permanent invalid spec",
+			err:             apierrs.NewInvalid(schema.GroupKind{Group: "apps", Kind: "StatefulSet"}, "test-notebook", nil),
+			expectError:     true,
+			expectRequeue:   false,
+			expectedFailInc: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-create-error")
+			r, _ := newTestReconciler(nb)
+			r.Client = &failingCreateClient{Client: r.Client, err: test.err}
+			failures := testutil.ToFloat64(testMetrics.NotebookFailCreation.WithLabelValues(nb.Namespace))
+			creations := testutil.ToFloat64(testMetrics.NotebookCreation.WithLabelValues(nb.Namespace))
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			result, err := r.Reconcile(req)
+			if (err != nil) != test.expectError {
+				t.Errorf("Got error %v, Expected error: %v", err, test.expectError)
+			}
+			if result.Requeue != test.expectRequeue {
+				t.Errorf("Got requeue %v, Expected %v", result.Requeue, test.expectRequeue)
+			}
+			inc := testutil.ToFloat64(testMetrics.NotebookFailCreation.WithLabelValues(nb.Namespace)) - failures
+			if inc != test.expectedFailInc {
+				t.Errorf("Got NotebookFailCreation increment %v, Expected %v", inc, test.expectedFailInc)
+			}
+			if inc := testutil.ToFloat64(testMetrics.NotebookCreation.WithLabelValues(nb.Namespace)) - creations; inc != 0 {
+				t.Errorf("Got NotebookCreation increment %v, Expected 0", inc)
+			}
+		})
+	}
+}
+
+func TestReconcileCreateStatefulSet(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-create")
+	r, _ := newTestReconciler(nb)
+	creations := testutil.ToFloat64(testMetrics.NotebookCreation.WithLabelValues(nb.Namespace))
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if inc := testutil.ToFloat64(testMetrics.NotebookCreation.WithLabelValues(nb.Namespace)) - creations; inc != 1 {
+		t.Errorf("Got NotebookCreation increment %v, Expected 1", inc)
+	}
+}
+
+func TestReconcileNetworkingMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          v1beta1.NetworkingMode
+		expectService bool
+	}{
+		{
+			name:          "default mode",
+			mode:          "",
+			expectService: true,
+		},
+		{
+			name:          "managed mode",
+			mode:          v1beta1.NetworkingModeManaged,
+			expectService: true,
+		},
+		{
+			name:          "none mode",
+			mode:          v1beta1.NetworkingModeNone,
+			expectService: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.NetworkingMode = test.mode
+			r, _ := newTestReconciler(nb)
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := r.Get(context.TODO(), req.NamespacedName, &appsv1.StatefulSet{}); err != nil {
+				t.Errorf("StatefulSet should be created, got %v", err)
+			}
+			err := r.Get(context.TODO(), req.NamespacedName, &corev1.Service{})
+			if test.expectService && err != nil {
+				t.Errorf("Service should be created, got %v", err)
+			}
+			if !test.expectService && !apierrs.IsNotFound(err) {
+				t.Errorf("Service should not be created, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReconcileNetworkingModeSwitchToNone(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.UID = "test-uid"
+	userService := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "user-service", Namespace: nb.Namespace}}
+	r, _ := newTestReconciler(nb, userService)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &corev1.Service{}); err != nil {
+		t.Fatalf("Service should be created, got %v", err)
+	}
+
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found.Spec.NetworkingMode = v1beta1.NetworkingModeNone
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &corev1.Service{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Service should be deleted, got %v", err)
+	}
+	key := types.NamespacedName{Name: userService.Name, Namespace: nb.Namespace}
+	if err := r.Get(context.TODO(), key, &corev1.Service{}); err != nil {
+		t.Errorf("Services not owned by the Notebook should be kept, got %v", err)
+	}
+}
+
+func TestValidateRouting(t *testing.T) {
+	tests := []struct {
+		ingressMode string
+		useIstio    string
+		expectError bool
+	}{
+		{ingressMode: "", useIstio: "true", expectError: false},
+		{ingressMode: "ingress", useIstio: "", expectError: false},
+		{ingressMode: "ingress", useIstio: "true", expectError: true},
+		{ingressMode: "gateway", useIstio: "", expectError: true},
+	}
+	defer os.Unsetenv("INGRESS_MODE")
+	defer os.Unsetenv("USE_ISTIO")
+
+	for _, test := range tests {
+		os.Setenv("INGRESS_MODE", test.ingressMode)
+		os.Setenv("USE_ISTIO", test.useIstio)
+		err := validateRouting()
+		if (err != nil) != test.expectError {
+			t.Errorf("INGRESS_MODE=%q USE_ISTIO=%q: got error %v, Expected error: %v",
+				test.ingressMode, test.useIstio, err, test.expectError)
+		}
+	}
+}
+
+func TestGenerateIngress(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedClass string
+		expectedHost  string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:          "class and host",
+			env:           map[string]string{"INGRESS_CLASS": "nginx", "INGRESS_HOST": "kubeflow.example.com"},
+			expectedClass: "nginx",
+			expectedHost:  "kubeflow.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			nb := newTestNotebook("test-notebook", "test-namespace")
+
+			ingress := generateIngress(nb)
+			if class := ingress.Annotations["kubernetes.io/ingress.class"]; class != test.expectedClass {
+				t.Errorf("Got ingress class %q, Expected %q", class, test.expectedClass)
+			}
+			if len(ingress.Spec.Rules) != 1 || len(ingress.Spec.Rules[0].HTTP.Paths) != 1 {
+				t.Fatalf("Expected a single rule and path, got %+v", ingress.Spec.Rules)
+			}
+			rule := ingress.Spec.Rules[0]
+			if rule.Host != test.expectedHost {
+				t.Errorf("Got host %q, Expected %q", rule.Host, test.expectedHost)
+			}
+			path := rule.HTTP.Paths[0]
+			if path.Path != "/notebook/test-namespace/test-notebook/" {
+				t.Errorf("Got path %q, Expected the notebook prefix", path.Path)
+			}
+			if path.Backend.ServiceName != nb.Name || path.Backend.ServicePort.IntValue() != DefaultServingPort {
+				t.Errorf("Got backend %+v, Expected the notebook Service", path.Backend)
+			}
+		})
+	}
+}
+
+func TestReconcileIngress(t *testing.T) {
+	os.Setenv("INGRESS_MODE", "ingress")
+	defer os.Unsetenv("INGRESS_MODE")
+
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.UID = "test-uid"
+	r, _ := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ingress := &networkingv1beta1.Ingress{}
+	if err := r.Get(context.TODO(), req.NamespacedName, ingress); err != nil {
+		t.Fatalf("Ingress should be created, got %v", err)
+	}
+	if !v1.IsControlledBy(ingress, nb) {
+		t.Errorf("Expected the Ingress to be owned by the Notebook, got %+v", ingress.OwnerReferences)
+	}
+
+	// Changing the class updates the Ingress
+	os.Setenv("INGRESS_CLASS", "nginx")
+	defer os.Unsetenv("INGRESS_CLASS")
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, ingress); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if class := ingress.Annotations["kubernetes.io/ingress.class"]; class != "nginx" {
+		t.Errorf("Got ingress class %q, Expected the Ingress to be updated", class)
+	}
+
+	// Switching to the none networking mode deletes it
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found.Spec.NetworkingMode = v1beta1.NetworkingModeNone
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, ingress); !apierrs.IsNotFound(err) {
+		t.Errorf("Ingress should be deleted, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetHomeSubPath(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Spec.HomeSubPath = "notebooks/test-notebook"
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "workspace", MountPath: DefaultWorkspacePath},
+		{Name: "data", MountPath: "/data"},
+	}
+
+	sts := generateStatefulSet(nb)
+	mounts := sts.Spec.Template.Spec.Containers[0].VolumeMounts
+	if mounts[0].SubPath != "notebooks/test-notebook" {
+		t.Errorf("Got workspace subPath %v, Expected %v", mounts[0].SubPath, nb.Spec.HomeSubPath)
+	}
+	if mounts[1].SubPath != "" {
+		t.Errorf("Got data subPath %v, Expected it to be empty", mounts[1].SubPath)
+	}
+	if nb.Spec.Template.Spec.Containers[0].VolumeMounts[0].SubPath != "" {
+		t.Errorf("The Notebook spec should not be modified")
+	}
+}
+
+func TestCullNotebookConcurrently(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-cull-concurrently")
+	nb.ResourceVersion = "1"
+	r, _ := newTestReconciler(nb)
+	r.Client = &optimisticClient{Client: r.Client}
+	culls := testutil.ToFloat64(testMetrics.NotebookCullingCount.WithLabelValues(nb.Namespace, nb.Name))
+
+	// Both reconciles decided to cull the same version of the Notebook
+	for _, instance := range []*v1beta1.Notebook{nb.DeepCopy(), nb.DeepCopy()} {
+		if err := r.cullNotebook(instance, culler.CullingDecision{Cull: true, Reason: "idle"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	inc := testutil.ToFloat64(testMetrics.NotebookCullingCount.WithLabelValues(nb.Namespace, nb.Name)) - culls
+	if inc != 1 {
+		t.Errorf("Got NotebookCullingCount increment %v, Expected 1", inc)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !culler.StopAnnotationIsSet(found.ObjectMeta) {
+		t.Errorf("Stop annotation should be set")
+	}
+}
+
+func TestCullNotebookIdleTime(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-cull-idle-time")
+	r, recorder := newTestReconciler(nb)
+
+	decision := culler.CullingDecision{
+		Cull:      true,
+		Reason:    "no activity",
+		IdleSince: time.Now().Add(-2 * time.Hour),
+	}
+	if err := r.cullNotebook(nb.DeepCopy(), decision); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	idle := testutil.ToFloat64(testMetrics.NotebookCullingIdleTime.WithLabelValues(nb.Namespace, nb.Name))
+	if idle < 7200 || idle > 7210 {
+		t.Errorf("Got NotebookCullingIdleTime %v, Expected 7200", idle)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "Culled") || !strings.Contains(event, "idle for 2h0m0s") {
+			t.Errorf("Got event %q, Expected a Culled event with the idle time", event)
+		}
+	default:
+		t.Errorf("Expected a Culled event")
+	}
+}
+
+func TestReconcileReadOnly(t *testing.T) {
+	tests := []struct {
+		name              string
+		readOnly          bool
+		expectedCondition bool
+	}{
+		{
+			name:              "read-only workspace",
+			readOnly:          true,
+			expectedCondition: true,
+		},
+		{
+			name:              "writable workspace",
+			readOnly:          false,
+			expectedCondition: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.ReadOnly = test.readOnly
+			nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+				{Name: "workspace", MountPath: DefaultWorkspacePath},
+			}
+			nb.Status.Conditions = []v1beta1.NotebookCondition{{Type: ReadOnlyCondition}}
+			r, _ := newTestReconciler(nb)
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			sts := &appsv1.StatefulSet{}
+			if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mount := sts.Spec.Template.Spec.Containers[0].VolumeMounts[0]; mount.ReadOnly != test.readOnly {
+				t.Errorf("Got workspace readOnly %v, Expected %v", mount.ReadOnly, test.readOnly)
+			}
+			found := &v1beta1.Notebook{}
+			if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			hasCondition := len(found.Status.Conditions) == 1 &&
+				found.Status.Conditions[0].Type == ReadOnlyCondition &&
+				found.Status.Conditions[0].Reason != ""
+			if hasCondition != test.expectedCondition {
+				t.Errorf("Got conditions %+v, Expected ReadOnly condition: %v", found.Status.Conditions, test.expectedCondition)
+			}
+		})
+	}
+}
+
+func TestReconcileReadyLatency(t *testing.T) {
+	readyLatencyCount := func(namespace string) uint64 {
+		m := &dto.Metric{}
+		testMetrics.NotebookReadyLatency.WithLabelValues(namespace).(prometheus.Histogram).Write(m)
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	tests := []struct {
+		name          string
+		generation    int64
+		readyReplicas int32
+		expectedCount uint64
+	}{
+		{
+			name:          "first start",
+			generation:    1,
+			readyReplicas: 0,
+			expectedCount: 1,
+		},
+		{
+			name:          "restarted after a stop",
+			generation:    3,
+			readyReplicas: 0,
+			expectedCount: 0,
+		},
+		{
+			name:          "already ready when the controller starts",
+			generation:    1,
+			readyReplicas: 1,
+			expectedCount: 0,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", fmt.Sprintf("test-ready-latency-%d", i))
+			nb.CreationTimestamp = v1.NewTime(time.Now().Add(-time.Minute))
+			nb.Status.ReadyReplicas = test.readyReplicas
+			sts := generateStatefulSet(nb)
+			sts.Generation = test.generation
+			sts.Status.ReadyReplicas = 1
+			r, _ := newTestReconciler(nb, sts)
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			for j := 0; j < 2; j++ {
+				if _, err := r.Reconcile(req); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if count := readyLatencyCount(nb.Namespace); count != test.expectedCount {
+				t.Errorf("Got %d ready latency observations, Expected %d", count, test.expectedCount)
+			}
+		})
+	}
+}
+
+func TestReconcileScheduleTimeout(t *testing.T) {
+	tests := []struct {
+		name              string
+		podAge            time.Duration
+		unschedulable     bool
+		expectedCondition bool
+	}{
+		{
+			name:              "unschedulable for too long",
+			podAge:            10 * time.Minute,
+			unschedulable:     true,
+			expectedCondition: true,
+		},
+		{
+			name:              "recently created",
+			podAge:            time.Minute,
+			unschedulable:     true,
+			expectedCondition: false,
+		},
+		{
+			name:              "scheduled",
+			podAge:            10 * time.Minute,
+			unschedulable:     false,
+			expectedCondition: false,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", fmt.Sprintf("test-schedule-timeout-%d", i))
+			pod := &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:              nb.Name + "-0",
+					Namespace:         nb.Namespace,
+					Labels:            map[string]string{"statefulset": nb.Name},
+					CreationTimestamp: v1.NewTime(time.Now().Add(-test.podAge)),
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			if test.unschedulable {
+				pod.Status.Phase = corev1.PodPending
+				pod.Status.Conditions = []corev1.PodCondition{{
+					Type:   corev1.PodScheduled,
+					Status: corev1.ConditionFalse,
+					Reason: corev1.PodReasonUnschedulable,
+				}}
+			}
+			r, _ := newTestReconciler(nb, pod)
+			timeouts := testutil.ToFloat64(testMetrics.NotebookScheduleTimeouts.WithLabelValues(nb.Namespace))
+
+			// Reconcile twice to make sure the timeout is only reported once
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			for j := 0; j < 2; j++ {
+				if _, err := r.Reconcile(req); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			found := &v1beta1.Notebook{}
+			if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			hasCondition := false
+			for _, c := range found.Status.Conditions {
+				hasCondition = hasCondition || c.Type == ScheduleTimeoutCondition
+			}
+			if hasCondition != test.expectedCondition {
+				t.Errorf("Got conditions %+v, Expected ScheduleTimeout condition: %v", found.Status.Conditions, test.expectedCondition)
+			}
+			inc := testutil.ToFloat64(testMetrics.NotebookScheduleTimeouts.WithLabelValues(nb.Namespace)) - timeouts
+			if test.expectedCondition && inc != 1 || !test.expectedCondition && inc != 0 {
+				t.Errorf("Got NotebookScheduleTimeouts increment %v", inc)
+			}
+		})
+	}
+}
+
+func TestGetStatefulSetPod(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-pod-lookup")
+	sts := generateStatefulSet(nb)
+	now := v1.Now()
+	newPod := func(name, sts string, deleting bool) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      name,
+				Namespace: nb.Namespace,
+				Labels:    map[string]string{"statefulset": sts},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+				}},
+			},
+		}
+		if deleting {
+			pod.DeletionTimestamp = &now
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name        string
+		pods        []runtime.Object
+		expectedPod string
+	}{
+		{
+			name:        "no pod",
+			expectedPod: "",
+		},
+		{
+			name:        "pod with a custom name",
+			pods:        []runtime.Object{newPod("custom-name", nb.Name, false)},
+			expectedPod: "custom-name",
+		},
+		{
+			name: "several pods",
+			pods: []runtime.Object{
+				newPod(nb.Name+"-1", nb.Name, false),
+				newPod(nb.Name+"-0", nb.Name, false),
+				newPod("other-0", "other", false),
+			},
+			expectedPod: nb.Name + "-0",
+		},
+		{
+			name: "pod being deleted",
+			pods: []runtime.Object{
+				newPod(nb.Name+"-0", nb.Name, true),
+				newPod(nb.Name+"-1", nb.Name, false),
+			},
+			expectedPod: nb.Name + "-1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := newTestReconciler(append([]runtime.Object{nb, sts}, test.pods...)...)
+			pod, err := r.getStatefulSetPod(sts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			name := ""
+			if pod != nil {
+				name = pod.Name
+			}
+			if name != test.expectedPod {
+				t.Errorf("Got pod %q, Expected %q", name, test.expectedPod)
+			}
+		})
+	}
+
+	// The status is read from the Pod found by label
+	r, _ := newTestReconciler(nb, sts, newPod("custom-name", nb.Name, false))
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found.Status.ContainerState.Running == nil {
+		t.Errorf("Expected the container state of the pod to be reported, got %+v", found.Status.ContainerState)
+	}
+}
+
+func TestGenerateStatefulSetShm(t *testing.T) {
+	shmSize := resource.MustParse("2Gi")
+	zeroSize := resource.MustParse("0")
+	tests := []struct {
+		name         string
+		shmSize      *resource.Quantity
+		defaultSize  string
+		volumes      []corev1.Volume
+		mounts       []corev1.VolumeMount
+		expectedSize string
+	}{
+		{
+			name:         "no size",
+			expectedSize: "",
+		},
+		{
+			name:         "size from spec",
+			shmSize:      &shmSize,
+			defaultSize:  "1Gi",
+			expectedSize: "2Gi",
+		},
+		{
+			name:         "default size",
+			defaultSize:  "1Gi",
+			expectedSize: "1Gi",
+		},
+		{
+			name:         "invalid default size",
+			defaultSize:  "a lot",
+			expectedSize: "",
+		},
+		{
+			name:         "user defined /dev/shm",
+			shmSize:      &shmSize,
+			mounts:       []corev1.VolumeMount{{Name: "my-shm", MountPath: ShmPath}},
+			expectedSize: "",
+		},
+		{
+			name:         "zero size from spec",
+			shmSize:      &zeroSize,
+			defaultSize:  "1Gi",
+			expectedSize: "",
+		},
+		{
+			name:         "negative default size",
+			defaultSize:  "-1Gi",
+			expectedSize: "",
+		},
+		{
+			name:         "user volume named dshm",
+			shmSize:      &shmSize,
+			volumes:      []corev1.Volume{{Name: "dshm"}},
+			mounts:       []corev1.VolumeMount{{Name: "dshm", MountPath: "/data"}},
+			expectedSize: "2Gi",
+		},
+	}
+	defer os.Unsetenv("DEFAULT_SHM_SIZE")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Unsetenv("DEFAULT_SHM_SIZE")
+			if test.defaultSize != "" {
+				os.Setenv("DEFAULT_SHM_SIZE", test.defaultSize)
+			}
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.ShmSize = test.shmSize
+			nb.Spec.Template.Spec.Volumes = test.volumes
+			nb.Spec.Template.Spec.Containers[0].VolumeMounts = test.mounts
+
+			sts := generateStatefulSet(nb)
+			volumes := sts.Spec.Template.Spec.Volumes[len(test.volumes):]
+			mounts := sts.Spec.Template.Spec.Containers[0].VolumeMounts[len(test.mounts):]
+			if test.expectedSize == "" {
+				if len(volumes) != 0 || len(mounts) != 0 {
+					t.Errorf("Expected no shm volume, got volumes %+v and mounts %+v", volumes, mounts)
+				}
+				return
+			}
+			if len(volumes) != 1 || volumes[0].EmptyDir == nil ||
+				volumes[0].EmptyDir.Medium != corev1.StorageMediumMemory ||
+				volumes[0].EmptyDir.SizeLimit.String() != test.expectedSize {
+				t.Errorf("Got volumes %+v, Expected a %v memory emptyDir", volumes, test.expectedSize)
+			}
+			for _, v := range test.volumes {
+				if v.Name == volumes[0].Name {
+					t.Errorf("The shm volume name %v collides with a user volume", v.Name)
+				}
+			}
+			if len(mounts) != 1 || mounts[0].MountPath != ShmPath || mounts[0].Name != volumes[0].Name {
+				t.Errorf("Got mounts %+v, Expected the volume mounted at %v", mounts, ShmPath)
+			}
+		})
+	}
+}
+
+func TestReconcileClone(t *testing.T) {
+	withWorkspace := func(nb *v1beta1.Notebook, claimName string) *v1beta1.Notebook {
+		nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+			{Name: "workspace", MountPath: DefaultWorkspacePath},
+		}
+		nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+			},
+		}}
+		return nb
+	}
+	source := withWorkspace(newTestNotebook("source", "test-namespace"), "source-workspace")
+	sourcePVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "source-workspace", Namespace: "test-namespace"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			},
+		},
+	}
+
+	getCloneReason := func(r *NotebookReconciler, nb *v1beta1.Notebook) string {
+		found := &v1beta1.Notebook{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, found); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, c := range found.Status.Conditions {
+			if c.Type == CloneCondition {
+				return c.Reason
+			}
+		}
+		return ""
+	}
+	getReplicas := func(r *NotebookReconciler, nb *v1beta1.Notebook) int32 {
+		sts := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, sts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return *sts.Spec.Replicas
+	}
+
+	os.Setenv("RSYNC_IMAGE", "rsync")
+	defer os.Unsetenv("RSYNC_IMAGE")
+
+	t.Run("source not found", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = "missing"
+		r, _ := newTestReconciler(nb)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneSourceNotFound {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneSourceNotFound)
+		}
+		if replicas := getReplicas(r, nb); replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 until the clone completes", replicas)
+		}
+	})
+
+	t.Run("copy completes", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		r, _ := newTestReconciler(nb, source, sourcePVC)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-workspace", Namespace: nb.Namespace}, pvc); err != nil {
+			t.Fatalf("Workspace PVC should be created, got %v", err)
+		}
+		if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "10Gi" {
+			t.Errorf("Got PVC size %v, Expected 10Gi", size.String())
+		}
+		job := &batchv1.Job{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-clone", Namespace: nb.Namespace}, job); err != nil {
+			t.Fatalf("Rsync Job should be created, got %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneCopying {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneCopying)
+		}
+		if replicas := getReplicas(r, nb); replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 until the clone completes", replicas)
+		}
+
+		succeeded := testMetrics.NotebookMaintenanceJobs.WithLabelValues("clone", "success")
+		before := testutil.ToFloat64(succeeded)
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		if err := r.Status().Update(context.TODO(), job); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if count := testutil.ToFloat64(succeeded) - before; count != 1 {
+			t.Errorf("Got %v successful clone Jobs counted, Expected 1", count)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneCompleted {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneCompleted)
+		}
+		if replicas := getReplicas(r, nb); replicas != 1 {
+			t.Errorf("Got %d replicas, Expected 1 once the clone completed", replicas)
+		}
+	})
+
+	t.Run("copy fails", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		job := generateRsyncJob(nb, "clone", helperConfig{Image: "rsync", Command: DefaultRsyncCommand}, "source-workspace", "clone-workspace", source.Name)
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+		r, recorder := newTestReconciler(nb, source, sourcePVC, job)
+		failed := testMetrics.NotebookMaintenanceJobs.WithLabelValues("clone", "failure")
+		before := testutil.ToFloat64(failed)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		for i := 0; i < 2; i++ {
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if count := testutil.ToFloat64(failed) - before; count != 1 {
+			t.Errorf("Got %v failed clone Jobs counted, Expected the Job to be counted once", count)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneCopyFailed {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneCopyFailed)
+		}
+		if len(recorder.Events) != 1 {
+			t.Errorf("Expected a warning event, got %d events", len(recorder.Events))
+		}
+	})
+
+	t.Run("cloneFrom added to an existing notebook", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		sts := generateStatefulSet(nb)
+		nb.Spec.CloneFrom = source.Name
+		r, _ := newTestReconciler(nb, source, sourcePVC, sts)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneIgnored {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneIgnored)
+		}
+		if replicas := getReplicas(r, nb); replicas != 1 {
+			t.Errorf("Got %d replicas, Expected the running notebook to be kept", replicas)
+		}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-clone", Namespace: nb.Namespace}, &batchv1.Job{})
+		if !apierrs.IsNotFound(err) {
+			t.Errorf("Rsync Job should not be created, got %v", err)
+		}
+	})
+
+	t.Run("clone from itself", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = nb.Name
+		r, _ := newTestReconciler(nb)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneInvalidSource {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneInvalidSource)
+		}
+	})
+
+	t.Run("existing workspace PVC", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: v1.ObjectMeta{Name: "clone-workspace", Namespace: "test-namespace"},
+		}
+		r, _ := newTestReconciler(nb, source, sourcePVC, pvc)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneWorkspaceExists {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneWorkspaceExists)
+		}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-clone", Namespace: nb.Namespace}, &batchv1.Job{})
+		if !apierrs.IsNotFound(err) {
+			t.Errorf("Rsync Job should not be created, got %v", err)
+		}
+	})
+
+	t.Run("workspace storage class", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		className := "fast"
+		nb.Spec.WorkspaceStorageClass = &className
+		fast := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "fast"}, Provisioner: "ebs.csi.aws.com"}
+		r, _ := newTestReconciler(nb, source, sourcePVC, fast)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-workspace", Namespace: nb.Namespace}, pvc); err != nil {
+			t.Fatalf("Workspace PVC should be created, got %v", err)
+		}
+		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "fast" {
+			t.Errorf("Got PVC StorageClass %v, Expected fast", pvc.Spec.StorageClassName)
+		}
+	})
+
+	t.Run("workspace storage class not found", func(t *testing.T) {
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		className := "missing"
+		nb.Spec.WorkspaceStorageClass = &className
+		r, _ := newTestReconciler(nb, source, sourcePVC)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneStorageClassNotFound {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneStorageClassNotFound)
+		}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: "clone-workspace", Namespace: nb.Namespace}, &corev1.PersistentVolumeClaim{})
+		if !apierrs.IsNotFound(err) {
+			t.Errorf("Expected no PVC without the StorageClass, got %v", err)
+		}
+	})
+
+	t.Run("rsync image not set", func(t *testing.T) {
+		os.Unsetenv("RSYNC_IMAGE")
+		defer os.Setenv("RSYNC_IMAGE", "rsync")
+		nb := withWorkspace(newTestNotebook("clone", "test-namespace"), "clone-workspace")
+		nb.Spec.CloneFrom = source.Name
+		r, _ := newTestReconciler(nb, source, sourcePVC)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getCloneReason(r, nb); reason != CloneNotConfigured {
+			t.Errorf("Got Clone reason %v, Expected %v", reason, CloneNotConfigured)
+		}
+	})
+}
+
+func TestReconcileStatefulSetImmutableFields(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Spec.Template.Spec.Containers[0].Image = "jupyter:v2"
+	// The StatefulSet was created with a claim template the controller no
+	// longer generates
+	sts := generateStatefulSet(newTestNotebook("test-notebook", "test-namespace"))
+	sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{
+		ObjectMeta: v1.ObjectMeta{Name: "workspace"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("5Gi")},
+			},
+		},
+	}}
+	sts.Annotations[ImmutableSpecAnnotation] = immutableSpec(sts)
+	r, recorder := newTestReconciler(nb, sts)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected a single ImmutableFieldChanged event, got %d events", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "ImmutableFieldChanged") ||
+		!strings.Contains(event, "spec.volumeClaimTemplates") || !strings.Contains(event, "allows volume expansion") {
+		t.Errorf("Got event %q, Expected an ImmutableFieldChanged event", event)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&found.Status, ImmutableFieldsCondition) {
+		t.Errorf("Expected a %s condition, got %v", ImmutableFieldsCondition, found.Status.Conditions)
+	}
+	foundSts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, foundSts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image := foundSts.Spec.Template.Spec.Containers[0].Image; image != "jupyter:v2" {
+		t.Errorf("Mutable fields should still be updated, got image %v", image)
+	}
+	if foundSts.Annotations[ImmutableSpecAnnotation] != sts.Annotations[ImmutableSpecAnnotation] {
+		t.Errorf("The applied immutable fields should be kept, got %v", foundSts.Annotations[ImmutableSpecAnnotation])
+	}
+}
+
+func TestReconcileStatefulSetWithoutImmutableSpec(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	// StatefulSets created by older controllers don't have the annotation
+	sts := generateStatefulSet(nb)
+	sts.Annotations = nil
+	sts.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{ObjectMeta: v1.ObjectMeta{Name: "workspace"}}}
+	r, recorder := newTestReconciler(nb, sts)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no event, got %q", <-recorder.Events)
+	}
+	foundSts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, foundSts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := foundSts.Annotations[ImmutableSpecAnnotation]; !ok {
+		t.Errorf("The %s annotation should be added", ImmutableSpecAnnotation)
+	}
+}
+
+func TestReconcileStatefulSetDrift(t *testing.T) {
+	privileged := true
+	testCases := []struct {
+		name   string
+		tamper func(sts *appsv1.StatefulSet)
+	}{
+		{
+			name: "NB_PREFIX env var",
+			tamper: func(sts *appsv1.StatefulSet) {
+				env := sts.Spec.Template.Spec.Containers[0].Env
+				for i := range env {
+					if env[i].Name == "NB_PREFIX" {
+						env[i].Value = "/edited"
+					}
+				}
+			},
+		},
+		{
+			name: "ports",
+			tamper: func(sts *appsv1.StatefulSet) {
+				sts.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "debug", ContainerPort: 5678}}
+			},
+		},
+		{
+			name: "working dir",
+			tamper: func(sts *appsv1.StatefulSet) {
+				sts.Spec.Template.Spec.Containers[0].WorkingDir = "/tmp"
+			},
+		},
+		{
+			name: "security context",
+			tamper: func(sts *appsv1.StatefulSet) {
+				sts.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			},
+		},
+		{
+			name: "template labels",
+			tamper: func(sts *appsv1.StatefulSet) {
+				delete(sts.Spec.Template.Labels, "notebook-name")
+			},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			r, _ := newTestReconciler(nb)
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := &appsv1.StatefulSet{}
+			if err := r.Get(context.TODO(), req.NamespacedName, expected); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			tampered := expected.DeepCopy()
+			c.tamper(tampered)
+			if err := r.Update(context.TODO(), tampered); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			found := &appsv1.StatefulSet{}
+			if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !apiequality.Semantic.DeepEqual(found.Spec.Template.Spec, expected.Spec.Template.Spec) {
+				t.Errorf("Got pod spec %+v, Expected the edit to be reverted to %+v",
+					found.Spec.Template.Spec, expected.Spec.Template.Spec)
+			}
+			if !reflect.DeepEqual(found.Spec.Template.Labels, expected.Spec.Template.Labels) {
+				t.Errorf("Got template labels %v, Expected the edit to be reverted to %v",
+					found.Spec.Template.Labels, expected.Spec.Template.Labels)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetNodeName(t *testing.T) {
+	tests := []struct {
+		name             string
+		affinity         *corev1.Affinity
+		nodeName         string
+		expectedSelector string
+	}{
+		{
+			name:             "pinned to the node",
+			expectedSelector: "node-1",
+		},
+		{
+			name: "user node affinity",
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{},
+			}},
+			expectedSelector: "",
+		},
+		{
+			name:             "user nodeName",
+			nodeName:         "node-2",
+			expectedSelector: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Annotations = map[string]string{NodeNameAnnotation: "node-1"}
+			nb.Spec.Template.Spec.Affinity = test.affinity
+			nb.Spec.Template.Spec.NodeName = test.nodeName
+
+			sts := generateStatefulSet(nb)
+			selector := sts.Spec.Template.Spec.NodeSelector["kubernetes.io/hostname"]
+			if selector != test.expectedSelector {
+				t.Errorf("Got hostname selector %q, Expected %q", selector, test.expectedSelector)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetLabelPropagation(t *testing.T) {
+	labels := map[string]string{
+		"app.kubernetes.io/part-of":     "kubeflow",
+		"internal.example.com/team":     "ml",
+		"internal.example.com/owner-id": "42",
+		"access-ml-pipeline":            "true",
+		// Reserved, the pod is selected with it
+		"statefulset": "other",
+	}
+	tests := []struct {
+		name           string
+		prefixes       string
+		expectedLabels []string
+	}{
+		{
+			name:     "unset",
+			prefixes: "",
+			expectedLabels: []string{"app.kubernetes.io/part-of", "internal.example.com/team",
+				"internal.example.com/owner-id", "access-ml-pipeline"},
+		},
+		{
+			name:           "allow list",
+			prefixes:       "app.kubernetes.io/, access-",
+			expectedLabels: []string{"app.kubernetes.io/part-of", "access-ml-pipeline"},
+		},
+		{
+			name:           "deny list",
+			prefixes:       "-internal.example.com/",
+			expectedLabels: []string{"app.kubernetes.io/part-of", "access-ml-pipeline"},
+		},
+		{
+			name:           "allow and deny lists",
+			prefixes:       "internal.example.com/,-internal.example.com/owner",
+			expectedLabels: []string{"internal.example.com/team"},
+		},
+	}
+	defer os.Unsetenv("PROPAGATE_LABEL_PREFIXES")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("PROPAGATE_LABEL_PREFIXES", test.prefixes)
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Labels = labels
+
+			sts := generateStatefulSet(nb)
+			podLabels := sts.Spec.Template.Labels
+			if podLabels["statefulset"] != nb.Name || podLabels["notebook-name"] != nb.Name {
+				t.Errorf("Expected the statefulset and notebook-name labels, got %v", podLabels)
+			}
+			for k := range labels {
+				if k == "statefulset" {
+					continue
+				}
+				expected := false
+				for _, e := range test.expectedLabels {
+					expected = expected || e == k
+				}
+				if _, ok := podLabels[k]; ok != expected {
+					t.Errorf("Label %s: got copied %v, Expected %v", k, ok, expected)
+				}
+			}
+		})
+	}
+}
+
+// podDefaultClient lists the given PodDefaults, since the fake client can't
+// list unstructured objects.
+type podDefaultClient struct {
+	client.Client
+	podDefaults []unstructured.Unstructured
+}
+
+func (c *podDefaultClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if u, ok := list.(*unstructured.UnstructuredList); ok && u.GetKind() == "PodDefaultList" {
+		u.Items = c.podDefaults
+		return nil
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestReconcilePodDefaultLabels(t *testing.T) {
+	os.Setenv("PROPAGATE_LABEL_PREFIXES", "app.kubernetes.io/")
+	defer os.Unsetenv("PROPAGATE_LABEL_PREFIXES")
+
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Labels = map[string]string{
+		"app.kubernetes.io/part-of": "kubeflow",
+		"access-ml-pipeline":        "true",
+		"internal":                  "true",
+	}
+	podDefault := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubeflow.org/v1alpha1",
+		"kind":       "PodDefault",
+		"metadata":   map[string]interface{}{"name": "access-ml-pipeline", "namespace": nb.Namespace},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"access-ml-pipeline": "true"},
+			},
+		},
+	}}
+	r, _ := newTestReconciler(nb)
+	r.Client = &podDefaultClient{Client: r.Client, podDefaults: []unstructured.Unstructured{*podDefault}}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	podLabels := sts.Spec.Template.Labels
+	if podLabels["access-ml-pipeline"] != "true" {
+		t.Errorf("Expected the PodDefault label to be copied, got %v", podLabels)
+	}
+	if _, ok := podLabels["internal"]; ok {
+		t.Errorf("Expected the internal label not to be copied, got %v", podLabels)
+	}
+}
+
+func TestGenerateStatefulSetNoNbPrefix(t *testing.T) {
+	tests := []struct {
+		name           string
+		annotations    map[string]string
+		expectedPrefix bool
+	}{
+		{
+			name:           "injected by default",
+			expectedPrefix: true,
+		},
+		{
+			name:           "opted out",
+			annotations:    map[string]string{NoNbPrefixAnnotation: "true"},
+			expectedPrefix: false,
+		},
+		{
+			name:           "annotation not true",
+			annotations:    map[string]string{NoNbPrefixAnnotation: "false"},
+			expectedPrefix: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Annotations = test.annotations
+
+			sts := generateStatefulSet(nb)
+			hasPrefix := false
+			for _, env := range sts.Spec.Template.Spec.Containers[0].Env {
+				hasPrefix = hasPrefix || env.Name == "NB_PREFIX"
+			}
+			if hasPrefix != test.expectedPrefix {
+				t.Errorf("Got NB_PREFIX set: %v, Expected %v", hasPrefix, test.expectedPrefix)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetRuntimeClassName(t *testing.T) {
+	gvisor, kata := "gvisor", "kata"
+	tests := []struct {
+		name          string
+		specClass     *string
+		templateClass *string
+		defaultClass  string
+		expectedClass string
+	}{
+		{
+			name:          "unset",
+			expectedClass: "",
+		},
+		{
+			name:          "spec field",
+			specClass:     &gvisor,
+			templateClass: &kata,
+			expectedClass: "gvisor",
+		},
+		{
+			name:          "pod template",
+			templateClass: &kata,
+			defaultClass:  "gvisor",
+			expectedClass: "kata",
+		},
+		{
+			name:          "default",
+			defaultClass:  "gvisor",
+			expectedClass: "gvisor",
+		},
+	}
+	defer os.Unsetenv("DEFAULT_RUNTIME_CLASS")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("DEFAULT_RUNTIME_CLASS", test.defaultClass)
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.RuntimeClassName = test.specClass
+			nb.Spec.Template.Spec.RuntimeClassName = test.templateClass
+
+			sts := generateStatefulSet(nb)
+			runtimeClass := ""
+			if sts.Spec.Template.Spec.RuntimeClassName != nil {
+				runtimeClass = *sts.Spec.Template.Spec.RuntimeClassName
+			}
+			if runtimeClass != test.expectedClass {
+				t.Errorf("Got runtimeClassName %q, Expected %q", runtimeClass, test.expectedClass)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetAutomountServiceAccountToken(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name              string
+		defaultAutomount  string
+		specAutomount     *bool
+		templateAutomount *bool
+		expected          *bool
+	}{
+		{
+			name:     "default on",
+			expected: nil,
+		},
+		{
+			name:             "default off",
+			defaultAutomount: "false",
+			expected:         &disabled,
+		},
+		{
+			name:              "default off, set in the pod template",
+			defaultAutomount:  "false",
+			templateAutomount: &enabled,
+			expected:          &enabled,
+		},
+		{
+			name:              "default off, overridden by the notebook",
+			defaultAutomount:  "false",
+			specAutomount:     &enabled,
+			templateAutomount: &disabled,
+			expected:          &enabled,
+		},
+		{
+			name:          "default on, overridden by the notebook",
+			specAutomount: &disabled,
+			expected:      &disabled,
+		},
+	}
+	defer os.Unsetenv("DEFAULT_AUTOMOUNT_SA_TOKEN")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("DEFAULT_AUTOMOUNT_SA_TOKEN", test.defaultAutomount)
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.AutomountServiceAccountToken = test.specAutomount
+			nb.Spec.Template.Spec.AutomountServiceAccountToken = test.templateAutomount
+
+			sts := generateStatefulSet(nb)
+			automount := sts.Spec.Template.Spec.AutomountServiceAccountToken
+			if !reflect.DeepEqual(automount, test.expected) {
+				t.Errorf("Got automountServiceAccountToken %v, Expected %v", automount, test.expected)
+			}
+		})
+	}
+}
+
+func TestReconcileNodeNotFound(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Annotations = map[string]string{NodeNameAnnotation: "missing-node"}
+	r, recorder := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected a single NodeNotFound event, got %d events", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, NodeNotFoundCondition) {
+		t.Errorf("Got event %q, Expected a %s event", event, NodeNotFoundCondition)
+	}
+
+	node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "missing-node"}}
+	if err := r.Create(context.TODO(), node); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&found.Status, NodeNotFoundCondition) {
+		t.Errorf("The %s condition should be removed once the node exists", NodeNotFoundCondition)
+	}
+}
+
+func TestReconcileMissingVolume(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace-pvc"},
+			},
+		},
+		{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data-pvc"},
+			},
+		},
+	}
+	// The data PVC is still being provisioned
+	dataPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "data-pvc", Namespace: nb.Namespace},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	}
+	r, recorder := newTestReconciler(nb, dataPVC)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	for i := 0; i < 2; i++ {
+		result, err := r.Reconcile(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if result.RequeueAfter == 0 {
+			t.Errorf("Expected the Notebook to be requeued while its PVC is missing")
+		}
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the StatefulSet not to be created, got %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var condition *v1beta1.NotebookCondition
+	for i, c := range found.Status.Conditions {
+		if c.Type == MissingVolumeCondition {
+			condition = &found.Status.Conditions[i]
+		}
+	}
+	if condition == nil || !strings.Contains(condition.Message, "workspace-pvc") ||
+		strings.Contains(condition.Message, "data-pvc") {
+		t.Errorf("Got condition %+v, Expected a %s condition for workspace-pvc", condition, MissingVolumeCondition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected a single %s event, got %d events", MissingVolumeCondition, len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, MissingVolumeCondition) {
+		t.Errorf("Got event %q, Expected a %s event", event, MissingVolumeCondition)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "workspace-pvc", Namespace: nb.Namespace}}
+	if err := r.Create(context.TODO(), pvc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Errorf("Expected the StatefulSet to be created once the PVC exists, got %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&found.Status, MissingVolumeCondition) {
+		t.Errorf("The %s condition should be removed once the PVC exists", MissingVolumeCondition)
+	}
+}
+
+func TestReconcileConfigChecksum(t *testing.T) {
+	os.Setenv("ROLL_ON_CONFIG_CHANGE", "true")
+	defer os.Unsetenv("ROLL_ON_CONFIG_CHANGE")
+
+	nb := newTestNotebook("test-notebook", "test-config-checksum")
+	nb.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}},
+	}}
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name:         "credentials",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "credentials"}},
+	}}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: "config", Namespace: nb.Namespace},
+		Data:       map[string]string{"KEY": "value"},
+	}
+	unrelated := newTestNotebook("unrelated", nb.Namespace)
+	r, _ := newTestReconciler(nb, unrelated, cm)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	getChecksum := func() string {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		sts := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] != "now" {
+			sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = "now"
+			if err := r.Update(context.TODO(), sts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		return sts.Spec.Template.Annotations[ConfigChecksumAnnotation]
+	}
+
+	checksum := getChecksum()
+	if checksum == "" {
+		t.Fatalf("Expected the %s annotation to be set", ConfigChecksumAnnotation)
+	}
+	if c := getChecksum(); c != checksum {
+		t.Errorf("Expected the checksum to be stable, got %s and %s", checksum, c)
+	}
+
+	cm.Data["KEY"] = "other value"
+	if err := r.Update(context.TODO(), cm); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	changed := getChecksum()
+	if changed == checksum {
+		t.Errorf("Expected the checksum to change with the ConfigMap")
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "credentials", Namespace: nb.Namespace},
+		Data:       map[string][]byte{"token": []byte("secret")},
+	}
+	if err := r.Create(context.TODO(), secret); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c := getChecksum(); c == changed {
+		t.Errorf("Expected the checksum to change when the Secret is created")
+	}
+
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] != "now" {
+		t.Errorf("Expected the other template annotations to be kept, got %v", sts.Spec.Template.Annotations)
+	}
+
+	requests := r.notebooksReferencingConfig(false)(handler.MapObject{Meta: cm, Object: cm})
+	if len(requests) != 1 || requests[0].Name != nb.Name {
+		t.Errorf("Got requests %v for the ConfigMap, Expected only %s", requests, nb.Name)
+	}
+	requests = r.notebooksReferencingConfig(true)(handler.MapObject{Meta: cm, Object: cm})
+	if len(requests) != 0 {
+		t.Errorf("Got requests %v for a Secret named like the ConfigMap, Expected none", requests)
+	}
+}
+
+func TestReconcileBackup(t *testing.T) {
+	newStoppedNotebook := func() *v1beta1.Notebook {
+		nb := newTestNotebook("test-notebook", "test-namespace")
+		nb.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Format(time.RFC3339)}
+		nb.Spec.BackupOnStop = &v1beta1.NotebookBackup{Destination: "s3:bucket/test-notebook", SecretName: "rclone"}
+		nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+			{Name: "workspace", MountPath: DefaultWorkspacePath},
+		}
+		nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace"},
+			},
+		}}
+		return nb
+	}
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "workspace", Namespace: "test-namespace"}}
+	reconcileNotebook := func(r *NotebookReconciler, nb *v1beta1.Notebook) (*v1beta1.Notebook, int32) {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		found := &v1beta1.Notebook{}
+		if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		sts := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return found, *sts.Spec.Replicas
+	}
+	getBackupReason := func(nb *v1beta1.Notebook) string {
+		for _, c := range nb.Status.Conditions {
+			if c.Type == BackupCondition {
+				return c.Reason
+			}
+		}
+		return ""
+	}
+	jobKey := types.NamespacedName{Name: "test-notebook-backup", Namespace: "test-namespace"}
+
+	os.Setenv("BACKUP_IMAGE", "rclone")
+	defer os.Unsetenv("BACKUP_IMAGE")
+
+	t.Run("backup completes", func(t *testing.T) {
+		nb := newStoppedNotebook()
+		r, _ := newTestReconciler(nb, pvc.DeepCopy())
+
+		found, replicas := reconcileNotebook(r, nb)
+		if reason := getBackupReason(found); reason != BackupRunning {
+			t.Errorf("Got Backup reason %q, Expected %q", reason, BackupRunning)
+		}
+		if replicas != 1 {
+			t.Errorf("Got %d replicas, Expected 1 while the backup runs", replicas)
+		}
+		job := &batchv1.Job{}
+		if err := r.Get(context.TODO(), jobKey, job); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		container := job.Spec.Template.Spec.Containers[0]
+		if container.Command[len(container.Command)-1] != "s3:bucket/test-notebook" {
+			t.Errorf("Got command %v, Expected to sync to the destination", container.Command)
+		}
+		if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef.Name != "rclone" {
+			t.Errorf("Got envFrom %+v, Expected the rclone Secret", container.EnvFrom)
+		}
+
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		if err := r.Status().Update(context.TODO(), job); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		found, replicas = reconcileNotebook(r, nb)
+		if reason := getBackupReason(found); reason != BackupCompleted {
+			t.Errorf("Got Backup reason %q, Expected %q", reason, BackupCompleted)
+		}
+		if replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 once the backup completed", replicas)
+		}
+
+		// Starting the notebook again cleans up for the next stop
+		delete(found.Annotations, culler.STOP_ANNOTATION)
+		if err := r.Update(context.TODO(), found); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		found, replicas = reconcileNotebook(r, nb)
+		if reason := getBackupReason(found); reason != "" {
+			t.Errorf("Got Backup reason %q, Expected the condition to be removed", reason)
+		}
+		if replicas != 1 {
+			t.Errorf("Got %d replicas, Expected 1 once started", replicas)
+		}
+		if err := r.Get(context.TODO(), jobKey, job); !apierrs.IsNotFound(err) {
+			t.Errorf("Expected the backup Job to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("backup fails", func(t *testing.T) {
+		nb := newStoppedNotebook()
+		job := generateBackupJob(nb, "rclone", "workspace")
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+		r, recorder := newTestReconciler(nb, job, pvc.DeepCopy())
+
+		found, replicas := reconcileNotebook(r, nb)
+		if reason := getBackupReason(found); reason != BackupFailed {
+			t.Errorf("Got Backup reason %q, Expected %q", reason, BackupFailed)
+		}
+		if replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 after a failed backup", replicas)
+		}
+		if len(recorder.Events) != 1 {
+			t.Errorf("Expected a warning event, got %d events", len(recorder.Events))
+		}
+	})
+
+	t.Run("backup image unset", func(t *testing.T) {
+		os.Unsetenv("BACKUP_IMAGE")
+		defer os.Setenv("BACKUP_IMAGE", "rclone")
+		nb := newStoppedNotebook()
+		r, _ := newTestReconciler(nb, pvc.DeepCopy())
+
+		found, replicas := reconcileNotebook(r, nb)
+		if reason := getBackupReason(found); reason != BackupNotConfigured {
+			t.Errorf("Got Backup reason %q, Expected %q", reason, BackupNotConfigured)
+		}
+		if replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 without a backup", replicas)
+		}
+	})
+}
+
+func TestReconcileVolumesStatus(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{
+		{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace-pvc"},
+			},
+		},
+		{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "pending-pvc"},
+			},
+		},
+		{
+			Name:         "config",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}},
+		},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "workspace-pvc", Namespace: nb.Namespace},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+		},
+	}
+	pendingPVC := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "pending-pvc", Namespace: nb.Namespace},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	}
+	r, _ := newTestReconciler(nb, pvc, pendingPVC)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	volumes := found.Status.Volumes
+	if len(volumes) != 2 {
+		t.Fatalf("Got volumes %+v, Expected the 2 PVCs", volumes)
+	}
+	if volumes[0].PVCName != "workspace-pvc" || volumes[0].Size == nil || volumes[0].Size.String() != "10Gi" {
+		t.Errorf("Got volume %+v, Expected workspace-pvc of 10Gi", volumes[0])
+	}
+	if volumes[1].PVCName != "pending-pvc" || volumes[1].Size != nil {
+		t.Errorf("Got volume %+v, Expected pending-pvc without a size", volumes[1])
+	}
+
+	changed, err := r.updateVolumesStatus(found)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if changed {
+		t.Errorf("Expected the volumes not to change")
+	}
+}
+
+func TestGenerateStatefulSetPodAnnotations(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	nb.Spec.PodAnnotations = map[string]string{"sidecar.istio.io/inject": "false"}
+	sts := generateStatefulSet(nb)
+	if got := sts.Spec.Template.ObjectMeta.Annotations["sidecar.istio.io/inject"]; got != "false" {
+		t.Errorf("Expected the pod annotation to be set, got %v", sts.Spec.Template.ObjectMeta.Annotations)
+	}
+}
+
+func TestReconcilePodAnnotations(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-pod-annotations")
+	nb.Spec.PodAnnotations = map[string]string{"first": "1", "second": "2"}
+	r, _ := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = "now"
+	if err := r.Update(context.TODO(), sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := r.Get(context.TODO(), req.NamespacedName, nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nb.Spec.PodAnnotations = map[string]string{"first": "changed"}
+	if err := r.Update(context.TODO(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts = &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{"first": "changed", "kubectl.kubernetes.io/restartedAt": "now"}
+	if !reflect.DeepEqual(sts.Spec.Template.Annotations, expected) {
+		t.Errorf("Got pod annotations %v, Expected %v", sts.Spec.Template.Annotations, expected)
+	}
+}
+
+func TestGenerateChildren(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+
+	nb := newTestNotebook("test-notebook", "default")
+	children, err := GenerateChildren(nb, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(children) != 3 {
+		t.Fatalf("Expected a StatefulSet, a Service and a VirtualService, got %v", children)
+	}
+	if _, ok := children[0].(*appsv1.StatefulSet); !ok {
+		t.Errorf("Expected a StatefulSet first, got %T", children[0])
+	}
+
+	nb.Spec.NetworkingMode = v1beta1.NetworkingModeNone
+	if children, err = GenerateChildren(nb, nil); err != nil || len(children) != 1 {
+		t.Errorf("Expected only the StatefulSet with the none networking mode, got %v, %v", children, err)
+	}
+
+	nb.Spec.Template.Spec.Containers = nil
+	if _, err := GenerateChildren(nb, nil); err == nil {
+		t.Errorf("Expected an error for a notebook without container")
+	}
+
+	// The containers may all come from the NotebookTemplate
+	nb.Spec.TemplateRef = &v1beta1.NotebookTemplateReference{Name: "approved"}
+	if _, err := GenerateChildren(nb, nil); err == nil {
+		t.Errorf("Expected an error for a notebook whose NotebookTemplate isn't given")
+	}
+	template := &v1beta1.NotebookTemplate{
+		ObjectMeta: v1.ObjectMeta{Name: "approved", Namespace: "default"},
+		Spec: v1beta1.NotebookTemplateDefinition{
+			Template: v1beta1.NotebookTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "notebook", Image: "approved-image"}},
+				},
+			},
+		},
+	}
+	children, err = GenerateChildren(nb, template)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image := children[0].(*appsv1.StatefulSet).Spec.Template.Spec.Containers[0].Image; image != "approved-image" {
+		t.Errorf("Got image %q, Expected the image of the NotebookTemplate", image)
+	}
+}
+
+func TestGenerateStatefulSetGPU(t *testing.T) {
+	os.Setenv("GPU_RESOURCES", `{"shared": {"resourceName": "nvidia.com/gpu.shared", `+
+		`"nodeSelector": {"nvidia.com/gpu.sharing-strategy": "time-slicing"}}}`)
+	defer os.Unsetenv("GPU_RESOURCES")
+
+	testCases := []struct {
+		name         string
+		gpu          *v1beta1.NotebookGPU
+		resourceName corev1.ResourceName
+		nodeSelector map[string]string
+	}{
+		{
+			name: "no GPU",
+		},
+		{
+			name:         "dedicated",
+			gpu:          &v1beta1.NotebookGPU{Count: 2},
+			resourceName: "nvidia.com/gpu",
+		},
+		{
+			name:         "shared",
+			gpu:          &v1beta1.NotebookGPU{Count: 1, Shared: true},
+			resourceName: "nvidia.com/gpu.shared",
+			nodeSelector: map[string]string{"nvidia.com/gpu.sharing-strategy": "time-slicing"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.GPU = c.gpu
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			limits := podSpec.Containers[0].Resources.Limits
+			if c.gpu == nil {
+				if len(limits) != 0 {
+					t.Errorf("Expected no limit, got %v", limits)
+				}
+				return
+			}
+			quantity := limits[c.resourceName]
+			if len(limits) != 1 || quantity.Value() != c.gpu.Count {
+				t.Errorf("Expected a limit of %d %s, got %v", c.gpu.Count, c.resourceName, limits)
+			}
+			if !reflect.DeepEqual(podSpec.NodeSelector, c.nodeSelector) {
+				t.Errorf("Got nodeSelector %v, Expected %v", podSpec.NodeSelector, c.nodeSelector)
+			}
+		})
+	}
+}
+
+func TestGetGPUResources(t *testing.T) {
+	defer os.Unsetenv("GPU_RESOURCES")
+	for _, value := range []string{"nvidia.com/gpu", `{"mig": {"resourceName": "nvidia.com/mig-1g.5gb"}}`, `{"shared": {}}`} {
+		os.Setenv("GPU_RESOURCES", value)
+		if err := validateGPUResources(); err == nil {
+			t.Errorf("Expected an error for GPU_RESOURCES %q", value)
+		}
+	}
+}
+
+func TestGenerateEgressNetworkPolicy(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	allowed := []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}}}
+	for _, peers := range [][]networkingv1.NetworkPolicyPeer{nil, allowed} {
+		policy := generateEgressNetworkPolicy(nb, peers)
+		if !reflect.DeepEqual(policy.Spec.PolicyTypes, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}) {
+			t.Errorf("Expected only the egress to be restricted, got %v", policy.Spec.PolicyTypes)
+		}
+		dns := policy.Spec.Egress[0]
+		if len(dns.To) != 0 || len(dns.Ports) != 2 || dns.Ports[0].Port.IntValue() != DNSPort ||
+			dns.Ports[1].Port.IntValue() != DNSPort {
+			t.Errorf("Expected the DNS to be allowed on UDP and TCP, got %+v", dns)
+		}
+		if len(peers) == 0 && len(policy.Spec.Egress) != 1 {
+			t.Errorf("Expected only the DNS to be allowed, got %+v", policy.Spec.Egress)
+		}
+		if len(peers) != 0 && !reflect.DeepEqual(policy.Spec.Egress[1].To, peers) {
+			t.Errorf("Expected the egress to %+v to be allowed, got %+v", peers, policy.Spec.Egress)
+		}
+	}
+}
+
+func TestGetEgressAllowlist(t *testing.T) {
+	defer os.Unsetenv("EGRESS_ALLOW_CIDRS")
+	defer os.Unsetenv("EGRESS_ALLOW_NAMESPACE_SELECTOR")
+
+	os.Setenv("EGRESS_ALLOW_CIDRS", "10.0.0.0/8, 192.168.1.0/24")
+	os.Setenv("EGRESS_ALLOW_NAMESPACE_SELECTOR", "egress=allowed")
+	peers, err := getEgressAllowlist()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(peers) != 3 || peers[1].IPBlock.CIDR != "192.168.1.0/24" ||
+		peers[2].NamespaceSelector.MatchLabels["egress"] != "allowed" {
+		t.Errorf("Got unexpected peers %+v", peers)
+	}
+
+	os.Setenv("EGRESS_ALLOW_CIDRS", "10.0.0.0")
+	if err := validateEgressConfig(); err == nil {
+		t.Errorf("Expected an error for an invalid CIDR")
+	}
+}
+
+func TestReconcileEgressNetworkPolicy(t *testing.T) {
+	os.Setenv("RESTRICT_EGRESS", "true")
+	defer os.Unsetenv("RESTRICT_EGRESS")
+
+	nb := newTestNotebook("test-notebook", "test-egress")
+	nb.UID = "test-uid"
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key := types.NamespacedName{Name: egressPolicyName(nb), Namespace: nb.Namespace}
+	policy := &networkingv1.NetworkPolicy{}
+	if err := r.Get(context.TODO(), key, policy); err != nil {
+		t.Fatalf("NetworkPolicy should be created, got %v", err)
+	}
+	if !v1.IsControlledBy(policy, nb) {
+		t.Errorf("Expected the NetworkPolicy to be owned by the Notebook, got %+v", policy.OwnerReferences)
+	}
+
+	// Adding a destination updates it
+	os.Setenv("EGRESS_ALLOW_CIDRS", "10.0.0.0/8")
+	defer os.Unsetenv("EGRESS_ALLOW_CIDRS")
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	policy = &networkingv1.NetworkPolicy{}
+	if err := r.Get(context.TODO(), key, policy); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(policy.Spec.Egress) != 2 {
+		t.Errorf("Expected the NetworkPolicy to be updated, got %+v", policy.Spec.Egress)
+	}
+
+	// Lifting the restriction deletes it
+	os.Unsetenv("RESTRICT_EGRESS")
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, policy); !apierrs.IsNotFound(err) {
+		t.Errorf("NetworkPolicy should be deleted, got %v", err)
+	}
+}
+
+func TestReconcilePVCResizing(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-pvc-resizing")
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name: "workspace",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace-pvc"},
+		},
+	}}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "workspace-pvc", Namespace: nb.Namespace},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+			Conditions: []corev1.PersistentVolumeClaimCondition{{
+				Type:   corev1.PersistentVolumeClaimResizing,
+				Status: corev1.ConditionTrue,
+			}},
+		},
+	}
+	r, recorder := newTestReconciler(nb, pvc)
+	getCondition := func(nb *v1beta1.Notebook) *v1beta1.NotebookCondition {
+		for i, c := range nb.Status.Conditions {
+			if c.Type == PVCResizingCondition {
+				return &nb.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	condition := getCondition(found)
+	if condition == nil || condition.Reason != "Resizing" || condition.Message != "PVC workspace-pvc: Resizing" {
+		t.Fatalf("Expected a Resizing %s condition, got %+v", PVCResizingCondition, found.Status.Conditions)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("Expected an event, got %d", len(recorder.Events))
+	}
+
+	// The condition is cleared once the resize completes
+	pvc.Status.Conditions = nil
+	pvc.Status.Capacity[corev1.ResourceStorage] = resource.MustParse("20Gi")
+	if err := r.Update(context.TODO(), pvc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c := getCondition(found); c != nil {
+		t.Errorf("Expected the %s condition to be removed, got %+v", PVCResizingCondition, c)
+	}
+	if size := found.Status.Volumes[0].Size; size == nil || size.String() != "20Gi" {
+		t.Errorf("Expected the new size to be reported, got %v", size)
+	}
+}
+
+func TestGetRequeueTime(t *testing.T) {
+	os.Setenv("CULLING_CHECK_PERIOD", "5")
+	defer os.Unsetenv("CULLING_CHECK_PERIOD")
+
+	readyPod := &corev1.Pod{Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+		Type:   corev1.PodReady,
+		Status: corev1.ConditionTrue,
+	}}}}
+	testCases := []struct {
+		name     string
+		state    corev1.ContainerState
+		pod      *corev1.Pod
+		expected time.Duration
+	}{
+		{
+			name:     "healthy",
+			state:    corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			pod:      readyPod,
+			expected: 5 * time.Minute,
+		},
+		{
+			name:     "crash looping",
+			state:    corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			pod:      &corev1.Pod{},
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "running but not ready",
+			state:    corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			pod:      &corev1.Pod{},
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "terminated",
+			state:    corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+			pod:      readyPod,
+			expected: 30 * time.Second,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Status.ContainerState = c.state
+			if got := getRequeueTime(nb, c.pod); got != c.expected {
+				t.Errorf("Got requeue time %v, Expected %v", got, c.expected)
+			}
+		})
+	}
+}
+
+// annotatedRecorder records the annotations of the events, which the
+// FakeRecorder drops.
+type annotatedRecorder struct {
+	record.FakeRecorder
+	annotations []map[string]string
+}
+
+func (r *annotatedRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.annotations = append(r.annotations, annotations)
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func TestReissueEvent(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	event := &corev1.Event{
+		ObjectMeta: v1.ObjectMeta{Name: "test-notebook-0.123", Namespace: nb.Namespace, UID: "event-uid"},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      "Pod",
+			Name:      "test-notebook-0",
+			Namespace: nb.Namespace,
+			UID:       "pod-uid",
+		},
+		Type:    corev1.EventTypeWarning,
+		Reason:  "BackOff",
+		Message: "Back-off restarting failed container",
+		Count:   1,
+	}
+	r, _ := newTestReconciler(nb)
+	recorder := &annotatedRecorder{FakeRecorder: *record.NewFakeRecorder(20)}
+	r.EventRecorder = recorder
+
+	r.reissueEvent(nb, event)
+	r.reissueEvent(nb, event)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected the event to be reissued once, got %d events", len(recorder.Events))
+	}
+	if message := <-recorder.Events; message != "Warning BackOff Reissued from pod/test-notebook-0: Back-off restarting failed container" {
+		t.Errorf("Got unexpected event %q", message)
+	}
+	expected := map[string]string{
+		SourceEventAnnotation: "test-notebook-0.123",
+		SourceKindAnnotation:  "Pod",
+		SourceNameAnnotation:  "test-notebook-0",
+		SourceUIDAnnotation:   "pod-uid",
+	}
+	if !reflect.DeepEqual(recorder.annotations[0], expected) {
+		t.Errorf("Got annotations %v, Expected %v", recorder.annotations[0], expected)
+	}
+
+	// A new occurrence of the event is reissued
+	event.Count = 2
+	r.reissueEvent(nb, event)
+	if len(recorder.Events) != 1 {
+		t.Errorf("Expected the new occurrence to be reissued, got %d events", len(recorder.Events))
+	}
+}
+
+func TestCullMode(t *testing.T) {
+	defer os.Unsetenv("CULL_MODE")
+
+	testCases := []struct {
+		mode             string
+		stopped          bool
+		expectedReplicas int32
+		expectedSelector map[string]string
+	}{
+		{
+			mode:             "",
+			stopped:          false,
+			expectedReplicas: 1,
+			expectedSelector: map[string]string{"statefulset": "test-notebook"},
+		},
+		{
+			mode:             CullModeScale,
+			stopped:          true,
+			expectedReplicas: 0,
+			expectedSelector: map[string]string{"statefulset": "test-notebook"},
+		},
+		{
+			mode:             CullModeDetach,
+			stopped:          false,
+			expectedReplicas: 1,
+			expectedSelector: map[string]string{"statefulset": "test-notebook"},
+		},
+		{
+			mode:             CullModeDetach,
+			stopped:          true,
+			expectedReplicas: 1,
+			expectedSelector: map[string]string{"statefulset": "test-notebook", DetachedLabel: "true"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("mode %q stopped %v", c.mode, c.stopped), func(t *testing.T) {
+			os.Setenv("CULL_MODE", c.mode)
+			nb := newTestNotebook("test-notebook", "default")
+			if c.stopped {
+				nb.Annotations = map[string]string{culler.STOP_ANNOTATION: "2020-01-01T00:00:00Z"}
+			}
+			if replicas := *generateStatefulSet(nb).Spec.Replicas; replicas != c.expectedReplicas {
+				t.Errorf("Got %d replicas, Expected %d", replicas, c.expectedReplicas)
+			}
+			if selector := generateService(nb).Spec.Selector; !reflect.DeepEqual(selector, c.expectedSelector) {
+				t.Errorf("Got Service selector %v, Expected %v", selector, c.expectedSelector)
+			}
+		})
+	}
+
+	os.Setenv("CULL_MODE", "suspend")
+	if err := validateCullMode(); err == nil {
+		t.Errorf("Expected an error for an invalid CULL_MODE")
+	}
+}
+
+func TestCullModeStopMethod(t *testing.T) {
+	defer os.Unsetenv("CULL_MODE")
+
+	testCases := []struct {
+		envMode      string
+		stopMethod   v1beta1.StopMethod
+		expectedMode string
+	}{
+		{envMode: "", stopMethod: "", expectedMode: CullModeScale},
+		{envMode: CullModeDetach, stopMethod: "", expectedMode: CullModeDetach},
+		{envMode: "", stopMethod: v1beta1.StopMethodDetach, expectedMode: CullModeDetach},
+		{envMode: CullModeDetach, stopMethod: v1beta1.StopMethodScaleToZero, expectedMode: CullModeScale},
+		{envMode: CullModeScale, stopMethod: v1beta1.StopMethodDetach, expectedMode: CullModeDetach},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("mode %q method %q", c.envMode, c.stopMethod), func(t *testing.T) {
+			os.Setenv("CULL_MODE", c.envMode)
+			nb := newTestNotebook("test-notebook", "default")
+			if c.stopMethod != "" {
+				nb.Spec.CullingPolicy = &v1beta1.NotebookCullingPolicy{StopMethod: c.stopMethod}
+			}
+			if mode := getCullMode(nb); mode != c.expectedMode {
+				t.Errorf("Got cull mode %q, Expected %q", mode, c.expectedMode)
+			}
+
+			nb.Annotations = map[string]string{culler.STOP_ANNOTATION: "2020-01-01T00:00:00Z"}
+			expectedReplicas := int32(0)
+			if c.expectedMode == CullModeDetach {
+				expectedReplicas = 1
+			}
+			if replicas := *generateStatefulSet(nb).Spec.Replicas; replicas != expectedReplicas {
+				t.Errorf("Got %d replicas, Expected %d", replicas, expectedReplicas)
+			}
+			_, detached := generateService(nb).Spec.Selector[DetachedLabel]
+			if detached != (c.expectedMode == CullModeDetach) {
+				t.Errorf("Got Service detached %v, Expected %v", detached, !detached)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetInitContainers(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	nb.Spec.HomeSubPath = "home"
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "workspace", MountPath: DefaultWorkspacePath}}
+	nb.Spec.Template.Spec.InitContainers = []corev1.Container{{Name: "template-init", Image: "busybox"}}
+	nb.Spec.InitContainers = []corev1.Container{
+		{Name: "clone", Image: "alpine/git"},
+		{
+			Name:         "download",
+			Image:        "curl",
+			WorkingDir:   "/data",
+			VolumeMounts: []corev1.VolumeMount{{Name: "workspace", MountPath: "/data"}},
+		},
+	}
+
+	initContainers := generateStatefulSet(nb).Spec.Template.Spec.InitContainers
+	names := []string{}
+	for _, c := range initContainers {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"clone", "download", "template-init"}) {
+		t.Fatalf("Got init containers %v, Expected the ones of the spec first", names)
+	}
+
+	expected := []corev1.VolumeMount{{Name: "workspace", MountPath: DefaultWorkspacePath, SubPath: "home"}}
+	if !reflect.DeepEqual(initContainers[0].VolumeMounts, expected) || initContainers[0].WorkingDir != DefaultWorkspacePath {
+		t.Errorf("Expected the workspace to be mounted like in the notebook container, got %+v", initContainers[0])
+	}
+	if len(initContainers[1].VolumeMounts) != 1 || initContainers[1].WorkingDir != "/data" {
+		t.Errorf("Expected the workspace mount of the container to be kept, got %+v", initContainers[1])
+	}
+	if len(initContainers[2].VolumeMounts) != 0 {
+		t.Errorf("Expected the init containers of the template to be left as is, got %+v", initContainers[2])
+	}
+	if len(nb.Spec.InitContainers[0].VolumeMounts) != 0 {
+		t.Errorf("Expected the Notebook not to be modified, got %+v", nb.Spec.InitContainers[0])
+	}
+}
+
+func TestCheckVirtualServiceCRD(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	if err := checkVirtualServiceCRD(mapper); err == nil || !strings.Contains(err.Error(), "isn't installed") {
+		t.Errorf("Expected an error as the CRD isn't installed, got %v", err)
+	}
+
+	mapper.Add(virtualServiceGVK(), meta.RESTScopeNamespace)
+	if err := checkVirtualServiceCRD(mapper); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestGenerateVirtualServiceAPIVersion(t *testing.T) {
+	defer os.Unsetenv("ISTIO_VS_API_VERSION")
+	nb := newTestNotebook("test-notebook", "default")
+
+	vsvc, err := generateVirtualService(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vsvc.GetAPIVersion() != "networking.istio.io/v1alpha3" {
+		t.Errorf("Got apiVersion %s, Expected the v1alpha3 default", vsvc.GetAPIVersion())
+	}
+
+	os.Setenv("ISTIO_VS_API_VERSION", "v1beta1")
+	vsvc, err = generateVirtualService(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vsvc.GetAPIVersion() != "networking.istio.io/v1beta1" || vsvc.GetKind() != "VirtualService" {
+		t.Errorf("Got %s %s, Expected a networking.istio.io/v1beta1 VirtualService", vsvc.GetAPIVersion(), vsvc.GetKind())
+	}
+	if err := validateRouting(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	os.Setenv("ISTIO_VS_API_VERSION", "v2")
+	if err := validateRouting(); err == nil {
+		t.Errorf("Expected an error for an unknown version")
+	}
+}
+
+func TestGenerateStatefulSetSchedulerName(t *testing.T) {
+	tests := []struct {
+		name              string
+		specScheduler     string
+		templateScheduler string
+		defaultScheduler  string
+		expectedScheduler string
+	}{
+		{
+			name:              "unset",
+			expectedScheduler: "",
+		},
+		{
+			name:              "spec field",
+			specScheduler:     "volcano",
+			templateScheduler: "default-scheduler",
+			expectedScheduler: "volcano",
+		},
+		{
+			name:              "pod template",
+			templateScheduler: "default-scheduler",
+			defaultScheduler:  "volcano",
+			expectedScheduler: "default-scheduler",
+		},
+		{
+			name:              "default",
+			defaultScheduler:  "volcano",
+			expectedScheduler: "volcano",
+		},
+	}
+	defer os.Unsetenv("DEFAULT_SCHEDULER_NAME")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("DEFAULT_SCHEDULER_NAME", test.defaultScheduler)
+			nb := newTestNotebook("test-notebook", "test-namespace")
+			nb.Spec.SchedulerName = test.specScheduler
+			nb.Spec.Template.Spec.SchedulerName = test.templateScheduler
+
+			sts := generateStatefulSet(nb)
+			if scheduler := sts.Spec.Template.Spec.SchedulerName; scheduler != test.expectedScheduler {
+				t.Errorf("Got schedulerName %q, Expected %q", scheduler, test.expectedScheduler)
+			}
+		})
+	}
+}
+
+func TestReconcileRestartedNotebook(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-restart")
+	nb.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Format(time.RFC3339)}
+	r, _ := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !culler.StopAnnotationIsSet(sts.ObjectMeta) {
+		t.Errorf("Expected the stop annotation on the StatefulSet, got %v", sts.Annotations)
+	}
+
+	// The user starts the Notebook again
+	nb = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(nb.Annotations, culler.STOP_ANNOTATION)
+	if err := r.Update(context.TODO(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nb = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := nb.Annotations[culler.LAST_STARTED_ANNOTATION]; !ok {
+		t.Errorf("Expected the last started annotation on the Notebook, got %v", nb.Annotations)
+	}
+	sts = &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if culler.StopAnnotationIsSet(sts.ObjectMeta) || *sts.Spec.Replicas != 1 {
+		t.Errorf("Expected the StatefulSet to be started, got %v replicas and %v", *sts.Spec.Replicas, sts.Annotations)
+	}
+}
+
+func TestNotebookKind(t *testing.T) {
+	os.Setenv("NOTEBOOK_KINDS", `{"jupyter": {"image": "jupyter/scipy-notebook"}, `+
+		`"rstudio": {"image": "rocker/rstudio", "servingPort": 8787}}`)
+	defer os.Unsetenv("NOTEBOOK_KINDS")
+
+	testCases := []struct {
+		name  string
+		kind  string
+		image string
+		ports []corev1.ContainerPort
+		// The expected image and port
+		expectedImage string
+		expectedPort  int32
+	}{
+		{
+			name:          "no kind",
+			image:         "custom",
+			expectedImage: "custom",
+			expectedPort:  DefaultContainerPort,
+		},
+		{
+			name:          "image of the kind",
+			kind:          "jupyter",
+			expectedImage: "jupyter/scipy-notebook",
+			expectedPort:  DefaultContainerPort,
+		},
+		{
+			name:          "image and port of the kind",
+			kind:          "rstudio",
+			expectedImage: "rocker/rstudio",
+			expectedPort:  8787,
+		},
+		{
+			name:          "explicit image and port",
+			kind:          "rstudio",
+			image:         "custom",
+			ports:         []corev1.ContainerPort{{ContainerPort: 8080}},
+			expectedImage: "custom",
+			expectedPort:  8080,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.Kind = c.kind
+			nb.Spec.Template.Spec.Containers[0].Image = c.image
+			nb.Spec.Template.Spec.Containers[0].Ports = c.ports
+
+			container := generateStatefulSet(nb).Spec.Template.Spec.Containers[0]
+			if container.Image != c.expectedImage {
+				t.Errorf("Got image %q, Expected %q", container.Image, c.expectedImage)
+			}
+			if port := container.Ports[0].ContainerPort; port != c.expectedPort {
+				t.Errorf("Got container port %d, Expected %d", port, c.expectedPort)
+			}
+			if port := generateService(nb).Spec.Ports[0].TargetPort.IntVal; port != c.expectedPort {
+				t.Errorf("Got target port %d, Expected %d", port, c.expectedPort)
+			}
+		})
+	}
+}
+
+func TestReconcileUnknownKind(t *testing.T) {
+	os.Setenv("NOTEBOOK_KINDS", `{"jupyter": {"image": "jupyter/scipy-notebook"}}`)
+	defer os.Unsetenv("NOTEBOOK_KINDS")
+
+	nb := newTestNotebook("test-notebook", "test-unknown-kind")
+	nb.Spec.Kind = "vscode"
+	r, recorder := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `Warning UnknownKind unknown kind "vscode" of notebook test-unknown-kind/test-notebook, the known kinds are: jupyter`
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("Got event %q, Expected %q", event, expected)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected no StatefulSet for an unknown kind, got %v", err)
+	}
+	if _, err := GenerateChildren(nb, nil); err == nil {
+		t.Errorf("Expected an error generating the children of an unknown kind")
+	}
+
+	for _, value := range []string{"jupyter", `{"jupyter": {}}`, `{"jupyter": {"image": "jupyter", "servingPort": 70000}}`} {
+		os.Setenv("NOTEBOOK_KINDS", value)
+		if err := validateNotebookKinds(); err == nil {
+			t.Errorf("Expected an error for NOTEBOOK_KINDS %q", value)
+		}
+	}
+}
+
+func TestReconcileNoContainers(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-no-containers")
+	nb.Spec.Template.Spec.Containers = []corev1.Container{}
+	r, recorder := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	_, err := r.Reconcile(req)
+	expected := "notebook test-no-containers/test-notebook has no container in its pod template"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Got error %v, Expected %q", err, expected)
+	}
+	if event := <-recorder.Events; event != "Warning NoContainers "+expected {
+		t.Errorf("Got event %q, Expected a NoContainers event", event)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &appsv1.StatefulSet{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected no StatefulSet without containers, got %v", err)
+	}
+	if port := generateService(nb).Spec.Ports[0].TargetPort.IntVal; port != DefaultContainerPort {
+		t.Errorf("Got target port %d, Expected %d", port, DefaultContainerPort)
+	}
+}
+
+func TestGenerateStatefulSetDefaultResources(t *testing.T) {
+	os.Setenv("DEFAULT_RESOURCES", `{"requests": {"cpu": "500m", "memory": "1Gi"}, "limits": {"cpu": "2", "memory": "2Gi"}}`)
+	os.Setenv("DEFAULT_GPU_RESOURCES", `{"requests": {"cpu": "4"}, "limits": {"memory": "32Gi"}}`)
+	defer os.Unsetenv("DEFAULT_RESOURCES")
+	defer os.Unsetenv("DEFAULT_GPU_RESOURCES")
+
+	testCases := []struct {
+		name      string
+		gpu       *v1beta1.NotebookGPU
+		resources corev1.ResourceRequirements
+		expected  corev1.ResourceRequirements
+	}{
+		{
+			name: "defaults",
+			expected: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("500m"), "memory": resource.MustParse("1Gi")},
+				Limits:   corev1.ResourceList{"cpu": resource.MustParse("2"), "memory": resource.MustParse("2Gi")},
+			},
+		},
+		{
+			name: "user resources win",
+			resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("4")},
+				Limits:   corev1.ResourceList{"memory": resource.MustParse("512Mi")},
+			},
+			expected: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("4")},
+				Limits:   corev1.ResourceList{"memory": resource.MustParse("512Mi")},
+			},
+		},
+		{
+			name: "merged with the user resources",
+			resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("1")},
+			},
+			expected: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1Gi")},
+				Limits:   corev1.ResourceList{"memory": resource.MustParse("2Gi")},
+			},
+		},
+		{
+			name: "GPU defaults",
+			gpu:  &v1beta1.NotebookGPU{Count: 1},
+			expected: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{"cpu": resource.MustParse("4")},
+				Limits:   corev1.ResourceList{"memory": resource.MustParse("32Gi"), "nvidia.com/gpu": resource.MustParse("1")},
+			},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.GPU = c.gpu
+			nb.Spec.Template.Spec.Containers[0].Resources = c.resources
+			resources := generateStatefulSet(nb).Spec.Template.Spec.Containers[0].Resources
+			if !apiequality.Semantic.DeepEqual(resources, c.expected) {
+				t.Errorf("Got resources %v, Expected %v", resources, c.expected)
+			}
+		})
+	}
+
+	os.Setenv("DEFAULT_RESOURCES", `{"requests": {"cpu": "2"}, "limits": {"cpu": "1"}}`)
+	if err := validateDefaultResources(); err == nil {
+		t.Errorf("Expected an error for a default request higher than the limit")
+	}
+}
+
+// failingVirtualServiceClient fails to read the VirtualServices, like an
+// unavailable Istio API, while failing is set.
+type failingVirtualServiceClient struct {
+	client.Client
+	failing bool
+}
+
+func (c *failingVirtualServiceClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if u, ok := obj.(*unstructured.Unstructured); ok && c.failing && u.GetKind() == "VirtualService" {
+		return apierrs.NewServiceUnavailable("the Istio API is unavailable")
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestReconcileNetworkingDegraded(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+
+	nb := newTestNotebook("test-notebook", "test-networking-degraded")
+	r, recorder := newTestReconciler(nb)
+	failingClient := &failingVirtualServiceClient{Client: r.Client, failing: true}
+	r.Client = failingClient
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("A VirtualService failure shouldn't fail the reconcile, got %v", err)
+	}
+	if result.RequeueAfter != getUnhealthyRequeuePeriod() {
+		t.Errorf("Got requeue after %v, Expected %v", result.RequeueAfter, getUnhealthyRequeuePeriod())
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &appsv1.StatefulSet{}); err != nil {
+		t.Errorf("Expected the StatefulSet to be reconciled, got %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&found.Status, NetworkingDegradedCondition) {
+		t.Errorf("Expected the %s condition, got %v", NetworkingDegradedCondition, found.Status.Conditions)
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning "+NetworkingDegradedCondition) {
+		t.Errorf("Got event %q, Expected a %s event", event, NetworkingDegradedCondition)
+	}
+
+	failingClient.failing = false
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&found.Status, NetworkingDegradedCondition) {
+		t.Errorf("The %s condition should be removed once the VirtualService is reconciled", NetworkingDegradedCondition)
+	}
+}
+
+func TestReconcileImageStatus(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-image-status")
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "test-notebook-0",
+			Namespace: nb.Namespace,
+			Labels:    map[string]string{"statefulset": nb.Name},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "istio-proxy", Image: "istio/proxyv2:1.4", ImageID: "docker-pullable://istio/proxyv2@sha256:1111"},
+				{Name: nb.Name, Image: "jupyter:latest", ImageID: "docker-pullable://jupyter@sha256:2222"},
+			},
+		},
+	}
+	r, _ := newTestReconciler(nb, pod)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found.Status.ContainerImage != "jupyter:latest" || found.Status.ImageID != "docker-pullable://jupyter@sha256:2222" {
+		t.Errorf("Got image %q and imageID %q, Expected the ones of the notebook container",
+			found.Status.ContainerImage, found.Status.ImageID)
+	}
+	if updateImageStatus(found, nb.Name, pod) {
+		t.Errorf("Expected the image status not to change")
+	}
+}
+
+func TestGenerateSidecar(t *testing.T) {
+	testCases := []struct {
+		namespace string
+		gateway   string
+		hosts     []string
+	}{
+		{namespace: "test-namespace", hosts: []string{"./*", "kubeflow/*"}},
+		{namespace: "test-namespace", gateway: "istio-system/ingressgateway", hosts: []string{"./*", "istio-system/*"}},
+		{namespace: "kubeflow", hosts: []string{"./*"}},
+	}
+	defer os.Unsetenv("ISTIO_GATEWAY")
+	for _, c := range testCases {
+		os.Setenv("ISTIO_GATEWAY", c.gateway)
+		sidecar, err := generateSidecar(newTestNotebook("test-notebook", c.namespace))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sidecar.GetKind() != "Sidecar" || sidecar.GetAPIVersion() != "networking.istio.io/v1alpha3" {
+			t.Errorf("Got %s %s, Expected a networking.istio.io/v1alpha3 Sidecar", sidecar.GetAPIVersion(), sidecar.GetKind())
+		}
+		selector, _, _ := unstructured.NestedStringMap(sidecar.Object, "spec", "workloadSelector", "labels")
+		if !reflect.DeepEqual(selector, map[string]string{"statefulset": "test-notebook"}) {
+			t.Errorf("Got workloadSelector %v, Expected the pod of the notebook", selector)
+		}
+		egress, _, _ := unstructured.NestedSlice(sidecar.Object, "spec", "egress")
+		hosts, _, _ := unstructured.NestedStringSlice(egress[0].(map[string]interface{}), "hosts")
+		if !reflect.DeepEqual(hosts, c.hosts) {
+			t.Errorf("Namespace %s and gateway %q: got egress hosts %v, Expected %v", c.namespace, c.gateway, hosts, c.hosts)
+		}
+	}
+}
+
+func TestReconcileSidecar(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	os.Setenv("ISTIO_SIDECAR", "true")
+	defer os.Unsetenv("USE_ISTIO")
+	defer os.Unsetenv("ISTIO_SIDECAR")
+
+	nb := newTestNotebook("test-notebook", "test-sidecar")
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(sidecarGVK())
+	if err := r.Get(context.TODO(), req.NamespacedName, sidecar); err != nil {
+		t.Fatalf("Expected the Sidecar to be created, got %v", err)
+	}
+	if owner := sidecar.GetOwnerReferences(); len(owner) != 1 || owner[0].Name != nb.Name {
+		t.Errorf("Expected the Sidecar to be owned by the notebook, got %v", owner)
+	}
+
+	os.Unsetenv("ISTIO_SIDECAR")
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sidecar = &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(sidecarGVK())
+	if err := r.Get(context.TODO(), req.NamespacedName, sidecar); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the Sidecar to be deleted once ISTIO_SIDECAR is unset, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetReplicasAnnotation(t *testing.T) {
+	stopped := time.Now().Format(time.RFC3339)
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		replicas    int32
+	}{
+		{name: "default", replicas: 1},
+		{name: "stopped", annotations: map[string]string{culler.STOP_ANNOTATION: stopped}, replicas: 0},
+		{name: "explicit", annotations: map[string]string{ReplicasAnnotation: "3"}, replicas: 3},
+		{name: "explicit zero", annotations: map[string]string{ReplicasAnnotation: "0"}, replicas: 0},
+		{
+			name:        "explicit overrides the stop annotation",
+			annotations: map[string]string{ReplicasAnnotation: "2", culler.STOP_ANNOTATION: stopped},
+			replicas:    2,
+		},
+		{name: "invalid", annotations: map[string]string{ReplicasAnnotation: "-1"}, replicas: 1},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Annotations = c.annotations
+			if replicas := *generateStatefulSet(nb).Spec.Replicas; replicas != c.replicas {
+				t.Errorf("Got %d replicas, Expected %d", replicas, c.replicas)
+			}
+		})
+	}
+}
+
+func TestReconcileTTL(t *testing.T) {
+	ttl := int64(3600)
+
+	// Not expired yet, requeued at the deadline
+	nb := newTestNotebook("test-notebook", "test-ttl")
+	nb.CreationTimestamp = v1.NewTime(time.Now().Add(-30 * time.Minute))
+	nb.Spec.TTLSeconds = &ttl
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &v1beta1.Notebook{}); err != nil {
+		t.Errorf("Expected the notebook to be kept before its deadline, got %v", err)
+	}
+	if result.RequeueAfter < 30*time.Minute || result.RequeueAfter > 31*time.Minute {
+		t.Errorf("Got requeue after %v, Expected the deadline in about 30m", result.RequeueAfter)
+	}
+
+	// Within the clock skew margin
+	nb = newTestNotebook("test-notebook", "test-ttl")
+	nb.CreationTimestamp = v1.NewTime(time.Now().Add(-time.Hour - TTLClockSkew/2))
+	nb.Spec.TTLSeconds = &ttl
+	r, _ = newTestReconciler(nb)
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &v1beta1.Notebook{}); err != nil {
+		t.Errorf("Expected the notebook to be kept within the clock skew margin, got %v", err)
+	}
+
+	// Expired
+	nb = newTestNotebook("test-notebook", "test-ttl")
+	nb.CreationTimestamp = v1.NewTime(time.Now().Add(-2 * time.Hour))
+	nb.Spec.TTLSeconds = &ttl
+	r, recorder := newTestReconciler(nb)
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &v1beta1.Notebook{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the expired notebook to be deleted, got %v", err)
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal Expired") {
+		t.Errorf("Got event %q, Expected an Expired event", event)
+	}
+}
+
+func TestGenerateStatefulSetPostStartCommand(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	if lifecycle := generateStatefulSet(nb).Spec.Template.Spec.Containers[0].Lifecycle; lifecycle != nil {
+		t.Errorf("Expected no lifecycle hook, got %v", lifecycle)
+	}
+
+	preStop := &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"save.sh"}}}
+	nb.Spec.Template.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{PreStop: preStop}
+	nb.Spec.PostStartCommand = []string{"/bin/sh", "-c", "register.sh"}
+	lifecycle := generateStatefulSet(nb).Spec.Template.Spec.Containers[0].Lifecycle
+	if lifecycle == nil || lifecycle.PostStart == nil || lifecycle.PostStart.Exec == nil ||
+		!reflect.DeepEqual(lifecycle.PostStart.Exec.Command, nb.Spec.PostStartCommand) {
+		t.Fatalf("Got lifecycle %+v, Expected the postStart command %v", lifecycle, nb.Spec.PostStartCommand)
+	}
+	if !reflect.DeepEqual(lifecycle.PreStop, preStop) {
+		t.Errorf("Got preStop hook %+v, Expected the one of the template", lifecycle.PreStop)
+	}
+}
+
+func TestReconcileActivityService(t *testing.T) {
+	os.Setenv("ACTIVITY_SERVICE", "true")
+	defer os.Unsetenv("ACTIVITY_SERVICE")
+
+	nb := newTestNotebook("test-notebook", "test-activity")
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	name := types.NamespacedName{Name: "test-notebook-activity", Namespace: nb.Namespace}
+	service := &corev1.Service{}
+	if err := r.Get(context.TODO(), name, service); err != nil {
+		t.Fatalf("Expected the activity Service to be created, got %v", err)
+	}
+	if owner := service.OwnerReferences; len(owner) != 1 || owner[0].Name != nb.Name {
+		t.Errorf("Expected the activity Service to be owned by the notebook, got %v", owner)
+	}
+	if ports := service.Spec.Ports; len(ports) != 1 || ports[0].Name != "activity" ||
+		ports[0].TargetPort.IntValue() != int(DefaultContainerPort) {
+		t.Errorf("Got ports %+v, Expected a single activity port to the notebook container", ports)
+	}
+	if selector := service.Spec.Selector; !reflect.DeepEqual(selector, map[string]string{"statefulset": nb.Name}) {
+		t.Errorf("Got selector %v, Expected the notebook pod", selector)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, &corev1.Service{}); err != nil {
+		t.Errorf("Expected the main Service to be created too, got %v", err)
+	}
+	if activityServiceName(nb) != name.Name {
+		t.Errorf("Expected the culler to query the activity Service, got %s", activityServiceName(nb))
+	}
+
+	os.Unsetenv("ACTIVITY_SERVICE")
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), name, &corev1.Service{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the activity Service to be deleted once ACTIVITY_SERVICE is unset, got %v", err)
+	}
+}
+
+func TestGenerateStatefulSetDefaultSecurityContext(t *testing.T) {
+	os.Setenv("DEFAULT_SECURITY_CONTEXT",
+		`{"runAsNonRoot": true, "allowPrivilegeEscalation": false, "capabilities": {"drop": ["ALL"]}}`)
+	defer os.Unsetenv("DEFAULT_SECURITY_CONTEXT")
+	if err := validateDefaultSecurityContext(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	yes, no := true, false
+	dropAll := &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+
+	testCases := []struct {
+		name     string
+		pod      *corev1.PodSecurityContext
+		user     *corev1.SecurityContext
+		expected *corev1.SecurityContext
+	}{
+		{
+			name:     "defaults",
+			expected: &corev1.SecurityContext{RunAsNonRoot: &yes, AllowPrivilegeEscalation: &no, Capabilities: dropAll},
+		},
+		{
+			name: "user override",
+			user: &corev1.SecurityContext{RunAsNonRoot: &no, Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}}},
+			expected: &corev1.SecurityContext{
+				RunAsNonRoot:             &no,
+				AllowPrivilegeEscalation: &no,
+				Capabilities:             &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}},
+			},
+		},
+		{
+			name:     "privileged",
+			user:     &corev1.SecurityContext{Privileged: &yes},
+			expected: &corev1.SecurityContext{Privileged: &yes, RunAsNonRoot: &yes, Capabilities: dropAll},
+		},
+		{
+			name:     "pod securityContext",
+			pod:      &corev1.PodSecurityContext{RunAsNonRoot: &no},
+			expected: &corev1.SecurityContext{AllowPrivilegeEscalation: &no, Capabilities: dropAll},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.Template.Spec.SecurityContext = c.pod
+			nb.Spec.Template.Spec.Containers[0].SecurityContext = c.user
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+			if sc := podSpec.Containers[0].SecurityContext; !apiequality.Semantic.DeepEqual(sc, c.expected) {
+				t.Errorf("Got securityContext %+v, Expected %+v", sc, c.expected)
+			}
+			// The defaults compose with the fsGroup of the pod
+			if c.pod == nil && (podSpec.SecurityContext == nil || podSpec.SecurityContext.FSGroup == nil) {
+				t.Errorf("Expected the default fsGroup to be set, got %+v", podSpec.SecurityContext)
+			}
+		})
+	}
+
+	os.Setenv("DEFAULT_SECURITY_CONTEXT", `{"privileged": true, "allowPrivilegeEscalation": false}`)
+	if err := validateDefaultSecurityContext(); err == nil {
+		t.Errorf("Expected an error for a privileged default without privilege escalation")
+	}
+}
+
+func TestUpdateStoppedCondition(t *testing.T) {
+	stopped := time.Now().Format(time.RFC3339)
+	testCases := []struct {
+		name          string
+		annotations   map[string]string
+		readyReplicas int32
+		cullMode      string
+		reason        string
+	}{
+		{name: "running", readyReplicas: 1},
+		{
+			name:        "culled",
+			annotations: map[string]string{culler.STOP_ANNOTATION: stopped, culler.STOP_REASON_ANNOTATION: culler.STOP_REASON_CULLED},
+			reason:      StoppedReasonCulled,
+		},
+		{
+			name:        "scheduled",
+			annotations: map[string]string{culler.STOP_ANNOTATION: stopped, culler.STOP_REASON_ANNOTATION: culler.STOP_REASON_SCHEDULED},
+			reason:      StoppedReasonScheduled,
+		},
+		{
+			name:        "manual",
+			annotations: map[string]string{culler.STOP_ANNOTATION: stopped},
+			reason:      StoppedReasonManual,
+		},
+		{
+			name:          "stopping",
+			annotations:   map[string]string{culler.STOP_ANNOTATION: stopped},
+			readyReplicas: 1,
+		},
+		{
+			name:          "detached",
+			annotations:   map[string]string{culler.STOP_ANNOTATION: stopped},
+			readyReplicas: 1,
+			cullMode:      CullModeDetach,
+			reason:        StoppedReasonManual,
+		},
+		{
+			name:        "explicit replicas",
+			annotations: map[string]string{culler.STOP_ANNOTATION: stopped, ReplicasAnnotation: "1"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("CULL_MODE", c.cullMode)
+			defer os.Unsetenv("CULL_MODE")
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Annotations = c.annotations
+			nb.Status.ReadyReplicas = c.readyReplicas
+			// A leftover condition is removed when the notebook isn't stopped
+			setNotebookCondition(&nb.Status, v1beta1.NotebookCondition{Type: StoppedCondition, Reason: "Previous"})
+
+			updateStoppedCondition(nb)
+			reason := ""
+			for _, condition := range nb.Status.Conditions {
+				if condition.Type == StoppedCondition {
+					reason = condition.Reason
+				}
+			}
+			if reason != c.reason {
+				t.Errorf("Got Stopped condition reason %q, Expected %q", reason, c.reason)
+			}
+			if updateStoppedCondition(nb) {
+				t.Errorf("Expected the conditions not to change on a second update")
+			}
+		})
+	}
+}
+
+func TestReconcileStoppedCondition(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-stopped")
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Culled by the controller
+	instance := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.cullNotebook(instance, culler.CullingDecision{Cull: true, Reason: "idle"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&instance.Status, StoppedCondition) ||
+		instance.Status.Conditions[len(instance.Status.Conditions)-1].Reason != StoppedReasonCulled {
+		t.Errorf("Expected a Stopped condition with reason %s, got %+v", StoppedReasonCulled, instance.Status.Conditions)
+	}
+
+	// Started again
+	culler.RemoveStopAnnotation(&instance.ObjectMeta)
+	if _, ok := instance.Annotations[culler.STOP_REASON_ANNOTATION]; ok {
+		t.Errorf("Expected the stop reason to be removed when the notebook is started")
+	}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&instance.Status, StoppedCondition) {
+		t.Errorf("Expected the Stopped condition to be removed, got %+v", instance.Status.Conditions)
+	}
+}
+
+func TestAddFSGroupPlatform(t *testing.T) {
+	defer func() { detectedPlatform = PlatformKubernetes }()
+	defer os.Unsetenv("PLATFORM")
+	defer os.Unsetenv("ADD_FSGROUP")
+
+	hasFSGroup := func() bool {
+		sc := generateStatefulSet(newTestNotebook("test-notebook", "default")).Spec.Template.Spec.SecurityContext
+		return sc != nil && sc.FSGroup != nil && *sc.FSGroup == DefaultFSGroup
+	}
+
+	// Vanilla Kubernetes
+	mapper := meta.NewDefaultRESTMapper(nil)
+	if err := detectPlatform(mapper); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getPlatform() != PlatformKubernetes || !hasFSGroup() {
+		t.Errorf("Expected the default fsGroup on %s", getPlatform())
+	}
+
+	// OpenShift, detected from the SecurityContextConstraints API
+	mapper.Add(sccGVK, meta.RESTScopeRoot)
+	if err := detectPlatform(mapper); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getPlatform() != PlatformOpenShift || hasFSGroup() {
+		t.Errorf("Expected no fsGroup on %s", getPlatform())
+	}
+	os.Setenv("ADD_FSGROUP", "true")
+	if !hasFSGroup() {
+		t.Errorf("Expected ADD_FSGROUP=true to set the fsGroup on OpenShift")
+	}
+	os.Unsetenv("ADD_FSGROUP")
+
+	// PLATFORM takes precedence over the detection
+	os.Setenv("PLATFORM", PlatformKubernetes)
+	if err := detectPlatform(mapper); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasFSGroup() {
+		t.Errorf("Expected the default fsGroup with PLATFORM=kubernetes")
+	}
+	os.Setenv("ADD_FSGROUP", "false")
+	if hasFSGroup() {
+		t.Errorf("Expected ADD_FSGROUP=false to suppress the fsGroup")
+	}
+	os.Unsetenv("ADD_FSGROUP")
+	detectedPlatform = PlatformKubernetes
+	os.Setenv("PLATFORM", PlatformOpenShift)
+	if hasFSGroup() {
+		t.Errorf("Expected no fsGroup with PLATFORM=openshift")
+	}
+
+	os.Setenv("PLATFORM", "gke")
+	if err := validatePlatform(); err == nil {
+		t.Errorf("Expected an error for an unknown platform")
+	}
+}
+
+func TestGenerateStatefulSetMetricsSidecar(t *testing.T) {
+	defer os.Unsetenv("METRICS_SIDECAR_IMAGE")
+	nb := newTestNotebook("test-notebook", "default")
+	nb.Spec.MetricsSidecar = true
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{
+		{Name: "workspace", VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace-pvc"},
+		}},
+		{Name: "config", VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}},
+		}},
+	}
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "workspace", MountPath: "/home/jovyan"},
+		{Name: "config", MountPath: "/etc/config"},
+	}
+
+	// Without an image, the sidecar isn't added
+	if containers := generateStatefulSet(nb).Spec.Template.Spec.Containers; len(containers) != 1 {
+		t.Errorf("Expected no sidecar without METRICS_SIDECAR_IMAGE, got %d containers", len(containers))
+	}
+
+	os.Setenv("METRICS_SIDECAR_IMAGE", "notebook-metrics:v1")
+	template := generateStatefulSet(nb).Spec.Template
+	containers := template.Spec.Containers
+	if len(containers) != 2 || containers[1].Name != MetricsSidecarName || containers[1].Image != "notebook-metrics:v1" {
+		t.Fatalf("Expected the metrics sidecar to be added, got %+v", containers)
+	}
+	expectedMounts := []corev1.VolumeMount{{Name: "workspace", MountPath: "/home/jovyan", ReadOnly: true}}
+	if !reflect.DeepEqual(containers[1].VolumeMounts, expectedMounts) {
+		t.Errorf("Got mounts %+v, Expected the PVCs mounted read-only %+v", containers[1].VolumeMounts, expectedMounts)
+	}
+	expectedEnv := []corev1.EnvVar{
+		{Name: "VOLUME_PATHS", Value: "/home/jovyan"},
+		{Name: "NOTEBOOK_URL", Value: "http://localhost:8888/notebook/default/test-notebook"},
+	}
+	if !reflect.DeepEqual(containers[1].Env, expectedEnv) {
+		t.Errorf("Got env %+v, Expected %+v", containers[1].Env, expectedEnv)
+	}
+	if template.Annotations["prometheus.io/scrape"] != "true" || template.Annotations["prometheus.io/port"] != "9100" {
+		t.Errorf("Expected the pod to be annotated for scraping, got %v", template.Annotations)
+	}
+	if containers[0].VolumeMounts[0].ReadOnly {
+		t.Errorf("Expected the mounts of the notebook container to be left alone")
+	}
+
+	nb.Spec.MetricsSidecar = false
+	if containers := generateStatefulSet(nb).Spec.Template.Spec.Containers; len(containers) != 1 {
+		t.Errorf("Expected no sidecar when disabled, got %d containers", len(containers))
+	}
+}
+
+func TestConcurrentMaintenanceCreatesOneJob(t *testing.T) {
+	os.Setenv("BACKUP_IMAGE", "rclone")
+	defer os.Unsetenv("BACKUP_IMAGE")
+
+	nb := newTestNotebook("test-notebook", "test-maintenance")
+	nb.Annotations = map[string]string{culler.STOP_ANNOTATION: time.Now().Format(time.RFC3339)}
+	nb.Spec.BackupOnStop = &v1beta1.NotebookBackup{Destination: "s3:bucket/test-notebook", SecretName: "rclone"}
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "workspace", MountPath: DefaultWorkspacePath},
+	}
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+		Name: "workspace",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace"},
+		},
+	}}
+	r, _ := newTestReconciler(nb)
+
+	// Concurrent reconciles of the same notebook, e.g. with
+	// MAX_CONCURRENT_RECONCILES > 1, each with their own copy of it
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.reconcileMaintenance(nb.DeepCopy())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := r.List(context.TODO(), jobs, client.InNamespace(nb.Namespace)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(jobs.Items) != 1 {
+		t.Errorf("Expected a single backup Job, got %d", len(jobs.Items))
+	}
+	if len(r.maintenanceLocks.locks) != 0 {
+		t.Errorf("Expected the locks to be released, got %v", r.maintenanceLocks.locks)
+	}
+}
+
+// recordingNotifier records the events it is notified of, and fails if err
+// is set.
+type recordingNotifier struct {
+	events []notify.Event
+	err    error
+}
+
+func (n *recordingNotifier) Notify(event notify.Event) error {
+	n.events = append(n.events, event)
+	return n.err
+}
+
+func TestNotifyCullAndStart(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-notify")
+	nb.Annotations = map[string]string{CreatorAnnotation: "user@example.com"}
+	r, _ := newTestReconciler(nb)
+	notifier := &recordingNotifier{}
+	r.Notifier = notifier
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(notifier.events) != 0 {
+		t.Errorf("Expected no notification on creation, got %+v", notifier.events)
+	}
+
+	instance := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.cullNotebook(instance, culler.CullingDecision{Cull: true, Reason: "no activity"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventCulled ||
+		notifier.events[0].Reason != "no activity" || notifier.events[0].Owner != "user@example.com" ||
+		notifier.events[0].Namespace != nb.Namespace || notifier.events[0].Name != nb.Name {
+		t.Fatalf("Expected a culled notification, got %+v", notifier.events)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A failing notifier doesn't block starting the notebook again
+	notifier.err = fmt.Errorf("webhook unavailable")
+	instance = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(instance.Annotations, culler.STOP_ANNOTATION)
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(notifier.events) != 2 || notifier.events[1].Type != notify.EventStarted {
+		t.Errorf("Expected a started notification, got %+v", notifier.events)
+	}
+}
+
+func TestReconcileAccessToken(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-token")
+	nb.Spec.GenerateAccessToken = true
+	r, recorder := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	secretKey := types.NamespacedName{Name: "test-notebook-access-token", Namespace: nb.Namespace}
+	getToken := func() string {
+		secret := &corev1.Secret{}
+		if err := r.Get(context.TODO(), secretKey, secret); err != nil {
+			t.Fatalf("Expected the access token Secret, got %v", err)
+		}
+		if owner := secret.OwnerReferences; len(owner) != 1 || owner[0].Name != nb.Name {
+			t.Errorf("Expected the Secret to be owned by the notebook, got %v", owner)
+		}
+		return string(secret.Data[AccessTokenKey])
+	}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	token := getToken()
+	if len(token) != 64 {
+		t.Errorf("Expected a 32 bytes hex token, got %q", token)
+	}
+	instance := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if instance.Status.AccessTokenSecret != secretKey.Name {
+		t.Errorf("Got accessTokenSecret %q, Expected %q", instance.Status.AccessTokenSecret, secretKey.Name)
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	container := sts.Spec.Template.Spec.Containers[0]
+	if !hasVolumeMount(&container, AccessTokenPath) {
+		t.Errorf("Expected the token to be mounted at %s, got %+v", AccessTokenPath, container.VolumeMounts)
+	}
+	foundEnv := false
+	for _, env := range container.Env {
+		if env.Name == AccessTokenEnvVar && env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil &&
+			env.ValueFrom.SecretKeyRef.Name == secretKey.Name {
+			foundEnv = true
+		}
+	}
+	if !foundEnv {
+		t.Errorf("Expected the %s env var from the Secret, got %+v", AccessTokenEnvVar, container.Env)
+	}
+
+	// The token is kept across reconciles
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getToken() != token {
+		t.Errorf("Expected the token to be kept")
+	}
+
+	// Rotated on demand, once per value of the annotation
+	instance = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance.Annotations = map[string]string{RotateAccessTokenAnnotation: "2020-01-01T00:00:00Z"}
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rotated := getToken()
+	if rotated == token {
+		t.Errorf("Expected the token to be rotated")
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getToken() != rotated {
+		t.Errorf("Expected the token to be rotated once per annotation value")
+	}
+	rotations := 0
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, "AccessTokenRotated") {
+			rotations++
+		}
+	}
+	if rotations != 1 {
+		t.Errorf("Expected a single AccessTokenRotated event, got %d", rotations)
+	}
+
+	// Deleted once disabled
+	instance = &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance.Spec.GenerateAccessToken = false
+	if err := r.Update(context.TODO(), instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), secretKey, &corev1.Secret{}); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the Secret to be deleted, got %v", err)
+	}
+}
+
+func TestGenerateVirtualServiceStripPathPrefix(t *testing.T) {
+	getRewrite := func(nb *v1beta1.Notebook) (string, string) {
+		vsvc, err := generateVirtualService(nb)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+		route := http[0].(map[string]interface{})
+		match, _, _ := unstructured.NestedSlice(route, "match")
+		prefix, _, _ := unstructured.NestedString(match[0].(map[string]interface{}), "uri", "prefix")
+		rewrite, _, _ := unstructured.NestedString(route, "rewrite", "uri")
+		return prefix, rewrite
+	}
+
+	nb := newTestNotebook("test-notebook", "default")
+	if prefix, rewrite := getRewrite(nb); prefix != "/notebook/default/test-notebook/" || rewrite != prefix {
+		t.Errorf("Got prefix %q rewritten to %q, Expected the prefix to be kept", prefix, rewrite)
+	}
+	if message := prefixConflict(nb); message != "" {
+		t.Errorf("Expected no conflict without stripPathPrefix, got %q", message)
+	}
+
+	nb.Spec.StripPathPrefix = true
+	if prefix, rewrite := getRewrite(nb); prefix != "/notebook/default/test-notebook/" || rewrite != "/" {
+		t.Errorf("Got prefix %q rewritten to %q, Expected it to be rewritten to /", prefix, rewrite)
+	}
+
+	// The NB_PREFIX injected by the controller conflicts with the rewrite
+	if message := prefixConflict(nb); !strings.Contains(message, "/notebook/default/test-notebook") {
+		t.Errorf("Expected a conflict with the injected NB_PREFIX, got %q", message)
+	}
+	nb.Annotations = map[string]string{NoNbPrefixAnnotation: "true"}
+	if message := prefixConflict(nb); message != "" {
+		t.Errorf("Expected no conflict without NB_PREFIX, got %q", message)
+	}
+	nb.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "NB_PREFIX", Value: "/custom"}}
+	if message := prefixConflict(nb); !strings.Contains(message, "/custom") {
+		t.Errorf("Expected a conflict with the NB_PREFIX of the template, got %q", message)
+	}
+}
+
+func TestReconcilePrefixConflict(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-prefix")
+	nb.Spec.StripPathPrefix = true
+	r, recorder := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	instance := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&instance.Status, PrefixConflictCondition) {
+		t.Errorf("Expected a %s condition, got %+v", PrefixConflictCondition, instance.Status.Conditions)
+	}
+	warnings := 0
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, PrefixConflictCondition) {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("Expected a single %s event, got %d", PrefixConflictCondition, warnings)
+	}
+}
+
+func TestGenerateVirtualServiceMirror(t *testing.T) {
+	generate := func(nb *v1beta1.Notebook) *unstructured.Unstructured {
+		vsvc, err := generateVirtualService(nb)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return vsvc
+	}
+	getRoute := func(nb *v1beta1.Notebook) map[string]interface{} {
+		http, _, _ := unstructured.NestedSlice(generate(nb).Object, "spec", "http")
+		return http[0].(map[string]interface{})
+	}
+
+	nb := newTestNotebook("test-notebook", "default")
+	route := getRoute(nb)
+	if _, ok := route["mirror"]; ok {
+		t.Errorf("Expected no mirror by default, got %v", route["mirror"])
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		mirror      map[string]interface{}
+		percentage  interface{}
+	}{
+		{
+			name:        "host",
+			annotations: map[string]string{MirrorHostAnnotation: "collector.debug.svc.cluster.local"},
+			mirror:      map[string]interface{}{"host": "collector.debug.svc.cluster.local"},
+		},
+		{
+			name: "host and port, percentage",
+			annotations: map[string]string{
+				MirrorHostAnnotation:       "collector.debug.svc.cluster.local:8080",
+				MirrorPercentageAnnotation: "12.5",
+			},
+			mirror: map[string]interface{}{
+				"host": "collector.debug.svc.cluster.local",
+				"port": map[string]interface{}{"number": int64(8080)},
+			},
+			percentage: map[string]interface{}{"value": 12.5},
+		},
+		{
+			name: "invalid percentage",
+			annotations: map[string]string{
+				MirrorHostAnnotation:       "collector",
+				MirrorPercentageAnnotation: "150",
+			},
+			mirror: map[string]interface{}{"host": "collector"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Annotations = c.annotations
+			route := getRoute(nb)
+			if !reflect.DeepEqual(route["mirror"], c.mirror) {
+				t.Errorf("Got mirror %v, Expected %v", route["mirror"], c.mirror)
+			}
+			if !reflect.DeepEqual(route["mirrorPercentage"], c.percentage) {
+				t.Errorf("Got mirrorPercentage %v, Expected %v", route["mirrorPercentage"], c.percentage)
+			}
+		})
+	}
+
+	// Changing the mirror updates the existing VirtualService
+	found := generate(nb)
+	nb.Annotations = map[string]string{MirrorHostAnnotation: "collector"}
+	if !reconcilehelper.CopyVirtualService(generate(nb), found) {
+		t.Errorf("Expected the VirtualService to be updated with the mirror")
+	}
+	nb.Annotations = nil
+	if !reconcilehelper.CopyVirtualService(generate(nb), found) {
+		t.Errorf("Expected the mirror to be removed from the VirtualService")
+	}
+}
+
+func TestReconcileWorkspaceRestore(t *testing.T) {
+	newNotebook := func() *v1beta1.Notebook {
+		nb := newTestNotebook("restored", "test-namespace")
+		nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+			{Name: "workspace", MountPath: DefaultWorkspacePath},
+		}
+		nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "restored-workspace"},
+			},
+		}}
+		nb.Spec.WorkspaceFrom = &v1beta1.WorkspaceSource{SnapshotName: "nightly"}
+		return nb
+	}
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "nightly", "namespace": "test-namespace"},
+		"status": map[string]interface{}{
+			"readyToUse":                     true,
+			"restoreSize":                    "5Gi",
+			"boundVolumeSnapshotContentName": "snapcontent-nightly",
+		},
+	}}
+	snapshot.SetGroupVersionKind(snapshotGVK("VolumeSnapshot"))
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "snapcontent-nightly"},
+		"spec":     map[string]interface{}{"driver": "ebs.csi.aws.com"},
+	}}
+	content.SetGroupVersionKind(snapshotGVK("VolumeSnapshotContent"))
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "gp3",
+			Annotations: map[string]string{defaultStorageClassAnnotation: "true"},
+		},
+		Provisioner: "ebs.csi.aws.com",
+	}
+
+	getRestoreReason := func(r *NotebookReconciler, nb *v1beta1.Notebook) string {
+		found := &v1beta1.Notebook{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, found); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, c := range found.Status.Conditions {
+			if c.Type == WorkspaceRestoreCondition {
+				return c.Reason
+			}
+		}
+		return ""
+	}
+	getReplicas := func(r *NotebookReconciler, nb *v1beta1.Notebook) int32 {
+		sts := &appsv1.StatefulSet{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}, sts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return *sts.Spec.Replicas
+	}
+
+	t.Run("snapshot not found", func(t *testing.T) {
+		nb := newNotebook()
+		r, recorder := newTestReconciler(nb, storageClass)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getRestoreReason(r, nb); reason != RestoreSnapshotNotFound {
+			t.Errorf("Got WorkspaceRestore reason %v, Expected %v", reason, RestoreSnapshotNotFound)
+		}
+		if replicas := getReplicas(r, nb); replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 until the workspace is restored", replicas)
+		}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: "restored-workspace", Namespace: nb.Namespace}, &corev1.PersistentVolumeClaim{})
+		if !apierrs.IsNotFound(err) {
+			t.Errorf("Expected no PVC without the snapshot, got %v", err)
+		}
+		found := false
+		for len(recorder.Events) > 0 {
+			if strings.Contains(<-recorder.Events, WorkspaceRestoreCondition+RestoreSnapshotNotFound) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a %s event", WorkspaceRestoreCondition+RestoreSnapshotNotFound)
+		}
+	})
+
+	t.Run("storage class unsupported", func(t *testing.T) {
+		nb := newNotebook()
+		nfsClass := "nfs"
+		nb.Spec.WorkspaceFrom.StorageClassName = &nfsClass
+		nfs := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "nfs"}, Provisioner: "nfs.csi.k8s.io"}
+		r, _ := newTestReconciler(nb, snapshot.DeepCopy(), content.DeepCopy(), storageClass, nfs)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getRestoreReason(r, nb); reason != RestoreStorageClassUnsupported {
+			t.Errorf("Got WorkspaceRestore reason %v, Expected %v", reason, RestoreStorageClassUnsupported)
+		}
+	})
+
+	t.Run("workspace storage class", func(t *testing.T) {
+		nb := newNotebook()
+		className := "io2"
+		nb.Spec.WorkspaceStorageClass = &className
+		io2 := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "io2"}, Provisioner: "ebs.csi.aws.com"}
+		r, _ := newTestReconciler(nb, snapshot.DeepCopy(), content.DeepCopy(), storageClass, io2)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "restored-workspace", Namespace: nb.Namespace}, pvc); err != nil {
+			t.Fatalf("Workspace PVC should be created, got %v", err)
+		}
+		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "io2" {
+			t.Errorf("Got PVC StorageClass %v, Expected io2", pvc.Spec.StorageClassName)
+		}
+	})
+
+	t.Run("restore completes", func(t *testing.T) {
+		nb := newNotebook()
+		r, _ := newTestReconciler(nb, snapshot.DeepCopy(), content.DeepCopy(), storageClass)
+
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: "restored-workspace", Namespace: nb.Namespace}, pvc); err != nil {
+			t.Fatalf("Workspace PVC should be created, got %v", err)
+		}
+		dataSource := pvc.Spec.DataSource
+		if dataSource == nil || dataSource.APIGroup == nil || *dataSource.APIGroup != "snapshot.storage.k8s.io" ||
+			dataSource.Kind != "VolumeSnapshot" || dataSource.Name != "nightly" {
+			t.Errorf("Got PVC dataSource %+v, Expected VolumeSnapshot nightly", dataSource)
+		}
+		if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != "5Gi" {
+			t.Errorf("Got PVC size %v, Expected the restoreSize 5Gi", size.String())
+		}
+		if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "gp3" {
+			t.Errorf("Got PVC StorageClass %v, Expected the default one gp3", pvc.Spec.StorageClassName)
+		}
+		if reason := getRestoreReason(r, nb); reason != RestoreRestoring {
+			t.Errorf("Got WorkspaceRestore reason %v, Expected %v", reason, RestoreRestoring)
+		}
+		if replicas := getReplicas(r, nb); replicas != 0 {
+			t.Errorf("Got %d replicas, Expected 0 until the PVC is bound", replicas)
+		}
+
+		pvc.Status.Phase = corev1.ClaimBound
+		if err := r.Status().Update(context.TODO(), pvc); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := r.Reconcile(req); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reason := getRestoreReason(r, nb); reason != RestoreCompleted {
+			t.Errorf("Got WorkspaceRestore reason %v, Expected %v", reason, RestoreCompleted)
+		}
+		if replicas := getReplicas(r, nb); replicas != 1 {
+			t.Errorf("Got %d replicas, Expected 1 once the PVC is bound", replicas)
+		}
+	})
+}
+
+func TestGenerateStatefulSetDefaultNodeAffinity(t *testing.T) {
+	os.Setenv("DEFAULT_NODE_AFFINITY", `{"matchExpressions": [{"key": "workload", "operator": "In", "values": ["notebook"]}]}`)
+	defer os.Unsetenv("DEFAULT_NODE_AFFINITY")
+	defer os.Unsetenv("DEFAULT_NODE_AFFINITY_MODE")
+	if err := validateDefaultNodeAffinity(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	term := corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+		{Key: "workload", Operator: corev1.NodeSelectorOpIn, Values: []string{"notebook"}},
+	}}
+	userAffinity := &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: "gpu", Operator: corev1.NodeSelectorOpExists},
+			}}},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		mode     string
+		affinity *corev1.Affinity
+		nodeName string
+		expected *corev1.NodeAffinity
+	}{
+		{
+			name: "preferred",
+			expected: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 100, Preference: term}},
+			},
+		},
+		{
+			name: "required",
+			mode: NodeAffinityRequired,
+			expected: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term}},
+			},
+		},
+		{
+			name:     "user node affinity",
+			affinity: &corev1.Affinity{NodeAffinity: userAffinity},
+			expected: userAffinity,
+		},
+		{
+			name:     "user pod anti-affinity",
+			affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{}},
+			expected: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 100, Preference: term}},
+			},
+		},
+		{
+			name:     "pinned to a node",
+			nodeName: "node-1",
+			expected: nil,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("DEFAULT_NODE_AFFINITY_MODE", c.mode)
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.Template.Spec.Affinity = c.affinity
+			if c.nodeName != "" {
+				nb.Annotations = map[string]string{NodeNameAnnotation: c.nodeName}
+			}
+			var nodeAffinity *corev1.NodeAffinity
+			if affinity := generateStatefulSet(nb).Spec.Template.Spec.Affinity; affinity != nil {
+				nodeAffinity = affinity.NodeAffinity
+			}
+			if !reflect.DeepEqual(nodeAffinity, c.expected) {
+				t.Errorf("Got node affinity %+v, Expected %+v", nodeAffinity, c.expected)
+			}
+		})
+	}
+
+	os.Setenv("DEFAULT_NODE_AFFINITY_MODE", "hard")
+	if err := validateDefaultNodeAffinity(); err == nil {
+		t.Errorf("Expected an error for an invalid DEFAULT_NODE_AFFINITY_MODE")
+	}
+}
+
+func TestGenerateVirtualServiceTrailingSlashRedirect(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	vsvc, err := generateVirtualService(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	if len(http) != 2 {
+		t.Fatalf("Got %d routes, Expected the notebook route and the redirect one", len(http))
+	}
+	expected := map[string]interface{}{
+		"match": []interface{}{
+			map[string]interface{}{
+				"uri": map[string]interface{}{"exact": "/notebook/test-namespace/test-notebook"},
+			},
+		},
+		"redirect": map[string]interface{}{
+			"uri":          "/notebook/test-namespace/test-notebook/",
+			"redirectCode": int64(301),
+		},
+	}
+	if !reflect.DeepEqual(http[1], expected) {
+		t.Errorf("Got redirect route %v, Expected %v", http[1], expected)
+	}
+
+	// A VirtualService created before the redirect is updated with it, once
+	found := vsvc.DeepCopy()
+	if err := unstructured.SetNestedSlice(found.Object, http[:1], "spec", "http"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reconcilehelper.CopyVirtualService(vsvc, found) {
+		t.Errorf("Expected the VirtualService without the redirect route to be updated")
+	}
+	if foundHTTP, _, _ := unstructured.NestedSlice(found.Object, "spec", "http"); !reflect.DeepEqual(foundHTTP, http) {
+		t.Errorf("Got routes %v, Expected %v", foundHTTP, http)
+	}
+	if reconcilehelper.CopyVirtualService(vsvc, found) {
+		t.Errorf("Expected no update of an up to date VirtualService")
+	}
+
+	nb.Annotations = map[string]string{TrailingSlashRedirectAnnotation: "false"}
+	vsvc, err = generateVirtualService(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http"); len(http) != 1 {
+		t.Errorf("Got %d routes, Expected no redirect route when it is disabled", len(http))
+	}
+}
+
+func TestGenerateStatefulSetDefaultPodAntiAffinity(t *testing.T) {
+	defer os.Unsetenv("POD_ANTI_AFFINITY")
+	expected := &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+			Weight: 100,
+			PodAffinityTerm: corev1.PodAffinityTerm{
+				LabelSelector: &v1.LabelSelector{MatchExpressions: []v1.LabelSelectorRequirement{
+					{Key: "notebook-name", Operator: v1.LabelSelectorOpExists},
+				}},
+				TopologyKey: "kubernetes.io/hostname",
+			},
+		}},
+	}
+	userAntiAffinity := &corev1.PodAntiAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+			LabelSelector: &v1.LabelSelector{MatchLabels: map[string]string{"app": "spark"}},
+			TopologyKey:   "kubernetes.io/hostname",
+		}},
+	}
+
+	testCases := []struct {
+		name        string
+		topologyKey string
+		annotations map[string]string
+		affinity    *corev1.Affinity
+		expected    *corev1.PodAntiAffinity
+	}{
+		{
+			name:     "disabled",
+			expected: nil,
+		},
+		{
+			name:        "injected",
+			topologyKey: "kubernetes.io/hostname",
+			expected:    expected,
+		},
+		{
+			name:        "user pod anti-affinity",
+			topologyKey: "kubernetes.io/hostname",
+			affinity:    &corev1.Affinity{PodAntiAffinity: userAntiAffinity},
+			expected:    userAntiAffinity,
+		},
+		{
+			name:        "user node affinity",
+			topologyKey: "kubernetes.io/hostname",
+			affinity:    &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{}},
+			expected:    expected,
+		},
+		{
+			name:        "opted out",
+			topologyKey: "kubernetes.io/hostname",
+			annotations: map[string]string{PodAntiAffinityAnnotation: "false"},
+			expected:    nil,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("POD_ANTI_AFFINITY", c.topologyKey)
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Annotations = c.annotations
+			nb.Spec.Template.Spec.Affinity = c.affinity
+			var antiAffinity *corev1.PodAntiAffinity
+			if affinity := generateStatefulSet(nb).Spec.Template.Spec.Affinity; affinity != nil {
+				antiAffinity = affinity.PodAntiAffinity
+			}
+			if !reflect.DeepEqual(antiAffinity, c.expected) {
+				t.Errorf("Got pod anti-affinity %+v, Expected %+v", antiAffinity, c.expected)
+			}
+		})
+	}
+
+	os.Setenv("POD_ANTI_AFFINITY", "not a label key")
+	if err := validatePodAntiAffinity(); err == nil {
+		t.Errorf("Expected an error for an invalid POD_ANTI_AFFINITY")
+	}
+}
+
+func TestRequiredAPIs(t *testing.T) {
+	defer os.Unsetenv("USE_ISTIO")
+	defer os.Unsetenv("ISTIO_SIDECAR")
+	r, _ := newTestReconciler()
+	notebookGVK := v1beta1.GroupVersion.WithKind("Notebook")
+
+	if gvks := r.RequiredAPIs(); !reflect.DeepEqual(gvks, []schema.GroupVersionKind{notebookGVK}) {
+		t.Errorf("Got %v, Expected only the Notebook API without Istio", gvks)
+	}
+	os.Setenv("USE_ISTIO", "true")
+	os.Setenv("ISTIO_SIDECAR", "true")
+	expected := []schema.GroupVersionKind{notebookGVK, virtualServiceGVK(), sidecarGVK()}
+	if gvks := r.RequiredAPIs(); !reflect.DeepEqual(gvks, expected) {
+		t.Errorf("Got %v, Expected %v", gvks, expected)
+	}
+}
+
+func TestGenerateStatefulSetDefaultCommand(t *testing.T) {
+	os.Setenv("DEFAULT_NOTEBOOK_COMMAND", `["start-notebook.sh"]`)
+	os.Setenv("DEFAULT_NOTEBOOK_ARGS", `["--ServerApp.base_url=$(NB_PREFIX)"]`)
+	os.Setenv("NOTEBOOK_KINDS", `{"rstudio": {"image": "rocker/rstudio", "command": ["/init"]}, "jupyter": {"image": "jupyter/base-notebook"}}`)
+	defer os.Unsetenv("DEFAULT_NOTEBOOK_COMMAND")
+	defer os.Unsetenv("DEFAULT_NOTEBOOK_ARGS")
+	defer os.Unsetenv("NOTEBOOK_KINDS")
+	if err := ValidateConfig(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name            string
+		kind            string
+		command         []string
+		args            []string
+		expectedCommand []string
+		expectedArgs    []string
+	}{
+		{
+			name:            "defaults",
+			expectedCommand: []string{"start-notebook.sh"},
+			expectedArgs:    []string{"--ServerApp.base_url=$(NB_PREFIX)"},
+		},
+		{
+			name:            "kind without command",
+			kind:            "jupyter",
+			expectedCommand: []string{"start-notebook.sh"},
+			expectedArgs:    []string{"--ServerApp.base_url=$(NB_PREFIX)"},
+		},
+		{
+			name:            "kind command",
+			kind:            "rstudio",
+			expectedCommand: []string{"/init"},
+		},
+		{
+			name:            "user command",
+			command:         []string{"jupyter", "lab"},
+			expectedCommand: []string{"jupyter", "lab"},
+		},
+		{
+			name:         "user args",
+			args:         []string{"--debug"},
+			expectedArgs: []string{"--debug"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.Kind = c.kind
+			nb.Spec.Template.Spec.Containers[0].Command = c.command
+			nb.Spec.Template.Spec.Containers[0].Args = c.args
+			container := generateStatefulSet(nb).Spec.Template.Spec.Containers[0]
+			if !reflect.DeepEqual(container.Command, c.expectedCommand) {
+				t.Errorf("Got command %q, Expected %q", container.Command, c.expectedCommand)
+			}
+			if !reflect.DeepEqual(container.Args, c.expectedArgs) {
+				t.Errorf("Got args %q, Expected %q", container.Args, c.expectedArgs)
+			}
+			// The args refer to NB_PREFIX, which must stay set on the container
+			hasPrefix := false
+			for _, env := range container.Env {
+				hasPrefix = hasPrefix || env.Name == "NB_PREFIX"
+			}
+			if !hasPrefix {
+				t.Errorf("Expected the NB_PREFIX env var to be set, got %v", container.Env)
+			}
+		})
+	}
+
+	os.Setenv("DEFAULT_NOTEBOOK_ARGS", "--debug")
+	if err := validateDefaultCommand(); err == nil {
+		t.Errorf("Expected an error for an invalid DEFAULT_NOTEBOOK_ARGS")
+	}
+}
+
+func TestUpdateLastActivityUser(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	if updateLastActivityUser(nb) || nb.Status.LastActivityUser != "" || nb.Status.LastActivityTime != nil {
+		t.Errorf("Expected no change without the annotation, got %+v", nb.Status)
+	}
+
+	nb.Annotations = map[string]string{
+		LastActivityUserAnnotation: "alice@example.com",
+		LastActivityTimeAnnotation: "2020-01-01T10:00:00.5Z",
+	}
+	if !updateLastActivityUser(nb) {
+		t.Errorf("Expected the status to change")
+	}
+	expectedTime := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	if nb.Status.LastActivityUser != "alice@example.com" || nb.Status.LastActivityTime == nil ||
+		!nb.Status.LastActivityTime.Time.Equal(expectedTime) {
+		t.Errorf("Got user %q at %v, Expected alice@example.com at %v",
+			nb.Status.LastActivityUser, nb.Status.LastActivityTime, expectedTime)
+	}
+	if updateLastActivityUser(nb) {
+		t.Errorf("Expected no change when the annotations didn't change")
+	}
+
+	nb.Annotations[LastActivityUserAnnotation] = "bob@example.com"
+	nb.Annotations[LastActivityTimeAnnotation] = "yesterday"
+	if !updateLastActivityUser(nb) || nb.Status.LastActivityUser != "bob@example.com" || nb.Status.LastActivityTime != nil {
+		t.Errorf("Expected bob@example.com at an unknown time, got %q at %v",
+			nb.Status.LastActivityUser, nb.Status.LastActivityTime)
+	}
+
+	delete(nb.Annotations, LastActivityUserAnnotation)
+	if updateLastActivityUser(nb) || nb.Status.LastActivityUser != "bob@example.com" {
+		t.Errorf("Expected the last user to be kept once the annotation is removed, got %q", nb.Status.LastActivityUser)
+	}
+}
+
+func TestGenerateServicePortName(t *testing.T) {
+	defer os.Unsetenv("USE_ISTIO")
+	defer os.Unsetenv("SERVICE_PORT_NAME")
+
+	testCases := []struct {
+		name         string
+		useIstio     string
+		portName     string
+		expectedName string
+	}{
+		{
+			name:         "istio",
+			useIstio:     "true",
+			expectedName: "http-test-notebook",
+		},
+		{
+			name:         "no istio",
+			expectedName: "http",
+		},
+		{
+			name:         "configured name with istio",
+			useIstio:     "true",
+			portName:     "http-notebook",
+			expectedName: "http-notebook",
+		},
+		{
+			name:         "configured name without istio",
+			portName:     "web",
+			expectedName: "web",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("USE_ISTIO", c.useIstio)
+			os.Setenv("SERVICE_PORT_NAME", c.portName)
+			if err := validateServicePortName(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			nb := newTestNotebook("test-notebook", "default")
+			if name := generateService(nb).Spec.Ports[0].Name; name != c.expectedName {
+				t.Errorf("Got port name %q, Expected %q", name, c.expectedName)
+			}
+		})
+	}
+
+	os.Setenv("SERVICE_PORT_NAME", "HTTP_Port")
+	if err := validateServicePortName(); err == nil {
+		t.Errorf("Expected an error for an invalid SERVICE_PORT_NAME")
+	}
+}
+
+// recordingLogger records the messages of the logs it emits, only the V(0)
+// ones like a logger of the default verbosity.
+type recordingLogger struct {
+	messages *[]string
+	disabled bool
+}
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	if !l.disabled {
+		*l.messages = append(*l.messages, msg)
+	}
+}
+
+func (l *recordingLogger) Enabled() bool {
+	return !l.disabled
+}
+
+func (l *recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	*l.messages = append(*l.messages, msg)
+}
+
+func (l *recordingLogger) V(level int) logr.InfoLogger {
+	return &recordingLogger{messages: l.messages, disabled: l.disabled || level > 0}
+}
+
+func (l *recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return l
+}
+
+func (l *recordingLogger) WithName(name string) logr.Logger {
+	return l
+}
+
+func TestReconcileLogLevel(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	debugNb := newTestNotebook("debug-notebook", "test-namespace")
+	debugNb.Annotations = map[string]string{LogLevelAnnotation: "debug"}
+	r, _ := newTestReconciler(nb, debugNb)
+
+	testCases := []struct {
+		name            string
+		notebook        *v1beta1.Notebook
+		expectedVerbose bool
+	}{
+		{
+			name:     "default log level",
+			notebook: nb,
+		},
+		{
+			name:            "debug log level",
+			notebook:        debugNb,
+			expectedVerbose: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			messages := []string{}
+			r.Log = &recordingLogger{messages: &messages}
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: c.notebook.Name, Namespace: c.notebook.Namespace}}
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			verbose := false
+			for _, m := range messages {
+				verbose = verbose || m == "Reconciling Notebook"
+			}
+			if verbose != c.expectedVerbose {
+				t.Errorf("Got verbose logs %v, Expected %v: %q", verbose, c.expectedVerbose, messages)
+			}
+			if len(messages) == 0 {
+				t.Errorf("Expected the default logs to be emitted")
+			}
+		})
+	}
+
+	for value, expected := range map[string]int{"debug": 1, "3": 3, "info": 0, "-1": 0, "": 0} {
+		debugNb.Annotations[LogLevelAnnotation] = value
+		if verbosity := getLogVerbosity(debugNb); verbosity != expected {
+			t.Errorf("Got verbosity %d for %q, Expected %d", verbosity, value, expected)
+		}
+	}
+}
+
+func TestReconcileCullDryRun(t *testing.T) {
+	for k, v := range map[string]string{
+		"ENABLE_CULLING":          "true",
+		"CULL_CPU_IDLE_THRESHOLD": "50m",
+		"CULL_IDLENESS_LOGIC":     "or",
+		"CULL_DRY_RUN":            "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	nb := newTestNotebook("test-notebook", "test-cull-dry-run")
+	nb.CreationTimestamp = v1.NewTime(time.Now().Add(-72 * time.Hour))
+	nb.Annotations = map[string]string{
+		culler.CPU_IDLE_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      nb.Name + "-0",
+			Namespace: nb.Namespace,
+			Labels:    map[string]string{"statefulset": nb.Name},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	r, recorder := newTestReconciler(nb, pod)
+	dryRuns := testutil.ToFloat64(testMetrics.NotebookCullingDryRunCount.WithLabelValues(nb.Namespace, nb.Name))
+	culls := testutil.ToFloat64(testMetrics.NotebookCullingCount.WithLabelValues(nb.Namespace, nb.Name))
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Errorf("Expected the Notebook to be checked again")
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if culler.StopAnnotationIsSet(found.ObjectMeta) {
+		t.Errorf("The stop annotation should not be set with CULL_DRY_RUN")
+	}
+	if inc := testutil.ToFloat64(testMetrics.NotebookCullingDryRunCount.WithLabelValues(nb.Namespace, nb.Name)) - dryRuns; inc != 1 {
+		t.Errorf("Got NotebookCullingDryRunCount increment %v, Expected 1", inc)
+	}
+	if inc := testutil.ToFloat64(testMetrics.NotebookCullingCount.WithLabelValues(nb.Namespace, nb.Name)) - culls; inc != 0 {
+		t.Errorf("Got NotebookCullingCount increment %v, Expected 0", inc)
+	}
+	dryRunEvent := false
+	for len(recorder.Events) > 0 {
+		event := <-recorder.Events
+		dryRunEvent = dryRunEvent || (strings.Contains(event, "CullDryRun") && strings.Contains(event, "idle for 48h0m0s"))
+	}
+	if !dryRunEvent {
+		t.Errorf("Expected a CullDryRun event with the idle time")
+	}
+}
+
+func TestReconcileCullCheckThrottled(t *testing.T) {
+	os.Setenv("ENABLE_CULLING", "true")
+	defer os.Unsetenv("ENABLE_CULLING")
+	nb := newTestNotebook("test-notebook", "test-cull-check")
+	// A Notebook started again is checked without polling its server
+	nb.Annotations = map[string]string{
+		culler.LAST_STARTED_ANNOTATION: time.Now().Format(time.RFC3339),
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      nb.Name + "-0",
+			Namespace: nb.Namespace,
+			Labels:    map[string]string{"statefulset": nb.Name},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	r, _ := newTestReconciler(nb, pod)
+	updates := 0
+	r.Client = &statusCountingClient{Client: r.Client, updates: &updates}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found.Status.LastCullCheck == nil || found.Status.CullReason == "" {
+		t.Fatalf("Expected the culling check to be recorded, got %+v", found.Status)
+	}
+
+	updates = 0
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if updates != 0 {
+		t.Errorf("Got %d status updates reconciling an unchanged Notebook, Expected none", updates)
+	}
+}
+
+func TestGenerateStatefulSetProjectedTokens(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	expiration := int64(3600)
+	nb.Spec.ProjectedTokens = []v1beta1.TokenMount{
+		{Audience: "sts.amazonaws.com", ExpirationSeconds: &expiration, MountPath: "/var/run/secrets/aws"},
+		{Audience: "vault", MountPath: "/var/run/secrets/vault"},
+	}
+	// The Pod template already mounts a volume at the vault path
+	nb.Spec.Template.Spec.Volumes = []corev1.Volume{{Name: "projected-token"}}
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "projected-token", MountPath: "/var/run/secrets/vault"},
+	}
+
+	podSpec := generateStatefulSet(nb).Spec.Template.Spec
+	var volume *corev1.Volume
+	for i, v := range podSpec.Volumes {
+		if v.Projected != nil {
+			if volume != nil {
+				t.Fatalf("Expected a single projected volume, got %+v", podSpec.Volumes)
+			}
+			volume = &podSpec.Volumes[i]
+		}
+	}
+	if volume == nil {
+		t.Fatalf("Expected a projected volume, got %+v", podSpec.Volumes)
+	}
+	if volume.Name != "projected-token-1" {
+		t.Errorf("Got volume name %q, Expected projected-token-1", volume.Name)
+	}
+	expected := []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+		Audience:          "sts.amazonaws.com",
+		ExpirationSeconds: &expiration,
+		Path:              ProjectedTokenPath,
+	}}}
+	if !reflect.DeepEqual(volume.Projected.Sources, expected) {
+		t.Errorf("Got projected sources %+v, Expected %+v", volume.Projected.Sources, expected)
+	}
+	mounted := false
+	for _, m := range podSpec.Containers[0].VolumeMounts {
+		if m.Name == volume.Name {
+			mounted = m.MountPath == "/var/run/secrets/aws" && m.ReadOnly
+		}
+	}
+	if !mounted {
+		t.Errorf("Expected the token to be mounted read-only at /var/run/secrets/aws, got %+v",
+			podSpec.Containers[0].VolumeMounts)
+	}
+}
+
+func TestGenerateStatefulSetLivenessProbe(t *testing.T) {
+	defer os.Unsetenv("DEFAULT_LIVENESS_PROBE_PATH")
+	kernelProbe := &corev1.Probe{Handler: corev1.Handler{
+		Exec: &corev1.ExecAction{Command: []string{"check-kernels.sh"}},
+	}}
+	templateProbe := &corev1.Probe{Handler: corev1.Handler{
+		TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8888)},
+	}}
+
+	testCases := []struct {
+		name          string
+		defaultPath   string
+		spec          *corev1.Probe
+		template      *corev1.Probe
+		stripPrefix   bool
+		expected      *corev1.Probe
+		expectedPath  string
+		expectDefault bool
+	}{
+		{
+			name: "no probe",
+		},
+		{
+			name:          "default probe",
+			defaultPath:   "/api",
+			expectDefault: true,
+			expectedPath:  "/notebook/default/test-notebook/api",
+		},
+		{
+			name:          "default probe with stripPathPrefix",
+			defaultPath:   "/api",
+			stripPrefix:   true,
+			expectDefault: true,
+			expectedPath:  "/api",
+		},
+		{
+			name:        "user probe",
+			defaultPath: "/api",
+			spec:        kernelProbe,
+			template:    templateProbe,
+			expected:    kernelProbe,
+		},
+		{
+			name:        "template probe",
+			defaultPath: "/api",
+			template:    templateProbe,
+			expected:    templateProbe,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("DEFAULT_LIVENESS_PROBE_PATH", c.defaultPath)
+			nb := newTestNotebook("test-notebook", "default")
+			nb.Spec.LivenessProbe = c.spec
+			nb.Spec.StripPathPrefix = c.stripPrefix
+			nb.Spec.Template.Spec.Containers[0].LivenessProbe = c.template
+			probe := generateStatefulSet(nb).Spec.Template.Spec.Containers[0].LivenessProbe
+			if !c.expectDefault {
+				if !reflect.DeepEqual(probe, c.expected) {
+					t.Errorf("Got liveness probe %+v, Expected %+v", probe, c.expected)
+				}
+				return
+			}
+			if probe == nil || probe.HTTPGet == nil {
+				t.Fatalf("Got liveness probe %+v, Expected an HTTP probe", probe)
+			}
+			if probe.HTTPGet.Path != c.expectedPath || probe.HTTPGet.Port.IntValue() != DefaultContainerPort {
+				t.Errorf("Got HTTP probe %s on port %s, Expected %s on port %d",
+					probe.HTTPGet.Path, probe.HTTPGet.Port.String(), c.expectedPath, DefaultContainerPort)
+			}
+		})
+	}
+
+	os.Setenv("DEFAULT_LIVENESS_PROBE_PATH", "api")
+	if err := validateDefaultLivenessProbe(); err == nil {
+		t.Errorf("Expected an error for a relative DEFAULT_LIVENESS_PROBE_PATH")
+	}
+}
+
+func TestMergePodSpec(t *testing.T) {
+	template := &corev1.PodSpec{
+		ServiceAccountName: "approved",
+		Containers: []corev1.Container{
+			{
+				Name:  "notebook",
+				Image: "approved-image",
+				Env: []corev1.EnvVar{
+					{Name: "PIP_INDEX_URL", Value: "https://pypi.example.com"},
+					{Name: "LOG_LEVEL", Value: "info"},
+				},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("500m"),
+						corev1.ResourceMemory: resource.MustParse("1Gi"),
+					},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{Name: "datasets", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		},
+	}
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "test-notebook",
+				Env:  []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{
+				Name: "workspace",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace-pvc"},
+				},
+			},
+		},
+	}
+
+	merged, err := mergePodSpec(template, spec)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if merged.ServiceAccountName != "approved" {
+		t.Errorf("Got serviceAccountName %q, Expected the one of the template", merged.ServiceAccountName)
+	}
+	if len(merged.Containers) != 1 {
+		t.Fatalf("Got containers %+v, Expected the notebook container merged with the one of the template", merged.Containers)
+	}
+	container := merged.Containers[0]
+	if container.Name != "test-notebook" || container.Image != "approved-image" {
+		t.Errorf("Got container %s with image %s, Expected test-notebook with the image of the template",
+			container.Name, container.Image)
+	}
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["LOG_LEVEL"] != "debug" || env["PIP_INDEX_URL"] != "https://pypi.example.com" {
+		t.Errorf("Got env %v, Expected the env of the template with LOG_LEVEL overridden", env)
+	}
+	if cpu := container.Resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("2")) != 0 {
+		t.Errorf("Got a CPU request of %s, Expected the one of the Notebook", cpu.String())
+	}
+	if memory := container.Resources.Requests[corev1.ResourceMemory]; memory.Cmp(resource.MustParse("1Gi")) != 0 {
+		t.Errorf("Got a memory request of %s, Expected the one of the template", memory.String())
+	}
+	if len(merged.Volumes) != 2 {
+		t.Errorf("Got volumes %+v, Expected the volumes of the template and of the Notebook", merged.Volumes)
+	}
+
+	// The template isn't modified by the merge
+	if template.Containers[0].Name != "notebook" {
+		t.Errorf("The container of the template was renamed to %s", template.Containers[0].Name)
+	}
+
+	// A Notebook without containers takes all the ones of the template
+	for _, containers := range [][]corev1.Container{nil, {}} {
+		spec := &corev1.PodSpec{Containers: containers, ServiceAccountName: "custom"}
+		merged, err := mergePodSpec(template, spec)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(merged.Containers) != 1 || merged.Containers[0].Name != "notebook" ||
+			merged.Containers[0].Image != "approved-image" {
+			t.Errorf("Got containers %+v, Expected the container of the template", merged.Containers)
+		}
+		if merged.ServiceAccountName != "custom" {
+			t.Errorf("Got serviceAccountName %q, Expected the one of the Notebook", merged.ServiceAccountName)
+		}
+	}
+}
+
+func TestReconcileNotebookTemplate(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	nb.Spec.Template.Spec.Containers[0].Image = ""
+	nb.Spec.TemplateRef = &v1beta1.NotebookTemplateReference{Name: "approved", Namespace: "platform"}
+	r, recorder := newTestReconciler(nb)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.RequeueAfter == 0 {
+		t.Errorf("Expected the Notebook to be requeued while its NotebookTemplate is missing")
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); !apierrs.IsNotFound(err) {
+		t.Errorf("Expected the StatefulSet not to be created, got %v", err)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&found.Status, MissingTemplateCondition) {
+		t.Errorf("Expected a %s condition, got %+v", MissingTemplateCondition, found.Status.Conditions)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "platform/approved") {
+		t.Errorf("Got event %q, Expected a %s event naming the template", event, MissingTemplateCondition)
+	}
+
+	template := &v1beta1.NotebookTemplate{
+		ObjectMeta: v1.ObjectMeta{Name: "approved", Namespace: "platform"},
+		Spec: v1beta1.NotebookTemplateDefinition{
+			Template: v1beta1.NotebookTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "notebook",
+						Image: "approved-image",
+						Ports: []corev1.ContainerPort{{Name: "notebook-port", ContainerPort: 8888}},
+					}},
+				},
+			},
+		},
+	}
+	if err := r.Create(context.TODO(), template); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Expected the StatefulSet to be created once the NotebookTemplate exists, got %v", err)
+	}
+	if image := sts.Spec.Template.Spec.Containers[0].Image; image != "approved-image" {
+		t.Errorf("Got image %q, Expected the image of the NotebookTemplate", image)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&found.Status, MissingTemplateCondition) {
+		t.Errorf("The %s condition should be removed once the NotebookTemplate exists", MissingTemplateCondition)
+	}
+	if found.Spec.Template.Spec.Containers[0].Image != "" {
+		t.Errorf("The merged pod template shouldn't be written back to the Notebook")
+	}
+
+	// A Notebook without containers runs the ones of its NotebookTemplate
+	fromTemplate := newTestNotebook("from-template", "test-namespace")
+	fromTemplate.Spec.Template.Spec.Containers = []corev1.Container{}
+	fromTemplate.Spec.TemplateRef = nb.Spec.TemplateRef
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fromTemplate.Name + "-0",
+			Namespace: fromTemplate.Namespace,
+			Labels:    map[string]string{"statefulset": fromTemplate.Name},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "notebook", Image: "approved-image", ImageID: "docker-pullable://approved-image@sha256:1111"},
+			},
+		},
+	}
+	for _, obj := range []runtime.Object{fromTemplate, pod} {
+		if err := r.Create(context.TODO(), obj); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	req = ctrl.Request{NamespacedName: types.NamespacedName{Name: fromTemplate.Name, Namespace: fromTemplate.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, sts); err != nil {
+		t.Fatalf("Expected the StatefulSet to be created from the containers of the NotebookTemplate, got %v", err)
+	}
+	if containers := sts.Spec.Template.Spec.Containers; len(containers) != 1 || containers[0].Image != "approved-image" {
+		t.Errorf("Got containers %+v, Expected the container of the NotebookTemplate", containers)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found.Status.ImageID != "docker-pullable://approved-image@sha256:1111" {
+		t.Errorf("Got imageID %q, Expected the one of the container of the NotebookTemplate", found.Status.ImageID)
+	}
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, "NoContainers") {
+			t.Errorf("Got event %q, Expected the containers of the NotebookTemplate to be used", event)
+		}
+	}
+}
+
+func TestReconcileDeletedChildren(t *testing.T) {
+	os.Setenv("USE_ISTIO", "true")
+	defer os.Unsetenv("USE_ISTIO")
+
+	nb := newTestNotebook("test-notebook", "test-deleted-children")
+	r, _ := newTestReconciler(nb)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The handler of the Owns watches of the builder
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1beta1.GroupVersion.WithKind("Notebook"), meta.RESTScopeNamespace)
+	ownerHandler := &handler.EnqueueRequestForOwner{OwnerType: &v1beta1.Notebook{}, IsController: true}
+	if err := ownerHandler.InjectScheme(scheme.Scheme); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ownerHandler.InjectMapper(mapper); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	virtualService := &unstructured.Unstructured{}
+	virtualService.SetGroupVersionKind(virtualServiceGVK())
+	tests := []struct {
+		name  string
+		child runtime.Object
+		key   types.NamespacedName
+	}{
+		{
+			name:  "Service",
+			child: &corev1.Service{},
+			key:   req.NamespacedName,
+		},
+		{
+			name:  "VirtualService",
+			child: virtualService,
+			key:   types.NamespacedName{Name: virtualServiceName(nb.Name, nb.Namespace), Namespace: nb.Namespace},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watched := false
+			for _, obj := range r.ownedTypes() {
+				watched = watched || obj.GetObjectKind().GroupVersionKind() == test.child.GetObjectKind().GroupVersionKind() &&
+					reflect.TypeOf(obj) == reflect.TypeOf(test.child)
+			}
+			if !watched {
+				t.Fatalf("Expected the %s to be watched", test.name)
+			}
+
+			if err := r.Get(context.TODO(), test.key, test.child); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := r.Delete(context.TODO(), test.child); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			childMeta, err := meta.Accessor(test.child)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			defer queue.ShutDown()
+			ownerHandler.Delete(event.DeleteEvent{Meta: childMeta, Object: test.child}, queue)
+			if queue.Len() != 1 {
+				t.Fatalf("Expected the deletion of the %s to enqueue the Notebook, got %d requests", test.name, queue.Len())
+			}
+			if item, _ := queue.Get(); item != req {
+				t.Errorf("Got request %v, Expected %v", item, req)
+			}
+
+			if _, err := r.Reconcile(req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := r.Get(context.TODO(), test.key, test.child); err != nil {
+				t.Errorf("Expected the %s to be recreated, got %v", test.name, err)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetServiceName(t *testing.T) {
+	testCases := []struct {
+		name       string
+		annotation string
+		expected   string
+	}{
+		{name: "default", expected: "test-notebook"},
+		{name: "headless Service", annotation: "test-notebook-headless", expected: "test-notebook-headless"},
+		{name: "invalid name", annotation: "Headless_Service", expected: "test-notebook"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook("test-notebook", "default")
+			if test.annotation != "" {
+				nb.Annotations = map[string]string{ServiceNameAnnotation: test.annotation}
+			}
+			if serviceName := generateStatefulSet(nb).Spec.ServiceName; serviceName != test.expected {
+				t.Errorf("Got serviceName %q, Expected %q", serviceName, test.expected)
+			}
+		})
+	}
+}
+
+func TestReconcileServiceNameChange(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-namespace")
+	// StatefulSets created by older controllers have no serviceName
+	sts := generateStatefulSet(nb)
+	sts.Spec.ServiceName = ""
+	sts.Annotations[ImmutableSpecAnnotation] = immutableSpec(sts)
+	r, recorder := newTestReconciler(nb, sts)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no event for the StatefulSets without serviceName, got %q", <-recorder.Events)
+	}
+	found := &v1beta1.Notebook{}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hasNotebookCondition(&found.Status, ImmutableFieldsCondition) {
+		t.Errorf("Expected no %s condition, got %v", ImmutableFieldsCondition, found.Status.Conditions)
+	}
+
+	// The serviceName can't be updated in place, the change is reported
+	found.Annotations = map[string]string{ServiceNameAnnotation: "test-notebook-headless"}
+	if err := r.Update(context.TODO(), found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatalf("Changing the serviceName shouldn't fail the reconcile, got %v", err)
+	}
+	if err := r.Get(context.TODO(), req.NamespacedName, found); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !hasNotebookCondition(&found.Status, ImmutableFieldsCondition) {
+		t.Errorf("Expected a %s condition, got %v", ImmutableFieldsCondition, found.Status.Conditions)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "spec.serviceName") {
+		t.Errorf("Got event %q, Expected an event about spec.serviceName", event)
+	}
+	foundSts := &appsv1.StatefulSet{}
+	if err := r.Get(context.TODO(), req.NamespacedName, foundSts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if foundSts.Spec.ServiceName != "" {
+		t.Errorf("Got serviceName %q, Expected it not to be updated", foundSts.Spec.ServiceName)
+	}
+}
+
+func TestReconcileTerminatingNamespace(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "test-terminating")
+	namespace := &corev1.Namespace{
+		ObjectMeta: v1.ObjectMeta{Name: nb.Namespace},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+	}
+	r, recorder := newTestReconciler(nb, namespace)
+	// Any create attempt fails the reconcile
+	r.Client = &failingCreateClient{Client: r.Client, err: apierrs.NewForbidden(
+		schema.GroupResource{Resource: "statefulsets"}, nb.Name, fmt.Errorf("namespace %s is being terminated", nb.Namespace))}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	result, err := r.Reconcile(req)
+	if err != nil {
+		t.Fatalf("Expected the reconcile to be skipped, got %v", err)
+	}
+	if result.Requeue || result.RequeueAfter != 0 {
+		t.Errorf("Got %+v, Expected the Notebook not to be requeued", result)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("Expected no event, got %q", <-recorder.Events)
+	}
+
+	// The Notebooks of active namespaces are reconciled
+	namespace.Status.Phase = corev1.NamespaceActive
+	if err := r.Update(context.TODO(), namespace); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := r.Reconcile(req); err == nil {
+		t.Errorf("Expected the create attempt of an active namespace to fail")
+	}
+}
+
+func TestGenerateServiceAdditionalPorts(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	nb.Spec.AdditionalPorts = []v1beta1.ServicePortSpec{
+		{Name: "http-dask", Port: 8787},
+		{Name: "tcp-debugger", Port: 5678, TargetPort: 5679},
+		{Name: "udp-metrics", Port: 8125, Protocol: corev1.ProtocolUDP},
+		// Rejected by the validating webhook, skipped
+		{Name: "http-dask", Port: 8788},
+		{Name: "http-web", Port: DefaultServingPort},
+	}
+
+	expected := []corev1.ServicePort{
+		{Name: "http-dask", Port: 8787, TargetPort: intstr.FromInt(8787), Protocol: corev1.ProtocolTCP},
+		{Name: "tcp-debugger", Port: 5678, TargetPort: intstr.FromInt(5679), Protocol: corev1.ProtocolTCP},
+		{Name: "udp-metrics", Port: 8125, TargetPort: intstr.FromInt(8125), Protocol: corev1.ProtocolUDP},
+	}
+	ports := generateService(nb).Spec.Ports
+	if len(ports) != 1+len(expected) {
+		t.Fatalf("Got ports %+v, Expected the notebook port and %+v", ports, expected)
+	}
+	if ports[0].Port != DefaultServingPort {
+		t.Errorf("Got first port %+v, Expected the notebook port", ports[0])
+	}
+	if !reflect.DeepEqual(ports[1:], expected) {
+		t.Errorf("Got additional ports %+v, Expected %+v", ports[1:], expected)
+	}
+}
+
+func TestGenerateVirtualServiceAdditionalPorts(t *testing.T) {
+	nb := newTestNotebook("test-notebook", "default")
+	nb.Spec.AdditionalPorts = []v1beta1.ServicePortSpec{
+		{Name: "http-dask", Port: 8787},
+		{Name: "udp-metrics", Port: 8125, Protocol: corev1.ProtocolUDP},
+	}
+	vsvc, err := generateVirtualService(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	http, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	if len(http) != 3 {
+		t.Fatalf("Expected the route of the TCP additional port, of the notebook and the redirect, got %v", http)
+	}
+
+	route := http[0].(map[string]interface{})
+	prefix, _, _ := unstructured.NestedString(route["match"].([]interface{})[0].(map[string]interface{}), "uri", "prefix")
+	if prefix != "/notebook/default/test-notebook/http-dask/" {
+		t.Errorf("Got prefix %q, Expected the sub-path of the additional port", prefix)
+	}
+	rewrite, _, _ := unstructured.NestedString(route, "rewrite", "uri")
+	if rewrite != "/" {
+		t.Errorf("Got rewrite %q, Expected /", rewrite)
+	}
+	port, _, _ := unstructured.NestedInt64(route["route"].([]interface{})[0].(map[string]interface{}),
+		"destination", "port", "number")
+	if port != 8787 {
+		t.Errorf("Got destination port %d, Expected 8787", port)
+	}
+
+	notebookRoute := http[1].(map[string]interface{})
+	prefix, _, _ = unstructured.NestedString(notebookRoute["match"].([]interface{})[0].(map[string]interface{}), "uri", "prefix")
+	if prefix != "/notebook/default/test-notebook/" {
+		t.Errorf("Got prefix %q, Expected the notebook route after the additional ports", prefix)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// The port of the DNS servers, the Notebooks can always reach it.
+const DNSPort = 53
+
+// egressRestricted returns whether the egress of the Notebooks is restricted
+// to the allowlisted destinations, i.e. whether RESTRICT_EGRESS is true.
+func egressRestricted() bool {
+	return os.Getenv("RESTRICT_EGRESS") == "true"
+}
+
+// egressPolicyName returns the name of the egress NetworkPolicy of a Notebook.
+func egressPolicyName(instance *v1beta1.Notebook) string {
+	return instance.Name + "-egress"
+}
+
+// getEgressAllowlist returns the destinations the Notebooks may reach, read
+// from the EGRESS_ALLOW_CIDRS env var, a comma-separated list of CIDRs, and
+// the EGRESS_ALLOW_NAMESPACE_SELECTOR one, a label selector of namespaces.
+func getEgressAllowlist() ([]networkingv1.NetworkPolicyPeer, error) {
+	peers := []networkingv1.NetworkPolicyPeer{}
+	for _, cidr := range strings.Split(os.Getenv("EGRESS_ALLOW_CIDRS"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in EGRESS_ALLOW_CIDRS: %v", cidr, err)
+		}
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	if selector := os.Getenv("EGRESS_ALLOW_NAMESPACE_SELECTOR"); len(selector) != 0 {
+		namespaceSelector, err := metav1.ParseToLabelSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EGRESS_ALLOW_NAMESPACE_SELECTOR %q: %v", selector, err)
+		}
+		peers = append(peers, networkingv1.NetworkPolicyPeer{NamespaceSelector: namespaceSelector})
+	}
+	return peers, nil
+}
+
+func validateEgressConfig() error {
+	_, err := getEgressAllowlist()
+	return err
+}
+
+// generateEgressNetworkPolicy returns a NetworkPolicy denying the egress of
+// the Notebook Pod, except to the DNS servers and the allowed destinations.
+// The ingress of the Pod isn't restricted by it.
+func generateEgressNetworkPolicy(instance *v1beta1.Notebook, allowed []networkingv1.NetworkPolicyPeer) *networkingv1.NetworkPolicy {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dnsPort := intstr.FromInt(DNSPort)
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dnsPort},
+				{Protocol: &tcp, Port: &dnsPort},
+			},
+		},
+	}
+	if len(allowed) != 0 {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{To: allowed})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      egressPolicyName(instance),
+			Namespace: instance.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{"statefulset": instance.Name},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		},
+	}
+}
+
+// reconcileEgressNetworkPolicy creates or updates the egress NetworkPolicy of
+// the Notebook while RESTRICT_EGRESS is true, and deletes the one it created
+// otherwise.
+func (r *NotebookReconciler) reconcileEgressNetworkPolicy(instance *v1beta1.Notebook) error {
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	foundPolicy := &networkingv1.NetworkPolicy{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: egressPolicyName(instance), Namespace: instance.Namespace}, foundPolicy)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if !egressRestricted() {
+		if !found || !metav1.IsControlledBy(foundPolicy, instance) {
+			return nil
+		}
+		log.Info("Deleting NetworkPolicy", "namespace", foundPolicy.Namespace, "name", foundPolicy.Name)
+		return ignoreNotFound(r.Delete(context.TODO(), foundPolicy))
+	}
+
+	allowed, err := getEgressAllowlist()
+	if err != nil {
+		return err
+	}
+	policy := generateEgressNetworkPolicy(instance, allowed)
+	if err := ctrl.SetControllerReference(instance, policy, r.Scheme); err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating NetworkPolicy", "namespace", policy.Namespace, "name", policy.Name)
+		return r.Create(context.TODO(), policy)
+	}
+	if reconcilehelper.CopyNetworkPolicyFields(policy, foundPolicy) {
+		log.Info("Updating NetworkPolicy", "namespace", policy.Namespace, "name", policy.Name)
+		return r.Update(context.TODO(), foundPolicy)
+	}
+	return nil
+}
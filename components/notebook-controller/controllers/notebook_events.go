@@ -0,0 +1,74 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The annotations of the Notebook events reissued from the events of its Pod
+// or StatefulSet, pointing back to the source event and its object.
+const (
+	SourceEventAnnotation = "notebook.kubeflow.org/source-event"
+	SourceKindAnnotation  = "notebook.kubeflow.org/source-kind"
+	SourceNameAnnotation  = "notebook.kubeflow.org/source-name"
+	SourceUIDAnnotation   = "notebook.kubeflow.org/source-uid"
+)
+
+// How long the reissued events are remembered, the default time to live of
+// the events in the API server.
+const reissuedEventTTL = time.Hour
+
+// reissuedEvent records the count of a source event when it was reissued.
+type reissuedEvent struct {
+	count int32
+	seen  time.Time
+}
+
+// reissueEvent records an event on the Notebook correlated to an event of its
+// Pod or StatefulSet, which is kept as is. A source event is reissued once per
+// occurrence: reconciling it again, e.g. on a resync, doesn't record anything
+// until its count increases.
+func (r *NotebookReconciler) reissueEvent(instance *v1beta1.Notebook, event *corev1.Event) {
+	count := event.Count
+	if count == 0 {
+		count = 1
+	}
+	now := time.Now()
+	if previous, ok := r.reissuedEvents.Load(event.UID); ok && previous.(reissuedEvent).count >= count {
+		return
+	}
+	r.reissuedEvents.Store(event.UID, reissuedEvent{count: count, seen: now})
+	r.reissuedEvents.Range(func(uid, value interface{}) bool {
+		if now.Sub(value.(reissuedEvent).seen) > reissuedEventTTL {
+			r.reissuedEvents.Delete(uid)
+		}
+		return true
+	})
+
+	annotations := map[string]string{
+		SourceEventAnnotation: event.Name,
+		SourceKindAnnotation:  event.InvolvedObject.Kind,
+		SourceNameAnnotation:  event.InvolvedObject.Name,
+		SourceUIDAnnotation:   string(event.InvolvedObject.UID),
+	}
+	r.EventRecorder.AnnotatedEventf(instance, annotations, event.Type, event.Reason,
+		"Reissued from %s/%s: %s", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Message)
+}
@@ -0,0 +1,113 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The logical kinds of GPUs a Notebook can request, the keys of the
+// GPU_RESOURCES env var.
+const (
+	GPUDedicated = "dedicated"
+	GPUShared    = "shared"
+)
+
+// gpuResource is the actual resource requested for a logical kind of GPU, and
+// the nodeSelector of the nodes providing it.
+type gpuResource struct {
+	ResourceName corev1.ResourceName `json:"resourceName"`
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+}
+
+// defaultGPUResources are the GPU resources used if the GPU_RESOURCES env var
+// isn't set: whole GPUs, and the time-sliced ones advertised by the NVIDIA
+// device plugin with renamed resources.
+var defaultGPUResources = map[string]gpuResource{
+	GPUDedicated: {ResourceName: "nvidia.com/gpu"},
+	GPUShared:    {ResourceName: "nvidia.com/gpu.shared"},
+}
+
+// getGPUResources returns the mapping of the logical kinds of GPUs to the
+// actual resources, read from the GPU_RESOURCES env var, a JSON object. The
+// kinds it doesn't set keep their default.
+func getGPUResources() (map[string]gpuResource, error) {
+	resources := map[string]gpuResource{}
+	for k, v := range defaultGPUResources {
+		resources[k] = v
+	}
+	value := os.Getenv("GPU_RESOURCES")
+	if len(value) == 0 {
+		return resources, nil
+	}
+	configured := map[string]gpuResource{}
+	if err := json.Unmarshal([]byte(value), &configured); err != nil {
+		return nil, fmt.Errorf("invalid GPU_RESOURCES %q, expected a JSON object: %v", value, err)
+	}
+	for k, v := range configured {
+		if k != GPUDedicated && k != GPUShared {
+			return nil, fmt.Errorf("GPU_RESOURCES should only set %q and %q, got %q", GPUDedicated, GPUShared, k)
+		}
+		if len(v.ResourceName) == 0 {
+			return nil, fmt.Errorf("GPU_RESOURCES should set the resourceName of %q", k)
+		}
+		resources[k] = v
+	}
+	return resources, nil
+}
+
+func validateGPUResources() error {
+	_, err := getGPUResources()
+	return err
+}
+
+// applyGPU sets the GPU limit requested by the Notebook on its first
+// container, with the resource name of the kind of GPU it asks for, and
+// schedules the Pod on the nodes providing it.
+func applyGPU(instance *v1beta1.Notebook, podSpec *corev1.PodSpec) {
+	gpu := instance.Spec.GPU
+	if gpu == nil || gpu.Count <= 0 {
+		return
+	}
+	resources, err := getGPUResources()
+	if err != nil {
+		// The controller doesn't start with an invalid GPU_RESOURCES
+		resources = defaultGPUResources
+	}
+	kind := GPUDedicated
+	if gpu.Shared {
+		kind = GPUShared
+	}
+	gpuResource := resources[kind]
+
+	container := &podSpec.Containers[0]
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	container.Resources.Limits[gpuResource.ResourceName] = *resource.NewQuantity(gpu.Count, resource.DecimalSI)
+	if len(gpuResource.NodeSelector) != 0 && podSpec.NodeSelector == nil {
+		podSpec.NodeSelector = map[string]string{}
+	}
+	for k, v := range gpuResource.NodeSelector {
+		podSpec.NodeSelector[k] = v
+	}
+}
@@ -0,0 +1,156 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// notebookKind is the image of a kind of Notebook, e.g. jupyter or rstudio,
+// the port its server listens on, and the command and args it is started
+// with, if not the ones of the image.
+type notebookKind struct {
+	Image       string   `json:"image"`
+	ServingPort int32    `json:"servingPort,omitempty"`
+	Command     []string `json:"command,omitempty"`
+	Args        []string `json:"args,omitempty"`
+}
+
+// getNotebookKinds returns the kinds of Notebooks offered by the operators,
+// read from the NOTEBOOK_KINDS env var, a JSON object. There are none if it
+// isn't set.
+func getNotebookKinds() (map[string]notebookKind, error) {
+	kinds := map[string]notebookKind{}
+	value := os.Getenv("NOTEBOOK_KINDS")
+	if len(value) == 0 {
+		return kinds, nil
+	}
+	if err := json.Unmarshal([]byte(value), &kinds); err != nil {
+		return nil, fmt.Errorf("invalid NOTEBOOK_KINDS %q, expected a JSON object: %v", value, err)
+	}
+	for k, v := range kinds {
+		if len(v.Image) == 0 {
+			return nil, fmt.Errorf("NOTEBOOK_KINDS should set the image of %q", k)
+		}
+		if v.ServingPort < 0 || v.ServingPort > 65535 {
+			return nil, fmt.Errorf("NOTEBOOK_KINDS should set a valid servingPort for %q, got %d", k, v.ServingPort)
+		}
+	}
+	return kinds, nil
+}
+
+func validateNotebookKinds() error {
+	_, err := getNotebookKinds()
+	return err
+}
+
+// getNotebookKind returns the kind of the Notebook, or nil if it doesn't set
+// one. It fails if the kind isn't one of NOTEBOOK_KINDS.
+func getNotebookKind(instance *v1beta1.Notebook) (*notebookKind, error) {
+	if len(instance.Spec.Kind) == 0 {
+		return nil, nil
+	}
+	kinds, err := getNotebookKinds()
+	if err != nil {
+		return nil, err
+	}
+	kind, ok := kinds[instance.Spec.Kind]
+	if !ok {
+		known := []string{}
+		for k := range kinds {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown kind %q of notebook %s/%s, the known kinds are: %s",
+			instance.Spec.Kind, instance.Namespace, instance.Name, strings.Join(known, ", "))
+	}
+	return &kind, nil
+}
+
+// notebookContainerPort returns the port the notebook container listens on if
+// it doesn't declare any: the servingPort of its kind, or
+// DefaultContainerPort.
+func notebookContainerPort(instance *v1beta1.Notebook) int32 {
+	// Unknown kinds are rejected before the resources are generated
+	kind, _ := getNotebookKind(instance)
+	if kind != nil && kind.ServingPort != 0 {
+		return kind.ServingPort
+	}
+	return DefaultContainerPort
+}
+
+// notebookImage returns the image of the notebook container: the one it sets,
+// or the image of the kind of the Notebook.
+func notebookImage(instance *v1beta1.Notebook) string {
+	if image := instance.Spec.Template.Spec.Containers[0].Image; image != "" {
+		return image
+	}
+	if kind, _ := getNotebookKind(instance); kind != nil {
+		return kind.Image
+	}
+	return ""
+}
+
+// getDefaultCommand returns the command and args of the notebook containers
+// that don't set theirs, read from the DEFAULT_NOTEBOOK_COMMAND and
+// DEFAULT_NOTEBOOK_ARGS env vars, JSON arrays. Both are nil if unset.
+func getDefaultCommand() ([]string, []string, error) {
+	var command, args []string
+	if value := os.Getenv("DEFAULT_NOTEBOOK_COMMAND"); len(value) != 0 {
+		if err := json.Unmarshal([]byte(value), &command); err != nil {
+			return nil, nil, fmt.Errorf("invalid DEFAULT_NOTEBOOK_COMMAND %q, expected a JSON array: %v", value, err)
+		}
+	}
+	if value := os.Getenv("DEFAULT_NOTEBOOK_ARGS"); len(value) != 0 {
+		if err := json.Unmarshal([]byte(value), &args); err != nil {
+			return nil, nil, fmt.Errorf("invalid DEFAULT_NOTEBOOK_ARGS %q, expected a JSON array: %v", value, err)
+		}
+	}
+	return command, args, nil
+}
+
+func validateDefaultCommand() error {
+	_, _, err := getDefaultCommand()
+	return err
+}
+
+// applyDefaultCommand sets the command and args of the notebook container to
+// the ones of the kind of the Notebook, or else to the default ones, unless
+// it sets either of them: args meant for the command of the user, or the one
+// of the image, can't be combined with a default command. They can refer to
+// the env vars of the container, e.g. "--ServerApp.base_url=$(NB_PREFIX)".
+func applyDefaultCommand(instance *v1beta1.Notebook, container *corev1.Container) {
+	if len(container.Command) != 0 || len(container.Args) != 0 {
+		return
+	}
+	command, args, err := getDefaultCommand()
+	if err != nil {
+		// The controller doesn't start with an invalid default command
+		return
+	}
+	if kind, _ := getNotebookKind(instance); kind != nil && (len(kind.Command) != 0 || len(kind.Args) != 0) {
+		command, args = kind.Command, kind.Args
+	}
+	container.Command = append([]string(nil), command...)
+	container.Args = append([]string(nil), args...)
+}
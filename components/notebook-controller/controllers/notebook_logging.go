@@ -0,0 +1,74 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+)
+
+// Setting this annotation on a Notebook raises the verbosity of the logs of
+// its reconciles, to debug it without raising the one of the controller.
+// "debug" emits the V(1) logs, a number n the logs up to V(n).
+const LogLevelAnnotation = "notebook.kubeflow.org/log-level"
+
+// getLogVerbosity returns by how much the LogLevelAnnotation of the Notebook
+// raises the verbosity of its logs, 0 if it isn't set or is invalid.
+func getLogVerbosity(instance *v1beta1.Notebook) int {
+	value := instance.GetAnnotations()[LogLevelAnnotation]
+	if value == "debug" {
+		return 1
+	}
+	verbosity, err := strconv.Atoi(value)
+	if err != nil || verbosity < 0 {
+		return 0
+	}
+	return verbosity
+}
+
+// notebookLogger returns the logger of the reconcile of the Notebook, whose
+// verbosity is raised by its LogLevelAnnotation.
+func notebookLogger(log logr.Logger, instance *v1beta1.Notebook) logr.Logger {
+	verbosity := getLogVerbosity(instance)
+	if verbosity == 0 {
+		return log
+	}
+	return &verboseLogger{Logger: log, verbosity: verbosity}
+}
+
+// verboseLogger emits the logs of the levels up to its verbosity as the
+// V(0) logs of the underlying logger.
+type verboseLogger struct {
+	logr.Logger
+	verbosity int
+}
+
+func (l *verboseLogger) V(level int) logr.InfoLogger {
+	if level <= l.verbosity {
+		return l.Logger.V(0)
+	}
+	return l.Logger.V(level - l.verbosity)
+}
+
+func (l *verboseLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return &verboseLogger{Logger: l.Logger.WithValues(keysAndValues...), verbosity: l.verbosity}
+}
+
+func (l *verboseLogger) WithName(name string) logr.Logger {
+	return &verboseLogger{Logger: l.Logger.WithName(name), verbosity: l.verbosity}
+}
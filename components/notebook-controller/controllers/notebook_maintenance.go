@@ -0,0 +1,126 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// keyedMutex is a set of mutexes, one per key. Its zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is the mutex of a key, with the number of goroutines holding or
+// waiting for it, so that it is released once unused.
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks the mutex of the key, and returns the function unlocking it.
+func (m *keyedMutex) Lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		m.locks[key] = lock
+	}
+	lock.refs++
+	m.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		m.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// getMaxConcurrentReconciles returns how many Notebooks are reconciled
+// concurrently, set by the MAX_CONCURRENT_RECONCILES env var. Defaults to 1.
+func getMaxConcurrentReconciles() int {
+	value := os.Getenv("MAX_CONCURRENT_RECONCILES")
+	if len(value) == 0 {
+		return 1
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+func validateMaxConcurrentReconciles() error {
+	value := os.Getenv("MAX_CONCURRENT_RECONCILES")
+	if len(value) == 0 {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 1 {
+		return fmt.Errorf("MAX_CONCURRENT_RECONCILES should be a positive integer, got %q", value)
+	}
+	return nil
+}
+
+// reconcileMaintenance runs the maintenance flows of the Notebook, its clone,
+// restore and backup, which create its PVCs and the Jobs copying them. Only
+// one of them runs per Notebook at a time, whatever calls it, so that
+// concurrent calls don't both find no Job and start two copies of the same
+// volume. The Notebook is read
+// again once the lock is held, so that the flow sees the Jobs and conditions
+// of the previous one.
+func (r *NotebookReconciler) reconcileMaintenance(instance *v1beta1.Notebook) error {
+	unlock := r.maintenanceLocks.Lock(instance.Namespace + "/" + instance.Name)
+	defer unlock()
+
+	err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, instance)
+	if err != nil {
+		return err
+	}
+	if err := r.reconcileClone(instance); err != nil {
+		return err
+	}
+	if err := r.reconcileWorkspaceRestore(instance); err != nil {
+		return err
+	}
+	return r.reconcileBackup(instance)
+}
+
+// countMaintenanceJob counts a finished maintenance Job of the given type in
+// the notebook_maintenance_jobs_total metric. It is called when the condition
+// of its flow changes, so that each Job is only counted once.
+func (r *NotebookReconciler) countMaintenanceJob(jobType string, succeeded bool) {
+	result := "success"
+	if !succeeded {
+		result = "failure"
+	}
+	r.Metrics.NotebookMaintenanceJobs.WithLabelValues(jobType, result).Inc()
+}
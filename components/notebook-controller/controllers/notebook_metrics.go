@@ -0,0 +1,104 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The name of the metrics sidecar container.
+const MetricsSidecarName = "notebook-metrics"
+
+// The port the metrics sidecar serves the Prometheus metrics on.
+const MetricsSidecarPort = 9100
+
+// metricsSidecarImage returns the image of the metrics sidecar, set by the
+// METRICS_SIDECAR_IMAGE env var.
+func metricsSidecarImage() string {
+	return os.Getenv("METRICS_SIDECAR_IMAGE")
+}
+
+// metricsSidecarEnabled returns whether the metrics sidecar is added to the
+// Pod of the Notebook: it enables it and the image of the sidecar is set.
+func metricsSidecarEnabled(instance *v1beta1.Notebook) bool {
+	return instance.Spec.MetricsSidecar && metricsSidecarImage() != ""
+}
+
+// applyMetricsSidecar adds the metrics sidecar to the Pod of the Notebook. It
+// mounts the PVCs of the notebook container read-only at the same paths, to
+// report their usage, and reaches the server of the Notebook on localhost for
+// its kernel activity. The Pod is annotated for the Prometheus scraping.
+func applyMetricsSidecar(instance *v1beta1.Notebook, template *corev1.PodTemplateSpec) {
+	if !metricsSidecarEnabled(instance) {
+		return
+	}
+	podSpec := &template.Spec
+	for _, c := range podSpec.Containers {
+		if c.Name == MetricsSidecarName {
+			return
+		}
+	}
+
+	pvcs := map[string]bool{}
+	for _, v := range podSpec.Volumes {
+		if v.PersistentVolumeClaim != nil {
+			pvcs[v.Name] = true
+		}
+	}
+	container := &podSpec.Containers[0]
+	mounts := []corev1.VolumeMount{}
+	paths := []string{}
+	for _, m := range container.VolumeMounts {
+		if !pvcs[m.Name] {
+			continue
+		}
+		m.ReadOnly = true
+		mounts = append(mounts, m)
+		paths = append(paths, m.MountPath)
+	}
+	port := notebookContainerPort(instance)
+	if len(container.Ports) != 0 {
+		port = container.Ports[0].ContainerPort
+	}
+
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:  MetricsSidecarName,
+		Image: metricsSidecarImage(),
+		Env: []corev1.EnvVar{
+			{Name: "VOLUME_PATHS", Value: strings.Join(paths, ",")},
+			{Name: "NOTEBOOK_URL", Value: fmt.Sprintf("http://localhost:%d%s", port, notebookPrefix(instance))},
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				ContainerPort: MetricsSidecarPort,
+				Name:          "metrics",
+				Protocol:      "TCP",
+			},
+		},
+		VolumeMounts: mounts,
+	})
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations["prometheus.io/scrape"] = "true"
+	template.Annotations["prometheus.io/port"] = strconv.Itoa(MetricsSidecarPort)
+}
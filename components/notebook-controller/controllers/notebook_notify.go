@@ -0,0 +1,48 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
+)
+
+// The annotation recording the user who created the Notebook, set by the
+// Jupyter web app. It is the owner the notifications are sent for.
+const CreatorAnnotation = "notebooks.kubeflow.org/creator"
+
+// notify sends an event of the Notebook to the Notifier of the reconciler, if
+// any. Failures are only logged: the notifications never block the lifecycle
+// of the Notebook.
+func (r *NotebookReconciler) notify(instance *v1beta1.Notebook, eventType, reason string) {
+	if r.Notifier == nil {
+		return
+	}
+	err := r.Notifier.Notify(notify.Event{
+		Type:      eventType,
+		Namespace: instance.Namespace,
+		Name:      instance.Name,
+		Owner:     instance.GetAnnotations()[CreatorAnnotation],
+		Reason:    reason,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		r.Log.Info("Unable to send the notification", "namespace", instance.Namespace, "name", instance.Name,
+			"type", eventType, "error", err.Error())
+	}
+}
@@ -0,0 +1,86 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The platforms the controller runs on, set by the PLATFORM env var or
+// detected when it starts.
+const (
+	PlatformKubernetes = "kubernetes"
+	PlatformOpenShift  = "openshift"
+)
+
+// The GroupVersionKind of the SecurityContextConstraints of OpenShift, whose
+// API tells OpenShift clusters apart.
+var sccGVK = schema.GroupVersionKind{Group: "security.openshift.io", Version: "v1", Kind: "SecurityContextConstraints"}
+
+// The platform detected by detectPlatform when the PLATFORM env var isn't set.
+var detectedPlatform = PlatformKubernetes
+
+func validatePlatform() error {
+	switch platform := os.Getenv("PLATFORM"); platform {
+	case "", PlatformKubernetes, PlatformOpenShift:
+		return nil
+	default:
+		return fmt.Errorf("PLATFORM should be %q or %q, got %q", PlatformKubernetes, PlatformOpenShift, platform)
+	}
+}
+
+// detectPlatform records whether the cluster is an OpenShift one, i.e. it
+// serves the SecurityContextConstraints API, unless the PLATFORM env var sets
+// the platform.
+func detectPlatform(mapper meta.RESTMapper) error {
+	if os.Getenv("PLATFORM") != "" {
+		return nil
+	}
+	_, err := mapper.RESTMapping(sccGVK.GroupKind(), sccGVK.Version)
+	if meta.IsNoMatchError(err) {
+		detectedPlatform = PlatformKubernetes
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to check whether the %s API is served: %v", sccGVK, err)
+	}
+	detectedPlatform = PlatformOpenShift
+	return nil
+}
+
+// getPlatform returns the platform set by the PLATFORM env var, or the
+// detected one.
+func getPlatform() string {
+	if platform := os.Getenv("PLATFORM"); platform != "" {
+		return platform
+	}
+	return detectedPlatform
+}
+
+// addFSGroup returns whether the default fsGroup is set on the Notebook Pods
+// that don't set a securityContext, as set by the ADD_FSGROUP env var. It
+// defaults to true on Kubernetes and to false on OpenShift, where the
+// SecurityContextConstraints assign the fsGroup from the range of the
+// namespace and reject the Pods setting one outside of it.
+func addFSGroup() bool {
+	if value, exists := os.LookupEnv("ADD_FSGROUP"); exists {
+		return value == "true"
+	}
+	return getPlatform() != PlatformOpenShift
+}
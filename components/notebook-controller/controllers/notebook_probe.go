@@ -0,0 +1,71 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// getDefaultLivenessProbePath returns the path, relative to the URL prefix of
+// the Notebooks, probed by their default liveness probe, e.g. "/api" for
+// Jupyter servers. It is set by the DEFAULT_LIVENESS_PROBE_PATH env var, and
+// no default probe is added if it isn't set.
+func getDefaultLivenessProbePath() string {
+	return os.Getenv("DEFAULT_LIVENESS_PROBE_PATH")
+}
+
+func validateDefaultLivenessProbe() error {
+	path := getDefaultLivenessProbePath()
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("DEFAULT_LIVENESS_PROBE_PATH should start with a /, got %q", path)
+	}
+	return nil
+}
+
+// applyLivenessProbe sets the LivenessProbe of the Notebook on the notebook
+// container. If neither sets a probe, the default HTTP probe is added when
+// DEFAULT_LIVENESS_PROBE_PATH is set, on the first port of the container
+// under the prefix the server is served at.
+func applyLivenessProbe(instance *v1beta1.Notebook, container *corev1.Container) {
+	if instance.Spec.LivenessProbe != nil {
+		container.LivenessProbe = instance.Spec.LivenessProbe.DeepCopy()
+		return
+	}
+	path := getDefaultLivenessProbePath()
+	if container.LivenessProbe != nil || path == "" || len(container.Ports) == 0 {
+		return
+	}
+	if !instance.Spec.StripPathPrefix {
+		path = notebookPrefix(instance) + path
+	}
+	container.LivenessProbe = &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: path,
+				Port: intstr.FromInt(int(container.Ports[0].ContainerPort)),
+			},
+		},
+		InitialDelaySeconds: 30,
+		PeriodSeconds:       30,
+		FailureThreshold:    4,
+	}
+}
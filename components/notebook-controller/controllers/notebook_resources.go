@@ -0,0 +1,97 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getDefaultResources returns the default resources of the notebook
+// container, read from the given env var, a JSON ResourceRequirements. It
+// returns nil if the env var isn't set.
+func getDefaultResources(variable string) (*corev1.ResourceRequirements, error) {
+	value := os.Getenv(variable)
+	if len(value) == 0 {
+		return nil, nil
+	}
+	resources := &corev1.ResourceRequirements{}
+	if err := json.Unmarshal([]byte(value), resources); err != nil {
+		return nil, fmt.Errorf("invalid %s %q, expected a JSON object with requests and limits: %v", variable, value, err)
+	}
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return nil, fmt.Errorf("%s requests more %s than its limit", variable, name)
+		}
+	}
+	return resources, nil
+}
+
+func validateDefaultResources() error {
+	if _, err := getDefaultResources("DEFAULT_RESOURCES"); err != nil {
+		return err
+	}
+	_, err := getDefaultResources("DEFAULT_GPU_RESOURCES")
+	return err
+}
+
+// applyDefaultResources sets the default requests and limits on the notebook
+// container, for the resources it sets neither for. The default resources of
+// the Notebooks requesting GPUs are set by the DEFAULT_GPU_RESOURCES env var,
+// the ones of the others by DEFAULT_RESOURCES.
+func applyDefaultResources(instance *v1beta1.Notebook, container *corev1.Container) {
+	variable := "DEFAULT_RESOURCES"
+	if instance.Spec.GPU != nil && instance.Spec.GPU.Count > 0 {
+		variable = "DEFAULT_GPU_RESOURCES"
+	}
+	defaults, err := getDefaultResources(variable)
+	if err != nil || defaults == nil {
+		// The controller doesn't start with invalid default resources
+		return
+	}
+
+	// The user sets a request and a limit consistent with each other, a
+	// default one could be lower than the request or higher than the limit
+	userSet := map[corev1.ResourceName]bool{}
+	for name := range container.Resources.Requests {
+		userSet[name] = true
+	}
+	for name := range container.Resources.Limits {
+		userSet[name] = true
+	}
+	for name, quantity := range defaults.Requests {
+		if userSet[name] {
+			continue
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = quantity.DeepCopy()
+	}
+	for name, quantity := range defaults.Limits {
+		if userSet[name] {
+			continue
+		}
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Limits[name] = quantity.DeepCopy()
+	}
+}
@@ -0,0 +1,235 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// notebookRouter reconciles the object routing the external traffic to the
+// Service of a Notebook, e.g. an Istio VirtualService or an Ingress.
+type notebookRouter interface {
+	// kind returns the kind of the routing object, for logging.
+	kind() string
+	// newObject returns an empty routing object, to watch or get one.
+	newObject() runtime.Object
+	// objectName returns the name of the routing object of the Notebook.
+	objectName(instance *v1beta1.Notebook) string
+	// generate returns the desired routing object of the Notebook.
+	generate(instance *v1beta1.Notebook) (runtime.Object, error)
+	// reconcile creates or updates the routing object of the Notebook.
+	reconcile(instance *v1beta1.Notebook) error
+}
+
+// validateRouting checks the INGRESS_MODE and ISTIO_VS_API_VERSION env vars
+// once, when the controller starts.
+func validateRouting() error {
+	mode := os.Getenv("INGRESS_MODE")
+	if mode != "" && mode != "ingress" {
+		return fmt.Errorf("INGRESS_MODE should be empty or \"ingress\", got %q", mode)
+	}
+	if mode == "ingress" && os.Getenv("USE_ISTIO") == "true" {
+		return fmt.Errorf("INGRESS_MODE=ingress can't be combined with USE_ISTIO=true")
+	}
+	if os.Getenv("ISTIO_SIDECAR") == "true" && os.Getenv("USE_ISTIO") != "true" {
+		return fmt.Errorf("ISTIO_SIDECAR=true requires USE_ISTIO=true")
+	}
+	switch version := os.Getenv("ISTIO_VS_API_VERSION"); version {
+	case "", "v1alpha3", "v1beta1", "v1":
+	default:
+		return fmt.Errorf("ISTIO_VS_API_VERSION should be v1alpha3, v1beta1 or v1, got %q", version)
+	}
+	return nil
+}
+
+// checkVirtualServiceCRD checks that the VirtualService CRD of Istio is
+// installed, so that the controller doesn't fail to watch or create the
+// VirtualServices when USE_ISTIO is true.
+func checkVirtualServiceCRD(mapper meta.RESTMapper) error {
+	gvk := virtualServiceGVK()
+	_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return fmt.Errorf("USE_ISTIO is true but the %s CRD isn't installed: install Istio, "+
+			"or unset USE_ISTIO (or set INGRESS_MODE=ingress) to run without it", gvk)
+	} else if err != nil {
+		return fmt.Errorf("unable to check whether the %s CRD is installed: %v", gvk, err)
+	}
+	return nil
+}
+
+// The version of the VirtualService API used if the ISTIO_VS_API_VERSION env
+// var isn't set.
+const DefaultIstioVSAPIVersion = "v1alpha3"
+
+// virtualServiceGVK returns the GroupVersionKind of the VirtualServices, whose
+// version is set by the ISTIO_VS_API_VERSION env var.
+func virtualServiceGVK() schema.GroupVersionKind {
+	version := os.Getenv("ISTIO_VS_API_VERSION")
+	if len(version) == 0 {
+		version = DefaultIstioVSAPIVersion
+	}
+	return schema.GroupVersionKind{Group: "networking.istio.io", Version: version, Kind: "VirtualService"}
+}
+
+// getRouter returns the router configured by the INGRESS_MODE and USE_ISTIO
+// env vars, or nil if the controller doesn't route the traffic.
+func (r *NotebookReconciler) getRouter() notebookRouter {
+	if os.Getenv("INGRESS_MODE") == "ingress" {
+		return &ingressRouter{r}
+	}
+	if os.Getenv("USE_ISTIO") == "true" {
+		return &virtualServiceRouter{r}
+	}
+	return nil
+}
+
+// virtualServiceRouter routes the traffic with an Istio VirtualService.
+type virtualServiceRouter struct {
+	r *NotebookReconciler
+}
+
+func (vr *virtualServiceRouter) kind() string {
+	return "VirtualService"
+}
+
+func (vr *virtualServiceRouter) newObject() runtime.Object {
+	virtualService := &unstructured.Unstructured{}
+	virtualService.SetGroupVersionKind(virtualServiceGVK())
+	return virtualService
+}
+
+func (vr *virtualServiceRouter) objectName(instance *v1beta1.Notebook) string {
+	return virtualServiceName(instance.Name, instance.Namespace)
+}
+
+func (vr *virtualServiceRouter) generate(instance *v1beta1.Notebook) (runtime.Object, error) {
+	return generateVirtualService(instance)
+}
+
+func (vr *virtualServiceRouter) reconcile(instance *v1beta1.Notebook) error {
+	return vr.r.reconcileVirtualService(instance)
+}
+
+// ingressRouter routes the traffic with a Kubernetes Ingress.
+type ingressRouter struct {
+	r *NotebookReconciler
+}
+
+func (ir *ingressRouter) kind() string {
+	return "Ingress"
+}
+
+func (ir *ingressRouter) newObject() runtime.Object {
+	return &networkingv1beta1.Ingress{}
+}
+
+func (ir *ingressRouter) objectName(instance *v1beta1.Notebook) string {
+	return instance.Name
+}
+
+// generateIngress returns an Ingress routing the requests under the prefix of
+// the Notebook to its Service. The class of the Ingress is set by the
+// INGRESS_CLASS env var and its host by INGRESS_HOST, it matches all hosts if
+// INGRESS_HOST isn't set.
+func generateIngress(instance *v1beta1.Notebook) *networkingv1beta1.Ingress {
+	ingress := &networkingv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+		},
+		Spec: networkingv1beta1.IngressSpec{
+			Rules: []networkingv1beta1.IngressRule{
+				{
+					Host: os.Getenv("INGRESS_HOST"),
+					IngressRuleValue: networkingv1beta1.IngressRuleValue{
+						HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+							Paths: []networkingv1beta1.HTTPIngressPath{
+								{
+									Path: notebookPrefix(instance) + "/",
+									Backend: networkingv1beta1.IngressBackend{
+										ServiceName: instance.Name,
+										ServicePort: intstr.FromInt(DefaultServingPort),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if ingressClass := os.Getenv("INGRESS_CLASS"); ingressClass != "" {
+		ingress.Annotations = map[string]string{"kubernetes.io/ingress.class": ingressClass}
+	}
+	return ingress
+}
+
+func (ir *ingressRouter) generate(instance *v1beta1.Notebook) (runtime.Object, error) {
+	return generateIngress(instance), nil
+}
+
+func (ir *ingressRouter) reconcile(instance *v1beta1.Notebook) error {
+	r := ir.r
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	ingress := generateIngress(instance)
+	if err := ctrl.SetControllerReference(instance, ingress, r.Scheme); err != nil {
+		return err
+	}
+	// Check if the Ingress already exists
+	foundIngress := &networkingv1beta1.Ingress{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: ingress.Name, Namespace: ingress.Namespace}, foundIngress)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating Ingress", "namespace", ingress.Namespace, "name", ingress.Name)
+		return r.Create(context.TODO(), ingress)
+	} else if err != nil {
+		return err
+	}
+
+	if reconcilehelper.CopyIngressFields(ingress, foundIngress) {
+		log.Info("Updating Ingress", "namespace", ingress.Namespace, "name", ingress.Name)
+		return r.Update(context.TODO(), foundIngress)
+	}
+	return nil
+}
+
+// RequiredAPIs returns the GroupVersionKinds of the CRDs the controller needs
+// to reconcile the Notebooks with its configuration: the Notebooks, and the
+// VirtualServices and Sidecars of Istio when it is used.
+func (r *NotebookReconciler) RequiredAPIs() []schema.GroupVersionKind {
+	gvks := []schema.GroupVersionKind{v1beta1.GroupVersion.WithKind("Notebook")}
+	if _, ok := r.getRouter().(*virtualServiceRouter); ok {
+		gvks = append(gvks, virtualServiceGVK())
+	}
+	if istioSidecarEnabled() {
+		gvks = append(gvks, sidecarGVK())
+	}
+	return gvks
+}
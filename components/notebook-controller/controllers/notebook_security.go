@@ -0,0 +1,131 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getDefaultSecurityContext returns the default securityContext of the
+// containers of the Notebooks, read from the DEFAULT_SECURITY_CONTEXT env var,
+// a JSON SecurityContext. It returns nil if the env var isn't set.
+func getDefaultSecurityContext() (*corev1.SecurityContext, error) {
+	value := os.Getenv("DEFAULT_SECURITY_CONTEXT")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	securityContext := &corev1.SecurityContext{}
+	if err := json.Unmarshal([]byte(value), securityContext); err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_SECURITY_CONTEXT %q, expected a JSON object: %v", value, err)
+	}
+	if securityContext.Privileged != nil && *securityContext.Privileged &&
+		securityContext.AllowPrivilegeEscalation != nil && !*securityContext.AllowPrivilegeEscalation {
+		return nil, fmt.Errorf("DEFAULT_SECURITY_CONTEXT can't be privileged without privilege escalation")
+	}
+	return securityContext, nil
+}
+
+func validateDefaultSecurityContext() error {
+	_, err := getDefaultSecurityContext()
+	return err
+}
+
+// applyDefaultSecurityContext sets the default securityContext on the
+// containers and initContainers of the Pod, for the fields they don't set.
+// The users opt out of a default by setting the field, e.g. runAsNonRoot to
+// false. The user and SELinux fields the PodSecurityContext sets aren't
+// defaulted either, as they would override it.
+func applyDefaultSecurityContext(podSpec *corev1.PodSpec) {
+	defaults, err := getDefaultSecurityContext()
+	if err != nil || defaults == nil {
+		// The controller doesn't start with an invalid default securityContext
+		return
+	}
+	pod := podSpec.SecurityContext
+	if pod == nil {
+		pod = &corev1.PodSecurityContext{}
+	}
+
+	apply := func(container *corev1.Container) {
+		if container.SecurityContext == nil {
+			container.SecurityContext = &corev1.SecurityContext{}
+		}
+		sc := container.SecurityContext
+		if sc.Capabilities == nil && defaults.Capabilities != nil {
+			sc.Capabilities = defaults.Capabilities.DeepCopy()
+		}
+		if sc.Privileged == nil && defaults.Privileged != nil {
+			sc.Privileged = boolPtr(*defaults.Privileged)
+		}
+		if sc.SELinuxOptions == nil && pod.SELinuxOptions == nil && defaults.SELinuxOptions != nil {
+			sc.SELinuxOptions = defaults.SELinuxOptions.DeepCopy()
+		}
+		if sc.RunAsUser == nil && pod.RunAsUser == nil && defaults.RunAsUser != nil {
+			runAsUser := *defaults.RunAsUser
+			sc.RunAsUser = &runAsUser
+		}
+		if sc.RunAsGroup == nil && pod.RunAsGroup == nil && defaults.RunAsGroup != nil {
+			runAsGroup := *defaults.RunAsGroup
+			sc.RunAsGroup = &runAsGroup
+		}
+		if sc.RunAsNonRoot == nil && pod.RunAsNonRoot == nil && defaults.RunAsNonRoot != nil {
+			sc.RunAsNonRoot = boolPtr(*defaults.RunAsNonRoot)
+		}
+		if sc.ReadOnlyRootFilesystem == nil && defaults.ReadOnlyRootFilesystem != nil {
+			sc.ReadOnlyRootFilesystem = boolPtr(*defaults.ReadOnlyRootFilesystem)
+		}
+		// The privileged containers and the ones adding CAP_SYS_ADMIN
+		// escalate their privileges, the API server rejects them otherwise
+		if sc.AllowPrivilegeEscalation == nil && defaults.AllowPrivilegeEscalation != nil &&
+			(*defaults.AllowPrivilegeEscalation || !escalatesPrivileges(sc)) {
+			sc.AllowPrivilegeEscalation = boolPtr(*defaults.AllowPrivilegeEscalation)
+		}
+		if sc.ProcMount == nil && defaults.ProcMount != nil {
+			procMount := *defaults.ProcMount
+			sc.ProcMount = &procMount
+		}
+	}
+	for i := range podSpec.InitContainers {
+		apply(&podSpec.InitContainers[i])
+	}
+	for i := range podSpec.Containers {
+		apply(&podSpec.Containers[i])
+	}
+}
+
+// escalatesPrivileges returns whether the container is privileged or adds
+// the CAP_SYS_ADMIN capability.
+func escalatesPrivileges(sc *corev1.SecurityContext) bool {
+	if sc.Privileged != nil && *sc.Privileged {
+		return true
+	}
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Add {
+			if capability == "SYS_ADMIN" || capability == "CAP_SYS_ADMIN" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,130 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	reconcilehelper "github.com/kubeflow/kubeflow/components/common/reconcilehelper"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// istioSidecarEnabled returns whether the controller creates an Istio Sidecar
+// for each Notebook, set by the ISTIO_SIDECAR env var. It requires USE_ISTIO.
+func istioSidecarEnabled() bool {
+	return os.Getenv("ISTIO_SIDECAR") == "true" && os.Getenv("USE_ISTIO") == "true"
+}
+
+// sidecarGVK returns the GroupVersionKind of the Istio Sidecars, in the
+// version of the VirtualServices.
+func sidecarGVK() schema.GroupVersionKind {
+	gvk := virtualServiceGVK()
+	gvk.Kind = "Sidecar"
+	return gvk
+}
+
+// istioGateway returns the Istio gateway routing to the Notebooks, as
+// "<namespace>/<name>", set by the ISTIO_GATEWAY env var.
+func istioGateway() string {
+	gateway := os.Getenv("ISTIO_GATEWAY")
+	if len(gateway) == 0 {
+		gateway = "kubeflow/kubeflow-gateway"
+	}
+	return gateway
+}
+
+// generateSidecar returns an Istio Sidecar restricting the configuration of
+// the proxy of the Notebook Pod to the hosts of its namespace and of the
+// namespace of the Istio gateway, instead of all the services of the mesh.
+func generateSidecar(instance *v1beta1.Notebook) (*unstructured.Unstructured, error) {
+	hosts := []interface{}{"./*"}
+	if parts := strings.SplitN(istioGateway(), "/", 2); len(parts) == 2 && parts[0] != instance.Namespace {
+		hosts = append(hosts, parts[0]+"/*")
+	}
+
+	sidecar := &unstructured.Unstructured{}
+	sidecar.SetGroupVersionKind(sidecarGVK())
+	sidecar.SetName(instance.Name)
+	sidecar.SetNamespace(instance.Namespace)
+	spec := map[string]interface{}{
+		"workloadSelector": map[string]interface{}{
+			"labels": map[string]interface{}{
+				"statefulset": instance.Name,
+			},
+		},
+		"egress": []interface{}{
+			map[string]interface{}{
+				"hosts": hosts,
+			},
+		},
+	}
+	if err := unstructured.SetNestedMap(sidecar.Object, spec, "spec"); err != nil {
+		return nil, fmt.Errorf("Set .spec error: %v", err)
+	}
+	return sidecar, nil
+}
+
+// reconcileSidecar creates or updates the Istio Sidecar of the Notebook, and
+// deletes the one the controller created when ISTIO_SIDECAR is unset.
+func (r *NotebookReconciler) reconcileSidecar(instance *v1beta1.Notebook) error {
+	// The Sidecar CRD is only installed with Istio
+	if os.Getenv("USE_ISTIO") != "true" {
+		return nil
+	}
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	foundSidecar := &unstructured.Unstructured{}
+	foundSidecar.SetGroupVersionKind(sidecarGVK())
+	err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, foundSidecar)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if !istioSidecarEnabled() {
+		if !found || !metav1.IsControlledBy(foundSidecar, instance) {
+			return nil
+		}
+		log.Info("Deleting Sidecar", "namespace", foundSidecar.GetNamespace(), "name", foundSidecar.GetName())
+		return ignoreNotFound(r.Delete(context.TODO(), foundSidecar))
+	}
+
+	sidecar, err := generateSidecar(instance)
+	if err != nil {
+		return err
+	}
+	if err := ctrl.SetControllerReference(instance, sidecar, r.Scheme); err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating Sidecar", "namespace", sidecar.GetNamespace(), "name", sidecar.GetName())
+		return r.Create(context.TODO(), sidecar)
+	}
+	// CopyVirtualService copies the spec of any unstructured object
+	if reconcilehelper.CopyVirtualService(sidecar, foundSidecar) {
+		log.Info("Updating Sidecar", "namespace", sidecar.GetNamespace(), "name", sidecar.GetName())
+		return r.Update(context.TODO(), foundSidecar)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The type of the condition reporting the progress of the restore of the
+// workspace of a Notebook from Spec.WorkspaceFrom.
+const WorkspaceRestoreCondition = "WorkspaceRestore"
+
+// The reasons of the WorkspaceRestore condition.
+const (
+	RestoreRestoring               = "Restoring"
+	RestoreCompleted               = "Completed"
+	RestoreIgnored                 = "Ignored"
+	RestoreInvalidSource           = "InvalidSource"
+	RestoreSnapshotNotFound        = "SnapshotNotFound"
+	RestoreSnapshotNotReady        = "SnapshotNotReady"
+	RestoreStorageClassNotFound    = "StorageClassNotFound"
+	RestoreStorageClassUnsupported = "StorageClassUnsupported"
+	RestoreWorkspaceNotFound       = "WorkspaceNotFound"
+	RestoreWorkspaceExists         = "WorkspaceExists"
+)
+
+// The annotation set on the PVCs restored from a VolumeSnapshot, naming the
+// snapshot. The controller only waits for the PVCs it created.
+const SnapshotSourceAnnotation = "notebook.kubeflow.org/restored-from"
+
+// The annotation marking the default StorageClass of a cluster.
+const defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+// The group of the VolumeSnapshot API.
+const snapshotGroup = "snapshot.storage.k8s.io"
+
+// The version of the VolumeSnapshot API used if the
+// VOLUME_SNAPSHOT_API_VERSION env var isn't set.
+const DefaultVolumeSnapshotAPIVersion = "v1"
+
+// snapshotGVK returns the GroupVersionKind of the given kind of the
+// VolumeSnapshot API, whose version is set by the VOLUME_SNAPSHOT_API_VERSION
+// env var.
+func snapshotGVK(kind string) schema.GroupVersionKind {
+	version := os.Getenv("VOLUME_SNAPSHOT_API_VERSION")
+	if len(version) == 0 {
+		version = DefaultVolumeSnapshotAPIVersion
+	}
+	return schema.GroupVersionKind{Group: snapshotGroup, Version: version, Kind: kind}
+}
+
+func validateVolumeSnapshotAPIVersion() error {
+	switch version := os.Getenv("VOLUME_SNAPSHOT_API_VERSION"); version {
+	case "", "v1beta1", "v1":
+		return nil
+	default:
+		return fmt.Errorf("VOLUME_SNAPSHOT_API_VERSION should be v1beta1 or v1, got %q", version)
+	}
+}
+
+// restoreInProgress returns true if the workspace of the Notebook is being
+// restored from a snapshot, in which case it must not be started.
+func restoreInProgress(instance *v1beta1.Notebook) bool {
+	if instance.Spec.WorkspaceFrom == nil {
+		return false
+	}
+	for _, c := range instance.Status.Conditions {
+		if c.Type == WorkspaceRestoreCondition && (c.Reason == RestoreCompleted || c.Reason == RestoreIgnored) {
+			return false
+		}
+	}
+	return true
+}
+
+// generateRestoredPVC returns the workspace PVC of the Notebook, restored from
+// the VolumeSnapshot of Spec.WorkspaceFrom. It is labeled with the name of
+// the Notebook so that its binding triggers a reconciliation.
+func generateRestoredPVC(instance *v1beta1.Notebook, name string, size resource.Quantity, storageClass string) *corev1.PersistentVolumeClaim {
+	apiGroup := snapshotGroup
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   instance.Namespace,
+			Labels:      map[string]string{"notebook-name": instance.Name},
+			Annotations: map[string]string{SnapshotSourceAnnotation: instance.Spec.WorkspaceFrom.SnapshotName},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+			StorageClassName: &storageClass,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     instance.Spec.WorkspaceFrom.SnapshotName,
+			},
+		},
+	}
+}
+
+// getStorageClass returns the StorageClass of the given name, or the default
+// one of the cluster if the name is empty. Returns nil if it wasn't found.
+func (r *NotebookReconciler) getStorageClass(name string) (*storagev1.StorageClass, error) {
+	ctx := context.TODO()
+	if name != "" {
+		sc := &storagev1.StorageClass{}
+		err := r.Get(ctx, types.NamespacedName{Name: name}, sc)
+		if apierrs.IsNotFound(err) {
+			return nil, nil
+		}
+		return sc, err
+	}
+	classes := &storagev1.StorageClassList{}
+	if err := r.List(ctx, classes); err != nil {
+		return nil, err
+	}
+	for i := range classes.Items {
+		if classes.Items[i].Annotations[defaultStorageClassAnnotation] == "true" {
+			return &classes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// setRestoreCondition updates the WorkspaceRestore condition of the Notebook
+// and records an event if it changed.
+func (r *NotebookReconciler) setRestoreCondition(instance *v1beta1.Notebook, reason, message string) error {
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    WorkspaceRestoreCondition,
+		Reason:  reason,
+		Message: message,
+	})
+	if !changed {
+		return nil
+	}
+
+	eventType := corev1.EventTypeNormal
+	if reason != RestoreRestoring && reason != RestoreCompleted && reason != RestoreSnapshotNotReady {
+		eventType = corev1.EventTypeWarning
+	}
+	r.EventRecorder.Event(instance, eventType, WorkspaceRestoreCondition+reason, message)
+	return r.Status().Update(context.TODO(), instance)
+}
+
+// reconcileWorkspaceRestore provisions the workspace PVC of the Notebook from
+// the VolumeSnapshot named in Spec.WorkspaceFrom, when it is created. The
+// snapshot must be ready to use and taken by the CSI driver provisioning the
+// StorageClass of the PVC. The Notebook is kept stopped until the PVC is
+// bound, or until it is created if its StorageClass binds it once the Pod is
+// scheduled.
+func (r *NotebookReconciler) reconcileWorkspaceRestore(instance *v1beta1.Notebook) error {
+	if instance.Spec.WorkspaceFrom == nil {
+		if removeNotebookCondition(&instance.Status, WorkspaceRestoreCondition) {
+			return r.Status().Update(context.TODO(), instance)
+		}
+		return nil
+	}
+	if !restoreInProgress(instance) {
+		return nil
+	}
+	ctx := context.TODO()
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	snapshotName := instance.Spec.WorkspaceFrom.SnapshotName
+
+	// Restoring over the workspace of a running Notebook would lose its data
+	if !hasNotebookCondition(&instance.Status, WorkspaceRestoreCondition) {
+		err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &appsv1.StatefulSet{})
+		if err == nil {
+			return r.setRestoreCondition(instance, RestoreIgnored,
+				fmt.Sprintf("workspaceFrom is only applied when the Notebook is created, %s was not restored",
+					snapshotName))
+		} else if !apierrs.IsNotFound(err) {
+			return err
+		}
+	}
+	if instance.Spec.CloneFrom != "" {
+		return r.setRestoreCondition(instance, RestoreInvalidSource, "cloneFrom and workspaceFrom can't be combined")
+	}
+	claim := workspaceClaimName(instance)
+	if claim == "" {
+		return r.setRestoreCondition(instance, RestoreWorkspaceNotFound,
+			fmt.Sprintf("The home directory of Notebook %s must be mounted from a PVC", instance.Name))
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: claim, Namespace: instance.Namespace}, pvc)
+	if err == nil {
+		if pvc.Annotations[SnapshotSourceAnnotation] != snapshotName {
+			return r.setRestoreCondition(instance, RestoreWorkspaceExists,
+				fmt.Sprintf("PVC %s already exists, workspaces are only restored into a new PVC. "+
+					"Delete the PVC or remove workspaceFrom", claim))
+		}
+		return r.updateRestoreProgress(instance, pvc)
+	} else if !apierrs.IsNotFound(err) {
+		return err
+	}
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(snapshotGVK("VolumeSnapshot"))
+	err = r.Get(ctx, types.NamespacedName{Name: snapshotName, Namespace: instance.Namespace}, snapshot)
+	if err != nil && apierrs.IsNotFound(err) {
+		return r.setRestoreCondition(instance, RestoreSnapshotNotFound,
+			fmt.Sprintf("VolumeSnapshot %s to restore the workspace from was not found", snapshotName))
+	} else if err != nil {
+		return err
+	}
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	restoreSize, _, _ := unstructured.NestedString(snapshot.Object, "status", "restoreSize")
+	contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+	if !ready || restoreSize == "" || contentName == "" {
+		return r.setRestoreCondition(instance, RestoreSnapshotNotReady,
+			fmt.Sprintf("Waiting for VolumeSnapshot %s to be ready to use", snapshotName))
+	}
+	size, err := resource.ParseQuantity(restoreSize)
+	if err != nil {
+		return fmt.Errorf("invalid restoreSize %q of VolumeSnapshot %s/%s: %v",
+			restoreSize, instance.Namespace, snapshotName, err)
+	}
+
+	content := &unstructured.Unstructured{}
+	content.SetGroupVersionKind(snapshotGVK("VolumeSnapshotContent"))
+	if err := r.Get(ctx, types.NamespacedName{Name: contentName}, content); err != nil {
+		return err
+	}
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+
+	className := ""
+	if instance.Spec.WorkspaceFrom.StorageClassName != nil {
+		className = *instance.Spec.WorkspaceFrom.StorageClassName
+	} else if instance.Spec.WorkspaceStorageClass != nil {
+		className = *instance.Spec.WorkspaceStorageClass
+	}
+	sc, err := r.getStorageClass(className)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		message := fmt.Sprintf("StorageClass %s was not found", className)
+		if className == "" {
+			message = "The cluster has no default StorageClass, set workspaceStorageClass"
+		}
+		return r.setRestoreCondition(instance, RestoreStorageClassNotFound, message)
+	}
+	if sc.Provisioner != driver {
+		return r.setRestoreCondition(instance, RestoreStorageClassUnsupported,
+			fmt.Sprintf("StorageClass %s is provisioned by %s, it can't restore VolumeSnapshot %s taken by %s",
+				sc.Name, sc.Provisioner, snapshotName, driver))
+	}
+
+	pvc = generateRestoredPVC(instance, claim, size, sc.Name)
+	log.Info("Creating PVC", "namespace", instance.Namespace, "name", claim, "snapshot", snapshotName)
+	if err := r.Create(ctx, pvc); err != nil {
+		return err
+	}
+	return r.updateRestoreProgress(instance, pvc)
+}
+
+// updateRestoreProgress completes the restore once the restored PVC is bound,
+// or right away if its StorageClass waits for the Pod to bind it.
+func (r *NotebookReconciler) updateRestoreProgress(instance *v1beta1.Notebook, pvc *corev1.PersistentVolumeClaim) error {
+	snapshotName := instance.Spec.WorkspaceFrom.SnapshotName
+	if pvc.Status.Phase == corev1.ClaimBound {
+		return r.setRestoreCondition(instance, RestoreCompleted,
+			fmt.Sprintf("Restored PVC %s from VolumeSnapshot %s", pvc.Name, snapshotName))
+	}
+	if pvc.Spec.StorageClassName != nil {
+		sc, err := r.getStorageClass(*pvc.Spec.StorageClassName)
+		if err != nil {
+			return err
+		}
+		if sc != nil && sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+			return r.setRestoreCondition(instance, RestoreCompleted,
+				fmt.Sprintf("PVC %s is restored from VolumeSnapshot %s once the Notebook is scheduled",
+					pvc.Name, snapshotName))
+		}
+	}
+	return r.setRestoreCondition(instance, RestoreRestoring,
+		fmt.Sprintf("Restoring PVC %s from VolumeSnapshot %s", pvc.Name, snapshotName))
+}
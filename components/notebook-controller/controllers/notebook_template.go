@@ -0,0 +1,188 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+// The type of the condition set while the NotebookTemplate referenced by the
+// Notebook doesn't exist.
+const MissingTemplateCondition = "MissingTemplate"
+
+// templateKey returns the namespaced name of the NotebookTemplate referenced
+// by the Notebook.
+func templateKey(instance *v1beta1.Notebook) types.NamespacedName {
+	ref := instance.Spec.TemplateRef
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = instance.Namespace
+	}
+	return types.NamespacedName{Name: ref.Name, Namespace: namespace}
+}
+
+// applyNotebookTemplate returns a copy of the Notebook whose pod template is
+// merged with the one of its NotebookTemplate, to generate its StatefulSet
+// and Service from. It returns the Notebook itself if it doesn't reference a
+// NotebookTemplate, and nil if the NotebookTemplate doesn't exist.
+func (r *NotebookReconciler) applyNotebookTemplate(instance *v1beta1.Notebook) (*v1beta1.Notebook, error) {
+	if instance.Spec.TemplateRef == nil {
+		return instance, nil
+	}
+	template := &v1beta1.NotebookTemplate{}
+	err := r.Get(context.TODO(), templateKey(instance), template)
+	if apierrs.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return mergeNotebookTemplate(instance, template)
+}
+
+// mergeNotebookTemplate returns a copy of the Notebook whose pod template is
+// merged with the one of the given NotebookTemplate.
+func mergeNotebookTemplate(instance *v1beta1.Notebook, template *v1beta1.NotebookTemplate) (*v1beta1.Notebook, error) {
+	podSpec, err := mergePodSpec(&template.Spec.Template.Spec, &instance.Spec.Template.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge NotebookTemplate %s: %v", templateKey(instance), err)
+	}
+	generated := instance.DeepCopy()
+	generated.Spec.Template.Spec = *podSpec
+	return generated, nil
+}
+
+// mergePodSpec merges the pod spec of a Notebook into the one of its
+// NotebookTemplate, with a strategic merge patch: the fields the Notebook
+// sets win, and its containers, volumes, env vars or volume mounts are merged
+// with the ones of the template with the same name or path. The notebook
+// container is merged with the first container of the template, unless the
+// template has one named like it.
+func mergePodSpec(template, spec *corev1.PodSpec) (*corev1.PodSpec, error) {
+	base := template.DeepCopy()
+	if len(base.Containers) != 0 && len(spec.Containers) != 0 {
+		name := spec.Containers[0].Name
+		found := false
+		for _, c := range base.Containers {
+			found = found || c.Name == name
+		}
+		if !found {
+			base.Containers[0].Name = name
+		}
+	}
+
+	original, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	patchJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	// The fields the Notebook doesn't set, e.g. an empty list of containers,
+	// shouldn't delete the ones of the template
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(patchJSON, &patch); err != nil {
+		return nil, err
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(patch, k)
+		}
+	}
+	patchJSON, err = json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, patchJSON, corev1.PodSpec{})
+	if err != nil {
+		return nil, err
+	}
+	podSpec := &corev1.PodSpec{}
+	if err := json.Unmarshal(merged, podSpec); err != nil {
+		return nil, err
+	}
+	return podSpec, nil
+}
+
+// updateMissingTemplate sets the MissingTemplate condition if the
+// NotebookTemplate of the Notebook is missing, or removes it. Returns true if
+// the status changed.
+func (r *NotebookReconciler) updateMissingTemplate(instance *v1beta1.Notebook, missing bool) bool {
+	if !missing {
+		return removeNotebookCondition(&instance.Status, MissingTemplateCondition)
+	}
+	message := fmt.Sprintf("The StatefulSet isn't generated until NotebookTemplate %s exists", templateKey(instance))
+	changed := setNotebookCondition(&instance.Status, v1beta1.NotebookCondition{
+		Type:    MissingTemplateCondition,
+		Reason:  "NotebookTemplateNotFound",
+		Message: message,
+	})
+	if changed {
+		r.EventRecorder.Event(instance, corev1.EventTypeWarning, MissingTemplateCondition, message)
+	}
+	return changed
+}
+
+// notebooksReferencingTemplate returns a handler.ToRequestsFunc enqueuing the
+// Notebooks referencing a NotebookTemplate, so that its changes are rolled
+// out.
+func (r *NotebookReconciler) notebooksReferencingTemplate() handler.ToRequestsFunc {
+	return func(a handler.MapObject) []ctrl.Request {
+		notebooks := &v1beta1.NotebookList{}
+		if err := r.List(context.TODO(), notebooks); err != nil {
+			r.Log.Error(err, "unable to list Notebooks")
+			return nil
+		}
+		requests := []ctrl.Request{}
+		for i := range notebooks.Items {
+			nb := &notebooks.Items[i]
+			if nb.Spec.TemplateRef == nil {
+				continue
+			}
+			if key := templateKey(nb); key.Name == a.Meta.GetName() && key.Namespace == a.Meta.GetNamespace() {
+				requests = append(requests, ctrl.Request{
+					NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+				})
+			}
+		}
+		return requests
+	}
+}
+
+// notebookTemplateCRDInstalled returns whether the NotebookTemplate CRD is
+// served, so that the controller keeps running without it on the clusters it
+// wasn't installed on.
+func notebookTemplateCRDInstalled(mapper meta.RESTMapper) (bool, error) {
+	gvk := v1beta1.GroupVersion.WithKind("NotebookTemplate")
+	_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
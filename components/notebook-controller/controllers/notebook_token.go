@@ -0,0 +1,210 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Setting this annotation on a Notebook generating an access token rotates
+// the token, once per distinct value, e.g. a timestamp.
+const RotateAccessTokenAnnotation = "notebook.kubeflow.org/rotate-access-token"
+
+// The annotation of the access token Secret recording the value of the
+// RotateAccessTokenAnnotation its token was generated for.
+const AccessTokenRotationAnnotation = "notebook.kubeflow.org/access-token-rotation"
+
+// The key of the token in the access token Secret.
+const AccessTokenKey = "token"
+
+// The env var of the notebook container set to the access token.
+const AccessTokenEnvVar = "NOTEBOOK_ACCESS_TOKEN"
+
+// The directory the access token Secret is mounted in, in the notebook
+// container.
+const AccessTokenPath = "/var/run/secrets/kubeflow.org/notebook"
+
+// accessTokenSecretName returns the name of the access token Secret of the
+// Notebook.
+func accessTokenSecretName(instance *v1beta1.Notebook) string {
+	return instance.Name + "-access-token"
+}
+
+// newAccessToken returns a random token of 32 bytes, hex encoded.
+func newAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// applyAccessToken mounts the access token Secret into the notebook container
+// and sets the NOTEBOOK_ACCESS_TOKEN env var from it. The mounted file follows
+// the rotations of the token, the env var is only updated when the container
+// restarts.
+func applyAccessToken(instance *v1beta1.Notebook, podSpec *corev1.PodSpec) {
+	if !instance.Spec.GenerateAccessToken {
+		return
+	}
+	container := &podSpec.Containers[0]
+	secretName := accessTokenSecretName(instance)
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name: AccessTokenEnvVar,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  AccessTokenKey,
+			},
+		},
+	})
+	if hasVolumeMount(container, AccessTokenPath) {
+		return
+	}
+	volumeName := uniqueVolumeName(podSpec, "access-token")
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: AccessTokenPath,
+		ReadOnly:  true,
+	})
+}
+
+// reconcileAccessToken creates the access token Secret of the Notebook, and
+// regenerates its token when the RotateAccessTokenAnnotation changes. The
+// Secret the controller created is deleted once GenerateAccessToken is unset.
+// Only the name of the Secret is reported in the status. Returns true if the
+// status changed.
+func (r *NotebookReconciler) reconcileAccessToken(instance *v1beta1.Notebook) (bool, error) {
+	ctx := context.TODO()
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	name := accessTokenSecretName(instance)
+	foundSecret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, foundSecret)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return false, err
+	}
+	found := err == nil
+
+	if !instance.Spec.GenerateAccessToken {
+		if found && metav1.IsControlledBy(foundSecret, instance) {
+			log.Info("Deleting access token Secret", "namespace", instance.Namespace, "name", name)
+			if err := r.Delete(ctx, foundSecret); ignoreNotFound(err) != nil {
+				return false, err
+			}
+		}
+		changed := instance.Status.AccessTokenSecret != ""
+		instance.Status.AccessTokenSecret = ""
+		return changed, nil
+	}
+
+	if found && !metav1.IsControlledBy(foundSecret, instance) {
+		return false, fmt.Errorf("secret %s/%s already exists and isn't owned by notebook %s",
+			instance.Namespace, name, instance.Name)
+	}
+
+	rotation := instance.GetAnnotations()[RotateAccessTokenAnnotation]
+	if !found || foundSecret.Annotations[AccessTokenRotationAnnotation] != rotation {
+		token, err := newAccessToken()
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   instance.Namespace,
+					Annotations: map[string]string{AccessTokenRotationAnnotation: rotation},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{AccessTokenKey: []byte(token)},
+			}
+			if err := ctrl.SetControllerReference(instance, secret, r.Scheme); err != nil {
+				return false, err
+			}
+			log.Info("Creating access token Secret", "namespace", instance.Namespace, "name", name)
+			if err := r.Create(ctx, secret); err != nil {
+				return false, err
+			}
+		} else {
+			if foundSecret.Annotations == nil {
+				foundSecret.Annotations = map[string]string{}
+			}
+			foundSecret.Annotations[AccessTokenRotationAnnotation] = rotation
+			foundSecret.Data = map[string][]byte{AccessTokenKey: []byte(token)}
+			log.Info("Rotating access token", "namespace", instance.Namespace, "name", name)
+			if err := r.Update(ctx, foundSecret); err != nil {
+				return false, err
+			}
+			r.EventRecorder.Event(instance, corev1.EventTypeNormal, "AccessTokenRotated",
+				"The access token of the notebook was rotated")
+		}
+	}
+
+	changed := instance.Status.AccessTokenSecret != name
+	instance.Status.AccessTokenSecret = name
+	return changed, nil
+}
+
+// The file of the projected ServiceAccount tokens, in their mountPath.
+const ProjectedTokenPath = "token"
+
+// applyProjectedTokens mounts the ProjectedTokens of the Notebook into the
+// notebook container, each from its own projected volume. The tokens whose
+// mountPath is already used by the container are skipped.
+func applyProjectedTokens(instance *v1beta1.Notebook, podSpec *corev1.PodSpec) {
+	container := &podSpec.Containers[0]
+	for _, token := range instance.Spec.ProjectedTokens {
+		if hasVolumeMount(container, token.MountPath) {
+			continue
+		}
+		volumeName := uniqueVolumeName(podSpec, "projected-token")
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          token.Audience,
+							ExpirationSeconds: token.ExpirationSeconds,
+							Path:              ProjectedTokenPath,
+						},
+					}},
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: token.MountPath,
+			ReadOnly:  true,
+		})
+	}
+}
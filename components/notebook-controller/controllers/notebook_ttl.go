@@ -0,0 +1,72 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The time a Notebook is kept past its deadline, so that a clock of the
+// controller ahead of the one of the API server never deletes it early.
+const TTLClockSkew = 30 * time.Second
+
+// notebookDeadline returns when the Notebook is deleted, TTLSeconds after its
+// creation plus TTLClockSkew, and whether it has a TTL.
+func notebookDeadline(instance *v1beta1.Notebook) (time.Time, bool) {
+	if instance.Spec.TTLSeconds == nil {
+		return time.Time{}, false
+	}
+	ttl := time.Duration(*instance.Spec.TTLSeconds) * time.Second
+	return instance.CreationTimestamp.Add(ttl + TTLClockSkew), true
+}
+
+// reconcileTTL deletes the Notebook, with its children, once its deadline has
+// passed, after recording an event. Returns true if it is deleted.
+func (r *NotebookReconciler) reconcileTTL(instance *v1beta1.Notebook) (bool, error) {
+	deadline, ok := notebookDeadline(instance)
+	if !ok || instance.DeletionTimestamp != nil || time.Now().Before(deadline) {
+		return false, nil
+	}
+	log := r.Log.WithValues("notebook", instance.Namespace)
+	log.Info("Deleting expired Notebook", "namespace", instance.Namespace, "name", instance.Name)
+	r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, "Expired",
+		"Deleting the notebook, created at %s, whose TTL of %ds has passed",
+		instance.CreationTimestamp.Format(time.RFC3339), *instance.Spec.TTLSeconds)
+	err := r.Delete(context.TODO(), instance, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	return true, ignoreNotFound(err)
+}
+
+// requeueBeforeDeadline requeues the Notebook at its deadline at the latest,
+// so that it is deleted on time rather than by polling.
+func requeueBeforeDeadline(instance *v1beta1.Notebook, result ctrl.Result) ctrl.Result {
+	deadline, ok := notebookDeadline(instance)
+	if !ok {
+		return result
+	}
+	// Requeue just past the deadline, it is only deleted once it has passed
+	untilDeadline := time.Until(deadline) + time.Second
+	if result.RequeueAfter == 0 || untilDeadline < result.RequeueAfter {
+		result.RequeueAfter = untilDeadline
+	}
+	return result
+}
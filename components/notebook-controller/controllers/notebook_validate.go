@@ -0,0 +1,156 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ValidateConfig checks the env vars configuring the controller. It is
+// called when the controller starts, which refuses to start if they are
+// invalid.
+func ValidateConfig() error {
+	if err := validatePrefixTemplate(); err != nil {
+		return err
+	}
+	if err := validateDefaultShmSize(); err != nil {
+		return err
+	}
+	if err := validateTmpVolumeSize(); err != nil {
+		return err
+	}
+	if err := validateRouting(); err != nil {
+		return err
+	}
+	if err := validateServicePortName(); err != nil {
+		return err
+	}
+	if err := validateRsyncConfig(); err != nil {
+		return err
+	}
+	if err := validateGPUResources(); err != nil {
+		return err
+	}
+	if err := validateDefaultResources(); err != nil {
+		return err
+	}
+	if err := validateDefaultSecurityContext(); err != nil {
+		return err
+	}
+	if err := validateDefaultNodeAffinity(); err != nil {
+		return err
+	}
+	if err := validatePodAntiAffinity(); err != nil {
+		return err
+	}
+	if err := validateEgressConfig(); err != nil {
+		return err
+	}
+	if err := validateNotebookKinds(); err != nil {
+		return err
+	}
+	if err := validateDefaultCommand(); err != nil {
+		return err
+	}
+	if err := validateDefaultLivenessProbe(); err != nil {
+		return err
+	}
+	if err := validateCullMode(); err != nil {
+		return err
+	}
+	if err := validatePlatform(); err != nil {
+		return err
+	}
+	if err := validateMaxConcurrentReconciles(); err != nil {
+		return err
+	}
+	if err := validateVolumeSnapshotAPIVersion(); err != nil {
+		return err
+	}
+	return culler.ValidateIdlenessConfig()
+}
+
+// checkContainers checks that the pod template of the Notebook has a
+// container, which the StatefulSet and the Service are generated from.
+func checkContainers(instance *v1beta1.Notebook) error {
+	if len(instance.Spec.Template.Spec.Containers) == 0 {
+		return fmt.Errorf("notebook %s/%s has no container in its pod template", instance.Namespace, instance.Name)
+	}
+	return nil
+}
+
+// GenerateChildren returns the StatefulSet, the NetworkPolicy, the Istio
+// Sidecar, the Service and the routing object the controller generates for the
+// Notebook, without a cluster, e.g. to validate a manifest in CI. The parts of
+// the resources that depend on the cluster, like the checksum of the
+// referenced configuration or the labels of the PodDefaults, are left out.
+// The NotebookTemplate referenced by the Notebook must be given, and is
+// merged into its pod template like the controller does.
+func GenerateChildren(instance *v1beta1.Notebook, template *v1beta1.NotebookTemplate) ([]runtime.Object, error) {
+	if instance.Spec.TemplateRef != nil {
+		if template == nil {
+			return nil, fmt.Errorf("notebook %s/%s references NotebookTemplate %s, which isn't given",
+				instance.Namespace, instance.Name, templateKey(instance))
+		}
+		generated, err := mergeNotebookTemplate(instance, template)
+		if err != nil {
+			return nil, err
+		}
+		instance = generated
+	}
+	if err := checkContainers(instance); err != nil {
+		return nil, err
+	}
+	if _, err := getNotebookKind(instance); err != nil {
+		return nil, err
+	}
+
+	children := []runtime.Object{generateStatefulSet(instance)}
+	if egressRestricted() {
+		allowed, err := getEgressAllowlist()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, generateEgressNetworkPolicy(instance, allowed))
+	}
+	if istioSidecarEnabled() {
+		sidecar, err := generateSidecar(instance)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, sidecar)
+	}
+	if activityServiceEnabled() {
+		children = append(children, generateActivityService(instance))
+	}
+	if instance.Spec.NetworkingMode == v1beta1.NetworkingModeNone {
+		return children, nil
+	}
+	children = append(children, generateService(instance))
+	if router := (&NotebookReconciler{}).getRouter(); router != nil {
+		routing, err := router.generate(instance)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate the %s of notebook %s/%s: %v",
+				router.kind(), instance.Namespace, instance.Name, err)
+		}
+		children = append(children, routing)
+	}
+	return children, nil
+}
@@ -23,12 +23,17 @@ import (
 	nbv1alpha1 "github.com/kubeflow/kubeflow/components/notebook-controller/api/v1alpha1"
 	nbv1beta1 "github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
 	"github.com/kubeflow/kubeflow/components/notebook-controller/controllers"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/admin"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/health"
 	controller_metrics "github.com/kubeflow/kubeflow/components/notebook-controller/pkg/metrics"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/notify"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/validation"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -47,11 +52,21 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
+	var enableValidationWebhook bool
+	var healthProbeAddr string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableValidationWebhook, "enable-validation-webhook", false,
+		"Serve the Notebook validating webhook. Requires the webhook serving certificates.")
+	flag.StringVar(&healthProbeAddr, "health-probe-addr", ":9440",
+		"The address the /healthz and /readyz probes bind to. Set to \"\" to disable them.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.Logger(true))
@@ -66,17 +81,47 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.NotebookReconciler{
+	reconciler := &controllers.NotebookReconciler{
 		Client:        mgr.GetClient(),
 		Log:           ctrl.Log.WithName("controllers").WithName("Notebook"),
 		Scheme:        mgr.GetScheme(),
 		Metrics:       controller_metrics.NewMetrics(mgr.GetClient()),
 		EventRecorder: mgr.GetEventRecorderFor("notebook-controller"),
-	}).SetupWithManager(mgr); err != nil {
+	}
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		reconciler.Notifier = notify.NewWebhookNotifier(url)
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Notebook")
 		os.Exit(1)
 	}
 
+	if enableValidationWebhook {
+		mgr.GetWebhookServer().Register(validation.ValidatePath, &webhook.Admission{
+			Handler: &validation.NotebookValidator{Reader: mgr.GetAPIReader()},
+		})
+	}
+
+	if healthProbeAddr != "" {
+		probes := &health.Server{
+			Addr: healthProbeAddr,
+			ReadyChecks: map[string]health.Checker{
+				"crds": health.CRDChecker(mgr.GetRESTMapper(), reconciler.RequiredAPIs()...),
+			},
+		}
+		if err := mgr.Add(probes); err != nil {
+			setupLog.Error(err, "unable to add the health probes")
+			os.Exit(1)
+		}
+	}
+
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		if err := mgr.Add(&admin.Server{Addr: addr, Reader: mgr.GetClient()}); err != nil {
+			setupLog.Error(err, "unable to add the admin endpoint")
+			os.Exit(1)
+		}
+	}
+
 	// uncomment when we need the conversion webhook.
 	// if err = (&nbv1beta1.Notebook{}).SetupWebhookWithManager(mgr); err != nil {
 	// 	setupLog.Error(err, "unable to create webhook", "webhook", "Captain")
@@ -0,0 +1,129 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("admin")
+
+// The path the notebooks are listed under.
+const NotebooksPath = "/notebooks"
+
+// The path the per-namespace usage is reported under.
+const UsagePath = "/usage"
+
+// NotebookState is the state of a Notebook reported by the admin endpoint.
+type NotebookState struct {
+	Namespace     string       `json:"namespace"`
+	Name          string       `json:"name"`
+	ReadyReplicas int32        `json:"readyReplicas"`
+	Stopped       bool         `json:"stopped"`
+	LastCullCheck *metav1.Time `json:"lastCullCheck,omitempty"`
+	CullReason    string       `json:"cullReason,omitempty"`
+}
+
+// Server serves a read-only JSON listing of the Notebooks managed by the
+// controller, for operators. It is meant to be added to the manager, whose
+// cache it reads from.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr string
+	// Reader is used to list the Notebooks. It should be the cached client of
+	// the manager, to avoid any call to the API server.
+	Reader client.Reader
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so that the
+// endpoint is served by every replica of the controller.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable.
+func (s *Server) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(NotebooksPath, s.handleNotebooks)
+	mux.HandleFunc(UsagePath, s.handleUsage)
+	srv := &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	log.Info("Serving the admin endpoint", "addr", s.Addr)
+
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error(err, "unable to shut down the admin endpoint")
+		}
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleNotebooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	notebooks := &v1beta1.NotebookList{}
+	opts := []client.ListOption{}
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+	if err := s.Reader.List(r.Context(), notebooks, opts...); err != nil {
+		log.Error(err, "unable to list Notebooks")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	states := []NotebookState{}
+	for _, nb := range notebooks.Items {
+		states = append(states, NotebookState{
+			Namespace:     nb.Namespace,
+			Name:          nb.Name,
+			ReadyReplicas: nb.Status.ReadyReplicas,
+			Stopped:       culler.StopAnnotationIsSet(nb.ObjectMeta),
+			LastCullCheck: nb.Status.LastCullCheck,
+			CullReason:    nb.Status.CullReason,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		log.Error(err, "unable to write the Notebooks")
+	}
+}
@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func init() {
+	v1beta1.AddToScheme(scheme.Scheme)
+}
+
+func TestHandleNotebooks(t *testing.T) {
+	running := &v1beta1.Notebook{
+		ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "ns1"},
+		Status:     v1beta1.NotebookStatus{ReadyReplicas: 1, CullReason: "CPU busy"},
+	}
+	stopped := &v1beta1.Notebook{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "stopped",
+			Namespace:   "ns2",
+			Annotations: map[string]string{culler.STOP_ANNOTATION: "2020-01-01T00:00:00Z"},
+		},
+	}
+	s := &Server{Reader: fake.NewFakeClientWithScheme(scheme.Scheme, running, stopped)}
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		expectedCode   int
+		expectedStates []NotebookState
+	}{
+		{
+			name:         "all notebooks",
+			method:       http.MethodGet,
+			url:          NotebooksPath,
+			expectedCode: http.StatusOK,
+			expectedStates: []NotebookState{
+				{Namespace: "ns1", Name: "running", ReadyReplicas: 1, CullReason: "CPU busy"},
+				{Namespace: "ns2", Name: "stopped", Stopped: true},
+			},
+		},
+		{
+			name:         "one namespace",
+			method:       http.MethodGet,
+			url:          NotebooksPath + "?namespace=ns2",
+			expectedCode: http.StatusOK,
+			expectedStates: []NotebookState{
+				{Namespace: "ns2", Name: "stopped", Stopped: true},
+			},
+		},
+		{
+			name:         "read-only",
+			method:       http.MethodDelete,
+			url:          NotebooksPath,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleNotebooks(rec, httptest.NewRequest(test.method, test.url, nil))
+			if rec.Code != test.expectedCode {
+				t.Fatalf("Got status %d, Expected %d", rec.Code, test.expectedCode)
+			}
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+
+			states := []NotebookState{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(states) != len(test.expectedStates) {
+				t.Fatalf("Got %+v, Expected %+v", states, test.expectedStates)
+			}
+			for i := range states {
+				if states[i] != test.expectedStates[i] {
+					t.Errorf("Got %+v, Expected %+v", states[i], test.expectedStates[i])
+				}
+			}
+		})
+	}
+}
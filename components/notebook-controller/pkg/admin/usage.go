@@ -0,0 +1,140 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NamespaceUsage is the aggregate usage of the Notebooks of a namespace
+// reported by the admin endpoint.
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Notebooks int    `json:"notebooks"`
+	// CPURequests and MemoryRequests sum the requests of the containers of
+	// the running Notebooks. The stopped ones don't request anything.
+	CPURequests    resource.Quantity `json:"cpuRequests"`
+	MemoryRequests resource.Quantity `json:"memoryRequests"`
+	// Storage sums the sizes of the PVCs mounted by the Notebooks, stopped or
+	// not, each PVC counted once.
+	Storage resource.Quantity `json:"storage"`
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := []client.ListOption{}
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+	notebooks := &v1beta1.NotebookList{}
+	if err := s.Reader.List(r.Context(), notebooks, opts...); err != nil {
+		log.Error(err, "unable to list Notebooks")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := s.Reader.List(r.Context(), pvcs, opts...); err != nil {
+		log.Error(err, "unable to list PersistentVolumeClaims")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(aggregateUsage(notebooks.Items, pvcs.Items)); err != nil {
+		log.Error(err, "unable to write the usage")
+	}
+}
+
+// aggregateUsage returns the usage of the Notebooks per namespace, sorted by
+// namespace.
+func aggregateUsage(notebooks []v1beta1.Notebook, pvcs []corev1.PersistentVolumeClaim) []NamespaceUsage {
+	sizes := map[string]map[string]resource.Quantity{}
+	for _, pvc := range pvcs {
+		if sizes[pvc.Namespace] == nil {
+			sizes[pvc.Namespace] = map[string]resource.Quantity{}
+		}
+		sizes[pvc.Namespace][pvc.Name] = pvcSize(&pvc)
+	}
+
+	usages := map[string]*NamespaceUsage{}
+	counted := map[string]map[string]bool{}
+	for _, nb := range notebooks {
+		usage, ok := usages[nb.Namespace]
+		if !ok {
+			usage = &NamespaceUsage{Namespace: nb.Namespace}
+			usages[nb.Namespace] = usage
+			counted[nb.Namespace] = map[string]bool{}
+		}
+		usage.Notebooks++
+
+		podSpec := &nb.Spec.Template.Spec
+		if !culler.StopAnnotationIsSet(nb.ObjectMeta) {
+			for _, container := range podSpec.Containers {
+				if cpu, ok := container.Resources.Requests[corev1.ResourceCPU]; ok {
+					usage.CPURequests.Add(cpu)
+				}
+				if memory, ok := container.Resources.Requests[corev1.ResourceMemory]; ok {
+					usage.MemoryRequests.Add(memory)
+				}
+			}
+		}
+		for _, volume := range podSpec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			name := volume.PersistentVolumeClaim.ClaimName
+			size, ok := sizes[nb.Namespace][name]
+			if !ok || counted[nb.Namespace][name] {
+				continue
+			}
+			counted[nb.Namespace][name] = true
+			usage.Storage.Add(size)
+		}
+	}
+
+	namespaces := make([]string, 0, len(usages))
+	for namespace := range usages {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	result := make([]NamespaceUsage, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		result = append(result, *usages[namespace])
+	}
+	return result
+}
+
+// pvcSize returns the capacity of the PVC once bound, else the storage it
+// requests.
+func pvcSize(pvc *corev1.PersistentVolumeClaim) resource.Quantity {
+	if size, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		return size
+	}
+	return pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/culler"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newUsageNotebook(name, namespace, cpu, memory string, claims ...string) *v1beta1.Notebook {
+	nb := &v1beta1.Notebook{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1beta1.NotebookSpec{
+			Template: v1beta1.NotebookTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name: name,
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse(cpu),
+								corev1.ResourceMemory: resource.MustParse(memory),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+	for _, claim := range claims {
+		nb.Spec.Template.Spec.Volumes = append(nb.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: claim,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			},
+		})
+	}
+	return nb
+}
+
+func newUsagePVC(name, namespace, request, capacity string) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(request)},
+			},
+		},
+	}
+	if capacity != "" {
+		pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}
+	}
+	return pvc
+}
+
+func TestHandleUsage(t *testing.T) {
+	stopped := newUsageNotebook("stopped", "ns1", "2", "4Gi", "stopped-workspace")
+	stopped.Annotations = map[string]string{culler.STOP_ANNOTATION: "2020-01-01T00:00:00Z"}
+	objects := []runtime.Object{
+		newUsageNotebook("first", "ns1", "500m", "1Gi", "first-workspace", "shared"),
+		newUsageNotebook("second", "ns1", "1", "512Mi", "shared", "missing"),
+		stopped,
+		newUsageNotebook("third", "ns2", "250m", "256Mi"),
+		newUsagePVC("first-workspace", "ns1", "10Gi", ""),
+		newUsagePVC("shared", "ns1", "5Gi", "8Gi"),
+		newUsagePVC("stopped-workspace", "ns1", "1Gi", "1Gi"),
+		// Not mounted by any Notebook
+		newUsagePVC("other", "ns1", "100Gi", "100Gi"),
+		newUsagePVC("first-workspace", "ns2", "10Gi", "10Gi"),
+	}
+	s := &Server{Reader: fake.NewFakeClientWithScheme(scheme.Scheme, objects...)}
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		expectedCode   int
+		expectedUsages []NamespaceUsage
+	}{
+		{
+			name:         "all namespaces",
+			method:       http.MethodGet,
+			url:          UsagePath,
+			expectedCode: http.StatusOK,
+			expectedUsages: []NamespaceUsage{
+				{
+					Namespace:      "ns1",
+					Notebooks:      3,
+					CPURequests:    resource.MustParse("1500m"),
+					MemoryRequests: resource.MustParse("1536Mi"),
+					Storage:        resource.MustParse("19Gi"),
+				},
+				{
+					Namespace:      "ns2",
+					Notebooks:      1,
+					CPURequests:    resource.MustParse("250m"),
+					MemoryRequests: resource.MustParse("256Mi"),
+				},
+			},
+		},
+		{
+			name:         "one namespace",
+			method:       http.MethodGet,
+			url:          UsagePath + "?namespace=ns2",
+			expectedCode: http.StatusOK,
+			expectedUsages: []NamespaceUsage{
+				{
+					Namespace:      "ns2",
+					Notebooks:      1,
+					CPURequests:    resource.MustParse("250m"),
+					MemoryRequests: resource.MustParse("256Mi"),
+				},
+			},
+		},
+		{
+			name:         "read-only",
+			method:       http.MethodPost,
+			url:          UsagePath,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleUsage(rec, httptest.NewRequest(test.method, test.url, nil))
+			if rec.Code != test.expectedCode {
+				t.Fatalf("Got status %d, Expected %d", rec.Code, test.expectedCode)
+			}
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+
+			usages := []NamespaceUsage{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &usages); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(usages) != len(test.expectedUsages) {
+				t.Fatalf("Got %+v, Expected %+v", usages, test.expectedUsages)
+			}
+			for i, usage := range usages {
+				expected := test.expectedUsages[i]
+				if usage.Namespace != expected.Namespace || usage.Notebooks != expected.Notebooks ||
+					usage.CPURequests.Cmp(expected.CPURequests) != 0 ||
+					usage.MemoryRequests.Cmp(expected.MemoryRequests) != 0 ||
+					usage.Storage.Cmp(expected.Storage) != 0 {
+					t.Errorf("Got %+v, Expected %+v", usage, expected)
+				}
+			}
+		})
+	}
+}
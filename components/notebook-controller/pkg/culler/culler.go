@@ -1,15 +1,22 @@
 package culler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
@@ -25,6 +32,8 @@ const DEFAULT_IDLE_TIME = "1440" // One day
 const DEFAULT_CULLING_CHECK_PERIOD = "1"
 const DEFAULT_ENABLE_CULLING = "false"
 const DEFAULT_CLUSTER_DOMAIN = "cluster.local"
+const DEFAULT_IDLENESS_LOGIC = "and"
+const DEFAULT_CULL_MIN_LIFETIME = "0"
 
 // When a Resource should be stopped/culled, then the controller should add this
 // annotation in the Resource's Metadata. Then, inside the reconcile loop,
@@ -36,6 +45,52 @@ const DEFAULT_CLUSTER_DOMAIN = "cluster.local"
 // this annotation is set. If it's not set, then it will make the replicas 1.
 const STOP_ANNOTATION = "kubeflow-resource-stopped"
 
+// While CPU culling is enabled, the controller sets this annotation on a
+// Notebook when the CPU usage of its Pod drops below CULL_CPU_IDLE_THRESHOLD,
+// and removes it when the usage goes back above. The value is a timestamp of
+// when the usage dropped. The CPU is considered idle once IDLE_TIME has passed
+// since then.
+const CPU_IDLE_ANNOTATION = "notebook.kubeflow.org/cpu-idle-since"
+
+// When a Notebook is started again, i.e. its STOP_ANNOTATION is removed, this
+// annotation is set to the time it was started. The Notebook isn't culled
+// before IDLE_TIME has passed since then, whatever the activity reported by
+// its server, which may still be the one from before it was stopped.
+const LAST_STARTED_ANNOTATION = "notebook.kubeflow.org/last-started"
+
+// Why the Notebook was stopped, set along with the STOP_ANNOTATION by what
+// stops it: STOP_REASON_CULLED by the culler, STOP_REASON_SCHEDULED by the
+// tools stopping Notebooks on a schedule. Notebooks stopped without it were
+// stopped by hand. It is removed when the Notebook is started again.
+const STOP_REASON_ANNOTATION = "notebook.kubeflow.org/stop-reason"
+
+// When workspace culling is enabled, the controller records in this
+// annotation the last time a file of the workspace of the Notebook was
+// modified, as reported by its workspace check sidecar. For an empty
+// workspace, it records when the workspace was first found empty. It is
+// removed while the workspace can't be checked.
+const WORKSPACE_MODIFIED_ANNOTATION = "notebook.kubeflow.org/workspace-modified-at"
+
+// The path the workspace check sidecar serves the WorkspaceStatus on.
+const WORKSPACE_CHECK_PATH = "/workspace"
+
+const (
+	STOP_REASON_CULLED    = "culled"
+	STOP_REASON_SCHEDULED = "scheduled"
+)
+
+// CullingDecision is the outcome of a culling check.
+type CullingDecision struct {
+	// Cull is whether the Notebook should be stopped.
+	Cull bool
+	// Reason explains the decision. It is empty if the Notebook wasn't
+	// checked, e.g. because culling is disabled.
+	Reason string
+	// IdleSince is when the Notebook became idle, if it is culled. It is
+	// zero if the time is unknown.
+	IdleSince time.Time
+}
+
 type NotebookStatus struct {
 	Started      string `json:"started"`
 	LastActivity string `json:"last_activity"`
@@ -43,6 +98,13 @@ type NotebookStatus struct {
 	Kernels      int    `json:"kernels"`
 }
 
+// WorkspaceStatus is reported by the workspace check sidecar of a Notebook.
+// LastModified is the last modification time of the files of the workspace,
+// empty if it has no file.
+type WorkspaceStatus struct {
+	LastModified string `json:"last_modified"`
+}
+
 // Some Utility Functions
 func getEnvDefault(variable string, defaultVal string) string {
 	envVar := os.Getenv(variable)
@@ -87,6 +149,29 @@ func getMaxIdleTime() time.Duration {
 	return time.Minute * time.Duration(realIdleTime)
 }
 
+func getMinLifetime() time.Duration {
+	minLifetime := getEnvDefault("CULL_MIN_LIFETIME", DEFAULT_CULL_MIN_LIFETIME)
+	realMinLifetime, err := strconv.Atoi(minLifetime)
+	if err != nil || realMinLifetime < 0 {
+		log.Info(fmt.Sprintf(
+			"CULL_MIN_LIFETIME should be a non-negative Int. Got %s instead. Using default value.",
+			minLifetime))
+		realMinLifetime, _ = strconv.Atoi(DEFAULT_CULL_MIN_LIFETIME)
+	}
+
+	return time.Minute * time.Duration(realMinLifetime)
+}
+
+// notebookIsTooYoung returns whether the Notebook was created less than
+// CULL_MIN_LIFETIME ago, in which case it is never culled, whatever its
+// activity. Notebooks without a creation timestamp aren't guarded.
+func notebookIsTooYoung(created metav1.Time) bool {
+	if created.IsZero() {
+		return false
+	}
+	return time.Since(created.Time) < getMinLifetime()
+}
+
 // Stop Annotation handling functions
 func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	if meta == nil {
@@ -107,6 +192,9 @@ func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	}
 }
 
+// RemoveStopAnnotation starts the Notebook again: it removes the
+// STOP_ANNOTATION and sets the LAST_STARTED_ANNOTATION, so that the Notebook
+// gets a full idle window before it is culled again.
 func RemoveStopAnnotation(meta *metav1.ObjectMeta) {
 	if meta == nil {
 		log.Info("Error: Metadata is Nil. Can't remove Annotations")
@@ -114,12 +202,27 @@ func RemoveStopAnnotation(meta *metav1.ObjectMeta) {
 	}
 
 	if meta.GetAnnotations() == nil {
-		return
+		meta.SetAnnotations(map[string]string{})
 	}
+	delete(meta.Annotations, STOP_ANNOTATION)
+	delete(meta.Annotations, STOP_REASON_ANNOTATION)
+	meta.Annotations[LAST_STARTED_ANNOTATION] = createTimestamp()
+}
 
-	if _, ok := meta.GetAnnotations()[STOP_ANNOTATION]; ok {
-		delete(meta.GetAnnotations(), STOP_ANNOTATION)
+// recentlyStarted returns whether the Notebook was started again less than
+// IDLE_TIME ago, and when.
+func recentlyStarted(meta metav1.ObjectMeta) (bool, string) {
+	started, ok := meta.GetAnnotations()[LAST_STARTED_ANNOTATION]
+	if !ok {
+		return false, ""
+	}
+	t, err := time.Parse(time.RFC3339, started)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error parsing the %s annotation of Notebook %s/%s",
+			LAST_STARTED_ANNOTATION, meta.Namespace, meta.Name), "error", err)
+		return false, ""
 	}
+	return time.Since(t) < getMaxIdleTime(), started
 }
 
 func StopAnnotationIsSet(meta metav1.ObjectMeta) bool {
@@ -134,13 +237,286 @@ func StopAnnotationIsSet(meta metav1.ObjectMeta) bool {
 	}
 }
 
+// CPU idleness functions
+
+// ValidateIdlenessConfig checks the CULL_CPU_IDLE_THRESHOLD,
+// CULL_WORKSPACE_CHECK_PORT, CULL_IDLENESS_LOGIC and CULL_MIN_LIFETIME env
+// vars.
+func ValidateIdlenessConfig() error {
+	if threshold := os.Getenv("CULL_CPU_IDLE_THRESHOLD"); len(threshold) != 0 {
+		q, err := resource.ParseQuantity(threshold)
+		if err != nil {
+			return fmt.Errorf("invalid CULL_CPU_IDLE_THRESHOLD %q: %v", threshold, err)
+		}
+		if q.Sign() <= 0 {
+			return fmt.Errorf("CULL_CPU_IDLE_THRESHOLD should be positive, got %q", threshold)
+		}
+	}
+	if port := os.Getenv("CULL_WORKSPACE_CHECK_PORT"); len(port) != 0 {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("CULL_WORKSPACE_CHECK_PORT should be a port number, got %q", port)
+		}
+	}
+	logic := getEnvDefault("CULL_IDLENESS_LOGIC", DEFAULT_IDLENESS_LOGIC)
+	if logic != "and" && logic != "or" {
+		return fmt.Errorf("CULL_IDLENESS_LOGIC should be \"and\" or \"or\", got %q", logic)
+	}
+	minLifetime := getEnvDefault("CULL_MIN_LIFETIME", DEFAULT_CULL_MIN_LIFETIME)
+	if m, err := strconv.Atoi(minLifetime); err != nil || m < 0 {
+		return fmt.Errorf("CULL_MIN_LIFETIME should be a non-negative number of minutes, got %q", minLifetime)
+	}
+	return nil
+}
+
+// getCPUIdleThreshold returns the CPU usage under which a Notebook is idle, or
+// nil if CPU culling is disabled.
+func getCPUIdleThreshold() *resource.Quantity {
+	threshold := os.Getenv("CULL_CPU_IDLE_THRESHOLD")
+	if len(threshold) == 0 {
+		return nil
+	}
+	q, err := resource.ParseQuantity(threshold)
+	if err != nil || q.Sign() <= 0 {
+		return nil
+	}
+	return &q
+}
+
+// CPUCullingEnabled returns whether the CPU usage of the Notebooks is taken
+// into account to cull them, i.e. whether CULL_CPU_IDLE_THRESHOLD is set.
+func CPUCullingEnabled() bool {
+	return getCPUIdleThreshold() != nil
+}
+
+// GetPodCPUUsage returns the CPU usage of the Pod, summed over its containers,
+// as reported by the metrics API. The usage is averaged by the metrics server
+// over its scraping window.
+func GetPodCPUUsage(c k8sclient.Reader, pod *corev1.Pod) (*resource.Quantity, error) {
+	podMetrics := &unstructured.Unstructured{}
+	podMetrics.SetAPIVersion("metrics.k8s.io/v1beta1")
+	podMetrics.SetKind("PodMetrics")
+	key := types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}
+	if err := c.Get(context.TODO(), key, podMetrics); err != nil {
+		return nil, err
+	}
+	return podMetricsCPUUsage(podMetrics)
+}
+
+func podMetricsCPUUsage(podMetrics *unstructured.Unstructured) (*resource.Quantity, error) {
+	containers, _, err := unstructured.NestedSlice(podMetrics.Object, "containers")
+	if err != nil {
+		return nil, err
+	}
+	usage := resource.MustParse("0")
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected container metrics: %v", c)
+		}
+		cpu, _, err := unstructured.NestedString(container, "usage", "cpu")
+		if err != nil {
+			return nil, err
+		}
+		q, err := resource.ParseQuantity(cpu)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU usage %q: %v", cpu, err)
+		}
+		usage.Add(q)
+	}
+	return &usage, nil
+}
+
+// UpdateCPUIdleAnnotation sets the CPU idle annotation if the usage is below
+// CULL_CPU_IDLE_THRESHOLD and removes it otherwise. It returns whether the
+// annotations changed.
+func UpdateCPUIdleAnnotation(meta *metav1.ObjectMeta, usage *resource.Quantity) bool {
+	threshold := getCPUIdleThreshold()
+	if threshold == nil || usage.Cmp(*threshold) >= 0 {
+		return RemoveCPUIdleAnnotation(meta)
+	}
+	if _, ok := meta.GetAnnotations()[CPU_IDLE_ANNOTATION]; ok {
+		return false
+	}
+	if meta.GetAnnotations() == nil {
+		meta.SetAnnotations(map[string]string{})
+	}
+	meta.Annotations[CPU_IDLE_ANNOTATION] = createTimestamp()
+	return true
+}
+
+// RemoveCPUIdleAnnotation removes the CPU idle annotation and returns whether
+// it was set.
+func RemoveCPUIdleAnnotation(meta *metav1.ObjectMeta) bool {
+	if _, ok := meta.GetAnnotations()[CPU_IDLE_ANNOTATION]; !ok {
+		return false
+	}
+	delete(meta.Annotations, CPU_IDLE_ANNOTATION)
+	return true
+}
+
+func cpuIsIdle(meta metav1.ObjectMeta) bool {
+	t, ok := cpuIdleSince(meta)
+	if !ok {
+		return false
+	}
+	return time.Now().After(t.Add(getMaxIdleTime()))
+}
+
+// cpuIdleSince returns the time recorded by the CPU_IDLE_ANNOTATION, if it is
+// set and valid.
+func cpuIdleSince(meta metav1.ObjectMeta) (time.Time, bool) {
+	idleSince, ok := meta.GetAnnotations()[CPU_IDLE_ANNOTATION]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, idleSince)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error parsing the %s annotation of Notebook %s/%s",
+			CPU_IDLE_ANNOTATION, meta.GetNamespace(), meta.GetName()),
+			"error", err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func cpuReason(meta metav1.ObjectMeta, idle bool) string {
+	idleSince, ok := meta.GetAnnotations()[CPU_IDLE_ANNOTATION]
+	if !ok {
+		return "CPU busy"
+	}
+	if idle {
+		return fmt.Sprintf("CPU idle since %s, longer than %v", idleSince, getMaxIdleTime())
+	}
+	return fmt.Sprintf("CPU idle since %s, less than %v", idleSince, getMaxIdleTime())
+}
+
+// getWorkspaceCheckPort returns the port the workspace check sidecar of the
+// Notebook Pods listens on, or 0 if workspace culling is disabled.
+func getWorkspaceCheckPort() int {
+	port, err := strconv.Atoi(os.Getenv("CULL_WORKSPACE_CHECK_PORT"))
+	if err != nil || port < 1 || port > 65535 {
+		return 0
+	}
+	return port
+}
+
+// WorkspaceCullingEnabled returns whether the last modification of the files
+// of the workspaces is taken into account to cull the Notebooks, i.e. whether
+// CULL_WORKSPACE_CHECK_PORT is set.
+func WorkspaceCullingEnabled() bool {
+	return getWorkspaceCheckPort() != 0
+}
+
+// GetWorkspaceLastModified asks the workspace check sidecar of the Pod when a
+// file of the workspace was last modified. It returns nil if the workspace
+// has no file, and an error if it couldn't be checked, e.g. because the
+// sidecar can't read some of the files.
+func GetWorkspaceLastModified(pod *corev1.Pod) (*time.Time, error) {
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("pod %s/%s has no IP", pod.Namespace, pod.Name)
+	}
+	url := fmt.Sprintf("http://%s:%d%s", pod.Status.PodIP, getWorkspaceCheckPort(), WORKSPACE_CHECK_PATH)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %d", url, resp.StatusCode)
+	}
+
+	status := &WorkspaceStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("unable to parse the response of %s: %v", url, err)
+	}
+	if status.LastModified == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, status.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last modification %q: %v", status.LastModified, err)
+	}
+	return &t, nil
+}
+
+// UpdateWorkspaceAnnotation records the last modification of the files of
+// the workspace in the workspace modified annotation. For an empty workspace,
+// the annotation is only set if it wasn't, to when it was first found empty.
+// It returns whether the annotations changed.
+func UpdateWorkspaceAnnotation(meta *metav1.ObjectMeta, lastModified *time.Time) bool {
+	current, ok := meta.GetAnnotations()[WORKSPACE_MODIFIED_ANNOTATION]
+	if lastModified == nil && ok {
+		return false
+	}
+	value := createTimestamp()
+	if lastModified != nil {
+		value = lastModified.UTC().Format(time.RFC3339)
+	}
+	if ok && current == value {
+		return false
+	}
+	if meta.GetAnnotations() == nil {
+		meta.SetAnnotations(map[string]string{})
+	}
+	meta.Annotations[WORKSPACE_MODIFIED_ANNOTATION] = value
+	return true
+}
+
+// RemoveWorkspaceAnnotation removes the workspace modified annotation and
+// returns whether it was set.
+func RemoveWorkspaceAnnotation(meta *metav1.ObjectMeta) bool {
+	if _, ok := meta.GetAnnotations()[WORKSPACE_MODIFIED_ANNOTATION]; !ok {
+		return false
+	}
+	delete(meta.Annotations, WORKSPACE_MODIFIED_ANNOTATION)
+	return true
+}
+
+// workspaceModifiedAt returns the time recorded by the
+// WORKSPACE_MODIFIED_ANNOTATION, if it is set and valid.
+func workspaceModifiedAt(meta metav1.ObjectMeta) (time.Time, bool) {
+	modified, ok := meta.GetAnnotations()[WORKSPACE_MODIFIED_ANNOTATION]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, modified)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error parsing the %s annotation of Notebook %s/%s",
+			WORKSPACE_MODIFIED_ANNOTATION, meta.GetNamespace(), meta.GetName()),
+			"error", err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func workspaceIsIdle(meta metav1.ObjectMeta) bool {
+	t, ok := workspaceModifiedAt(meta)
+	if !ok {
+		return false
+	}
+	return time.Now().After(t.Add(getMaxIdleTime()))
+}
+
+func workspaceReason(meta metav1.ObjectMeta, idle bool) string {
+	modified, ok := meta.GetAnnotations()[WORKSPACE_MODIFIED_ANNOTATION]
+	if !ok {
+		return "workspace not checked"
+	}
+	if idle {
+		return fmt.Sprintf("workspace unmodified since %s, longer than %v", modified, getMaxIdleTime())
+	}
+	return fmt.Sprintf("workspace modified at %s, less than %v ago", modified, getMaxIdleTime())
+}
+
 // Culling Logic
-func getNotebookApiStatus(nm, ns string) *NotebookStatus {
+func getNotebookApiStatus(service, ns, prefix string) *NotebookStatus {
 	// Get the Notebook Status from the Server's /api/status endpoint
 	domain := getEnvDefault("CLUSTER_DOMAIN", DEFAULT_CLUSTER_DOMAIN)
 	url := fmt.Sprintf(
-		"http://%s.%s.svc.%s/notebook/%s/%s/api/status",
-		nm, ns, domain, ns, nm)
+		"http://%s.%s.svc.%s%s/api/status",
+		service, ns, domain, prefix)
 
 	resp, err := client.Get(url)
 	if err != nil {
@@ -160,7 +536,7 @@ func getNotebookApiStatus(nm, ns string) *NotebookStatus {
 	err = json.NewDecoder(resp.Body).Decode(status)
 	if err != nil {
 		log.Info(fmt.Sprintf(
-			"Error parsing the JSON response for Notebook %s/%s", nm, ns),
+			"Error parsing the JSON response of %s", url),
 			"error", err)
 		return nil
 	}
@@ -188,19 +564,97 @@ func notebookIsIdle(nm, ns string, status *NotebookStatus) bool {
 	return false
 }
 
-func NotebookNeedsCulling(nbMeta metav1.ObjectMeta) bool {
+func activityReason(status *NotebookStatus, idle bool) string {
+	if status == nil {
+		return "notebook server status unavailable"
+	}
+	if _, err := time.Parse(time.RFC3339, status.LastActivity); err != nil {
+		return fmt.Sprintf("invalid last activity %q", status.LastActivity)
+	}
+	if idle {
+		return fmt.Sprintf("no activity since %s, longer than %v", status.LastActivity, getMaxIdleTime())
+	}
+	return fmt.Sprintf("last activity at %s, less than %v ago", status.LastActivity, getMaxIdleTime())
+}
+
+// NotebookNeedsCulling checks whether the Notebook served by the given Service
+// under the given URL prefix has been idle for longer than IDLE_TIME. If CPU
+// culling is enabled, the CPU idleness recorded by the CPU idle annotation is
+// combined with the activity reported by the server, according to
+// CULL_IDLENESS_LOGIC: with "and" both must be idle, with "or" either. So is
+// the last modification of the workspace recorded by the workspace modified
+// annotation, if workspace culling is enabled. A workspace that couldn't be
+// checked is never idle. Notebooks started again less
+// than IDLE_TIME ago, or created less than
+// CULL_MIN_LIFETIME ago are never culled, so that they aren't stopped before
+// the server reports their first activity.
+func NotebookNeedsCulling(nbMeta metav1.ObjectMeta, service, prefix string) CullingDecision {
 	if getEnvDefault("ENABLE_CULLING", DEFAULT_ENABLE_CULLING) != "true" {
 		log.Info("Culling of idle Pods is Disabled. To enable it set the " +
 			"ENV Var 'ENABLE_CULLING=true'")
-		return false
+		return CullingDecision{}
 	}
 
 	nm, ns := nbMeta.GetName(), nbMeta.GetNamespace()
 	if StopAnnotationIsSet(nbMeta) {
 		log.Info(fmt.Sprintf("Notebook %s/%s is already stopping", ns, nm))
-		return false
+		return CullingDecision{}
 	}
 
-	notebookStatus := getNotebookApiStatus(nm, ns)
-	return notebookIsIdle(nm, ns, notebookStatus)
+	if started, at := recentlyStarted(nbMeta); started {
+		return CullingDecision{
+			Cull:   false,
+			Reason: fmt.Sprintf("started at %s, less than %v ago", at, getMaxIdleTime()),
+		}
+	}
+
+	if notebookIsTooYoung(nbMeta.CreationTimestamp) {
+		return CullingDecision{
+			Cull: false,
+			Reason: fmt.Sprintf("created at %s, less than %v ago",
+				nbMeta.CreationTimestamp.Format(time.RFC3339), getMinLifetime()),
+		}
+	}
+
+	reasons := []string{}
+	or := getEnvDefault("CULL_IDLENESS_LOGIC", DEFAULT_IDLENESS_LOGIC) == "or"
+	if CPUCullingEnabled() {
+		cpuIdle := cpuIsIdle(nbMeta)
+		reasons = append(reasons, cpuReason(nbMeta, cpuIdle))
+		if or && cpuIdle {
+			since, _ := cpuIdleSince(nbMeta)
+			return CullingDecision{Cull: true, Reason: strings.Join(reasons, "; "), IdleSince: since}
+		}
+		if !or && !cpuIdle {
+			return CullingDecision{Cull: false, Reason: strings.Join(reasons, "; ")}
+		}
+	}
+	if WorkspaceCullingEnabled() {
+		workspaceIdle := workspaceIsIdle(nbMeta)
+		reasons = append(reasons, workspaceReason(nbMeta, workspaceIdle))
+		if or && workspaceIdle {
+			since, _ := workspaceModifiedAt(nbMeta)
+			return CullingDecision{Cull: true, Reason: strings.Join(reasons, "; "), IdleSince: since}
+		}
+		if !or && !workspaceIdle {
+			return CullingDecision{Cull: false, Reason: strings.Join(reasons, "; ")}
+		}
+	}
+
+	notebookStatus := getNotebookApiStatus(service, ns, prefix)
+	idle := notebookIsIdle(nm, ns, notebookStatus)
+	reasons = append(reasons, activityReason(notebookStatus, idle))
+	decision := CullingDecision{Cull: idle, Reason: strings.Join(reasons, "; ")}
+	if idle {
+		// The activity and, when they are enabled, the CPU and the workspace
+		// are idle: the Notebook is idle since the latest of them
+		decision.IdleSince, _ = time.Parse(time.RFC3339, notebookStatus.LastActivity)
+		if since, ok := cpuIdleSince(nbMeta); ok && CPUCullingEnabled() && since.After(decision.IdleSince) {
+			decision.IdleSince = since
+		}
+		if since, ok := workspaceModifiedAt(nbMeta); ok && WorkspaceCullingEnabled() && since.After(decision.IdleSince) {
+			decision.IdleSince = since
+		}
+	}
+	return decision
 }
@@ -1,11 +1,18 @@
 package culler
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 func TestSetStopAnnotation(t *testing.T) {
@@ -91,10 +98,48 @@ func TestRemoveStopAnnotation(t *testing.T) {
 			if _, ok := c.meta.Annotations[STOP_ANNOTATION]; ok {
 				t.Errorf("Stop Annotation not removed for case: %+v", c)
 			}
+			if _, ok := c.meta.Annotations[LAST_STARTED_ANNOTATION]; !ok {
+				t.Errorf("Last started Annotation not set for case: %+v", c)
+			}
 		})
 	}
 }
 
+func TestRestartedNotebookIsNotCulled(t *testing.T) {
+	os.Setenv("ENABLE_CULLING", "true")
+	os.Setenv("CULL_CPU_IDLE_THRESHOLD", "50m")
+	os.Setenv("CULL_IDLENESS_LOGIC", "or")
+	os.Setenv("IDLE_TIME", "5")
+	defer func() {
+		os.Unsetenv("CULL_CPU_IDLE_THRESHOLD")
+		os.Unsetenv("CULL_IDLENESS_LOGIC")
+	}()
+
+	// The CPU was idle long before the Notebook was culled
+	meta := metav1.ObjectMeta{
+		Annotations: map[string]string{
+			CPU_IDLE_ANNOTATION: time.Now().Add(-time.Hour).Format(time.RFC3339),
+			STOP_ANNOTATION:     time.Now().Add(-time.Minute).Format(time.RFC3339),
+		},
+	}
+	RemoveStopAnnotation(&meta)
+
+	decision := NotebookNeedsCulling(meta, meta.Name, "/notebook/kubeflow/test")
+	if decision.Cull {
+		t.Errorf("Notebook culled right after it was started again: %s", decision.Reason)
+	}
+	started := meta.Annotations[LAST_STARTED_ANNOTATION]
+	if expected := "started at " + started + ", less than 5m0s ago"; decision.Reason != expected {
+		t.Errorf("Expected reason %q, got %q", expected, decision.Reason)
+	}
+
+	// Once IDLE_TIME has passed since it was started, it can be culled again
+	meta.Annotations[LAST_STARTED_ANNOTATION] = time.Now().Add(-6 * time.Minute).Format(time.RFC3339)
+	if decision := NotebookNeedsCulling(meta, meta.Name, "/notebook/kubeflow/test"); !decision.Cull {
+		t.Errorf("Notebook not culled once IDLE_TIME passed: %s", decision.Reason)
+	}
+}
+
 func TestStopAnnotationIsSet(t *testing.T) {
 	testCases := []struct {
 		testName string
@@ -215,11 +260,15 @@ func TestNotebookIsIdle(t *testing.T) {
 }
 
 func TestNotebookNeedsCulling(t *testing.T) {
+	idleSince := time.Now().Add(-6 * time.Minute).Format(time.RFC3339)
+	created := time.Now().Add(-time.Minute)
 	testCases := []struct {
-		testName string
-		meta     metav1.ObjectMeta
-		env      map[string]string
-		result   bool
+		testName  string
+		meta      metav1.ObjectMeta
+		env       map[string]string
+		result    bool
+		reason    string
+		idleSince string
 	}{
 		{
 			testName: "ENABLE_CULLING disabled",
@@ -241,6 +290,96 @@ func TestNotebookNeedsCulling(t *testing.T) {
 			},
 			result: false,
 		},
+		{
+			testName: "CPU is idle with the or logic",
+			env: map[string]string{
+				"ENABLE_CULLING":          "true",
+				"CULL_CPU_IDLE_THRESHOLD": "50m",
+				"CULL_IDLENESS_LOGIC":     "or",
+				"IDLE_TIME":               "5",
+			},
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					CPU_IDLE_ANNOTATION: idleSince,
+				},
+			},
+			result:    true,
+			reason:    "CPU idle since " + idleSince + ", longer than 5m0s",
+			idleSince: idleSince,
+		},
+		{
+			testName: "CPU is busy with the and logic",
+			env: map[string]string{
+				"ENABLE_CULLING":          "true",
+				"CULL_CPU_IDLE_THRESHOLD": "50m",
+				"CULL_IDLENESS_LOGIC":     "and",
+				"IDLE_TIME":               "5",
+			},
+			meta:   metav1.ObjectMeta{},
+			result: false,
+			reason: "CPU busy",
+		},
+		{
+			testName: "Workspace unmodified with the or logic",
+			env: map[string]string{
+				"ENABLE_CULLING":            "true",
+				"CULL_CPU_IDLE_THRESHOLD":   "",
+				"CULL_WORKSPACE_CHECK_PORT": "8888",
+				"CULL_IDLENESS_LOGIC":       "or",
+				"IDLE_TIME":                 "5",
+			},
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					WORKSPACE_MODIFIED_ANNOTATION: idleSince,
+				},
+			},
+			result:    true,
+			reason:    "workspace unmodified since " + idleSince + ", longer than 5m0s",
+			idleSince: idleSince,
+		},
+		{
+			testName: "Workspace recently modified with the and logic",
+			env: map[string]string{
+				"ENABLE_CULLING":            "true",
+				"CULL_CPU_IDLE_THRESHOLD":   "",
+				"CULL_WORKSPACE_CHECK_PORT": "8888",
+				"CULL_IDLENESS_LOGIC":       "and",
+				"IDLE_TIME":                 "5",
+			},
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					WORKSPACE_MODIFIED_ANNOTATION: created.Format(time.RFC3339),
+				},
+			},
+			result: false,
+			reason: "workspace modified at " + created.Format(time.RFC3339) + ", less than 5m0s ago",
+		},
+		{
+			testName: "Workspace not checked with the and logic",
+			env: map[string]string{
+				"ENABLE_CULLING":            "true",
+				"CULL_CPU_IDLE_THRESHOLD":   "",
+				"CULL_WORKSPACE_CHECK_PORT": "8888",
+				"CULL_IDLENESS_LOGIC":       "and",
+				"IDLE_TIME":                 "5",
+			},
+			meta:   metav1.ObjectMeta{},
+			result: false,
+			reason: "workspace not checked",
+		},
+		{
+			testName: "Notebook younger than CULL_MIN_LIFETIME",
+			env: map[string]string{
+				"ENABLE_CULLING":          "true",
+				"CULL_CPU_IDLE_THRESHOLD": "",
+				"CULL_MIN_LIFETIME":       "10",
+			},
+			meta: metav1.ObjectMeta{
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			result: false,
+			reason: "created at " + created.Format(time.RFC3339) + ", less than 10m0s ago",
+		},
 	}
 
 	for _, c := range testCases {
@@ -250,10 +389,403 @@ func TestNotebookNeedsCulling(t *testing.T) {
 				os.Setenv(envVar, val)
 			}
 
-			if NotebookNeedsCulling(c.meta) != c.result {
+			decision := NotebookNeedsCulling(c.meta, c.meta.Name, "/notebook/kubeflow/test")
+			if decision.Cull != c.result {
+				t.Errorf("Wrong result for case: %+v", c)
+			}
+			if decision.Reason != c.reason {
+				t.Errorf("Expected reason %q, got %q", c.reason, decision.Reason)
+			}
+			if c.idleSince != "" && decision.IdleSince.Format(time.RFC3339) != c.idleSince {
+				t.Errorf("Expected idle since %s, got %v", c.idleSince, decision.IdleSince)
+			}
+		})
+	}
+	os.Unsetenv("CULL_CPU_IDLE_THRESHOLD")
+	os.Unsetenv("CULL_WORKSPACE_CHECK_PORT")
+	os.Unsetenv("CULL_IDLENESS_LOGIC")
+	os.Unsetenv("CULL_MIN_LIFETIME")
+}
+
+func TestActivityReason(t *testing.T) {
+	os.Setenv("IDLE_TIME", "5")
+	lastActivity := "1996-04-11T00:00:00Z"
+	testCases := []struct {
+		testName string
+		status   *NotebookStatus
+		idle     bool
+		reason   string
+	}{
+		{
+			testName: "No Notebook Status received from Server",
+			status:   nil,
+			reason:   "notebook server status unavailable",
+		},
+		{
+			testName: "LastActivity is not RF3339 formated",
+			status:   &NotebookStatus{LastActivity: "should-fail"},
+			reason:   `invalid last activity "should-fail"`,
+		},
+		{
+			testName: "Idle",
+			status:   &NotebookStatus{LastActivity: lastActivity},
+			idle:     true,
+			reason:   "no activity since 1996-04-11T00:00:00Z, longer than 5m0s",
+		},
+		{
+			testName: "Active",
+			status:   &NotebookStatus{LastActivity: lastActivity},
+			idle:     false,
+			reason:   "last activity at 1996-04-11T00:00:00Z, less than 5m0s ago",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			if reason := activityReason(c.status, c.idle); reason != c.reason {
+				t.Errorf("Expected reason %q, got %q", c.reason, reason)
+			}
+		})
+	}
+}
+
+func TestValidateIdlenessConfig(t *testing.T) {
+	testCases := []struct {
+		testName string
+		env      map[string]string
+		valid    bool
+	}{
+		{
+			testName: "Unset",
+			env:      map[string]string{},
+			valid:    true,
+		},
+		{
+			testName: "Valid threshold and logic",
+			env: map[string]string{
+				"CULL_CPU_IDLE_THRESHOLD": "50m",
+				"CULL_IDLENESS_LOGIC":     "or",
+			},
+			valid: true,
+		},
+		{
+			testName: "Invalid threshold",
+			env: map[string]string{
+				"CULL_CPU_IDLE_THRESHOLD": "little",
+			},
+			valid: false,
+		},
+		{
+			testName: "Zero threshold",
+			env: map[string]string{
+				"CULL_CPU_IDLE_THRESHOLD": "0",
+			},
+			valid: false,
+		},
+		{
+			testName: "Invalid logic",
+			env: map[string]string{
+				"CULL_IDLENESS_LOGIC": "xor",
+			},
+			valid: false,
+		},
+		{
+			testName: "Valid workspace check port",
+			env: map[string]string{
+				"CULL_WORKSPACE_CHECK_PORT": "8889",
+			},
+			valid: true,
+		},
+		{
+			testName: "Invalid workspace check port",
+			env: map[string]string{
+				"CULL_WORKSPACE_CHECK_PORT": "70000",
+			},
+			valid: false,
+		},
+		{
+			testName: "Negative min lifetime",
+			env: map[string]string{
+				"CULL_MIN_LIFETIME": "-5",
+			},
+			valid: false,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			os.Unsetenv("CULL_CPU_IDLE_THRESHOLD")
+			os.Unsetenv("CULL_WORKSPACE_CHECK_PORT")
+			os.Unsetenv("CULL_IDLENESS_LOGIC")
+			os.Unsetenv("CULL_MIN_LIFETIME")
+			for envVar, val := range c.env {
+				os.Setenv(envVar, val)
+			}
+
+			err := ValidateIdlenessConfig()
+			if (err == nil) != c.valid {
+				t.Errorf("Wrong result for case %+v: %v", c, err)
+			}
+		})
+	}
+	os.Unsetenv("CULL_CPU_IDLE_THRESHOLD")
+	os.Unsetenv("CULL_WORKSPACE_CHECK_PORT")
+	os.Unsetenv("CULL_IDLENESS_LOGIC")
+	os.Unsetenv("CULL_MIN_LIFETIME")
+}
+
+func TestPodMetricsCPUUsage(t *testing.T) {
+	podMetrics := &unstructured.Unstructured{Object: map[string]interface{}{
+		"containers": []interface{}{
+			map[string]interface{}{
+				"name":  "notebook",
+				"usage": map[string]interface{}{"cpu": "20m", "memory": "100Mi"},
+			},
+			map[string]interface{}{
+				"name":  "istio-proxy",
+				"usage": map[string]interface{}{"cpu": "5m", "memory": "30Mi"},
+			},
+		},
+	}}
+
+	usage, err := podMetricsCPUUsage(podMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.MilliValue() != 25 {
+		t.Errorf("Expected a usage of 25m, got %s", usage.String())
+	}
+}
+
+func TestUpdateCPUIdleAnnotation(t *testing.T) {
+	os.Setenv("CULL_CPU_IDLE_THRESHOLD", "50m")
+	defer os.Unsetenv("CULL_CPU_IDLE_THRESHOLD")
+	since := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	testCases := []struct {
+		testName string
+		meta     *metav1.ObjectMeta
+		usage    string
+		changed  bool
+		idle     bool
+	}{
+		{
+			testName: "Usage drops below the threshold",
+			meta:     &metav1.ObjectMeta{},
+			usage:    "10m",
+			changed:  true,
+			idle:     true,
+		},
+		{
+			testName: "Usage stays below the threshold",
+			meta: &metav1.ObjectMeta{
+				Annotations: map[string]string{CPU_IDLE_ANNOTATION: since},
+			},
+			usage:   "10m",
+			changed: false,
+			idle:    true,
+		},
+		{
+			testName: "Usage goes back above the threshold",
+			meta: &metav1.ObjectMeta{
+				Annotations: map[string]string{CPU_IDLE_ANNOTATION: since},
+			},
+			usage:   "500m",
+			changed: true,
+			idle:    false,
+		},
+		{
+			testName: "Usage stays above the threshold",
+			meta:     &metav1.ObjectMeta{},
+			usage:    "500m",
+			changed:  false,
+			idle:     false,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			usage := resource.MustParse(c.usage)
+			if UpdateCPUIdleAnnotation(c.meta, &usage) != c.changed {
+				t.Errorf("Expected changed to be %v", c.changed)
+			}
+			if _, ok := c.meta.Annotations[CPU_IDLE_ANNOTATION]; ok != c.idle {
+				t.Errorf("Expected the annotation to be set: %v, got %v", c.idle, c.meta.Annotations)
+			}
+			if c.meta.Annotations[CPU_IDLE_ANNOTATION] == since && c.changed {
+				t.Errorf("Expected the annotation to change")
+			}
+		})
+	}
+}
+
+func TestCPUIsIdle(t *testing.T) {
+	os.Setenv("IDLE_TIME", "5")
+	testCases := []struct {
+		testName string
+		meta     metav1.ObjectMeta
+		result   bool
+	}{
+		{
+			testName: "Annotation not set",
+			meta:     metav1.ObjectMeta{},
+			result:   false,
+		},
+		{
+			testName: "Annotation is not RFC3339 formatted",
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{CPU_IDLE_ANNOTATION: "should-fail"},
+			},
+			result: false,
+		},
+		{
+			testName: "CPU idle for longer than IDLE_TIME",
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					CPU_IDLE_ANNOTATION: time.Now().Add(-6 * time.Minute).Format(time.RFC3339),
+				},
+			},
+			result: true,
+		},
+		{
+			testName: "CPU idle for less than IDLE_TIME",
+			meta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					CPU_IDLE_ANNOTATION: time.Now().Add(-4 * time.Minute).Format(time.RFC3339),
+				},
+			},
+			result: false,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			if cpuIsIdle(c.meta) != c.result {
 				t.Errorf("Wrong result for case: %+v", c)
 			}
 		})
 	}
+}
+
+func TestGetWorkspaceLastModified(t *testing.T) {
+	modified := "2020-01-01T00:00:00Z"
+	testCases := []struct {
+		testName string
+		code     int
+		body     string
+		result   string
+		empty    bool
+		err      bool
+	}{
+		{
+			testName: "Modified files",
+			code:     http.StatusOK,
+			body:     `{"last_modified": "` + modified + `"}`,
+			result:   modified,
+		},
+		{
+			testName: "Empty workspace",
+			code:     http.StatusOK,
+			body:     `{"last_modified": ""}`,
+			empty:    true,
+		},
+		{
+			testName: "Permission denied",
+			code:     http.StatusInternalServerError,
+			body:     "permission denied",
+			err:      true,
+		},
+		{
+			testName: "Invalid last modification",
+			code:     http.StatusOK,
+			body:     `{"last_modified": "yesterday"}`,
+			err:      true,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != WORKSPACE_CHECK_PATH {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(c.code)
+				fmt.Fprint(w, c.body)
+			}))
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			os.Setenv("CULL_WORKSPACE_CHECK_PORT", port)
+			defer os.Unsetenv("CULL_WORKSPACE_CHECK_PORT")
+
+			pod := &corev1.Pod{Status: corev1.PodStatus{PodIP: host}}
+			lastModified, err := GetWorkspaceLastModified(pod)
+			if (err != nil) != c.err {
+				t.Fatalf("Expected an error: %v, got %v", c.err, err)
+			}
+			if c.err {
+				return
+			}
+			if (lastModified == nil) != c.empty {
+				t.Fatalf("Expected an empty workspace: %v, got %v", c.empty, lastModified)
+			}
+			if !c.empty && lastModified.Format(time.RFC3339) != c.result {
+				t.Errorf("Expected %s, got %v", c.result, lastModified)
+			}
+		})
+	}
+}
+
+func TestUpdateWorkspaceAnnotation(t *testing.T) {
+	before := "2020-01-01T00:00:00Z"
+	modified := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		testName     string
+		meta         *metav1.ObjectMeta
+		lastModified *time.Time
+		changed      bool
+		expected     string
+	}{
+		{
+			testName:     "Files modified",
+			meta:         &metav1.ObjectMeta{Annotations: map[string]string{WORKSPACE_MODIFIED_ANNOTATION: before}},
+			lastModified: &modified,
+			changed:      true,
+			expected:     "2020-01-02T00:00:00Z",
+		},
+		{
+			testName:     "Files unmodified",
+			meta:         &metav1.ObjectMeta{Annotations: map[string]string{WORKSPACE_MODIFIED_ANNOTATION: "2020-01-02T00:00:00Z"}},
+			lastModified: &modified,
+			changed:      false,
+			expected:     "2020-01-02T00:00:00Z",
+		},
+		{
+			testName: "Workspace stays empty",
+			meta:     &metav1.ObjectMeta{Annotations: map[string]string{WORKSPACE_MODIFIED_ANNOTATION: before}},
+			changed:  false,
+			expected: before,
+		},
+		{
+			testName: "Workspace found empty",
+			meta:     &metav1.ObjectMeta{},
+			changed:  true,
+		},
+	}
 
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			if UpdateWorkspaceAnnotation(c.meta, c.lastModified) != c.changed {
+				t.Errorf("Expected changed to be %v", c.changed)
+			}
+			value, ok := c.meta.Annotations[WORKSPACE_MODIFIED_ANNOTATION]
+			if !ok {
+				t.Fatalf("Expected the annotation to be set, got %v", c.meta.Annotations)
+			}
+			if c.expected != "" && value != c.expected {
+				t.Errorf("Expected the annotation to be %s, got %s", c.expected, value)
+			}
+		})
+	}
 }
@@ -0,0 +1,126 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("health")
+
+// The paths of the liveness and readiness probes.
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// Checker returns an error when the controller isn't ready.
+type Checker func() error
+
+// CRDChecker returns a Checker failing while the RESTMapper can't resolve one
+// of the given GroupVersionKinds, i.e. its CRD isn't installed or served yet.
+func CRDChecker(mapper meta.RESTMapper, gvks ...schema.GroupVersionKind) Checker {
+	return func() error {
+		for _, gvk := range gvks {
+			if _, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+				if meta.IsNoMatchError(err) {
+					return fmt.Errorf("the %s API isn't served", gvk)
+				}
+				return fmt.Errorf("unable to check whether the %s API is served: %v", gvk, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Server serves the liveness and readiness probes of the controller. The
+// liveness probe succeeds as long as the server answers, the readiness one
+// once all the ReadyChecks pass. It is meant to be added to the manager.
+type Server struct {
+	// Addr is the address the server listens on.
+	Addr string
+	// ReadyChecks are the checks of the readiness probe, by name.
+	ReadyChecks map[string]Checker
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so that the
+// probes are served by every replica of the controller.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable.
+func (s *Server) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthzPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc(ReadyzPath, s.handleReadyz)
+	srv := &http.Server{Handler: mux}
+
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	log.Info("Serving the health probes", "addr", s.Addr)
+
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error(err, "unable to shut down the health probes")
+		}
+	}()
+
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// handleReadyz runs the ReadyChecks, and answers with a 503 listing the
+// failed ones if any fails.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.ReadyChecks))
+	for name := range s.ReadyChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := []string{}
+	for _, name := range names {
+		if err := s.ReadyChecks[name](); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) != 0 {
+		log.Info("Not ready", "failures", failures)
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
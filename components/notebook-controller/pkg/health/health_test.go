@@ -0,0 +1,78 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	notebookGVK       = schema.GroupVersionKind{Group: "kubeflow.org", Version: "v1beta1", Kind: "Notebook"}
+	virtualServiceGVK = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "VirtualService"}
+)
+
+func TestCRDChecker(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{notebookGVK.GroupVersion()})
+	mapper.Add(notebookGVK, meta.RESTScopeNamespace)
+
+	if err := CRDChecker(mapper, notebookGVK)(); err != nil {
+		t.Errorf("Expected the check to pass with the Notebook mapping, got %v", err)
+	}
+	err := CRDChecker(mapper, notebookGVK, virtualServiceGVK)()
+	if err == nil || !strings.Contains(err.Error(), "VirtualService") {
+		t.Errorf("Expected the check to fail without the VirtualService mapping, got %v", err)
+	}
+
+	// Another version of the same group isn't enough
+	v1 := schema.GroupVersionKind{Group: "kubeflow.org", Version: "v1", Kind: "Notebook"}
+	if err := CRDChecker(mapper, v1)(); err == nil {
+		t.Errorf("Expected the check to fail without the %s mapping", v1)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	tests := []struct {
+		name         string
+		checks       map[string]Checker
+		expectedCode int
+	}{
+		{
+			name:         "no checks",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "passing checks",
+			checks: map[string]Checker{
+				"crds": func() error { return nil },
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "failing check",
+			checks: map[string]Checker{
+				"crds":  func() error { return fmt.Errorf("the VirtualService API isn't served") },
+				"other": func() error { return nil },
+			},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{ReadyChecks: test.checks}
+			rec := httptest.NewRecorder()
+			s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+			if rec.Code != test.expectedCode {
+				t.Errorf("Got status %d, Expected %d", rec.Code, test.expectedCode)
+			}
+			if rec.Code != http.StatusOK && !strings.Contains(rec.Body.String(), "crds: ") {
+				t.Errorf("Expected the failed check to be named, got %q", rec.Body.String())
+			}
+		})
+	}
+}
@@ -5,18 +5,26 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
 // Metrics includes metrics used in notebook controller
 type Metrics struct {
-	cli                      client.Client
-	runningNotebooks         *prometheus.GaugeVec
-	NotebookCreation         *prometheus.CounterVec
-	NotebookFailCreation     *prometheus.CounterVec
-	NotebookCullingCount     *prometheus.CounterVec
-	NotebookCullingTimestamp *prometheus.GaugeVec
+	cli                        client.Client
+	runningNotebooks           *prometheus.GaugeVec
+	activeMaintenanceJobs      prometheus.Gauge
+	NotebookCreation           *prometheus.CounterVec
+	NotebookFailCreation       *prometheus.CounterVec
+	NotebookCullingCount       *prometheus.CounterVec
+	NotebookCullingTimestamp   *prometheus.GaugeVec
+	NotebookCullingIdleTime    *prometheus.GaugeVec
+	NotebookCullingDryRunCount *prometheus.CounterVec
+	NotebookScheduleTimeouts   *prometheus.CounterVec
+	NotebookReadyLatency       *prometheus.HistogramVec
+	NotebookMaintenanceJobs    *prometheus.CounterVec
 }
 
 func NewMetrics(cli client.Client) *Metrics {
@@ -57,6 +65,48 @@ func NewMetrics(cli client.Client) *Metrics {
 			},
 			[]string{"namespace", "name"},
 		),
+		NotebookCullingIdleTime: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "last_notebook_culling_idle_seconds",
+				Help: "Time the notebooks had been idle for when they were last culled, in seconds",
+			},
+			[]string{"namespace", "name"},
+		),
+		NotebookCullingDryRunCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "notebook_culling_dry_run_total",
+				Help: "Total times of notebooks that would have been culled with CULL_DRY_RUN",
+			},
+			[]string{"namespace", "name"},
+		),
+		NotebookScheduleTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "notebook_schedule_timeout_total",
+				Help: "Total times of notebook pods being unschedulable for longer than the schedule timeout",
+			},
+			[]string{"namespace"},
+		),
+		NotebookReadyLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "notebook_ready_latency_seconds",
+				Help:    "Time from the creation of notebooks to their pod being ready for the first time",
+				Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+			},
+			[]string{"namespace"},
+		),
+		activeMaintenanceJobs: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "notebook_maintenance_jobs_active",
+				Help: "Current running maintenance Jobs of notebooks, e.g. clones and backups, in the cluster",
+			},
+		),
+		NotebookMaintenanceJobs: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "notebook_maintenance_jobs_total",
+				Help: "Total finished maintenance Jobs of notebooks, by type and result",
+			},
+			[]string{"type", "result"},
+		),
 	}
 
 	metrics.Registry.MustRegister(m)
@@ -68,14 +118,31 @@ func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
 	m.runningNotebooks.Describe(ch)
 	m.NotebookCreation.Describe(ch)
 	m.NotebookFailCreation.Describe(ch)
+	m.NotebookCullingCount.Describe(ch)
+	m.NotebookCullingTimestamp.Describe(ch)
+	m.NotebookCullingIdleTime.Describe(ch)
+	m.NotebookCullingDryRunCount.Describe(ch)
+	m.NotebookScheduleTimeouts.Describe(ch)
+	m.NotebookReadyLatency.Describe(ch)
+	m.activeMaintenanceJobs.Describe(ch)
+	m.NotebookMaintenanceJobs.Describe(ch)
 }
 
 // Collect implements the prometheus.Collector interface.
 func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
 	m.scrape()
+	m.scrapeMaintenanceJobs()
 	m.runningNotebooks.Collect(ch)
 	m.NotebookCreation.Collect(ch)
 	m.NotebookFailCreation.Collect(ch)
+	m.NotebookCullingCount.Collect(ch)
+	m.NotebookCullingTimestamp.Collect(ch)
+	m.NotebookCullingIdleTime.Collect(ch)
+	m.NotebookCullingDryRunCount.Collect(ch)
+	m.NotebookScheduleTimeouts.Collect(ch)
+	m.NotebookReadyLatency.Collect(ch)
+	m.activeMaintenanceJobs.Collect(ch)
+	m.NotebookMaintenanceJobs.Collect(ch)
 }
 
 // scrape gets current running notebook statefulsets.
@@ -97,3 +164,29 @@ func (m *Metrics) scrape() {
 		m.runningNotebooks.WithLabelValues(ns).Set(v)
 	}
 }
+
+// scrapeMaintenanceJobs counts the maintenance Jobs of the notebooks, which
+// are labeled with their name, that haven't finished yet.
+func (m *Metrics) scrapeMaintenanceJobs() {
+	jobList := &batchv1.JobList{}
+	err := m.cli.List(context.TODO(), jobList)
+	if err != nil {
+		return
+	}
+	active := 0
+	for i, job := range jobList.Items {
+		if _, ok := job.Labels["notebook-name"]; ok && !jobFinished(&jobList.Items[i]) {
+			active++
+		}
+	}
+	m.activeMaintenanceJobs.Set(float64(active))
+}
+
+func jobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
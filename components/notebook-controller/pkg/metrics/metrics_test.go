@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestScrapeMaintenanceJobs(t *testing.T) {
+	newJob := func(name string, labels map[string]string, condition batchv1.JobConditionType) *batchv1.Job {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kubeflow-user", Labels: labels}}
+		if condition != "" {
+			job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: corev1.ConditionTrue}}
+		}
+		return job
+	}
+	notebookLabels := map[string]string{"notebook-name": "test-notebook"}
+	cli := fake.NewFakeClientWithScheme(scheme.Scheme,
+		newJob("clone-running", notebookLabels, ""),
+		newJob("backup-running", notebookLabels, ""),
+		newJob("clone-completed", notebookLabels, batchv1.JobComplete),
+		newJob("backup-failed", notebookLabels, batchv1.JobFailed),
+		newJob("unrelated", nil, ""),
+	)
+	m := NewMetrics(cli)
+
+	m.scrapeMaintenanceJobs()
+	if active := testutil.ToFloat64(m.activeMaintenanceJobs); active != 2 {
+		t.Errorf("Got %v active maintenance Jobs, Expected 2", active)
+	}
+
+	job := newJob("clone-running", notebookLabels, batchv1.JobComplete)
+	if err := cli.Update(context.TODO(), job); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m.scrapeMaintenanceJobs()
+	if active := testutil.ToFloat64(m.activeMaintenanceJobs); active != 1 {
+		t.Errorf("Got %v active maintenance Jobs, Expected 1 once a Job completed", active)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The types of the events the users are notified of.
+const (
+	// The Notebook was culled for being idle.
+	EventCulled = "culled"
+	// The Notebook was started again after being stopped.
+	EventStarted = "started"
+	// A maintenance Job, e.g. a backup or a clone, started on the Notebook.
+	EventMaintenance = "maintenance"
+)
+
+// Event is a change of a Notebook its owner is notified of.
+type Event struct {
+	Type      string    `json:"type"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+}
+
+// Notifier notifies the owners of the Notebooks of their events.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// WebhookNotifier POSTs the events as JSON to an HTTP endpoint, e.g. a Slack
+// or Teams incoming webhook behind a relay, or any generic receiver.
+type WebhookNotifier struct {
+	// URL is the endpoint the events are POSTed to.
+	URL string
+	// Client sends the requests.
+	Client *http.Client
+}
+
+// The time a webhook is given to accept an event.
+const webhookTimeout = 10 * time.Second
+
+// NewWebhookNotifier returns a WebhookNotifier POSTing to the given URL.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// webhookPayload is the body POSTed by the WebhookNotifier. Text summarizes
+// the event, for the chat webhooks that only display it.
+type webhookPayload struct {
+	Event
+	Text string `json:"text"`
+}
+
+// Notify POSTs the event, and fails unless the webhook answers with a 2xx
+// status.
+func (n *WebhookNotifier) Notify(event Event) error {
+	text := fmt.Sprintf("Notebook %s/%s %s: %s", event.Namespace, event.Name, event.Type, event.Reason)
+	body, err := json.Marshal(webhookPayload{Event: event, Text: text})
+	if err != nil {
+		return err
+	}
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to POST the %s event of notebook %s/%s: %v", event.Type, event.Namespace, event.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered the %s event of notebook %s/%s with status %d",
+			event.Type, event.Namespace, event.Name, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var received map[string]interface{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Got %s %s, Expected a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		received = map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Unable to decode the payload: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	n := NewWebhookNotifier(server.URL)
+	event := Event{
+		Type:      EventCulled,
+		Namespace: "kubeflow-user",
+		Name:      "test-notebook",
+		Owner:     "user@example.com",
+		Reason:    "no activity since 2020-01-01T00:00:00Z",
+		Time:      time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+	if err := n.Notify(event); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"type":      "culled",
+		"namespace": "kubeflow-user",
+		"name":      "test-notebook",
+		"owner":     "user@example.com",
+		"reason":    "no activity since 2020-01-01T00:00:00Z",
+		"time":      "2020-01-02T00:00:00Z",
+		"text":      "Notebook kubeflow-user/test-notebook culled: no activity since 2020-01-01T00:00:00Z",
+	}
+	for k, v := range expected {
+		if received[k] != v {
+			t.Errorf("Got %s %v, Expected %v", k, received[k], v)
+		}
+	}
+
+	status = http.StatusInternalServerError
+	if err := n.Notify(event); err == nil {
+		t.Errorf("Expected an error when the webhook fails")
+	}
+
+	server.Close()
+	if err := n.Notify(event); err == nil {
+		t.Errorf("Expected an error when the webhook is unreachable")
+	}
+}
@@ -0,0 +1,581 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var log = logf.Log.WithName("notebook-validator")
+
+// The path the validating webhook is served under.
+const ValidatePath = "/validate-notebook-v1beta1"
+
+// The namespace of the ConfigMaps configuring the validation, if the
+// CONFIG_NAMESPACE env var isn't set.
+const DefaultConfigNamespace = "kubeflow"
+
+// The ConfigMap listing the images Notebooks may use under its "images" key,
+// one per line. An entry ending with "*" allows every image starting with the
+// entry, e.g. a trusted registry. All images are allowed if it doesn't exist.
+const AllowedImagesConfigMap = "allowed-notebook-images"
+
+// The ConfigMap listing the types of volumes Notebooks may use, i.e. the
+// fields of the VolumeSource like hostPath or csi, one per line. Only the
+// types under its "allowed" key are allowed if it is set, and the ones under
+// its "denied" key are rejected. DefaultVolumeTypes apply if it doesn't exist,
+// and DefaultVolumeTypes.Denied if it doesn't set the "denied" key.
+const VolumeTypesConfigMap = "notebook-volume-types"
+
+// The ConfigMap capping the number of Notebooks per namespace. Its
+// "maxNotebooks" key is the limit of all the namespaces, and its "namespaces"
+// key overrides it for some namespaces, with one "<namespace>=<limit>" per
+// line. There is no limit if it doesn't exist.
+const NotebookLimitsConfigMap = "notebook-limits"
+
+// VolumeTypes are the types of volumes Notebooks may use.
+type VolumeTypes struct {
+	// Allowed are the only types allowed, unless it is empty.
+	Allowed []string
+	// Denied are the types rejected.
+	Denied []string
+}
+
+// DefaultVolumeTypes deny the hostPath volumes, which give access to the
+// nodes, in multi-tenant clusters.
+var DefaultVolumeTypes = VolumeTypes{Denied: []string{"hostPath"}}
+
+// Policies are the policies the Notebooks are validated against.
+type Policies struct {
+	// AllowedImages are the images Notebooks may use. The images aren't
+	// checked if it is nil.
+	AllowedImages []string
+	// VolumeTypes are the types of volumes Notebooks may use.
+	VolumeTypes VolumeTypes
+}
+
+// The path the workspace volume is mounted at in the notebook container.
+const WorkspacePath = "/home/jovyan"
+
+// The annotation setting the number of replicas of the StatefulSet of a
+// Notebook, a non-negative integer.
+const ReplicasAnnotation = "notebook.kubeflow.org/replicas"
+
+// The annotation setting the percentage of the traffic of a Notebook mirrored
+// by its VirtualService, a number between 0 and 100.
+const MirrorPercentageAnnotation = "notebook.kubeflow.org/mirror-percentage"
+
+// The annotation setting the governing Service of the StatefulSet of a
+// Notebook, a Service name.
+const ServiceNameAnnotation = "notebook.kubeflow.org/service-name"
+
+// ReservedLabels are the labels the controller sets on the Pod of a Notebook
+// to select it. The Notebook labels with these keys aren't copied to the Pod.
+var ReservedLabels = []string{"statefulset", "notebook-name"}
+
+// +kubebuilder:webhook:path=/validate-notebook-v1beta1,mutating=false,failurePolicy=fail,groups=kubeflow.org,resources=notebooks,verbs=create;update,versions=v1beta1,name=vnotebook.kubeflow.org
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
+// +kubebuilder:rbac:groups=kubeflow.org,resources=notebooks,verbs=list
+
+// NotebookValidator rejects Notebooks that don't comply with the policies
+// configured by the cluster admins.
+type NotebookValidator struct {
+	// Reader is used to read the configuration. It should read from the API
+	// server, to avoid caching every ConfigMap of the cluster.
+	Reader  client.Reader
+	decoder *admission.Decoder
+}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *NotebookValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (v *NotebookValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	nb := &v1beta1.Notebook{}
+	if err := v.decoder.Decode(req, nb); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// On updates, only the images that changed are validated, so that the
+	// Notebooks created before an image was disallowed can still be updated,
+	// e.g. stopped by the culler.
+	var oldNb *v1beta1.Notebook
+	if req.Operation == admissionv1beta1.Update {
+		oldNb = &v1beta1.Notebook{}
+		if err := v.decoder.DecodeRaw(req.OldObject, oldNb); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+
+	policies := Policies{VolumeTypes: DefaultVolumeTypes}
+	cm, err := v.getConfigMap(ctx, AllowedImagesConfigMap)
+	if err != nil {
+		log.Error(err, "unable to read the allowed images")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if cm != nil {
+		policies.AllowedImages = ParseList(cm.Data["images"])
+	}
+	cm, err = v.getConfigMap(ctx, VolumeTypesConfigMap)
+	if err != nil {
+		log.Error(err, "unable to read the volume types")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if cm != nil {
+		policies.VolumeTypes.Allowed = ParseList(cm.Data["allowed"])
+		if denied, ok := cm.Data["denied"]; ok {
+			policies.VolumeTypes.Denied = ParseList(denied)
+		}
+	}
+	if err := ValidateNotebook(nb, oldNb, policies); err != nil {
+		log.Info("Rejecting Notebook", "namespace", req.Namespace, "name", nb.Name, "reason", err.Error())
+		return admission.Denied(err.Error())
+	}
+
+	if req.Operation == admissionv1beta1.Create {
+		limit, err := v.getNotebookLimit(ctx, req.Namespace)
+		if err != nil {
+			log.Error(err, "unable to read the notebook limits")
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if limit >= 0 {
+			count, err := v.countNotebooks(ctx, req.Namespace)
+			if err != nil {
+				log.Error(err, "unable to count the notebooks", "namespace", req.Namespace)
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			if count >= limit {
+				message := fmt.Sprintf("namespace %s already has %d notebooks, the maximum is %d",
+					req.Namespace, count, limit)
+				log.Info("Rejecting Notebook", "namespace", req.Namespace, "name", nb.Name, "reason", message)
+				return admission.Denied(message)
+			}
+		}
+	}
+	return admission.Allowed("")
+}
+
+// getNotebookLimit returns the maximum number of Notebooks in the namespace,
+// set by the NotebookLimitsConfigMap, or -1 if there is none.
+func (v *NotebookValidator) getNotebookLimit(ctx context.Context, namespace string) (int, error) {
+	cm, err := v.getConfigMap(ctx, NotebookLimitsConfigMap)
+	if err != nil || cm == nil {
+		return -1, err
+	}
+	for _, line := range ParseList(cm.Data["namespaces"]) {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != namespace {
+			continue
+		}
+		return parseLimit(strings.TrimSpace(parts[1]))
+	}
+	value, ok := cm.Data["maxNotebooks"]
+	if !ok {
+		return -1, nil
+	}
+	return parseLimit(strings.TrimSpace(value))
+}
+
+func parseLimit(value string) (int, error) {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid limit %q in the %s ConfigMap, expected a non-negative integer",
+			value, NotebookLimitsConfigMap)
+	}
+	return limit, nil
+}
+
+// countNotebooks returns the number of Notebooks in the namespace, except the
+// ones being deleted, so that a Notebook can be recreated while the previous
+// one is terminating.
+func (v *NotebookValidator) countNotebooks(ctx context.Context, namespace string) (int, error) {
+	notebooks := &v1beta1.NotebookList{}
+	if err := v.Reader.List(ctx, notebooks, client.InNamespace(namespace)); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, nb := range notebooks.Items {
+		if nb.DeletionTimestamp == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ValidateNotebook checks the Notebook against the policies enforced by the
+// webhook. If oldNb is set, the images and the types of volumes it already
+// used are accepted.
+func ValidateNotebook(nb, oldNb *v1beta1.Notebook, policies Policies) error {
+	if nb.Spec.ShmSize != nil && nb.Spec.ShmSize.Sign() <= 0 {
+		return fmt.Errorf("shmSize should be positive, got %s", nb.Spec.ShmSize.String())
+	}
+	if err := validateInitContainers(nb); err != nil {
+		return err
+	}
+	if nb.Spec.PostStartCommand != nil && (len(nb.Spec.PostStartCommand) == 0 || nb.Spec.PostStartCommand[0] == "") {
+		return fmt.Errorf("postStartCommand should start with the command to run, got %q", nb.Spec.PostStartCommand)
+	}
+	if err := validateProjectedTokens(nb); err != nil {
+		return err
+	}
+	if err := validateLivenessProbe(nb); err != nil {
+		return err
+	}
+	if err := validateAdditionalPorts(nb); err != nil {
+		return err
+	}
+	if nb.Spec.WorkspaceFrom != nil && nb.Spec.CloneFrom != "" {
+		return fmt.Errorf("cloneFrom and workspaceFrom can't be combined, both provision the workspace PVC")
+	}
+	if err := validateLabels(nb, oldNb); err != nil {
+		return err
+	}
+	if value, ok := nb.Annotations[ReplicasAnnotation]; ok {
+		if replicas, err := strconv.ParseInt(value, 10, 32); err != nil || replicas < 0 {
+			return fmt.Errorf("annotation %s should be a non-negative integer, got %q", ReplicasAnnotation, value)
+		}
+	}
+	if value, ok := nb.Annotations[MirrorPercentageAnnotation]; ok {
+		percentage, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(percentage >= 0 && percentage <= 100) {
+			return fmt.Errorf("annotation %s should be a number between 0 and 100, got %q",
+				MirrorPercentageAnnotation, value)
+		}
+	}
+	if value, ok := nb.Annotations[ServiceNameAnnotation]; ok {
+		if errs := k8svalidation.IsDNS1035Label(value); len(errs) != 0 {
+			return fmt.Errorf("annotation %s should be a Service name, got %q: %s",
+				ServiceNameAnnotation, value, strings.Join(errs, ", "))
+		}
+	}
+	if err := validateVolumeTypes(nb, oldNb, policies.VolumeTypes); err != nil {
+		return err
+	}
+	if policies.AllowedImages == nil {
+		return nil
+	}
+	return validateImages(nb, oldNb, policies.AllowedImages)
+}
+
+// validateVolumeTypes checks the types of the volumes of the Notebook against
+// the allowed and denied ones. If oldNb is set, the types it already used are
+// accepted, so that the Notebooks created before can still be updated.
+func validateVolumeTypes(nb, oldNb *v1beta1.Notebook, types VolumeTypes) error {
+	oldTypes := map[string]bool{}
+	if oldNb != nil {
+		for _, v := range oldNb.Spec.Template.Spec.Volumes {
+			oldTypes[volumeType(v)] = true
+		}
+	}
+	for _, v := range nb.Spec.Template.Spec.Volumes {
+		t := volumeType(v)
+		if oldTypes[t] {
+			continue
+		}
+		if len(types.Allowed) != 0 && !listContains(types.Allowed, t) {
+			return fmt.Errorf("volume %q is of type %q, which is not allowed, the allowed types are: %s",
+				v.Name, t, strings.Join(types.Allowed, ", "))
+		}
+		if listContains(types.Denied, t) {
+			return fmt.Errorf("volume %q is of type %q, which is denied by the cluster admins", v.Name, t)
+		}
+	}
+	return nil
+}
+
+// volumeType returns the type of the volume, the name of the field of the
+// VolumeSource it sets, e.g. hostPath.
+func volumeType(v corev1.Volume) string {
+	data, err := json.Marshal(v.VolumeSource)
+	if err != nil {
+		return ""
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	for k := range fields {
+		return k
+	}
+	return ""
+}
+
+func listContains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateImages checks the images of the containers of the Notebook against
+// the allowed images. If oldNb is set, the images it already used are
+// accepted.
+func validateImages(nb, oldNb *v1beta1.Notebook, allowed []string) error {
+	oldImages := map[string]bool{}
+	if oldNb != nil {
+		for _, c := range oldNb.Spec.InitContainers {
+			oldImages[c.Image] = true
+		}
+		for _, c := range oldNb.Spec.Template.Spec.InitContainers {
+			oldImages[c.Image] = true
+		}
+		for _, c := range oldNb.Spec.Template.Spec.Containers {
+			oldImages[c.Image] = true
+		}
+	}
+
+	containers := []corev1.Container{}
+	containers = append(containers, nb.Spec.InitContainers...)
+	containers = append(containers, nb.Spec.Template.Spec.InitContainers...)
+	// The image of a notebook container without one is set by the controller
+	// from the kind of the Notebook, among the ones chosen by the operators
+	notebookContainers := nb.Spec.Template.Spec.Containers
+	if nb.Spec.Kind != "" && len(notebookContainers) != 0 && notebookContainers[0].Image == "" {
+		notebookContainers = notebookContainers[1:]
+	}
+	containers = append(containers, notebookContainers...)
+	for _, c := range containers {
+		if oldImages[c.Image] {
+			continue
+		}
+		if !imageIsAllowed(c.Image, allowed) {
+			return fmt.Errorf("image %q of container %q is not allowed, the allowed images are: %s",
+				c.Image, c.Name, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// validateInitContainers checks that the initContainers of the Notebook have
+// a workspace to set up, and don't clash with the ones of its Pod template.
+func validateInitContainers(nb *v1beta1.Notebook) error {
+	if len(nb.Spec.InitContainers) == 0 {
+		return nil
+	}
+	podSpec := &nb.Spec.Template.Spec
+	mountsWorkspace := false
+	if len(podSpec.Containers) != 0 {
+		for _, m := range podSpec.Containers[0].VolumeMounts {
+			mountsWorkspace = mountsWorkspace || m.MountPath == WorkspacePath
+		}
+	}
+	if !mountsWorkspace {
+		return fmt.Errorf("initContainers need a workspace volume mounted at %s in the notebook container", WorkspacePath)
+	}
+
+	names := map[string]bool{}
+	for _, c := range podSpec.InitContainers {
+		names[c.Name] = true
+	}
+	for _, c := range nb.Spec.InitContainers {
+		if names[c.Name] {
+			return fmt.Errorf("init container name %q is used more than once", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// validateProjectedTokens checks that the projectedTokens of the Notebook have
+// an audience, and are mounted at distinct absolute paths.
+func validateProjectedTokens(nb *v1beta1.Notebook) error {
+	paths := map[string]bool{}
+	for _, token := range nb.Spec.ProjectedTokens {
+		if strings.TrimSpace(token.Audience) == "" {
+			return fmt.Errorf("projected token mounted at %q should have an audience", token.MountPath)
+		}
+		if !path.IsAbs(token.MountPath) {
+			return fmt.Errorf("projected token mountPath should be an absolute path, got %q", token.MountPath)
+		}
+		if paths[path.Clean(token.MountPath)] {
+			return fmt.Errorf("projected token mountPath %q is used more than once", token.MountPath)
+		}
+		paths[path.Clean(token.MountPath)] = true
+		if token.ExpirationSeconds != nil && *token.ExpirationSeconds < 600 {
+			return fmt.Errorf("projected token expirationSeconds should be at least 600, got %d", *token.ExpirationSeconds)
+		}
+	}
+	return nil
+}
+
+// The port of the Service of a Notebook routing to the notebook port.
+const NotebookServicePort = 80
+
+// validateAdditionalPorts checks that the additionalPorts of the Notebook have
+// valid and distinct names and port numbers, which don't clash with the ones
+// of the notebook port of its Service.
+func validateAdditionalPorts(nb *v1beta1.Notebook) error {
+	names := map[string]bool{"http": true, "http-" + nb.Name: true}
+	numbers := map[int32]bool{NotebookServicePort: true}
+	for _, p := range nb.Spec.AdditionalPorts {
+		if errs := k8svalidation.IsDNS1123Label(p.Name); len(errs) != 0 {
+			return fmt.Errorf("additional port name should be a valid port name, got %q: %s",
+				p.Name, strings.Join(errs, ", "))
+		}
+		if names[p.Name] {
+			return fmt.Errorf("additional port name %q is already used by the Service of the notebook", p.Name)
+		}
+		names[p.Name] = true
+		if len(k8svalidation.IsValidPortNum(int(p.Port))) != 0 {
+			return fmt.Errorf("additional port %q should have a valid port number, got %d", p.Name, p.Port)
+		}
+		if p.TargetPort != 0 && len(k8svalidation.IsValidPortNum(int(p.TargetPort))) != 0 {
+			return fmt.Errorf("additional port %q should have a valid targetPort, got %d", p.Name, p.TargetPort)
+		}
+		if numbers[p.Port] {
+			return fmt.Errorf("additional port %q uses port %d, already used by the Service of the notebook", p.Name, p.Port)
+		}
+		numbers[p.Port] = true
+	}
+	return nil
+}
+
+// The name of the port of the notebook container when it doesn't declare any.
+const NotebookPortName = "notebook-port"
+
+// validateLivenessProbe checks that the livenessProbe of the Notebook has a
+// single handler, and that its HTTP or TCP port is a valid port number or the
+// name of a port of the notebook container.
+func validateLivenessProbe(nb *v1beta1.Notebook) error {
+	probe := nb.Spec.LivenessProbe
+	if probe == nil {
+		return nil
+	}
+	handlers := 0
+	var port *intstr.IntOrString
+	if probe.Exec != nil {
+		handlers++
+	}
+	if probe.HTTPGet != nil {
+		handlers++
+		port = &probe.HTTPGet.Port
+	}
+	if probe.TCPSocket != nil {
+		handlers++
+		port = &probe.TCPSocket.Port
+	}
+	if handlers != 1 {
+		return fmt.Errorf("livenessProbe should set one of exec, httpGet or tcpSocket")
+	}
+	if port == nil {
+		return nil
+	}
+	if port.Type == intstr.Int {
+		if port.IntVal < 1 || port.IntVal > 65535 {
+			return fmt.Errorf("livenessProbe port should be between 1 and 65535, got %d", port.IntVal)
+		}
+		return nil
+	}
+	names := []string{}
+	if containers := nb.Spec.Template.Spec.Containers; len(containers) != 0 {
+		for _, p := range containers[0].Ports {
+			names = append(names, p.Name)
+		}
+		if containers[0].Ports == nil {
+			names = append(names, NotebookPortName)
+		}
+	}
+	if !listContains(names, port.StrVal) {
+		return fmt.Errorf("livenessProbe port %q isn't a port of the notebook container, expected one of %q",
+			port.StrVal, names)
+	}
+	return nil
+}
+
+// validateLabels checks that the Notebook doesn't set the ReservedLabels,
+// which would be ignored. If oldNb is set, the ones it already set are
+// accepted, so that the Notebooks created before can still be updated.
+func validateLabels(nb, oldNb *v1beta1.Notebook) error {
+	for _, k := range ReservedLabels {
+		v, ok := nb.Labels[k]
+		if !ok {
+			continue
+		}
+		if oldNb != nil {
+			if old, ok := oldNb.Labels[k]; ok && old == v {
+				continue
+			}
+		}
+		return fmt.Errorf("label %q is reserved: the controller sets it on the notebook pod to select it, "+
+			"use another key", k)
+	}
+	return nil
+}
+
+func imageIsAllowed(image string, allowed []string) bool {
+	for _, a := range allowed {
+		if strings.HasSuffix(a, "*") && strings.HasPrefix(image, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+		if image == a {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigMap returns the configuration ConfigMap with the given name, or nil
+// if it doesn't exist.
+func (v *NotebookValidator) getConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	namespace := os.Getenv("CONFIG_NAMESPACE")
+	if len(namespace) == 0 {
+		namespace = DefaultConfigNamespace
+	}
+	cm := &corev1.ConfigMap{}
+	err := v.Reader.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, cm)
+	if err != nil && apierrs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read the %s/%s ConfigMap: %v", namespace, name, err)
+	}
+	return cm, nil
+}
+
+// ParseList returns the non-empty lines of a ConfigMap value, ignoring
+// comments.
+func ParseList(value string) []string {
+	list := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list
+}
@@ -0,0 +1,680 @@
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func init() {
+	_ = v1beta1.AddToScheme(scheme.Scheme)
+}
+
+func newTestValidator(t *testing.T, objects ...runtime.Object) *NotebookValidator {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	v := &NotebookValidator{Reader: fake.NewFakeClientWithScheme(scheme.Scheme, objects...)}
+	v.InjectDecoder(decoder)
+	return v
+}
+
+func newTestRequest(t *testing.T, nb *v1beta1.Notebook) admission.Request {
+	raw, err := json.Marshal(nb)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Namespace: nb.Namespace,
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func newTestNotebook(images ...string) *v1beta1.Notebook {
+	nb := &v1beta1.Notebook{
+		TypeMeta: metav1.TypeMeta{APIVersion: "kubeflow.org/v1beta1", Kind: "Notebook"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-notebook",
+			Namespace: "test-namespace",
+		},
+	}
+	for _, image := range images {
+		nb.Spec.Template.Spec.Containers = append(nb.Spec.Template.Spec.Containers,
+			corev1.Container{Name: "test-notebook", Image: image})
+	}
+	return nb
+}
+
+func TestValidateImages(t *testing.T) {
+	allowedImages := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      AllowedImagesConfigMap,
+			Namespace: DefaultConfigNamespace,
+		},
+		Data: map[string]string{
+			"images": `
+# Images built by the platform team
+gcr.io/kubeflow-images-public/*
+docker.io/jupyter/scipy-notebook:latest
+`,
+		},
+	}
+
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		images    []string
+		kind      string
+		isAllowed bool
+	}{
+		{
+			name:      "no allowlist",
+			objects:   []runtime.Object{},
+			images:    []string{"docker.io/someone/notebook:latest"},
+			isAllowed: true,
+		},
+		{
+			name:      "image of trusted registry",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{"gcr.io/kubeflow-images-public/tensorflow-1.10.1-notebook-cpu:v0.3.0"},
+			isAllowed: true,
+		},
+		{
+			name:      "exact image",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{"docker.io/jupyter/scipy-notebook:latest"},
+			isAllowed: true,
+		},
+		{
+			name:      "different tag of an exact image",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{"docker.io/jupyter/scipy-notebook:dev"},
+			isAllowed: false,
+		},
+		{
+			name:      "one of the containers is not allowed",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{"gcr.io/kubeflow-images-public/notebook:v1", "docker.io/someone/sidecar:latest"},
+			isAllowed: false,
+		},
+		{
+			name:      "image set by the kind",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{""},
+			kind:      "jupyter",
+			isAllowed: true,
+		},
+		{
+			name:      "no image and no kind",
+			objects:   []runtime.Object{allowedImages},
+			images:    []string{""},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestValidator(t, test.objects...)
+			nb := newTestNotebook(test.images...)
+			nb.Spec.Kind = test.kind
+			resp := v.Handle(context.TODO(), newTestRequest(t, nb))
+			if resp.Allowed != test.isAllowed {
+				t.Errorf("Got allowed %v (%v), Expected %v", resp.Allowed, resp.Result, test.isAllowed)
+			}
+		})
+	}
+}
+
+func TestValidateImagesOnUpdate(t *testing.T) {
+	allowedImages := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      AllowedImagesConfigMap,
+			Namespace: DefaultConfigNamespace,
+		},
+		Data: map[string]string{"images": "gcr.io/kubeflow-images-public/*"},
+	}
+
+	tests := []struct {
+		name      string
+		oldImages []string
+		images    []string
+		isAllowed bool
+	}{
+		{
+			name:      "unchanged image that isn't allowed anymore",
+			oldImages: []string{"docker.io/someone/notebook:latest"},
+			images:    []string{"docker.io/someone/notebook:latest"},
+			isAllowed: true,
+		},
+		{
+			name:      "changed to an allowed image",
+			oldImages: []string{"docker.io/someone/notebook:latest"},
+			images:    []string{"gcr.io/kubeflow-images-public/notebook:v1"},
+			isAllowed: true,
+		},
+		{
+			name:      "changed to an image that isn't allowed",
+			oldImages: []string{"gcr.io/kubeflow-images-public/notebook:v1"},
+			images:    []string{"docker.io/someone/notebook:latest"},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestValidator(t, allowedImages)
+			req := newTestRequest(t, newTestNotebook(test.images...))
+			req.Operation = admissionv1beta1.Update
+			req.OldObject = newTestRequest(t, newTestNotebook(test.oldImages...)).Object
+			resp := v.Handle(context.TODO(), req)
+			if resp.Allowed != test.isAllowed {
+				t.Errorf("Got allowed %v (%v), Expected %v", resp.Allowed, resp.Result, test.isAllowed)
+			}
+		})
+	}
+}
+
+// failingReader returns the given error on every Get call.
+type failingReader struct {
+	client.Reader
+	err error
+}
+
+func (r *failingReader) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	return r.err
+}
+
+func TestValidateImagesConfigError(t *testing.T) {
+	v := newTestValidator(t)
+	v.Reader = &failingReader{Reader: v.Reader, err: apierrs.NewForbidden(
+		schema.GroupResource{Resource: "configmaps"}, AllowedImagesConfigMap, fmt.Errorf("forbidden"))}
+
+	resp := v.Handle(context.TODO(), newTestRequest(t, newTestNotebook("docker.io/someone/notebook:latest")))
+	if resp.Allowed {
+		t.Errorf("Notebook should be rejected when the configuration can't be read")
+	}
+	if resp.Result.Code != http.StatusInternalServerError {
+		t.Errorf("Got code %v, Expected %v", resp.Result.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestValidateShmSize(t *testing.T) {
+	tests := []struct {
+		size      string
+		isAllowed bool
+	}{
+		{size: "1Gi", isAllowed: true},
+		{size: "0", isAllowed: false},
+		{size: "-64Mi", isAllowed: false},
+	}
+
+	for _, test := range tests {
+		v := newTestValidator(t)
+		nb := newTestNotebook("jupyter")
+		size := resource.MustParse(test.size)
+		nb.Spec.ShmSize = &size
+		resp := v.Handle(context.TODO(), newTestRequest(t, nb))
+		if resp.Allowed != test.isAllowed {
+			t.Errorf("Size %v: got allowed %v (%v), Expected %v", test.size, resp.Allowed, resp.Result, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateInitContainers(t *testing.T) {
+	workspace := corev1.VolumeMount{Name: "workspace", MountPath: WorkspacePath}
+	tests := []struct {
+		name      string
+		mounts    []corev1.VolumeMount
+		template  []corev1.Container
+		isAllowed bool
+	}{
+		{name: "workspace mounted", mounts: []corev1.VolumeMount{workspace}, isAllowed: true},
+		{name: "no workspace", isAllowed: false},
+		{
+			name:      "name used by the template",
+			mounts:    []corev1.VolumeMount{workspace},
+			template:  []corev1.Container{{Name: "setup", Image: "jupyter"}},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		v := newTestValidator(t)
+		nb := newTestNotebook("jupyter")
+		nb.Spec.Template.Spec.Containers[0].VolumeMounts = test.mounts
+		nb.Spec.Template.Spec.InitContainers = test.template
+		nb.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "jupyter"}}
+		resp := v.Handle(context.TODO(), newTestRequest(t, nb))
+		if resp.Allowed != test.isAllowed {
+			t.Errorf("%s: got allowed %v (%v), Expected %v", test.name, resp.Allowed, resp.Result, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		oldLabels map[string]string
+		isAllowed bool
+	}{
+		{name: "other labels", labels: map[string]string{"app": "jupyter"}, isAllowed: true},
+		{name: "reserved label", labels: map[string]string{"statefulset": "other"}, isAllowed: false},
+		{
+			name:      "reserved label already set",
+			labels:    map[string]string{"notebook-name": "other"},
+			oldLabels: map[string]string{"notebook-name": "other"},
+			isAllowed: true,
+		},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Labels = test.labels
+		var oldNb *v1beta1.Notebook
+		if test.oldLabels != nil {
+			oldNb = newTestNotebook("jupyter")
+			oldNb.Labels = test.oldLabels
+		}
+		err := ValidateNotebook(nb, oldNb, Policies{})
+		if (err == nil) != test.isAllowed {
+			t.Errorf("%s: got error %v, Expected allowed %v", test.name, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateVolumeTypes(t *testing.T) {
+	hostPath := corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{
+		HostPath: &corev1.HostPathVolumeSource{Path: "/data"}}}
+	pvc := corev1.Volume{Name: "workspace", VolumeSource: corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "workspace"}}}
+	csi := corev1.Volume{Name: "secrets", VolumeSource: corev1.VolumeSource{
+		CSI: &corev1.CSIVolumeSource{Driver: "secrets-store.csi.k8s.io"}}}
+	volumeTypes := func(data map[string]string) runtime.Object {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: VolumeTypesConfigMap, Namespace: DefaultConfigNamespace},
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		volumes    []corev1.Volume
+		oldVolumes []corev1.Volume
+		isAllowed  bool
+	}{
+		{name: "hostPath denied by default", volumes: []corev1.Volume{pvc, hostPath}, isAllowed: false},
+		{name: "PVC allowed by default", volumes: []corev1.Volume{pvc}, isAllowed: true},
+		{
+			name:      "hostPath allowed by the admins",
+			objects:   []runtime.Object{volumeTypes(map[string]string{"denied": ""})},
+			volumes:   []corev1.Volume{hostPath},
+			isAllowed: true,
+		},
+		{
+			name:      "CSI denied by the admins",
+			objects:   []runtime.Object{volumeTypes(map[string]string{"denied": "csi\nhostPath"})},
+			volumes:   []corev1.Volume{csi},
+			isAllowed: false,
+		},
+		{
+			name:      "type not in the allowed ones",
+			objects:   []runtime.Object{volumeTypes(map[string]string{"allowed": "persistentVolumeClaim\nemptyDir"})},
+			volumes:   []corev1.Volume{pvc, csi},
+			isAllowed: false,
+		},
+		{
+			name:       "hostPath already used",
+			volumes:    []corev1.Volume{hostPath},
+			oldVolumes: []corev1.Volume{hostPath},
+			isAllowed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestValidator(t, test.objects...)
+			nb := newTestNotebook("jupyter")
+			nb.Spec.Template.Spec.Volumes = test.volumes
+			req := newTestRequest(t, nb)
+			if test.oldVolumes != nil {
+				oldNb := newTestNotebook("jupyter")
+				oldNb.Spec.Template.Spec.Volumes = test.oldVolumes
+				req.Operation = admissionv1beta1.Update
+				req.OldObject = newTestRequest(t, oldNb).Object
+			}
+			resp := v.Handle(context.TODO(), req)
+			if resp.Allowed != test.isAllowed {
+				t.Errorf("Got allowed %v (%v), Expected %v", resp.Allowed, resp.Result, test.isAllowed)
+			}
+		})
+	}
+}
+
+func TestValidateNotebookLimit(t *testing.T) {
+	limits := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NotebookLimitsConfigMap, Namespace: DefaultConfigNamespace},
+		Data: map[string]string{
+			"maxNotebooks": "2",
+			"namespaces":   "team-a=1\nteam-b = 3",
+		},
+	}
+	existing := func(namespace string, names ...string) []runtime.Object {
+		objects := []runtime.Object{}
+		for _, name := range names {
+			nb := newTestNotebook("jupyter")
+			nb.Name = name
+			nb.Namespace = namespace
+			objects = append(objects, nb)
+		}
+		return objects
+	}
+	deleted := existing("test-namespace", "deleted")[0].(*v1beta1.Notebook)
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+
+	tests := []struct {
+		name      string
+		namespace string
+		objects   []runtime.Object
+		isAllowed bool
+	}{
+		{name: "no limits", namespace: "test-namespace", objects: existing("test-namespace", "a", "b", "c"), isAllowed: true},
+		{name: "under the limit", namespace: "test-namespace", objects: append(existing("test-namespace", "a"), limits), isAllowed: true},
+		{name: "at the limit", namespace: "test-namespace", objects: append(existing("test-namespace", "a", "b"), limits), isAllowed: false},
+		{
+			name:      "other namespaces aren't counted",
+			namespace: "test-namespace",
+			objects:   append(existing("other", "a", "b"), limits),
+			isAllowed: true,
+		},
+		{
+			name:      "notebook being deleted",
+			namespace: "test-namespace",
+			objects:   append(existing("test-namespace", "a"), deleted, limits),
+			isAllowed: true,
+		},
+		{name: "namespace limit", namespace: "team-a", objects: append(existing("team-a", "a"), limits), isAllowed: false},
+		{name: "higher namespace limit", namespace: "team-b", objects: append(existing("team-b", "a", "b"), limits), isAllowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestValidator(t, test.objects...)
+			nb := newTestNotebook("jupyter")
+			nb.Namespace = test.namespace
+			resp := v.Handle(context.TODO(), newTestRequest(t, nb))
+			if resp.Allowed != test.isAllowed {
+				t.Errorf("Got allowed %v (%v), Expected %v", resp.Allowed, resp.Result, test.isAllowed)
+			}
+		})
+	}
+}
+
+func TestValidateReplicasAnnotation(t *testing.T) {
+	tests := []struct {
+		value     string
+		isAllowed bool
+	}{
+		{value: "0", isAllowed: true},
+		{value: "3", isAllowed: true},
+		{value: "-1", isAllowed: false},
+		{value: "one", isAllowed: false},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Annotations = map[string]string{ReplicasAnnotation: test.value}
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("Replicas %q: got error %v, Expected allowed %v", test.value, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidatePostStartCommand(t *testing.T) {
+	tests := []struct {
+		command   []string
+		isAllowed bool
+	}{
+		{command: nil, isAllowed: true},
+		{command: []string{"register.sh", "--name", "test"}, isAllowed: true},
+		{command: []string{}, isAllowed: false},
+		{command: []string{"", "register.sh"}, isAllowed: false},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Spec.PostStartCommand = test.command
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("Command %q: got error %v, Expected allowed %v", test.command, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateMirrorPercentageAnnotation(t *testing.T) {
+	tests := []struct {
+		value     string
+		isAllowed bool
+	}{
+		{value: "0", isAllowed: true},
+		{value: "12.5", isAllowed: true},
+		{value: "100", isAllowed: true},
+		{value: "101", isAllowed: false},
+		{value: "-1", isAllowed: false},
+		{value: "NaN", isAllowed: false},
+		{value: "half", isAllowed: false},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Annotations = map[string]string{MirrorPercentageAnnotation: test.value}
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("Mirror percentage %q: got error %v, Expected allowed %v", test.value, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateServiceNameAnnotation(t *testing.T) {
+	tests := []struct {
+		value     string
+		isAllowed bool
+	}{
+		{value: "jupyter-headless", isAllowed: true},
+		{value: "", isAllowed: false},
+		{value: "Jupyter", isAllowed: false},
+		{value: "1jupyter", isAllowed: false},
+		{value: "jupyter.headless", isAllowed: false},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Annotations = map[string]string{ServiceNameAnnotation: test.value}
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("Service name %q: got error %v, Expected allowed %v", test.value, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateAdditionalPorts(t *testing.T) {
+	tests := []struct {
+		name      string
+		ports     []v1beta1.ServicePortSpec
+		isAllowed bool
+	}{
+		{
+			name: "valid ports",
+			ports: []v1beta1.ServicePortSpec{
+				{Name: "http-dask", Port: 8787},
+				{Name: "tcp-debugger", Port: 5678, TargetPort: 5679},
+			},
+			isAllowed: true,
+		},
+		{
+			name:      "invalid name",
+			ports:     []v1beta1.ServicePortSpec{{Name: "Dask_Dashboard", Port: 8787}},
+			isAllowed: false,
+		},
+		{
+			name: "duplicate name",
+			ports: []v1beta1.ServicePortSpec{
+				{Name: "http-dask", Port: 8787},
+				{Name: "http-dask", Port: 8788},
+			},
+			isAllowed: false,
+		},
+		{
+			name:      "name of the notebook port",
+			ports:     []v1beta1.ServicePortSpec{{Name: "http-test-notebook", Port: 8787}},
+			isAllowed: false,
+		},
+		{
+			name: "duplicate port",
+			ports: []v1beta1.ServicePortSpec{
+				{Name: "http-dask", Port: 8787},
+				{Name: "http-dask-2", Port: 8787},
+			},
+			isAllowed: false,
+		},
+		{
+			name:      "port of the notebook",
+			ports:     []v1beta1.ServicePortSpec{{Name: "http-web", Port: 80}},
+			isAllowed: false,
+		},
+		{
+			name:      "invalid target port",
+			ports:     []v1beta1.ServicePortSpec{{Name: "http-dask", Port: 8787, TargetPort: 70000}},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Spec.AdditionalPorts = test.ports
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("%s: got error %v, Expected allowed %v", test.name, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateProjectedTokens(t *testing.T) {
+	short := int64(60)
+	tests := []struct {
+		name      string
+		tokens    []v1beta1.TokenMount
+		isAllowed bool
+	}{
+		{
+			name:      "valid",
+			tokens:    []v1beta1.TokenMount{{Audience: "vault", MountPath: "/var/run/secrets/vault"}},
+			isAllowed: true,
+		},
+		{
+			name:      "empty audience",
+			tokens:    []v1beta1.TokenMount{{Audience: " ", MountPath: "/var/run/secrets/vault"}},
+			isAllowed: false,
+		},
+		{
+			name:      "relative mountPath",
+			tokens:    []v1beta1.TokenMount{{Audience: "vault", MountPath: "secrets"}},
+			isAllowed: false,
+		},
+		{
+			name: "duplicate mountPath",
+			tokens: []v1beta1.TokenMount{
+				{Audience: "vault", MountPath: "/var/run/secrets/token"},
+				{Audience: "aws", MountPath: "/var/run/secrets/token/"},
+			},
+			isAllowed: false,
+		},
+		{
+			name:      "short expiration",
+			tokens:    []v1beta1.TokenMount{{Audience: "vault", ExpirationSeconds: &short, MountPath: "/var/run/secrets/vault"}},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Spec.ProjectedTokens = test.tokens
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("%s: got error %v, Expected allowed %v", test.name, err, test.isAllowed)
+		}
+	}
+}
+
+func TestValidateLivenessProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     *corev1.Probe
+		ports     []corev1.ContainerPort
+		isAllowed bool
+	}{
+		{
+			name:      "exec probe",
+			probe:     &corev1.Probe{Handler: corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"check.sh"}}}},
+			isAllowed: true,
+		},
+		{
+			name:      "no handler",
+			probe:     &corev1.Probe{},
+			isAllowed: false,
+		},
+		{
+			name:      "port number",
+			probe:     &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8888)}}},
+			isAllowed: true,
+		},
+		{
+			name:      "invalid port number",
+			probe:     &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(70000)}}},
+			isAllowed: false,
+		},
+		{
+			name:      "default port name",
+			probe:     &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString(NotebookPortName)}}},
+			isAllowed: true,
+		},
+		{
+			name:      "declared port name",
+			probe:     &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString("http")}}},
+			ports:     []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			isAllowed: true,
+		},
+		{
+			name:      "unknown port name",
+			probe:     &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{Port: intstr.FromString("debug")}}},
+			ports:     []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			isAllowed: false,
+		},
+	}
+
+	for _, test := range tests {
+		nb := newTestNotebook("jupyter")
+		nb.Spec.LivenessProbe = test.probe
+		nb.Spec.Template.Spec.Containers[0].Ports = test.ports
+		if err := ValidateNotebook(nb, nil, Policies{}); (err == nil) != test.isAllowed {
+			t.Errorf("%s: got error %v, Expected allowed %v", test.name, err, test.isAllowed)
+		}
+	}
+}
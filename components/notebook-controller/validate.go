@@ -0,0 +1,137 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	nbv1beta1 "github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/controllers"
+	"github.com/kubeflow/kubeflow/components/notebook-controller/pkg/validation"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// runValidate implements the validate subcommand: it checks a Notebook
+// manifest offline, with the webhook validation and the generation of the
+// resources of the controller, and returns the exit code.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	allowedImages := fs.String("allowed-images", "",
+		"A file listing the images notebooks may use, in the format of the images key of the "+
+			"allowed-notebook-images ConfigMap. The images aren't checked if it isn't set.")
+	templatePath := fs.String("template", "",
+		"A manifest of the NotebookTemplate the notebook references, merged into its pod template.")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s validate [flags] <notebook.yaml|->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := validateManifest(fs.Arg(0), *allowedImages, *templatePath, stdout); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+func validateManifest(path, allowedImagesPath, templatePath string, stdout io.Writer) error {
+	obj, gvk, err := decodeFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to decode the notebook: %v", err)
+	}
+	nb, ok := obj.(*nbv1beta1.Notebook)
+	if !ok {
+		return fmt.Errorf("expected a %s Notebook, got %v", nbv1beta1.GroupVersion, gvk)
+	}
+	if nb.Namespace == "" {
+		nb.Namespace = "default"
+	}
+
+	var template *nbv1beta1.NotebookTemplate
+	if templatePath != "" {
+		obj, gvk, err := decodeFile(templatePath)
+		if err != nil {
+			return fmt.Errorf("unable to decode the notebook template: %v", err)
+		}
+		if template, ok = obj.(*nbv1beta1.NotebookTemplate); !ok {
+			return fmt.Errorf("expected a %s NotebookTemplate, got %v", nbv1beta1.GroupVersion, gvk)
+		}
+	}
+
+	policies := validation.Policies{VolumeTypes: validation.DefaultVolumeTypes}
+	if allowedImagesPath != "" {
+		list, err := ioutil.ReadFile(allowedImagesPath)
+		if err != nil {
+			return err
+		}
+		policies.AllowedImages = validation.ParseList(string(list))
+	}
+	if err := validation.ValidateNotebook(nb, nil, policies); err != nil {
+		return err
+	}
+
+	if err := controllers.ValidateConfig(); err != nil {
+		return fmt.Errorf("invalid controller configuration: %v", err)
+	}
+	children, err := controllers.GenerateChildren(nb, template)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		m, err := meta.Accessor(child)
+		if err != nil {
+			return err
+		}
+		gvk, err := apiutil.GVKForObject(child, scheme)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s %s/%s\n", gvk.Kind, m.GetNamespace(), m.GetName())
+	}
+	return nil
+}
+
+// decodeFile decodes the manifest at path, or stdin if path is "-".
+func decodeFile(path string) (runtime.Object, *schema.GroupVersionKind, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return serializer.NewCodecFactory(scheme).UniversalDeserializer().Decode(data, nil, nil)
+}
+
+// readFile reads the file at path, or stdin if path is "-".
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}